@@ -0,0 +1,296 @@
+// Package auth holds the users of the server and what they may do. Every
+// user has a password, stored hashed, and a list of rules granting an
+// access level on the keys starting with a prefix. The rule with the
+// longest prefix matching a key decides the access on it, so a narrow rule
+// can take back part of what a broad one grants:
+//
+//	prefix ""         access read
+//	prefix "orders:"  access write
+//	prefix "secret:"  access none
+//
+// Rules apply to the keys of every namespace alike. Which namespaces other
+// than default a user may select is listed apart, "*" standing for all of
+// them.
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"sync"
+
+	dbengine "github.com/Avash027/midDB/db_engine"
+	LsmTree "github.com/Avash027/midDB/lsm_tree"
+)
+
+// Access is what a rule allows on its keys, each level includes the ones
+// below it.
+type Access int
+
+const (
+	ACCESS_NONE Access = iota
+	// ACCESS_READ allows GET, MGET, TTL, SCAN and PREFIX
+	ACCESS_READ
+	// ACCESS_WRITE allows PUT, DEL, EXPIRE, CAS and PUTIFABSENT
+	ACCESS_WRITE
+	// ACCESS_ADMIN allows the commands on the whole server, which need it on
+	// every key
+	ACCESS_ADMIN
+)
+
+func ParseAccess(name string) (Access, error) {
+	switch name {
+	case "none":
+		return ACCESS_NONE, nil
+	case "read":
+		return ACCESS_READ, nil
+	case "write":
+		return ACCESS_WRITE, nil
+	case "admin":
+		return ACCESS_ADMIN, nil
+	default:
+		return ACCESS_NONE, fmt.Errorf("unknown access %q, expected none, read, write or admin", name)
+	}
+}
+
+func (a Access) String() string {
+	switch a {
+	case ACCESS_READ:
+		return "read"
+	case ACCESS_WRITE:
+		return "write"
+	case ACCESS_ADMIN:
+		return "admin"
+	default:
+		return "none"
+	}
+}
+
+type PermissionOpts struct {
+	Prefix string
+	Access string
+}
+
+type UserOpts struct {
+	Name string
+	// PasswordHash is the output of HashPassword
+	PasswordHash string
+	Permissions  []PermissionOpts
+	// Namespaces the user may select besides default, "*" for all
+	Namespaces []string
+}
+
+type permission struct {
+	prefix []byte
+	access Access
+}
+
+type User struct {
+	Name         string
+	passwordHash string
+	permissions  []permission
+	namespaces   []string
+}
+
+// Users checks passwords. It is safe for concurrent use.
+type Users struct {
+	users map[string]*User
+
+	// verified maps a user to an HMAC of the password that last
+	// authenticated it, so clients that send the password with every
+	// request, like HTTP ones, only pay for the slow hash once. The key is
+	// drawn when the process starts, so the sums are worthless outside of
+	// it.
+	mu       sync.Mutex
+	key      []byte
+	verified map[string][]byte
+
+	// dummyHash is checked for unknown users, so they take as long to
+	// refuse as a wrong password
+	dummyHash string
+}
+
+// New checks the users and their rules. A user without rules has no access.
+func New(opts []UserOpts) (*Users, error) {
+	users := &Users{
+		users:    map[string]*User{},
+		key:      make([]byte, sha256.Size),
+		verified: map[string][]byte{},
+	}
+
+	if _, err := rand.Read(users.key); err != nil {
+		return nil, err
+	}
+
+	iterations := HASH_ITERATIONS
+
+	for _, userOpts := range opts {
+		if userOpts.Name == "" {
+			return nil, fmt.Errorf("user without a name")
+		}
+
+		if _, ok := users.users[userOpts.Name]; ok {
+			return nil, fmt.Errorf("user %s is defined twice", userOpts.Name)
+		}
+
+		hash, err := parseHash(userOpts.PasswordHash)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", userOpts.Name, err)
+		}
+		iterations = hash.iterations
+
+		user := &User{Name: userOpts.Name, passwordHash: userOpts.PasswordHash, namespaces: userOpts.Namespaces}
+
+		for _, permissionOpts := range userOpts.Permissions {
+			access, err := ParseAccess(permissionOpts.Access)
+			if err != nil {
+				return nil, fmt.Errorf("user %s: %w", userOpts.Name, err)
+			}
+
+			user.permissions = append(user.permissions, permission{
+				prefix: []byte(permissionOpts.Prefix),
+				access: access,
+			})
+		}
+
+		users.users[user.Name] = user
+	}
+
+	// the key of the dummy hash is never matched, it only has to cost as
+	// much to check as the ones of the users
+	salt := make([]byte, HASH_SALT_SIZE)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	users.dummyHash = fmt.Sprintf("%s$%d$%s$%s", HASH_SCHEME, iterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(make([]byte, HASH_KEY_SIZE)))
+
+	return users, nil
+}
+
+// Authenticate returns the user when the password is right.
+func (u *Users) Authenticate(name string, password []byte) (*User, bool) {
+	user, ok := u.users[name]
+	if !ok {
+		checkPassword(u.dummyHash, password)
+		return nil, false
+	}
+
+	mac := hmac.New(sha256.New, u.key)
+	mac.Write(password)
+	sum := mac.Sum(nil)
+
+	u.mu.Lock()
+	verified, ok := u.verified[name]
+	u.mu.Unlock()
+
+	if ok && hmac.Equal(sum, verified) {
+		return user, true
+	}
+
+	if !checkPassword(user.passwordHash, password) {
+		return nil, false
+	}
+
+	u.mu.Lock()
+	u.verified[name] = sum
+	u.mu.Unlock()
+
+	return user, true
+}
+
+// Can reports whether the user has access on key.
+func (u *User) Can(key []byte, access Access) bool {
+	rule := u.rule(key)
+	return rule != nil && rule.access >= access
+}
+
+// CanRange reports whether the user has access on every key in
+// [start, end), an empty end meaning there is no upper bound.
+func (u *User) CanRange(start []byte, end []byte, access Access) bool {
+	// the longest rule whose prefix every key of the range starts with
+	var cover *permission
+	for i := range u.permissions {
+		p := &u.permissions[i]
+		if covers(p.prefix, start, end) && (cover == nil || len(p.prefix) > len(cover.prefix)) {
+			cover = p
+		}
+	}
+
+	if cover == nil || cover.access < access {
+		return false
+	}
+
+	// a longer rule giving less access takes back part of the range
+	for _, p := range u.permissions {
+		if len(p.prefix) > len(cover.prefix) && p.access < access && overlaps(p.prefix, start, end) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// IsAdmin reports whether the user may run the commands on the whole
+// server.
+func (u *User) IsAdmin() bool {
+	return u.CanRange(nil, nil, ACCESS_ADMIN)
+}
+
+// CanSelect reports whether the user may use a namespace, an empty name
+// being the default one. Admins may use all of them.
+func (u *User) CanSelect(namespace string) bool {
+	if namespace == "" || namespace == dbengine.DEFAULT_NAMESPACE || u.IsAdmin() {
+		return true
+	}
+
+	for _, name := range u.namespaces {
+		if name == namespace || name == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rule returns the rule with the longest prefix of key, or nil.
+func (u *User) rule(key []byte) *permission {
+	var rule *permission
+
+	for i := range u.permissions {
+		p := &u.permissions[i]
+		if bytes.HasPrefix(key, p.prefix) && (rule == nil || len(p.prefix) > len(rule.prefix)) {
+			rule = p
+		}
+	}
+
+	return rule
+}
+
+// covers reports whether every key in [start, end) starts with prefix.
+func covers(prefix []byte, start []byte, end []byte) bool {
+	if !bytes.HasPrefix(start, prefix) {
+		return false
+	}
+
+	prefixEnd := LsmTree.PrefixEnd(prefix)
+	if prefixEnd == nil {
+		return true
+	}
+
+	return len(end) > 0 && bytes.Compare(end, prefixEnd) <= 0
+}
+
+// overlaps reports whether some key in [start, end) starts with prefix.
+func overlaps(prefix []byte, start []byte, end []byte) bool {
+	if len(end) > 0 && bytes.Compare(prefix, end) >= 0 {
+		return false
+	}
+
+	prefixEnd := LsmTree.PrefixEnd(prefix)
+	return prefixEnd == nil || bytes.Compare(start, prefixEnd) < 0
+}
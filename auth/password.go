@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// HASH_ITERATIONS is the PBKDF2 cost of new hashes. Hashes keep the cost
+// they were made with, so raising it does not break the existing ones.
+const HASH_ITERATIONS = 600000
+
+const HASH_SALT_SIZE = 16
+const HASH_KEY_SIZE = 32
+
+// HASH_SCHEME prefixes hashes, which look like
+// pbkdf2-sha256$<iterations>$<salt>$<key> with base64 salt and key.
+const HASH_SCHEME = "pbkdf2-sha256"
+
+type passwordHash struct {
+	iterations int
+	salt       []byte
+	key        []byte
+}
+
+// HashPassword returns the hash to put in the password_hash of a user.
+func HashPassword(password []byte) (string, error) {
+	salt := make([]byte, HASH_SALT_SIZE)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key, err := pbkdf2.Key(sha256.New, string(password), salt, HASH_ITERATIONS, HASH_KEY_SIZE)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s$%d$%s$%s", HASH_SCHEME, HASH_ITERATIONS,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func parseHash(hash string) (passwordHash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != HASH_SCHEME {
+		return passwordHash{}, fmt.Errorf("password_hash is not a %s hash", HASH_SCHEME)
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return passwordHash{}, fmt.Errorf("invalid iterations in password_hash")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return passwordHash{}, fmt.Errorf("invalid salt in password_hash")
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return passwordHash{}, fmt.Errorf("invalid key in password_hash")
+	}
+
+	return passwordHash{iterations: iterations, salt: salt, key: key}, nil
+}
+
+func checkPassword(hash string, password []byte) bool {
+	parsed, err := parseHash(hash)
+	if err != nil {
+		return false
+	}
+
+	key, err := pbkdf2.Key(sha256.New, string(password), parsed.salt, parsed.iterations, len(parsed.key))
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(key, parsed.key) == 1
+}
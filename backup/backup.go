@@ -0,0 +1,361 @@
+// Package backup takes consistent copies of a running server and restores
+// them.
+//
+// A backup is a directory holding a checkpoint of every namespace, see
+// dbengine.DBEngine.Checkpoint: the disk blocks hard linked and the
+// partitions copied. The WAL of a server is a directory of segments, the
+// backup only holds the records that were not in the partitions yet, copied
+// into a single file by wal.WAL.CopyTo. The BACKUP manifest is written last
+// and lists every file with its size and checksum, so a backup without one
+// is incomplete.
+//
+//	BACKUP
+//	default/sstables/MANIFEST, default/sstables/000012.sst, ...
+//	default/partitions/partition_0, ...
+//	default/wal.aof, the records after the partitions
+//	namespaces/<name>/...
+//
+// Restore copies a backup into the directories of a server that is not
+// running, and can replay the WAL segments the server archived since, up to
+// a time or a sequence number.
+package backup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dbengine "github.com/Avash027/midDB/db_engine"
+)
+
+// MANIFEST_FILE_NAME is the file that completes a backup.
+const MANIFEST_FILE_NAME = "BACKUP"
+
+var (
+	ErrNotEmpty        = errors.New("the directory is not empty")
+	ErrInvalidManifest = errors.New("invalid backup manifest")
+	ErrCorruptBackup   = errors.New("backup file is missing or corrupt")
+)
+
+// Manifest describes a backup.
+type Manifest struct {
+	// Time is the unix time in milliseconds once every namespace was
+	// copied, a backup holds no write made after it
+	Time       int64
+	Namespaces []Namespace
+	Files      []File
+}
+
+// Namespace is the checkpoint of a namespace, which holds its writes up to
+// Seq.
+type Namespace struct {
+	Name string
+	Seq  uint64
+}
+
+// File is a file of the backup, with a path relative to its directory.
+type File struct {
+	Path     string
+	Size     int64
+	Checksum uint32
+}
+
+// lock lets one backup run at a time.
+var lock sync.Mutex
+
+// Create backs the engine and its namespaces up to path, which must not
+// exist or be empty. The server keeps serving meanwhile, only the persisting
+// cycle of each namespace waits for its checkpoint. A failed backup is
+// removed.
+func Create(db *dbengine.DBEngine, path string) (*Manifest, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := checkEmpty(path); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+
+	manifest, err := create(db, path)
+	if err != nil {
+		os.RemoveAll(path)
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func create(db *dbengine.DBEngine, path string) (*Manifest, error) {
+	manifest := &Manifest{}
+
+	for _, name := range db.Namespaces() {
+		namespace, err := db.Namespace(name)
+		if err == dbengine.ErrNamespaceNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		dir := filepath.Join(path, namespaceDir(name))
+
+		seq, err := namespace.Checkpoint(dir)
+		if err == dbengine.ErrNamespaceDropped {
+			// dropped while the others were copied
+			if err := os.RemoveAll(dir); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("namespace %s: %w", name, err)
+		}
+
+		if name != dbengine.DEFAULT_NAMESPACE {
+			if err := dbengine.WriteQuota(dir, namespace.Stats().Quota); err != nil {
+				return nil, err
+			}
+		}
+
+		manifest.Namespaces = append(manifest.Namespaces, Namespace{Name: name, Seq: seq})
+	}
+
+	manifest.Time = time.Now().UnixMilli()
+
+	err := filepath.WalkDir(path, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(path, filePath)
+		if err != nil {
+			return err
+		}
+
+		size, checksum, err := checksumFile(filePath)
+		if err != nil {
+			return err
+		}
+
+		manifest.Files = append(manifest.Files, File{Path: filepath.ToSlash(rel), Size: size, Checksum: checksum})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeManifest(path, manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// namespaceDir is where the checkpoint of a namespace goes in a backup.
+func namespaceDir(name string) string {
+	if name == dbengine.DEFAULT_NAMESPACE {
+		return dbengine.DEFAULT_NAMESPACE
+	}
+
+	return filepath.Join("namespaces", name)
+}
+
+// checkEmpty fails with ErrNotEmpty when path is a directory with files in
+// it, or is not a directory.
+func checkEmpty(path string) error {
+	dirEntries, err := os.ReadDir(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	if len(dirEntries) > 0 {
+		return fmt.Errorf("%s: %w", path, ErrNotEmpty)
+	}
+
+	return nil
+}
+
+func checksumFile(path string) (int64, uint32, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	hash := crc32.NewIEEE()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return size, hash.Sum32(), nil
+}
+
+// ReadManifest reads the manifest of the backup in path. It holds one line
+// per fact:
+//
+//	time <unix time in milliseconds>
+//	namespace <name> <seq>
+//	file <quoted path> <size> <crc32>
+//
+// The paths are quoted like Go strings, so they may hold spaces.
+func ReadManifest(path string) (*Manifest, error) {
+	file, err := os.Open(filepath.Join(path, MANIFEST_FILE_NAME))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s has no %s file, it is not a complete backup", path, MANIFEST_FILE_NAME)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	manifest := &Manifest{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields, err := splitFields(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidManifest, scanner.Text())
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch {
+		case fields[0] == "time" && len(fields) == 2:
+			manifest.Time, err = strconv.ParseInt(fields[1], 10, 64)
+		case fields[0] == "namespace" && len(fields) == 3:
+			namespace := Namespace{Name: fields[1]}
+			namespace.Seq, err = strconv.ParseUint(fields[2], 10, 64)
+			manifest.Namespaces = append(manifest.Namespaces, namespace)
+		case fields[0] == "file" && len(fields) == 4:
+			file := File{Path: fields[1]}
+			var checksum uint64
+			if file.Size, err = strconv.ParseInt(fields[2], 10, 64); err == nil {
+				checksum, err = strconv.ParseUint(fields[3], 10, 32)
+				file.Checksum = uint32(checksum)
+			}
+			manifest.Files = append(manifest.Files, file)
+		default:
+			err = ErrInvalidManifest
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidManifest, scanner.Text())
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if manifest.Time == 0 || len(manifest.Namespaces) == 0 {
+		return nil, ErrInvalidManifest
+	}
+
+	return manifest, nil
+}
+
+// splitFields splits a line of the manifest at spaces, but inside quoted
+// fields.
+func splitFields(line string) ([]string, error) {
+	fields := []string{}
+
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return fields, nil
+		}
+
+		if line[0] != '"' {
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+
+			fields = append(fields, line[:end])
+			line = line[end:]
+			continue
+		}
+
+		quoted, err := strconv.QuotedPrefix(line)
+		if err != nil {
+			return nil, err
+		}
+
+		field, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, err
+		}
+
+		fields = append(fields, field)
+		line = line[len(quoted):]
+		if line != "" && line[0] != ' ' && line[0] != '\t' {
+			return nil, ErrInvalidManifest
+		}
+	}
+}
+
+// writeManifest writes the manifest through a temporary file that is synced
+// before it is renamed.
+func writeManifest(path string, manifest *Manifest) error {
+	lines := []string{fmt.Sprintf("time %d", manifest.Time)}
+	for _, namespace := range manifest.Namespaces {
+		lines = append(lines, fmt.Sprintf("namespace %s %d", namespace.Name, namespace.Seq))
+	}
+	for _, file := range manifest.Files {
+		lines = append(lines, fmt.Sprintf("file %s %d %d", strconv.Quote(file.Path), file.Size, file.Checksum))
+	}
+
+	manifestPath := filepath.Join(path, MANIFEST_FILE_NAME)
+	tmpPath := manifestPath + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, manifestPath)
+}
+
+// Verify checks that every file of the backup in path is there with the
+// size and checksum of the manifest.
+func Verify(path string, manifest *Manifest) error {
+	for _, file := range manifest.Files {
+		size, checksum, err := checksumFile(filepath.Join(path, filepath.FromSlash(file.Path)))
+		if err != nil || size != file.Size || checksum != file.Checksum {
+			return fmt.Errorf("%w: %s", ErrCorruptBackup, file.Path)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,263 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	dbengine "github.com/Avash027/midDB/db_engine"
+	LsmTree "github.com/Avash027/midDB/lsm_tree"
+	"github.com/Avash027/midDB/wal"
+)
+
+var ErrTooEarly = errors.New("the backup is newer than the point to restore")
+
+// RestoreOpts say where a backup goes, with the directories of the
+// configuration of the server.
+type RestoreOpts struct {
+	// Backup is the directory made by Create
+	Backup string
+
+	// the default namespace
+	SSTableDirectory   string
+	PartitionDirectory string
+	NumOfPartitions    int
+	WalPath            string
+
+	NamespaceDirectory string
+
+	// ArchiveDirectory, when set, holds the WAL segments the server
+	// archived, one subdirectory per namespace. The writes made after the
+	// backup are replayed up to UntilTime or UntilSeq, or to the end of the
+	// archive when both are zero.
+	ArchiveDirectory string
+	UntilTime        time.Time
+	// UntilSeq is a sequence number of the default namespace, the other
+	// namespaces are restored as of the backup with it
+	UntilSeq uint64
+}
+
+// Restored tells how far a namespace was restored.
+type Restored struct {
+	Name string
+	// Seq is the sequence number of the last write restored
+	Seq uint64
+	// Records is the number of archived records replayed after the backup
+	Records int
+}
+
+// Restore checks the backup, copies it into the directories of opts, which
+// must hold no data, and writes the WAL of each namespace followed by the
+// archived writes to replay. The server replays them when it starts.
+func Restore(opts RestoreOpts) ([]Restored, error) {
+	manifest, err := ReadManifest(opts.Backup)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := Verify(opts.Backup, manifest); err != nil {
+		return nil, err
+	}
+
+	if err := checkTarget(opts, manifest); err != nil {
+		return nil, err
+	}
+
+	restored := []Restored{}
+
+	for _, namespace := range manifest.Namespaces {
+		walPath, err := restoreNamespace(opts, namespace.Name)
+		if err != nil {
+			return nil, fmt.Errorf("namespace %s: %w", namespace.Name, err)
+		}
+
+		result := Restored{Name: namespace.Name, Seq: namespace.Seq}
+
+		records, err := wal.ReadRecords(filepath.Join(opts.Backup, namespaceDir(namespace.Name), wal.DEFAULT_WAL_PATH))
+		if err != nil {
+			return nil, err
+		}
+
+		if opts.ArchiveDirectory != "" && (opts.UntilSeq == 0 || namespace.Name == dbengine.DEFAULT_NAMESPACE) {
+			archived, err := archivedRecords(opts, namespace)
+			if err != nil {
+				return nil, fmt.Errorf("namespace %s: %w", namespace.Name, err)
+			}
+
+			if len(archived) > 0 {
+				last := archived[len(archived)-1]
+				result.Seq = last.Seq + uint64(len(last.Entries)) - 1
+				result.Records = len(archived)
+			}
+
+			records = append(records, archived...)
+		}
+
+		if err := wal.WriteLog(walPath, records); err != nil {
+			return nil, err
+		}
+
+		restored = append(restored, result)
+	}
+
+	return restored, nil
+}
+
+// checkTarget checks that the point to restore is not before the backup, and
+// that the directories of the server hold no data, so nothing is
+// overwritten.
+func checkTarget(opts RestoreOpts, manifest *Manifest) error {
+	if !opts.UntilTime.IsZero() && opts.UntilTime.UnixMilli() < manifest.Time {
+		return fmt.Errorf("%w, it was taken at %s", ErrTooEarly, time.UnixMilli(manifest.Time).Format(time.RFC3339))
+	}
+
+	for _, namespace := range manifest.Namespaces {
+		if namespace.Name == dbengine.DEFAULT_NAMESPACE && opts.UntilSeq > 0 && opts.UntilSeq < namespace.Seq {
+			return fmt.Errorf("%w, it holds the writes up to seq %d", ErrTooEarly, namespace.Seq)
+		}
+	}
+
+	if (opts.UntilSeq > 0 || !opts.UntilTime.IsZero()) && opts.ArchiveDirectory == "" {
+		return fmt.Errorf("restoring up to a time or a seq needs the WAL archive")
+	}
+
+	partitions, err := os.ReadDir(filepath.Join(opts.Backup, dbengine.DEFAULT_NAMESPACE, "partitions"))
+	if err != nil {
+		return err
+	}
+	if len(partitions) != opts.NumOfPartitions {
+		return fmt.Errorf("the backup has %d partitions, the server %d", len(partitions), opts.NumOfPartitions)
+	}
+
+	for _, dir := range []string{opts.SSTableDirectory, opts.NamespaceDirectory} {
+		if err := checkEmpty(dir); err != nil {
+			return err
+		}
+	}
+
+	empty, err := wal.Empty(opts.WalPath)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return fmt.Errorf("%s: %w", opts.WalPath, ErrNotEmpty)
+	}
+
+	for i := 0; i < opts.NumOfPartitions; i++ {
+		path := filepath.Join(opts.PartitionDirectory, fmt.Sprintf("partition_%d", i))
+		if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+			return fmt.Errorf("%s: %w", path, ErrNotEmpty)
+		}
+	}
+
+	return nil
+}
+
+// restoreNamespace copies the checkpoint of a namespace where the server
+// expects it, but for the WAL, and returns the path of its WAL.
+func restoreNamespace(opts RestoreOpts, name string) (string, error) {
+	src := filepath.Join(opts.Backup, namespaceDir(name))
+
+	if name != dbengine.DEFAULT_NAMESPACE {
+		dst := filepath.Join(opts.NamespaceDirectory, name)
+		return filepath.Join(dst, wal.DEFAULT_WAL_PATH), copyDir(src, dst)
+	}
+
+	if err := copyDir(filepath.Join(src, "sstables"), opts.SSTableDirectory); err != nil {
+		return "", err
+	}
+
+	if err := copyDir(filepath.Join(src, "partitions"), opts.PartitionDirectory); err != nil {
+		return "", err
+	}
+
+	return opts.WalPath, os.MkdirAll(filepath.Dir(opts.WalPath), 0755)
+}
+
+// archivedRecords returns the records archived for the namespace after its
+// checkpoint, up to the point to restore.
+func archivedRecords(opts RestoreOpts, namespace Namespace) ([]wal.Record, error) {
+	archived, err := wal.ReadArchive(filepath.Join(opts.ArchiveDirectory, namespace.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	records := []wal.Record{}
+	for _, record := range archived {
+		if record.Seq <= namespace.Seq {
+			continue
+		}
+
+		if opts.UntilSeq > 0 && record.Seq+uint64(len(record.Entries))-1 > opts.UntilSeq {
+			break
+		}
+		if !opts.UntilTime.IsZero() && record.Time > opts.UntilTime.UnixMilli() {
+			break
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// copyDir copies the files of src into dst, hard linking the disk blocks,
+// which are never written again, and copying the rest. The WAL is left out,
+// see wal.WriteLog.
+func copyDir(src string, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == wal.DEFAULT_WAL_PATH {
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+
+		if entry.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+
+		if strings.HasSuffix(entry.Name(), LsmTree.DISK_BLOCK_EXTENSION) {
+			if err := os.Link(path, target); err == nil {
+				return nil
+			}
+		}
+
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,20 @@
+package client
+
+// Backup makes the server write a consistent copy of every namespace to
+// path, a directory on the server that must not exist or be empty, see
+// BACKUP. It returns the time of the backup and one namespace:<name> pair
+// per namespace holding the sequence number of its last write. Large
+// backups may need a longer Options.ReadTimeout.
+func (c *Client) Backup(path string) ([]Pair, error) {
+	var pairs []Pair
+
+	err := c.do(false, func(cn *conn) error {
+		return c.roundTrip(cn, [][]byte{[]byte("BACKUP"), []byte(path)}, func(id uint64) error {
+			var err error
+			pairs, err = cn.readPairs(id)
+			return err
+		})
+	})
+
+	return pairs, err
+}
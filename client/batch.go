@@ -0,0 +1,94 @@
+package client
+
+import (
+	"fmt"
+	"time"
+)
+
+// Batch collects puts and deletes that Write applies atomically.
+type Batch struct {
+	cmds [][][]byte
+}
+
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+func (b *Batch) Put(key []byte, value []byte) {
+	b.PutWithTTL(key, value, 0)
+}
+
+func (b *Batch) PutWithTTL(key []byte, value []byte, ttl time.Duration) {
+	b.cmds = append(b.cmds, putArgs(key, value, ttl))
+}
+
+func (b *Batch) Delete(key []byte) {
+	b.cmds = append(b.cmds, delArgs(key))
+}
+
+func (b *Batch) Len() int {
+	return len(b.cmds)
+}
+
+func (b *Batch) Reset() {
+	b.cmds = b.cmds[:0]
+}
+
+// Write applies every operation of the batch or none of them, through
+// MULTI and EXEC. The operations are queued first and only executed once
+// the server accepted all of them.
+func (c *Client) Write(batch *Batch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	// the batch only holds puts and deletes, so running it twice gives the
+	// same result
+	return c.do(true, func(cn *conn) error {
+		firstID := cn.writeCommand([]byte("MULTI"))
+		for _, cmd := range batch.cmds {
+			cn.writeCommand(cmd...)
+		}
+
+		if err := cn.flush(c.opts.WriteTimeout); err != nil {
+			return err
+		}
+
+		if err := cn.setReadTimeout(c.opts.ReadTimeout); err != nil {
+			return err
+		}
+
+		var queueErr error
+		for i := 0; i <= len(batch.cmds); i++ {
+			if err := cn.readStatus(firstID + uint64(i)); err != nil {
+				if !isReplyError(err) {
+					return err
+				}
+				if queueErr == nil {
+					queueErr = fmt.Errorf("operation %d: %w", i, err)
+				}
+			}
+		}
+
+		var id uint64
+		if queueErr != nil {
+			id = cn.writeCommand([]byte("DISCARD"))
+		} else {
+			id = cn.writeCommand([]byte("EXEC"))
+		}
+
+		if err := cn.flush(c.opts.WriteTimeout); err != nil {
+			return err
+		}
+
+		if err := cn.setReadTimeout(c.opts.ReadTimeout); err != nil {
+			return err
+		}
+
+		if err := cn.readStatus(id); err != nil {
+			return err
+		}
+
+		return queueErr
+	})
+}
@@ -0,0 +1,305 @@
+// Package client is the Go client of midDB. Client talks to the TCP
+// listener of server.Server through a pool of connections, UDPClient sends
+// single requests to the UDP listener.
+package client
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const DEFAULT_ADDR = "localhost:8080"
+const DEFAULT_POOL_SIZE = 10
+const DEFAULT_DIAL_TIMEOUT = 5 * time.Second
+const DEFAULT_READ_TIMEOUT = 3 * time.Second
+const DEFAULT_WRITE_TIMEOUT = 3 * time.Second
+const DEFAULT_POOL_TIMEOUT = 4 * time.Second
+const DEFAULT_MAX_RETRIES = 3
+const DEFAULT_RETRY_BACKOFF = 100 * time.Millisecond
+
+// NO_EXPIRY is the TTL of a key that never expires.
+const NO_EXPIRY time.Duration = -1
+
+// Options configure a Client. Zero fields take the DEFAULT_* values, a
+// negative MaxRetries disables retries.
+type Options struct {
+	Addr string
+
+	PoolSize    int
+	PoolTimeout time.Duration
+
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// MaxRetries is how many times a request is retried after a network
+	// error, waiting RetryBackoff times the attempt number in between.
+	// Conditional writes are only retried when the request was never sent.
+	MaxRetries   int
+	RetryBackoff time.Duration
+
+	// TLSConfig is set to connect to a server that has TLS enabled, with
+	// Certificates holding the client certificate when the server verifies
+	// clients
+	TLSConfig *tls.Config
+
+	// User and Password authenticate every connection when the server has
+	// users configured
+	User     string
+	Password string
+
+	// Namespace is selected on every connection, the default namespace
+	// when empty
+	Namespace string
+}
+
+// Pair is a key and its value, as returned by scans.
+type Pair struct {
+	Key   []byte
+	Value []byte
+}
+
+// Client is safe for concurrent use. Connections are opened on demand.
+type Client struct {
+	opts Options
+	pool *pool
+}
+
+func New(opts Options) *Client {
+	if opts.Addr == "" {
+		opts.Addr = DEFAULT_ADDR
+	}
+
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = DEFAULT_POOL_SIZE
+	}
+
+	if opts.PoolTimeout == 0 {
+		opts.PoolTimeout = DEFAULT_POOL_TIMEOUT
+	}
+
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = DEFAULT_DIAL_TIMEOUT
+	}
+
+	if opts.ReadTimeout == 0 {
+		opts.ReadTimeout = DEFAULT_READ_TIMEOUT
+	}
+
+	if opts.WriteTimeout == 0 {
+		opts.WriteTimeout = DEFAULT_WRITE_TIMEOUT
+	}
+
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = DEFAULT_MAX_RETRIES
+	} else if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	}
+
+	if opts.RetryBackoff == 0 {
+		opts.RetryBackoff = DEFAULT_RETRY_BACKOFF
+	}
+
+	c := &Client{opts: opts}
+	c.pool = newPool(&c.opts)
+
+	return c
+}
+
+// Close closes the idle connections, the busy ones are closed as they are
+// released.
+func (c *Client) Close() error {
+	return c.pool.close()
+}
+
+// do runs fn on a pooled connection. Network errors drop the connection and,
+// for idempotent requests, are retried on a fresh one.
+func (c *Client) do(idempotent bool, fn func(cn *conn) error) error {
+	var err error
+
+	for attempt := 0; attempt <= c.opts.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * c.opts.RetryBackoff)
+		}
+
+		var cn *conn
+		cn, err = c.pool.get()
+		if err == ErrClosed || err == ErrPoolTimeout || isReplyError(err) {
+			// a failed AUTH or SELECT fails again
+			return err
+		}
+		if err != nil {
+			// nothing was sent, so even a conditional write can be retried
+			continue
+		}
+
+		err = fn(cn)
+
+		if err == nil || isReplyError(err) {
+			c.pool.put(cn, false)
+			return err
+		}
+
+		c.pool.put(cn, true)
+
+		if !idempotent {
+			return err
+		}
+	}
+
+	return err
+}
+
+// roundTrip sends one request and reads its reply with read.
+func (c *Client) roundTrip(cn *conn, args [][]byte, read func(id uint64) error) error {
+	id := cn.writeCommand(args...)
+
+	if err := cn.flush(c.opts.WriteTimeout); err != nil {
+		return err
+	}
+
+	if err := cn.setReadTimeout(c.opts.ReadTimeout); err != nil {
+		return err
+	}
+
+	return read(id)
+}
+
+// Get returns the value of key, or ErrNotFound.
+func (c *Client) Get(key []byte) ([]byte, error) {
+	var value []byte
+
+	err := c.do(true, func(cn *conn) error {
+		return c.roundTrip(cn, getArgs(key), func(id uint64) (err error) {
+			value, err = cn.readSingle(id)
+			return err
+		})
+	})
+
+	return value, err
+}
+
+// MGet returns the values of the keys in order, nil for the keys that do not
+// exist.
+func (c *Client) MGet(keys ...[]byte) ([][]byte, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	var values [][]byte
+
+	err := c.do(true, func(cn *conn) error {
+		return c.roundTrip(cn, mgetArgs(keys), func(id uint64) (err error) {
+			values, err = cn.readList(id, len(keys))
+			return err
+		})
+	})
+
+	return values, err
+}
+
+func (c *Client) Put(key []byte, value []byte) error {
+	return c.PutWithTTL(key, value, 0)
+}
+
+// PutWithTTL sets key to a value that expires after ttl, which is rounded
+// up to whole seconds. A ttl of 0 means the value never expires.
+func (c *Client) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	return c.do(true, func(cn *conn) error {
+		return c.roundTrip(cn, putArgs(key, value, ttl), cn.readStatus)
+	})
+}
+
+func (c *Client) Del(key []byte) error {
+	return c.do(true, func(cn *conn) error {
+		return c.roundTrip(cn, delArgs(key), cn.readStatus)
+	})
+}
+
+// Expire makes key expire after ttl, a ttl of 0 or less deletes it. Returns
+// ErrNotFound when the key does not exist.
+func (c *Client) Expire(key []byte, ttl time.Duration) error {
+	return c.do(true, func(cn *conn) error {
+		return c.roundTrip(cn, expireArgs(key, ttl), cn.readStatus)
+	})
+}
+
+// TTL returns the time left before key expires, in whole seconds, or
+// NO_EXPIRY when it never does. Returns ErrNotFound when the key does not
+// exist.
+func (c *Client) TTL(key []byte) (time.Duration, error) {
+	var ttl time.Duration
+
+	err := c.do(true, func(cn *conn) error {
+		return c.roundTrip(cn, [][]byte{[]byte("TTL"), key}, func(id uint64) error {
+			value, err := cn.readSingle(id)
+			if err != nil {
+				return err
+			}
+
+			seconds, err := strconv.ParseInt(string(value), 10, 64)
+			if err != nil {
+				return fmt.Errorf("%w: invalid TTL %q", ErrProtocol, value)
+			}
+
+			if seconds < 0 {
+				ttl = NO_EXPIRY
+			} else {
+				ttl = time.Duration(seconds) * time.Second
+			}
+			return nil
+		})
+	})
+
+	return ttl, err
+}
+
+// CompareAndSwap sets key to value only if it currently holds expected.
+// Returns ErrConflict otherwise.
+func (c *Client) CompareAndSwap(key []byte, expected []byte, value []byte) error {
+	return c.do(false, func(cn *conn) error {
+		return c.roundTrip(cn, [][]byte{[]byte("CAS"), key, expected, value}, cn.readStatus)
+	})
+}
+
+// PutIfAbsent sets key only if it does not exist. Returns ErrConflict
+// otherwise.
+func (c *Client) PutIfAbsent(key []byte, value []byte) error {
+	return c.do(false, func(cn *conn) error {
+		return c.roundTrip(cn, [][]byte{[]byte("PUTIFABSENT"), key, value}, cn.readStatus)
+	})
+}
+
+func getArgs(key []byte) [][]byte {
+	return [][]byte{[]byte("GET"), key}
+}
+
+func mgetArgs(keys [][]byte) [][]byte {
+	return append([][]byte{[]byte("MGET")}, keys...)
+}
+
+func putArgs(key []byte, value []byte, ttl time.Duration) [][]byte {
+	if ttl <= 0 {
+		return [][]byte{[]byte("PUT"), key, value}
+	}
+
+	return [][]byte{[]byte("PUT"), key, value, []byte("EX"), []byte(strconv.FormatInt(seconds(ttl), 10))}
+}
+
+func delArgs(key []byte) [][]byte {
+	return [][]byte{[]byte("DEL"), key}
+}
+
+func expireArgs(key []byte, ttl time.Duration) [][]byte {
+	return [][]byte{[]byte("EXPIRE"), key, []byte(strconv.FormatInt(seconds(ttl), 10))}
+}
+
+// seconds rounds a positive duration up to whole seconds.
+func seconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,39 @@
+package client
+
+// ClusterStatus describes the Raft cluster the server is a member of, see
+// CLUSTER STATUS. There is one member:<id> pair per member, holding its
+// address, its client address and, on the leader, the last index it has.
+func (c *Client) ClusterStatus() ([]Pair, error) {
+	var pairs []Pair
+
+	err := c.do(true, func(cn *conn) error {
+		return c.roundTrip(cn, [][]byte{[]byte("CLUSTER"), []byte("STATUS")}, func(id uint64) error {
+			var err error
+			pairs, err = cn.readPairs(id)
+			return err
+		})
+	})
+
+	return pairs, err
+}
+
+// AddMember adds a member to the cluster, it has to be sent to the leader.
+// clientAddr is where clients reach the member and may be empty.
+func (c *Client) AddMember(id string, addr string, clientAddr string) error {
+	args := [][]byte{[]byte("CLUSTER"), []byte("ADD"), []byte(id), []byte(addr)}
+	if clientAddr != "" {
+		args = append(args, []byte(clientAddr))
+	}
+
+	return c.do(false, func(cn *conn) error {
+		return c.roundTrip(cn, args, cn.readStatus)
+	})
+}
+
+// RemoveMember removes a member from the cluster, it has to be sent to the
+// leader.
+func (c *Client) RemoveMember(id string) error {
+	return c.do(false, func(cn *conn) error {
+		return c.roundTrip(cn, [][]byte{[]byte("CLUSTER"), []byte("REMOVE"), []byte(id)}, cn.readStatus)
+	})
+}
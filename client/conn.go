@@ -0,0 +1,282 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// conn is a TCP connection to the server. Requests are framed and carry a
+// request ID, so keys and values may hold any byte and every reply has the
+// same layout:
+//
+//	*<number of arguments> <request id>\n
+//	$<length>\n<argument>\n
+//	...
+//
+//	=<request id> <status> <number of values>\n
+//	$<length>\n<value>\n
+//	...
+type conn struct {
+	netConn net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	// lastID is the ID of the last request written
+	lastID uint64
+}
+
+func dial(opts *Options) (*conn, error) {
+	dialer := &net.Dialer{Timeout: opts.DialTimeout}
+
+	var netConn net.Conn
+	var err error
+	if opts.TLSConfig != nil {
+		netConn, err = tls.DialWithDialer(dialer, "tcp", opts.Addr, opts.TLSConfig)
+	} else {
+		netConn, err = dialer.Dial("tcp", opts.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cn := &conn{
+		netConn: netConn,
+		reader:  bufio.NewReader(netConn),
+		writer:  bufio.NewWriter(netConn),
+	}
+
+	if opts.User != "" {
+		if err := cn.setup(opts, []byte("AUTH"), []byte(opts.User), []byte(opts.Password)); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+
+	if opts.Namespace != "" {
+		if err := cn.setup(opts, []byte("SELECT"), []byte(opts.Namespace)); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+
+	return cn, nil
+}
+
+// setup runs a command that prepares a new connection, like AUTH.
+func (cn *conn) setup(opts *Options, args ...[]byte) error {
+	id := cn.writeCommand(args...)
+
+	if err := cn.flush(opts.WriteTimeout); err != nil {
+		return err
+	}
+
+	if err := cn.setReadTimeout(opts.ReadTimeout); err != nil {
+		return err
+	}
+
+	return cn.readStatus(id)
+}
+
+func (cn *conn) Close() error {
+	return cn.netConn.Close()
+}
+
+// writeCommand buffers a request and returns its ID, flush sends it.
+func (cn *conn) writeCommand(args ...[]byte) uint64 {
+	cn.lastID++
+	writeRequest(cn.writer, cn.lastID, args)
+	return cn.lastID
+}
+
+func writeRequest(writer *bufio.Writer, id uint64, args [][]byte) {
+	writer.WriteString("*" + strconv.Itoa(len(args)) + " " + strconv.FormatUint(id, 10) + "\n")
+
+	for _, arg := range args {
+		writer.WriteString("$" + strconv.Itoa(len(arg)) + "\n")
+		writer.Write(arg)
+		writer.WriteString("\n")
+	}
+}
+
+func (cn *conn) flush(timeout time.Duration) error {
+	if err := cn.netConn.SetWriteDeadline(deadline(timeout)); err != nil {
+		return err
+	}
+
+	return cn.writer.Flush()
+}
+
+// setReadTimeout bounds the time spent reading the replies to the requests
+// sent by the last flush.
+func (cn *conn) setReadTimeout(timeout time.Duration) error {
+	return cn.netConn.SetReadDeadline(deadline(timeout))
+}
+
+// readReply reads the reply to the request with the given ID. Replies come
+// in request order, so any other ID means the stream is out of sync.
+func (cn *conn) readReply(id uint64) (string, [][]byte, error) {
+	return readReply(cn.reader, id)
+}
+
+func readReply(reader *bufio.Reader, id uint64) (string, [][]byte, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return "", nil, err
+	}
+
+	fields := bytes.Split(line, []byte(" "))
+	if len(fields) != 3 || len(fields[0]) < 2 || fields[0][0] != '=' {
+		return "", nil, fmt.Errorf("%w: invalid reply %q", ErrProtocol, line)
+	}
+
+	if replyID, err := strconv.ParseUint(string(fields[0][1:]), 10, 64); err != nil || replyID != id {
+		return "", nil, fmt.Errorf("%w: expected the reply to request %d, got %q", ErrProtocol, id, fields[0][1:])
+	}
+
+	count, err := strconv.Atoi(string(fields[2]))
+	if err != nil || count < 0 {
+		return "", nil, fmt.Errorf("%w: invalid reply %q", ErrProtocol, line)
+	}
+
+	values := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		value, err := readValue(reader)
+		if err != nil {
+			return "", nil, err
+		}
+		values = append(values, value)
+	}
+
+	return string(fields[1]), values, nil
+}
+
+// readStatus reads a reply that carries no value, such as the reply to PUT.
+func (cn *conn) readStatus(id uint64) error {
+	status, values, err := cn.readReply(id)
+	if err != nil {
+		return err
+	}
+
+	return replyError(status, values)
+}
+
+// readSingle reads a reply that carries one value, like the reply to GET.
+func (cn *conn) readSingle(id uint64) ([]byte, error) {
+	status, values, err := cn.readReply(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := replyError(status, values); err != nil {
+		return nil, err
+	}
+
+	if len(values) != 1 {
+		return nil, fmt.Errorf("%w: expected one value, got %d", ErrProtocol, len(values))
+	}
+
+	return values[0], nil
+}
+
+// readList reads the reply to MGET, a value per key and nil for the missing
+// ones.
+func (cn *conn) readList(id uint64, count int) ([][]byte, error) {
+	status, values, err := cn.readReply(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := replyError(status, values); err != nil {
+		return nil, err
+	}
+
+	if len(values) != count {
+		return nil, fmt.Errorf("%w: expected %d values, got %d", ErrProtocol, count, len(values))
+	}
+
+	return values, nil
+}
+
+// readPairs reads the reply to SCAN, a key and a value per pair.
+func (cn *conn) readPairs(id uint64) ([]Pair, error) {
+	status, values, err := cn.readReply(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := replyError(status, values); err != nil {
+		return nil, err
+	}
+
+	if len(values)%2 != 0 {
+		return nil, fmt.Errorf("%w: odd number of values in a scan", ErrProtocol)
+	}
+
+	pairs := make([]Pair, 0, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		pairs = append(pairs, Pair{Key: values[i], Value: values[i+1]})
+	}
+
+	return pairs, nil
+}
+
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+
+	return line, nil
+}
+
+// readValue reads a $<length> header and the value that follows it. $-1
+// stands for a missing value and is returned as nil, other values are never
+// nil.
+func readValue(reader *bufio.Reader) ([]byte, error) {
+	header, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(header) == 0 || header[0] != '$' {
+		return nil, fmt.Errorf("%w: expected a value, got %q", ErrProtocol, header)
+	}
+
+	if string(header) == "$-1" {
+		return nil, nil
+	}
+
+	length, err := strconv.Atoi(string(header[1:]))
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("%w: invalid length %q", ErrProtocol, header)
+	}
+
+	value := make([]byte, length)
+	if _, err := io.ReadFull(reader, value); err != nil {
+		return nil, err
+	}
+
+	// the value is followed by a line ending
+	if rest, err := readLine(reader); err != nil {
+		return nil, err
+	} else if len(rest) != 0 {
+		return nil, fmt.Errorf("%w: value longer than announced", ErrProtocol)
+	}
+
+	return value, nil
+}
+
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"errors"
+	"strconv"
+)
+
+// ErrNotFound is returned when the key does not exist.
+var ErrNotFound = errors.New("key not found")
+
+// ErrConflict is returned when a conditional write fails because the key did
+// not hold what the caller expected.
+var ErrConflict = errors.New("conflict")
+
+// ErrClosed is returned once the client has been closed.
+var ErrClosed = errors.New("client is closed")
+
+// ErrPoolTimeout is returned when every connection of the pool stayed busy
+// for longer than PoolTimeout.
+var ErrPoolTimeout = errors.New("timed out waiting for a connection")
+
+// ErrProtocol is returned when the server sends a reply the client does not
+// understand. The connection it came from is dropped.
+var ErrProtocol = errors.New("protocol error")
+
+// ServerError is an error reported by the server, with the status INVALID
+// for a request the server did not accept, such as "Invalid command", or
+// ERROR for a failure of the server, such as "Error writing to WAL". The
+// connection stays usable after one.
+type ServerError struct {
+	Status  string
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return "server error: " + e.Message
+}
+
+// MovedError is returned when the key is served by another node of a
+// sharded ring, the request should be sent to Addr.
+type MovedError struct {
+	Slot int
+	Addr string
+}
+
+func (e *MovedError) Error() string {
+	return "moved: slot " + strconv.Itoa(e.Slot) + " is served by " + e.Addr
+}
+
+// replyError maps the status of a reply to an error, nil for OK and QUEUED.
+// The message of INVALID and ERROR replies is their only value.
+func replyError(status string, values [][]byte) error {
+	switch status {
+	case "OK", "QUEUED":
+		return nil
+	case "NOT_FOUND":
+		return ErrNotFound
+	case "CONFLICT":
+		return ErrConflict
+	case "MOVED":
+		if len(values) == 2 {
+			if slot, err := strconv.Atoi(string(values[0])); err == nil {
+				return &MovedError{Slot: slot, Addr: string(values[1])}
+			}
+		}
+		return ErrProtocol
+	default:
+		message := status
+		if len(values) == 1 {
+			message = string(values[0])
+		}
+		return &ServerError{Status: status, Message: message}
+	}
+}
+
+// isReplyError reports whether err was decoded from a well formed reply, in
+// which case the connection is still in sync with the server.
+func isReplyError(err error) bool {
+	var serverErr *ServerError
+	var movedErr *MovedError
+	return errors.Is(err, ErrNotFound) || errors.Is(err, ErrConflict) || errors.As(err, &serverErr) || errors.As(err, &movedErr)
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// NamespaceStats describe a namespace, see NAMESPACE STATS. The counters
+// start at zero when the server starts.
+type NamespaceStats struct {
+	Gets    int64
+	Scans   int64
+	Puts    int64
+	Deletes int64
+
+	LastSeq       int64
+	DiskBlocks    int64
+	DiskBytes     int64
+	MemtableBytes int64
+	// MaxBytes is the quota of the namespace, 0 when there is none
+	MaxBytes int64
+}
+
+// CreateNamespace creates an empty namespace, maxBytes caps its size and 0
+// means no limit.
+func (c *Client) CreateNamespace(name string, maxBytes int64) error {
+	args := [][]byte{[]byte("NAMESPACE"), []byte("CREATE"), []byte(name)}
+	if maxBytes > 0 {
+		args = append(args, []byte("MAXBYTES"), []byte(strconv.FormatInt(maxBytes, 10)))
+	}
+
+	return c.do(false, func(cn *conn) error {
+		return c.roundTrip(cn, args, cn.readStatus)
+	})
+}
+
+// DropNamespace deletes a namespace and everything it holds.
+func (c *Client) DropNamespace(name string) error {
+	return c.do(false, func(cn *conn) error {
+		return c.roundTrip(cn, [][]byte{[]byte("NAMESPACE"), []byte("DROP"), []byte(name)}, cn.readStatus)
+	})
+}
+
+// SetNamespaceQuota replaces the quota of a namespace, a maxBytes of 0
+// removes it.
+func (c *Client) SetNamespaceQuota(name string, maxBytes int64) error {
+	args := [][]byte{[]byte("NAMESPACE"), []byte("QUOTA"), []byte(name), []byte("MAXBYTES"), []byte(strconv.FormatInt(maxBytes, 10))}
+
+	return c.do(true, func(cn *conn) error {
+		return c.roundTrip(cn, args, cn.readStatus)
+	})
+}
+
+// Namespaces returns the names of every namespace in order.
+func (c *Client) Namespaces() ([]string, error) {
+	var names []string
+
+	err := c.do(true, func(cn *conn) error {
+		return c.roundTrip(cn, [][]byte{[]byte("NAMESPACE"), []byte("LIST")}, func(id uint64) error {
+			status, values, err := cn.readReply(id)
+			if err != nil {
+				return err
+			}
+
+			if err := replyError(status, values); err != nil {
+				return err
+			}
+
+			names = make([]string, len(values))
+			for i, value := range values {
+				names[i] = string(value)
+			}
+			return nil
+		})
+	})
+
+	return names, err
+}
+
+// NamespaceStats returns the stats of a namespace, the one of the client
+// when name is empty.
+func (c *Client) NamespaceStats(name string) (NamespaceStats, error) {
+	args := [][]byte{[]byte("NAMESPACE"), []byte("STATS")}
+	if name != "" {
+		args = append(args, []byte(name))
+	}
+
+	var stats NamespaceStats
+
+	err := c.do(true, func(cn *conn) error {
+		return c.roundTrip(cn, args, func(id uint64) error {
+			pairs, err := cn.readPairs(id)
+			if err != nil {
+				return err
+			}
+
+			fields := map[string]*int64{
+				"gets":           &stats.Gets,
+				"scans":          &stats.Scans,
+				"puts":           &stats.Puts,
+				"deletes":        &stats.Deletes,
+				"last_seq":       &stats.LastSeq,
+				"disk_blocks":    &stats.DiskBlocks,
+				"disk_bytes":     &stats.DiskBytes,
+				"memtable_bytes": &stats.MemtableBytes,
+				"max_bytes":      &stats.MaxBytes,
+			}
+
+			for _, pair := range pairs {
+				field, ok := fields[string(pair.Key)]
+				if !ok {
+					// newer servers may report more stats
+					continue
+				}
+
+				if *field, err = strconv.ParseInt(string(pair.Value), 10, 64); err != nil {
+					return fmt.Errorf("%w: invalid %s %q", ErrProtocol, pair.Key, pair.Value)
+				}
+			}
+			return nil
+		})
+	})
+
+	return stats, err
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"time"
+)
+
+// Pipeline queues requests and sends them in one write, then reads all the
+// replies, which saves a round trip per request. The server applies the
+// puts and deletes of a pipeline together, but they are not guaranteed to
+// be atomic, use Write for that.
+//
+//	pipe := c.Pipeline()
+//	pipe.Put([]byte("a"), []byte("1"))
+//	pipe.Get([]byte("b"))
+//	results, err := pipe.Exec()
+type Pipeline struct {
+	c    *Client
+	cmds []pipelineCommand
+}
+
+type pipelineCommand struct {
+	args      [][]byte
+	withValue bool
+}
+
+// Result is the outcome of one request of a pipeline. Value is set for Get,
+// Err holds ErrNotFound or a ServerError.
+type Result struct {
+	Value []byte
+	Err   error
+}
+
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
+
+func (p *Pipeline) Get(key []byte) {
+	p.cmds = append(p.cmds, pipelineCommand{args: getArgs(key), withValue: true})
+}
+
+func (p *Pipeline) Put(key []byte, value []byte) {
+	p.PutWithTTL(key, value, 0)
+}
+
+func (p *Pipeline) PutWithTTL(key []byte, value []byte, ttl time.Duration) {
+	p.cmds = append(p.cmds, pipelineCommand{args: putArgs(key, value, ttl)})
+}
+
+func (p *Pipeline) Del(key []byte) {
+	p.cmds = append(p.cmds, pipelineCommand{args: delArgs(key)})
+}
+
+func (p *Pipeline) Expire(key []byte, ttl time.Duration) {
+	p.cmds = append(p.cmds, pipelineCommand{args: expireArgs(key, ttl)})
+}
+
+func (p *Pipeline) Len() int {
+	return len(p.cmds)
+}
+
+// Exec sends the queued requests and returns their results in order, then
+// empties the pipeline. The error is set only when the requests could not
+// be sent or the replies could not be read, after retries.
+func (p *Pipeline) Exec() ([]Result, error) {
+	cmds := p.cmds
+	p.cmds = nil
+
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+
+	var results []Result
+
+	// every request a pipeline can hold is idempotent, so the whole
+	// pipeline may be sent again
+	err := p.c.do(true, func(cn *conn) error {
+		ids := make([]uint64, len(cmds))
+		for i, cmd := range cmds {
+			ids[i] = cn.writeCommand(cmd.args...)
+		}
+
+		if err := cn.flush(p.c.opts.WriteTimeout); err != nil {
+			return err
+		}
+
+		if err := cn.setReadTimeout(p.c.opts.ReadTimeout); err != nil {
+			return err
+		}
+
+		results = make([]Result, len(cmds))
+
+		for i, cmd := range cmds {
+			var err error
+			if cmd.withValue {
+				results[i].Value, err = cn.readSingle(ids[i])
+			} else {
+				err = cn.readStatus(ids[i])
+			}
+
+			if err != nil && !isReplyError(err) {
+				return err
+			}
+			results[i].Err = err
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// pool keeps up to PoolSize connections open and hands them out one request
+// at a time.
+type pool struct {
+	opts *Options
+
+	// idle holds the open connections nobody is using
+	idle chan *conn
+	// slots holds a token for every connection that may still be opened
+	slots chan struct{}
+
+	lock   sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+func newPool(opts *Options) *pool {
+	p := &pool{
+		opts:  opts,
+		idle:  make(chan *conn, opts.PoolSize),
+		slots: make(chan struct{}, opts.PoolSize),
+		done:  make(chan struct{}),
+	}
+
+	for i := 0; i < opts.PoolSize; i++ {
+		p.slots <- struct{}{}
+	}
+
+	return p
+}
+
+// get returns an idle connection, or opens a new one when the pool is not
+// full, or waits up to PoolTimeout for one to be released.
+func (p *pool) get() (*conn, error) {
+	var timeout <-chan time.Time
+	if p.opts.PoolTimeout > 0 {
+		timer := time.NewTimer(p.opts.PoolTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	// close hands the slots back, which must not open new connections
+	select {
+	case <-p.done:
+		return nil, ErrClosed
+	default:
+	}
+
+	select {
+	case <-p.done:
+		return nil, ErrClosed
+	case cn := <-p.idle:
+		return cn, nil
+	case <-p.slots:
+	case <-timeout:
+		return nil, ErrPoolTimeout
+	}
+
+	cn, err := dial(p.opts)
+	if err != nil {
+		p.slots <- struct{}{}
+		return nil, err
+	}
+
+	return cn, nil
+}
+
+// put hands a connection back. Broken connections, whose stream may be out
+// of sync with the server, are closed instead of reused.
+func (p *pool) put(cn *conn, broken bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if broken || p.closed {
+		cn.Close()
+		p.slots <- struct{}{}
+		return
+	}
+
+	p.idle <- cn
+}
+
+func (p *pool) close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return nil
+	}
+
+	p.closed = true
+	close(p.done)
+
+	var err error
+	for {
+		select {
+		case cn := <-p.idle:
+			if closeErr := cn.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+			p.slots <- struct{}{}
+		default:
+			return err
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package client
+
+// Replication describes the role of the server, see REPLICATION. The pairs
+// depend on the role, a follower reports whether it is connected to its
+// leader and a leader the sequence number each follower acknowledged.
+func (c *Client) Replication() ([]Pair, error) {
+	var pairs []Pair
+
+	err := c.do(true, func(cn *conn) error {
+		return c.roundTrip(cn, [][]byte{[]byte("REPLICATION")}, func(id uint64) error {
+			var err error
+			pairs, err = cn.readPairs(id)
+			return err
+		})
+	})
+
+	return pairs, err
+}
@@ -0,0 +1,132 @@
+package client
+
+import (
+	"strconv"
+)
+
+const DEFAULT_SCAN_PAGE_SIZE = 1000
+
+// Scanner walks the keys of a range in order, fetching them a page at a
+// time:
+//
+//	scanner := c.Prefix([]byte("user:"), 0)
+//	for scanner.Next() {
+//		fmt.Println(string(scanner.Key()), string(scanner.Value()))
+//	}
+//	if err := scanner.Err(); err != nil {
+//		...
+//	}
+type Scanner struct {
+	c        *Client
+	start    []byte
+	end      []byte
+	pageSize int
+
+	page []Pair
+	pos  int
+	last bool
+	err  error
+}
+
+// Scan returns a scanner over the keys in [start, end), an empty end means
+// there is no upper bound. A pageSize of 0 uses DEFAULT_SCAN_PAGE_SIZE.
+func (c *Client) Scan(start []byte, end []byte, pageSize int) *Scanner {
+	if pageSize <= 0 {
+		pageSize = DEFAULT_SCAN_PAGE_SIZE
+	}
+
+	return &Scanner{
+		c:        c,
+		start:    start,
+		end:      end,
+		pageSize: pageSize,
+		pos:      -1,
+	}
+}
+
+// Prefix returns a scanner over the keys starting with prefix.
+func (c *Client) Prefix(prefix []byte, pageSize int) *Scanner {
+	return c.Scan(prefix, prefixEnd(prefix), pageSize)
+}
+
+// ScanAll returns every pair in [start, end).
+func (c *Client) ScanAll(start []byte, end []byte) ([]Pair, error) {
+	var pairs []Pair
+
+	scanner := c.Scan(start, end, 0)
+	for scanner.Next() {
+		pairs = append(pairs, Pair{Key: scanner.Key(), Value: scanner.Value()})
+	}
+
+	return pairs, scanner.Err()
+}
+
+// Next moves to the next pair, it returns false at the end of the range or
+// on error.
+func (s *Scanner) Next() bool {
+	if s.err != nil {
+		return false
+	}
+
+	s.pos++
+	if s.pos < len(s.page) {
+		return true
+	}
+
+	if s.last {
+		return false
+	}
+
+	if len(s.page) > 0 {
+		// the smallest key after the last one of the page
+		s.start = append(append([]byte{}, s.page[len(s.page)-1].Key...), 0)
+	}
+
+	s.page, s.err = s.fetch()
+	s.pos = 0
+	s.last = len(s.page) < s.pageSize
+
+	return s.err == nil && len(s.page) > 0
+}
+
+func (s *Scanner) Key() []byte {
+	return s.page[s.pos].Key
+}
+
+func (s *Scanner) Value() []byte {
+	return s.page[s.pos].Value
+}
+
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+func (s *Scanner) fetch() ([]Pair, error) {
+	var pairs []Pair
+
+	args := [][]byte{[]byte("SCAN"), s.start, s.end, []byte("LIMIT"), []byte(strconv.Itoa(s.pageSize))}
+
+	err := s.c.do(true, func(cn *conn) error {
+		return s.c.roundTrip(cn, args, func(id uint64) (err error) {
+			pairs, err = cn.readPairs(id)
+			return err
+		})
+	})
+
+	return pairs, err
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or nil when there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	return nil
+}
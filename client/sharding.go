@@ -0,0 +1,51 @@
+package client
+
+// ShardStatus describes the ring the server is a node of, see SHARD STATUS.
+// There is one node:<id> pair per node, holding its address, its client
+// address and the number of slots it owns.
+func (c *Client) ShardStatus() ([]Pair, error) {
+	return c.shardPairs([][]byte{[]byte("SHARD"), []byte("STATUS")})
+}
+
+// ShardSlot returns the slot of a key and the node that serves it, see
+// SHARD SLOT.
+func (c *Client) ShardSlot(key []byte) ([]Pair, error) {
+	return c.shardPairs([][]byte{[]byte("SHARD"), []byte("SLOT"), key})
+}
+
+func (c *Client) shardPairs(args [][]byte) ([]Pair, error) {
+	var pairs []Pair
+
+	err := c.do(true, func(cn *conn) error {
+		return c.roundTrip(cn, args, func(id uint64) error {
+			var err error
+			pairs, err = cn.readPairs(id)
+			return err
+		})
+	})
+
+	return pairs, err
+}
+
+// AddShardNode adds a node started without members to the ring, addr being
+// its sharding port and clientAddr where clients reach it.
+func (c *Client) AddShardNode(id string, addr string, clientAddr string) error {
+	args := [][]byte{[]byte("SHARD"), []byte("ADD"), []byte(id), []byte(addr), []byte(clientAddr)}
+
+	return c.do(false, func(cn *conn) error {
+		return c.roundTrip(cn, args, cn.readStatus)
+	})
+}
+
+// RemoveShardNode removes a node from the ring once it handed its slots
+// over, or right away with force.
+func (c *Client) RemoveShardNode(id string, force bool) error {
+	args := [][]byte{[]byte("SHARD"), []byte("REMOVE"), []byte(id)}
+	if force {
+		args = append(args, []byte("FORCE"))
+	}
+
+	return c.do(false, func(cn *conn) error {
+		return c.roundTrip(cn, args, cn.readStatus)
+	})
+}
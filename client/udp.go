@@ -0,0 +1,183 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const DEFAULT_UDP_ADDR = "localhost:1053"
+const DEFAULT_UDP_TIMEOUT = 500 * time.Millisecond
+const DEFAULT_UDP_BUFFER_SIZE = 65535
+
+// udpRequestID numbers the requests of every UDPClient.
+var udpRequestID uint64
+
+// UDPOptions configure a UDPClient. Zero fields take the DEFAULT_* values,
+// a negative MaxRetries disables retries.
+type UDPOptions struct {
+	Addr string
+
+	// Timeout is how long to wait for the reply to one packet
+	Timeout time.Duration
+	// MaxRetries is how many times a request is sent again when no reply
+	// came within Timeout
+	MaxRetries int
+	// BufferSize must be at least the udp_buffer_size of the server
+	BufferSize int
+}
+
+// UDPClient sends each request as a single datagram, which is cheaper than
+// TCP for small requests but may lose packets, so requests are resent on
+// timeout. Requests and replies must fit in a datagram, and in the
+// udp_buffer_size of the server, longer requests fail with a ServerError
+// whose status is INVALID. Writes fail with a ServerError whose status
+// is DENIED when the server has udp_read_only set.
+type UDPClient struct {
+	opts UDPOptions
+}
+
+func NewUDPClient(opts UDPOptions) *UDPClient {
+	if opts.Addr == "" {
+		opts.Addr = DEFAULT_UDP_ADDR
+	}
+
+	if opts.Timeout == 0 {
+		opts.Timeout = DEFAULT_UDP_TIMEOUT
+	}
+
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = DEFAULT_MAX_RETRIES
+	} else if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	}
+
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = DEFAULT_UDP_BUFFER_SIZE
+	}
+
+	return &UDPClient{opts: opts}
+}
+
+// Get returns the value of key, or ErrNotFound.
+func (c *UDPClient) Get(key []byte) ([]byte, error) {
+	status, values, err := c.roundTrip(getArgs(key))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := replyError(status, values); err != nil {
+		return nil, err
+	}
+
+	if len(values) != 1 {
+		return nil, fmt.Errorf("%w: expected one value, got %d", ErrProtocol, len(values))
+	}
+
+	return values[0], nil
+}
+
+// MGet returns the values of the keys in order, nil for the keys that do not
+// exist.
+func (c *UDPClient) MGet(keys ...[]byte) ([][]byte, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	status, values, err := c.roundTrip(mgetArgs(keys))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := replyError(status, values); err != nil {
+		return nil, err
+	}
+
+	if len(values) != len(keys) {
+		return nil, fmt.Errorf("%w: expected %d values, got %d", ErrProtocol, len(keys), len(values))
+	}
+
+	return values, nil
+}
+
+func (c *UDPClient) Put(key []byte, value []byte) error {
+	return c.PutWithTTL(key, value, 0)
+}
+
+// PutWithTTL sets key to a value that expires after ttl, which is rounded
+// up to whole seconds. A ttl of 0 means the value never expires. A put whose
+// reply was lost is sent again, which is harmless as puts are idempotent.
+func (c *UDPClient) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	status, values, err := c.roundTrip(putArgs(key, value, ttl))
+	if err != nil {
+		return err
+	}
+
+	return replyError(status, values)
+}
+
+func (c *UDPClient) Del(key []byte) error {
+	status, values, err := c.roundTrip(delArgs(key))
+	if err != nil {
+		return err
+	}
+
+	return replyError(status, values)
+}
+
+// roundTrip sends a request and returns the reply that carries its ID. A
+// socket is opened per request and replies to earlier attempts are told
+// apart by their ID, so a late reply is never taken for another one.
+func (c *UDPClient) roundTrip(args [][]byte) (string, [][]byte, error) {
+	udpConn, err := net.Dial("udp", c.opts.Addr)
+	if err != nil {
+		return "", nil, err
+	}
+	defer udpConn.Close()
+
+	buf := make([]byte, c.opts.BufferSize)
+
+	for attempt := 0; attempt <= c.opts.MaxRetries; attempt++ {
+		id := atomic.AddUint64(&udpRequestID, 1)
+
+		var request bytes.Buffer
+		writer := bufio.NewWriter(&request)
+		writeRequest(writer, id, args)
+		writer.Flush()
+
+		if _, err = udpConn.Write(request.Bytes()); err != nil {
+			continue
+		}
+
+		if err = udpConn.SetReadDeadline(time.Now().Add(c.opts.Timeout)); err != nil {
+			return "", nil, err
+		}
+
+		for {
+			var n int
+			n, err = udpConn.Read(buf)
+			if err != nil {
+				break
+			}
+
+			status, values, replyErr := readReply(bufio.NewReader(bytes.NewReader(buf[:n])), id)
+			if replyErr == nil {
+				return status, values, nil
+			}
+
+			if errors.Is(replyErr, io.EOF) || errors.Is(replyErr, io.ErrUnexpectedEOF) {
+				// the reply did not fit in a datagram
+				return "", nil, fmt.Errorf("%w: truncated reply", ErrProtocol)
+			}
+
+			// the reply to an earlier attempt, keep waiting for this one
+		}
+	}
+
+	return "", nil, err
+}
@@ -0,0 +1,225 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ErrSeqTooOld is returned when a watch resumes after changes the server no
+// longer retains. The consumer has to read the keys again and start a new
+// watch.
+var ErrSeqTooOld = errors.New("sequence number is no longer retained")
+
+// seqTooOldMessage is the message of the INVALID reply to a WATCH that
+// resumes too far back.
+const seqTooOldMessage = "Sequence number is no longer retained"
+
+// Event is a committed put or delete.
+type Event struct {
+	Seq    uint64
+	Key    []byte
+	Value  []byte
+	Delete bool
+	// ExpiresAt is when the value expires, the zero time for never
+	ExpiresAt time.Time
+}
+
+// Watcher streams the changes to the keys starting with a prefix over a
+// connection of its own. When the connection breaks, Next opens a new one
+// and resumes after the last event it returned, so no event is lost or
+// repeated. It is not safe for concurrent use.
+type Watcher struct {
+	client *Client
+	prefix []byte
+	// seq is the sequence number of the last event returned, or the one the
+	// stream started after
+	seq uint64
+	cn  *conn
+	id  uint64
+}
+
+// Watch streams the changes made from now on.
+func (c *Client) Watch(prefix []byte) (*Watcher, error) {
+	w := &Watcher{client: c, prefix: prefix}
+
+	if err := w.connect(false); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// WatchAfter streams the changes with a sequence number above seq, usually
+// the Seq of the last event a previous watcher returned. It returns
+// ErrSeqTooOld when the server no longer retains them.
+func (c *Client) WatchAfter(prefix []byte, seq uint64) (*Watcher, error) {
+	w := &Watcher{client: c, prefix: prefix, seq: seq}
+
+	if err := w.connect(true); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Seq returns the sequence number of the last event returned by Next, or
+// the one the stream started after. Passing it to WatchAfter resumes the
+// stream.
+func (w *Watcher) Seq() uint64 {
+	return w.seq
+}
+
+// Next waits for the next event. Network errors are retried like requests,
+// errors reported by the server end the stream.
+func (w *Watcher) Next() (Event, error) {
+	var err error
+
+	for attempt := 0; attempt <= w.client.opts.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * w.client.opts.RetryBackoff)
+		}
+
+		if w.cn == nil {
+			if err = w.connect(true); err != nil {
+				if isReplyError(err) || err == ErrSeqTooOld {
+					return Event{}, err
+				}
+				continue
+			}
+		}
+
+		var event Event
+		event, err = w.read()
+		if err == nil {
+			w.seq = event.Seq
+			return event, nil
+		}
+
+		if isReplyError(err) {
+			return Event{}, err
+		}
+
+		w.cn.Close()
+		w.cn = nil
+	}
+
+	return Event{}, err
+}
+
+// Close ends the stream.
+func (w *Watcher) Close() error {
+	if w.cn == nil {
+		return nil
+	}
+
+	err := w.cn.Close()
+	w.cn = nil
+	return err
+}
+
+// connect opens a connection and sends WATCH, resuming after w.seq when
+// resume is set. The first reply holds the sequence number the stream
+// starts after.
+func (w *Watcher) connect(resume bool) error {
+	opts := w.client.opts
+
+	cn, err := dial(&opts)
+	if err != nil {
+		return err
+	}
+
+	args := [][]byte{[]byte("WATCH"), w.prefix}
+	if resume {
+		args = append(args, []byte("AFTER"), []byte(strconv.FormatUint(w.seq, 10)))
+	}
+
+	id := cn.writeCommand(args...)
+
+	if err := cn.flush(opts.WriteTimeout); err != nil {
+		cn.Close()
+		return err
+	}
+
+	if err := cn.setReadTimeout(opts.ReadTimeout); err != nil {
+		cn.Close()
+		return err
+	}
+
+	value, err := cn.readSingle(id)
+	if err != nil {
+		cn.Close()
+
+		var serverErr *ServerError
+		if errors.As(err, &serverErr) && serverErr.Message == seqTooOldMessage {
+			return ErrSeqTooOld
+		}
+		return err
+	}
+
+	seq, err := strconv.ParseUint(string(value), 10, 64)
+	if err != nil {
+		cn.Close()
+		return fmt.Errorf("%w: invalid sequence number %q", ErrProtocol, value)
+	}
+
+	// events may be far apart, so only writes are bounded from now on
+	if err := cn.setReadTimeout(0); err != nil {
+		cn.Close()
+		return err
+	}
+
+	w.cn, w.id, w.seq = cn, id, seq
+	return nil
+}
+
+// read reads the next EVENT reply, which holds the sequence number, PUT or
+// DEL, the key and, for puts, the value and its expiry in unix milliseconds.
+func (w *Watcher) read() (Event, error) {
+	status, values, err := w.cn.readReply(w.id)
+	if err != nil {
+		return Event{}, err
+	}
+
+	if status != "EVENT" {
+		if err := replyError(status, values); err != nil {
+			return Event{}, err
+		}
+		return Event{}, fmt.Errorf("%w: unexpected %s reply in a watch", ErrProtocol, status)
+	}
+
+	if len(values) < 3 {
+		return Event{}, fmt.Errorf("%w: event with %d values", ErrProtocol, len(values))
+	}
+
+	seq, err := strconv.ParseUint(string(values[0]), 10, 64)
+	if err != nil {
+		return Event{}, fmt.Errorf("%w: invalid sequence number %q", ErrProtocol, values[0])
+	}
+
+	event := Event{Seq: seq, Key: values[2]}
+
+	switch string(values[1]) {
+	case "DEL":
+		event.Delete = true
+	case "PUT":
+		if len(values) != 5 {
+			return Event{}, fmt.Errorf("%w: put event with %d values", ErrProtocol, len(values))
+		}
+
+		expiresAt, err := strconv.ParseInt(string(values[4]), 10, 64)
+		if err != nil {
+			return Event{}, fmt.Errorf("%w: invalid expiry %q", ErrProtocol, values[4])
+		}
+
+		event.Value = values[3]
+		if expiresAt != 0 {
+			event.ExpiresAt = time.UnixMilli(expiresAt)
+		}
+	default:
+		return Event{}, fmt.Errorf("%w: unknown event type %q", ErrProtocol, values[1])
+	}
+
+	return event, nil
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Avash027/midDB/client"
+)
+
+var errQuit = errors.New("quit")
+
+const NAMESPACE_USAGE = "NAMESPACE CREATE ns [MAXBYTES n] | DROP ns | QUOTA ns MAXBYTES n | LIST | STATS [ns]"
+
+const CLUSTER_USAGE = "CLUSTER STATUS | ADD id addr [client_addr] | REMOVE id"
+
+const SHARD_USAGE = "SHARD STATUS | SLOT key | ADD id addr client_addr | REMOVE id [FORCE]"
+
+type command struct {
+	name  string
+	usage string
+	// argc is the number of arguments, or the smallest number when the
+	// command takes optional ones up to maxArgc, -1 meaning any number
+	argc    int
+	maxArgc int
+	run     func(s *session, args [][]byte) error
+}
+
+var commands = []command{
+	{name: "GET", usage: "GET key", argc: 1, run: (*session).get},
+	{name: "MGET", usage: "MGET key [key ...]", argc: 1, maxArgc: -1, run: (*session).mget},
+	{name: "PUT", usage: "PUT key value [EX seconds]", argc: 2, maxArgc: 4, run: (*session).put},
+	{name: "DEL", usage: "DEL key", argc: 1, run: (*session).del},
+	{name: "SCAN", usage: "SCAN start end [LIMIT n]", argc: 2, maxArgc: 4, run: (*session).scan},
+	{name: "PREFIX", usage: "PREFIX prefix [LIMIT n]", argc: 1, maxArgc: 3, run: (*session).prefix},
+	{name: "EXPIRE", usage: "EXPIRE key seconds", argc: 2, run: (*session).expire},
+	{name: "TTL", usage: "TTL key", argc: 1, run: (*session).ttl},
+	{name: "CAS", usage: "CAS key expected new", argc: 3, run: (*session).cas},
+	{name: "PUTIFABSENT", usage: "PUTIFABSENT key value", argc: 2, run: (*session).putIfAbsent},
+	{name: "MULTI", usage: "MULTI", run: (*session).multi},
+	{name: "EXEC", usage: "EXEC", run: (*session).exec},
+	{name: "DISCARD", usage: "DISCARD", run: (*session).discard},
+	{name: "WATCH", usage: "WATCH prefix [AFTER seq]", argc: 1, maxArgc: 3, run: (*session).watch},
+	{name: "SELECT", usage: "SELECT namespace", argc: 1, run: (*session).selectNamespace},
+	{name: "NAMESPACE", usage: NAMESPACE_USAGE, argc: 1, maxArgc: 4, run: (*session).namespace},
+	{name: "REPLICATION", usage: "REPLICATION", run: (*session).replication},
+	{name: "CLUSTER", usage: CLUSTER_USAGE, argc: 1, maxArgc: 4, run: (*session).cluster},
+	{name: "SHARD", usage: SHARD_USAGE, argc: 1, maxArgc: 4, run: (*session).shard},
+	{name: "BACKUP", usage: "BACKUP path", argc: 1, run: (*session).backup},
+	{name: "QUIT", usage: "QUIT", run: (*session).quit},
+}
+
+func init() {
+	// HELP lists the commands, so it can only be added once they exist
+	commands = append(commands, command{name: "HELP", usage: "HELP", run: (*session).help})
+}
+
+func findCommand(name string) (command, bool) {
+	name = strings.ToUpper(name)
+	if name == "EXIT" {
+		name = "QUIT"
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+
+	return command{}, false
+}
+
+// session runs the commands of one REPL or script against the server. Writes
+// between MULTI and EXEC are queued in batch and sent as one atomic batch.
+// SELECT replaces the client with one built from opts for the namespace.
+type session struct {
+	client  *client.Client
+	opts    client.Options
+	printer printer
+	out     io.Writer
+	batch   *client.Batch
+	// interactive is set in the REPL, which can not stop a WATCH
+	interactive bool
+}
+
+// run executes a line and prints its result. The error is returned for
+// failed commands, a missing key is not a failure.
+func (s *session) run(line string) error {
+	args, err := splitArgs(line)
+	if err != nil {
+		s.printer.error(err)
+		return err
+	}
+
+	if len(args) == 0 {
+		return nil
+	}
+
+	cmd, ok := findCommand(string(args[0]))
+	if !ok {
+		err := fmt.Errorf("unknown command %q, try HELP", args[0])
+		s.printer.error(err)
+		return err
+	}
+
+	args = args[1:]
+	maxArgc := cmd.maxArgc
+	if maxArgc == 0 {
+		maxArgc = cmd.argc
+	}
+
+	if len(args) < cmd.argc || (maxArgc >= 0 && len(args) > maxArgc) {
+		err := errors.New("usage: " + cmd.usage)
+		s.printer.error(err)
+		return err
+	}
+
+	if s.batch != nil {
+		switch cmd.name {
+		case "PUT", "DEL", "EXEC", "DISCARD", "MULTI", "HELP", "QUIT":
+		default:
+			err := errors.New("only PUT and DEL can be queued")
+			s.printer.error(err)
+			return err
+		}
+	}
+
+	err = cmd.run(s, args)
+
+	switch {
+	case err == errQuit:
+		return err
+	case errors.Is(err, client.ErrNotFound):
+		s.printer.notFound()
+		return nil
+	case err != nil:
+		s.printer.error(err)
+	}
+
+	return err
+}
+
+func (s *session) get(args [][]byte) error {
+	value, err := s.client.Get(args[0])
+	if err != nil {
+		return err
+	}
+
+	s.printer.value(value)
+	return nil
+}
+
+func (s *session) mget(args [][]byte) error {
+	values, err := s.client.MGet(args...)
+	if err != nil {
+		return err
+	}
+
+	s.printer.list(values)
+	return nil
+}
+
+func (s *session) put(args [][]byte) error {
+	var ttl time.Duration
+
+	if len(args) == 4 {
+		seconds, err := strconv.Atoi(string(args[3]))
+		if !strings.EqualFold(string(args[2]), "EX") || err != nil || seconds <= 0 {
+			return errors.New("usage: PUT key value [EX seconds]")
+		}
+		ttl = time.Duration(seconds) * time.Second
+	} else if len(args) == 3 {
+		return errors.New("usage: PUT key value [EX seconds]")
+	}
+
+	if s.batch != nil {
+		s.batch.PutWithTTL(args[0], args[1], ttl)
+		s.printer.status("QUEUED")
+		return nil
+	}
+
+	return s.status(s.client.PutWithTTL(args[0], args[1], ttl))
+}
+
+func (s *session) del(args [][]byte) error {
+	if s.batch != nil {
+		s.batch.Delete(args[0])
+		s.printer.status("QUEUED")
+		return nil
+	}
+
+	return s.status(s.client.Del(args[0]))
+}
+
+func (s *session) scan(args [][]byte) error {
+	limit, err := parseLimit(args[2:])
+	if err != nil {
+		return err
+	}
+
+	return s.pairs(s.client.Scan(args[0], args[1], limit), limit)
+}
+
+func (s *session) prefix(args [][]byte) error {
+	limit, err := parseLimit(args[1:])
+	if err != nil {
+		return err
+	}
+
+	return s.pairs(s.client.Prefix(args[0], limit), limit)
+}
+
+func (s *session) expire(args [][]byte) error {
+	seconds, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return errors.New("usage: EXPIRE key seconds")
+	}
+
+	return s.status(s.client.Expire(args[0], time.Duration(seconds)*time.Second))
+}
+
+func (s *session) ttl(args [][]byte) error {
+	ttl, err := s.client.TTL(args[0])
+	if err != nil {
+		return err
+	}
+
+	if ttl == client.NO_EXPIRY {
+		s.printer.integer(-1)
+	} else {
+		s.printer.integer(int64(ttl / time.Second))
+	}
+	return nil
+}
+
+func (s *session) cas(args [][]byte) error {
+	return s.status(s.client.CompareAndSwap(args[0], args[1], args[2]))
+}
+
+func (s *session) putIfAbsent(args [][]byte) error {
+	return s.status(s.client.PutIfAbsent(args[0], args[1]))
+}
+
+func (s *session) multi(args [][]byte) error {
+	if s.batch != nil {
+		return errors.New("MULTI calls can not be nested")
+	}
+
+	s.batch = client.NewBatch()
+	s.printer.status("OK")
+	return nil
+}
+
+func (s *session) exec(args [][]byte) error {
+	if s.batch == nil {
+		return errors.New("EXEC without MULTI")
+	}
+
+	batch := s.batch
+	s.batch = nil
+
+	return s.status(s.client.Write(batch))
+}
+
+func (s *session) discard(args [][]byte) error {
+	if s.batch == nil {
+		return errors.New("DISCARD without MULTI")
+	}
+
+	s.batch = nil
+	s.printer.status("OK")
+	return nil
+}
+
+// watch prints the events until the server ends the stream or the process
+// is interrupted.
+func (s *session) watch(args [][]byte) error {
+	if s.interactive {
+		return errors.New("WATCH runs until interrupted, use it from the command line: middb-cli WATCH prefix")
+	}
+
+	var watcher *client.Watcher
+	var err error
+
+	switch {
+	case len(args) == 1:
+		watcher, err = s.client.Watch(args[0])
+	case len(args) == 3 && strings.EqualFold(string(args[1]), "AFTER"):
+		seq, parseErr := strconv.ParseUint(string(args[2]), 10, 64)
+		if parseErr != nil {
+			return errors.New("usage: WATCH prefix [AFTER seq]")
+		}
+		watcher, err = s.client.WatchAfter(args[0], seq)
+	default:
+		return errors.New("usage: WATCH prefix [AFTER seq]")
+	}
+
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	for {
+		event, err := watcher.Next()
+		if err != nil {
+			return fmt.Errorf("after seq %d: %w", watcher.Seq(), err)
+		}
+
+		s.printer.event(event)
+	}
+}
+
+func (s *session) selectNamespace(args [][]byte) error {
+	opts := s.opts
+	opts.Namespace = string(args[0])
+
+	c := client.New(opts)
+
+	// the first request opens a connection, which selects the namespace
+	if _, err := c.NamespaceStats(""); err != nil {
+		c.Close()
+		return err
+	}
+
+	s.client.Close()
+	s.client, s.opts = c, opts
+
+	s.printer.status("OK")
+	return nil
+}
+
+func (s *session) namespace(args [][]byte) error {
+	usage := errors.New("usage: " + NAMESPACE_USAGE)
+
+	switch strings.ToUpper(string(args[0])) {
+	case "CREATE":
+		maxBytes, err := parseMaxBytes(args[2:])
+		if len(args) < 2 || err != nil {
+			return usage
+		}
+
+		return s.status(s.client.CreateNamespace(string(args[1]), maxBytes))
+	case "DROP":
+		if len(args) != 2 {
+			return usage
+		}
+
+		return s.status(s.client.DropNamespace(string(args[1])))
+	case "QUOTA":
+		if len(args) != 4 {
+			return usage
+		}
+
+		maxBytes, err := parseMaxBytes(args[2:])
+		if err != nil {
+			return usage
+		}
+
+		return s.status(s.client.SetNamespaceQuota(string(args[1]), maxBytes))
+	case "LIST":
+		if len(args) != 1 {
+			return usage
+		}
+
+		names, err := s.client.Namespaces()
+		if err != nil {
+			return err
+		}
+
+		values := make([][]byte, len(names))
+		for i, name := range names {
+			values[i] = []byte(name)
+		}
+
+		s.printer.list(values)
+		return nil
+	case "STATS":
+		if len(args) > 2 {
+			return usage
+		}
+
+		var name string
+		if len(args) == 2 {
+			name = string(args[1])
+		}
+
+		stats, err := s.client.NamespaceStats(name)
+		if err != nil {
+			return err
+		}
+
+		s.printer.pairs(statsPairs(stats))
+		return nil
+	default:
+		return usage
+	}
+}
+
+func (s *session) replication(args [][]byte) error {
+	pairs, err := s.client.Replication()
+	if err != nil {
+		return err
+	}
+
+	s.printer.pairs(pairs)
+	return nil
+}
+
+func (s *session) cluster(args [][]byte) error {
+	usage := errors.New("usage: " + CLUSTER_USAGE)
+
+	switch strings.ToUpper(string(args[0])) {
+	case "STATUS":
+		if len(args) != 1 {
+			return usage
+		}
+
+		pairs, err := s.client.ClusterStatus()
+		if err != nil {
+			return err
+		}
+
+		s.printer.pairs(pairs)
+		return nil
+	case "ADD":
+		if len(args) != 3 && len(args) != 4 {
+			return usage
+		}
+
+		var clientAddr string
+		if len(args) == 4 {
+			clientAddr = string(args[3])
+		}
+
+		return s.status(s.client.AddMember(string(args[1]), string(args[2]), clientAddr))
+	case "REMOVE":
+		if len(args) != 2 {
+			return usage
+		}
+
+		return s.status(s.client.RemoveMember(string(args[1])))
+	default:
+		return usage
+	}
+}
+
+func (s *session) shard(args [][]byte) error {
+	usage := errors.New("usage: " + SHARD_USAGE)
+
+	switch strings.ToUpper(string(args[0])) {
+	case "STATUS":
+		if len(args) != 1 {
+			return usage
+		}
+
+		pairs, err := s.client.ShardStatus()
+		if err != nil {
+			return err
+		}
+
+		s.printer.pairs(pairs)
+		return nil
+	case "SLOT":
+		if len(args) != 2 {
+			return usage
+		}
+
+		pairs, err := s.client.ShardSlot(args[1])
+		if err != nil {
+			return err
+		}
+
+		s.printer.pairs(pairs)
+		return nil
+	case "ADD":
+		if len(args) != 4 {
+			return usage
+		}
+
+		return s.status(s.client.AddShardNode(string(args[1]), string(args[2]), string(args[3])))
+	case "REMOVE":
+		force := len(args) == 3 && strings.ToUpper(string(args[2])) == "FORCE"
+		if len(args) != 2 && !force {
+			return usage
+		}
+
+		return s.status(s.client.RemoveShardNode(string(args[1]), force))
+	default:
+		return usage
+	}
+}
+
+func (s *session) backup(args [][]byte) error {
+	pairs, err := s.client.Backup(string(args[0]))
+	if err != nil {
+		return err
+	}
+
+	s.printer.pairs(pairs)
+	return nil
+}
+
+func (s *session) help(args [][]byte) error {
+	for _, cmd := range commands {
+		fmt.Fprintln(s.out, cmd.usage)
+	}
+	return nil
+}
+
+func (s *session) quit(args [][]byte) error {
+	return errQuit
+}
+
+func (s *session) status(err error) error {
+	if err == nil {
+		s.printer.status("OK")
+	}
+	return err
+}
+
+// pairs prints up to limit pairs of the scanner, every pair when limit is 0.
+// The scanner is expected to fetch pages of limit pairs, so only one round
+// trip is made when there is a limit.
+func (s *session) pairs(scanner *client.Scanner, limit int) error {
+	var pairs []client.Pair
+
+	for (limit == 0 || len(pairs) < limit) && scanner.Next() {
+		pairs = append(pairs, client.Pair{Key: scanner.Key(), Value: scanner.Value()})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	s.printer.pairs(pairs)
+	return nil
+}
+
+// parseMaxBytes parses an empty list or MAXBYTES n.
+func parseMaxBytes(args [][]byte) (int64, error) {
+	if len(args) == 0 {
+		return 0, nil
+	}
+
+	maxBytes, err := strconv.ParseInt(string(args[len(args)-1]), 10, 64)
+	if len(args) != 2 || !strings.EqualFold(string(args[0]), "MAXBYTES") || err != nil || maxBytes < 0 {
+		return 0, errors.New("expected MAXBYTES n")
+	}
+
+	return maxBytes, nil
+}
+
+// statsPairs lists the stats as the server names them.
+func statsPairs(stats client.NamespaceStats) []client.Pair {
+	fields := []struct {
+		name  string
+		value int64
+	}{
+		{"gets", stats.Gets},
+		{"scans", stats.Scans},
+		{"puts", stats.Puts},
+		{"deletes", stats.Deletes},
+		{"last_seq", stats.LastSeq},
+		{"disk_blocks", stats.DiskBlocks},
+		{"disk_bytes", stats.DiskBytes},
+		{"memtable_bytes", stats.MemtableBytes},
+		{"max_bytes", stats.MaxBytes},
+	}
+
+	pairs := make([]client.Pair, len(fields))
+	for i, field := range fields {
+		pairs[i] = client.Pair{Key: []byte(field.name), Value: []byte(strconv.FormatInt(field.value, 10))}
+	}
+
+	return pairs
+}
+
+func parseLimit(args [][]byte) (int, error) {
+	if len(args) == 0 {
+		return 0, nil
+	}
+
+	limit, err := strconv.Atoi(string(args[len(args)-1]))
+	if len(args) != 2 || !strings.EqualFold(string(args[0]), "LIMIT") || err != nil || limit <= 0 {
+		return 0, errors.New("expected LIMIT n")
+	}
+
+	return limit, nil
+}
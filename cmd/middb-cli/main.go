@@ -0,0 +1,377 @@
+// middb-cli is an interactive shell for midDB. It runs commands from the
+// terminal with history and tab completion, or from a file, stdin or its
+// arguments when scripting:
+//
+//	middb-cli -addr localhost:8080
+//	middb-cli -json GET user:42
+//	middb-cli -f seed.txt
+//	middb-cli -cacert ca.pem -cert client.pem -key client-key.pem
+//	MIDDB_PASSWORD=secret middb-cli -user app GET session:42
+//	middb-cli -n orders PREFIX order:
+//	middb-cli -json WATCH user: AFTER 1042
+//	echo 'PUT greeting "hello world"' | middb-cli
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Avash027/midDB/client"
+	"golang.org/x/term"
+)
+
+const DEFAULT_HISTORY_FILE = ".middb_history"
+const MAX_HISTORY_SIZE = 1000
+
+// PASSWORD_ENV holds the password of -user, so that it does not show in the
+// list of processes.
+const PASSWORD_ENV = "MIDDB_PASSWORD"
+
+func main() {
+	var addr string
+	var jsonOutput bool
+	var scriptFile string
+	var timeout time.Duration
+	var keepGoing bool
+	var useTLS bool
+	var caFile, certFile, keyFile string
+	var user string
+	var namespace string
+
+	flag.StringVar(&addr, "addr", client.DEFAULT_ADDR, "Address of the server")
+	flag.BoolVar(&jsonOutput, "json", false, "Print results as JSON, one object per line")
+	flag.StringVar(&scriptFile, "f", "", "Run the commands of a file, - for stdin")
+	flag.DurationVar(&timeout, "timeout", client.DEFAULT_READ_TIMEOUT, "Timeout of each request")
+	flag.BoolVar(&keepGoing, "k", false, "Keep running a script after a command fails")
+	flag.BoolVar(&useTLS, "tls", false, "Connect over TLS")
+	flag.StringVar(&caFile, "cacert", "", "CA certificate to check the server with, implies -tls")
+	flag.StringVar(&certFile, "cert", "", "Client certificate, implies -tls")
+	flag.StringVar(&keyFile, "key", "", "Key of the client certificate")
+	flag.StringVar(&user, "user", "", "User to authenticate as, the password is read from $"+PASSWORD_ENV+" or asked for")
+	flag.StringVar(&namespace, "n", "", "Namespace to select, the default one when empty")
+	flag.Parse()
+
+	opts := client.Options{
+		Addr:         addr,
+		PoolSize:     1,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+		Namespace:    namespace,
+	}
+
+	if useTLS || caFile != "" || certFile != "" {
+		tlsConfig, err := loadTLSConfig(addr, caFile, certFile, keyFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		opts.TLSConfig = tlsConfig
+	}
+
+	if user != "" {
+		password, err := readPassword()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		opts.User, opts.Password = user, password
+	}
+
+	s := &session{client: client.New(opts), opts: opts, out: os.Stdout}
+	// SELECT replaces the client
+	defer func() { s.client.Close() }()
+
+	if jsonOutput {
+		s.printer = jsonPrinter{out: os.Stdout}
+	} else {
+		s.printer = textPrinter{out: os.Stdout}
+	}
+
+	var failed bool
+
+	switch {
+	case flag.NArg() > 0:
+		// the arguments are a single command, already split by the shell
+		line := make([]string, 0, flag.NArg())
+		for _, arg := range flag.Args() {
+			line = append(line, formatValue([]byte(arg)))
+		}
+		failed = s.run(strings.Join(line, " ")) != nil
+	case scriptFile != "" && scriptFile != "-":
+		file, err := os.Open(scriptFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		failed = runScript(s, file, keepGoing)
+		file.Close()
+	case scriptFile == "-" || !term.IsTerminal(int(os.Stdin.Fd())):
+		failed = runScript(s, os.Stdin, keepGoing)
+	default:
+		if err := runREPL(s); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func readPassword() (string, error) {
+	if password, ok := os.LookupEnv(PASSWORD_ENV); ok {
+		return password, nil
+	}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", fmt.Errorf("-user needs $%s when stdin is not a terminal", PASSWORD_ENV)
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+
+	return string(password), err
+}
+
+// loadTLSConfig checks the server against caFile, or the system roots when
+// it is empty, and presents certFile when it is set.
+func loadTLSConfig(addr string, caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{ServerName: host}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+	}
+
+	if certFile != "" {
+		if keyFile == "" {
+			keyFile = certFile
+		}
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// runScript runs a command per line, skipping blank lines and # comments.
+// It stops at the first failed command unless keepGoing is set, and reports
+// whether any command failed.
+func runScript(s *session, input io.Reader, keepGoing bool) bool {
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	failed := false
+
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		err := s.run(line)
+		if err == errQuit {
+			break
+		}
+
+		if err != nil {
+			failed = true
+			fmt.Fprintf(os.Stderr, "line %d: %v\n", lineNum, err)
+
+			if !keepGoing {
+				return true
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return true
+	}
+
+	return failed
+}
+
+func runREPL(s *session) error {
+	history := loadHistory()
+
+	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return err
+	}
+	defer term.Restore(int(os.Stdin.Fd()), oldState)
+
+	terminal := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, s.prompt()+"> ")
+	terminal.AutoCompleteCallback = completeCommand
+
+	if history != nil {
+		terminal.History = history
+	}
+
+	// the terminal turns \n into \r\n, which raw mode needs
+	s.out = terminal
+	s.interactive = true
+	if _, ok := s.printer.(jsonPrinter); ok {
+		s.printer = jsonPrinter{out: terminal}
+	} else {
+		s.printer = textPrinter{out: terminal}
+	}
+
+	for {
+		if s.batch != nil {
+			terminal.SetPrompt(s.prompt() + "(multi)> ")
+		} else {
+			terminal.SetPrompt(s.prompt() + "> ")
+		}
+
+		line, err := terminal.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if s.run(line) == errQuit {
+			return nil
+		}
+	}
+}
+
+// prompt is the address of the server, followed by the namespace when one
+// is selected.
+func (s *session) prompt() string {
+	if s.opts.Namespace == "" {
+		return s.opts.Addr
+	}
+
+	return s.opts.Addr + "[" + s.opts.Namespace + "]"
+}
+
+// completeCommand completes the command name on tab, up to the longest
+// prefix shared by the commands that match.
+func completeCommand(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' || strings.ContainsAny(line[:pos], " \t") {
+		return "", 0, false
+	}
+
+	word := strings.ToUpper(line[:pos])
+
+	var match string
+	matches := 0
+	for _, cmd := range commands {
+		if !strings.HasPrefix(cmd.name, word) {
+			continue
+		}
+
+		matches++
+		if match == "" {
+			match = cmd.name
+			continue
+		}
+
+		for !strings.HasPrefix(cmd.name, match) {
+			match = match[:len(match)-1]
+		}
+	}
+
+	// a single match is followed by a space, ready for the arguments
+	if matches == 1 && len(line) == pos {
+		match += " "
+	}
+
+	if len(match) <= len(word) {
+		return "", 0, false
+	}
+
+	return match + line[pos:], len(match), true
+}
+
+// fileHistory keeps the lines entered in the REPL and appends them to a file
+// in the home directory, so they survive restarts.
+type fileHistory struct {
+	entries []string
+	file    *os.File
+}
+
+func loadHistory() *fileHistory {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+
+	path := home + string(os.PathSeparator) + DEFAULT_HISTORY_FILE
+	history := &fileHistory{}
+
+	if data, err := os.ReadFile(path); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if line != "" {
+				history.entries = append(history.entries, line)
+			}
+		}
+
+		if len(history.entries) > MAX_HISTORY_SIZE {
+			history.entries = history.entries[len(history.entries)-MAX_HISTORY_SIZE:]
+		}
+	}
+
+	history.file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		fmt.Println("Error opening history file")
+	}
+
+	return history
+}
+
+func (h *fileHistory) Add(entry string) {
+	if entry == "" || (len(h.entries) > 0 && h.entries[len(h.entries)-1] == entry) {
+		return
+	}
+
+	h.entries = append(h.entries, entry)
+	if len(h.entries) > MAX_HISTORY_SIZE {
+		h.entries = h.entries[1:]
+	}
+
+	if h.file != nil {
+		h.file.WriteString(entry + "\n")
+	}
+}
+
+func (h *fileHistory) Len() int {
+	return len(h.entries)
+}
+
+// At returns the entry idx positions before the most recent one.
+func (h *fileHistory) At(idx int) string {
+	return h.entries[len(h.entries)-1-idx]
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Avash027/midDB/client"
+)
+
+// printer writes the result of a command, as text for people or as one JSON
+// object per line for scripts.
+type printer interface {
+	status(status string)
+	value(value []byte)
+	// list writes a value per key, nil for the missing ones
+	list(values [][]byte)
+	pairs(pairs []client.Pair)
+	integer(n int64)
+	notFound()
+	error(err error)
+	event(event client.Event)
+}
+
+type textPrinter struct {
+	out io.Writer
+}
+
+func (p textPrinter) status(status string) {
+	fmt.Fprintln(p.out, status)
+}
+
+func (p textPrinter) value(value []byte) {
+	fmt.Fprintln(p.out, formatValue(value))
+}
+
+func (p textPrinter) list(values [][]byte) {
+	for _, value := range values {
+		if value == nil {
+			p.notFound()
+		} else {
+			p.value(value)
+		}
+	}
+}
+
+func (p textPrinter) pairs(pairs []client.Pair) {
+	if len(pairs) == 0 {
+		fmt.Fprintln(p.out, "(empty)")
+		return
+	}
+
+	for _, pair := range pairs {
+		fmt.Fprintln(p.out, formatValue(pair.Key), formatValue(pair.Value))
+	}
+}
+
+func (p textPrinter) integer(n int64) {
+	fmt.Fprintln(p.out, n)
+}
+
+func (p textPrinter) notFound() {
+	fmt.Fprintln(p.out, "(not found)")
+}
+
+func (p textPrinter) error(err error) {
+	fmt.Fprintln(p.out, "(error)", err)
+}
+
+// event writes the sequence number, PUT or DEL, the key and the value of
+// puts, followed by their expiry when they have one.
+func (p textPrinter) event(event client.Event) {
+	switch {
+	case event.Delete:
+		fmt.Fprintln(p.out, event.Seq, "DEL", formatValue(event.Key))
+	case event.ExpiresAt.IsZero():
+		fmt.Fprintln(p.out, event.Seq, "PUT", formatValue(event.Key), formatValue(event.Value))
+	default:
+		fmt.Fprintln(p.out, event.Seq, "PUT", formatValue(event.Key), formatValue(event.Value), event.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+}
+
+// jsonPrinter writes keys and values as strings, or under a _base64 suffixed
+// name when they are not valid UTF-8.
+type jsonPrinter struct {
+	out io.Writer
+}
+
+func (p jsonPrinter) write(object map[string]interface{}) {
+	line, _ := json.Marshal(object)
+	fmt.Fprintln(p.out, string(line))
+}
+
+func (p jsonPrinter) status(status string) {
+	p.write(map[string]interface{}{"status": status})
+}
+
+func (p jsonPrinter) value(value []byte) {
+	object := map[string]interface{}{}
+	putBytes(object, "value", value)
+	p.write(object)
+}
+
+func (p jsonPrinter) list(values [][]byte) {
+	items := make([]map[string]interface{}, 0, len(values))
+
+	for _, value := range values {
+		item := map[string]interface{}{}
+		if value == nil {
+			item["value"] = nil
+		} else {
+			putBytes(item, "value", value)
+		}
+		items = append(items, item)
+	}
+
+	p.write(map[string]interface{}{"items": items})
+}
+
+func (p jsonPrinter) pairs(pairs []client.Pair) {
+	items := make([]map[string]interface{}, 0, len(pairs))
+
+	for _, pair := range pairs {
+		item := map[string]interface{}{}
+		putBytes(item, "key", pair.Key)
+		putBytes(item, "value", pair.Value)
+		items = append(items, item)
+	}
+
+	p.write(map[string]interface{}{"items": items})
+}
+
+func (p jsonPrinter) integer(n int64) {
+	p.write(map[string]interface{}{"value": json.Number(strconv.FormatInt(n, 10))})
+}
+
+func (p jsonPrinter) notFound() {
+	p.write(map[string]interface{}{"value": nil})
+}
+
+func (p jsonPrinter) error(err error) {
+	p.write(map[string]interface{}{"error": err.Error()})
+}
+
+func (p jsonPrinter) event(event client.Event) {
+	object := map[string]interface{}{"seq": json.Number(strconv.FormatUint(event.Seq, 10))}
+	putBytes(object, "key", event.Key)
+
+	if event.Delete {
+		object["op"] = "del"
+	} else {
+		object["op"] = "put"
+		putBytes(object, "value", event.Value)
+		if !event.ExpiresAt.IsZero() {
+			object["expires_at"] = event.ExpiresAt.UnixMilli()
+		}
+	}
+
+	p.write(object)
+}
+
+func putBytes(object map[string]interface{}, name string, b []byte) {
+	if utf8.Valid(b) {
+		object[name] = string(b)
+	} else {
+		object[name+"_base64"] = base64.StdEncoding.EncodeToString(b)
+	}
+}
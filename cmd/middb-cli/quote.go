@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var errUnbalancedQuotes = errors.New("unbalanced quotes")
+
+// splitArgs splits a line into arguments separated by spaces. Double quoted
+// arguments may hold spaces and the escapes \" \\ \n \r \t \0 and \xHH,
+// single quoted arguments are taken as they are. Quoted and plain parts
+// next to each other form one argument, so "" is an empty argument.
+func splitArgs(line string) ([][]byte, error) {
+	var args [][]byte
+	var arg []byte
+	inArg := false
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+
+		switch {
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, arg)
+				arg, inArg = nil, false
+			}
+		case c == '"':
+			inArg = true
+			closed := false
+
+			for i++; i < len(line); i++ {
+				c = line[i]
+
+				if c == '"' {
+					closed = true
+					break
+				}
+
+				if c != '\\' {
+					arg = append(arg, c)
+					continue
+				}
+
+				if i+1 == len(line) {
+					return nil, errUnbalancedQuotes
+				}
+
+				i++
+				switch line[i] {
+				case 'n':
+					arg = append(arg, '\n')
+				case 'r':
+					arg = append(arg, '\r')
+				case 't':
+					arg = append(arg, '\t')
+				case '0':
+					arg = append(arg, 0)
+				case 'x':
+					if i+2 >= len(line) {
+						return nil, errors.New("invalid \\x escape")
+					}
+					b, err := strconv.ParseUint(line[i+1:i+3], 16, 8)
+					if err != nil {
+						return nil, errors.New("invalid \\x escape")
+					}
+					arg = append(arg, byte(b))
+					i += 2
+				default:
+					arg = append(arg, line[i])
+				}
+			}
+
+			if !closed {
+				return nil, errUnbalancedQuotes
+			}
+		case c == '\'':
+			inArg = true
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, errUnbalancedQuotes
+			}
+
+			arg = append(arg, line[i+1:i+1+end]...)
+			i += end + 1
+		default:
+			inArg = true
+			arg = append(arg, c)
+		}
+	}
+
+	if inArg {
+		args = append(args, arg)
+	}
+
+	return args, nil
+}
+
+// formatValue returns b as it is when it reads as a single plain argument,
+// or double quoted with escapes that splitArgs understands.
+func formatValue(b []byte) string {
+	if len(b) > 0 && utf8.Valid(b) && !strings.ContainsAny(string(b), " \t\"'\\") && !hasControl(b) {
+		return string(b)
+	}
+
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+
+		switch {
+		case r == utf8.RuneError && size == 1:
+			quoted.WriteString(`\x` + hex(b[0]))
+		case r == '"' || r == '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteRune(r)
+		case r == '\n':
+			quoted.WriteString(`\n`)
+		case r == '\r':
+			quoted.WriteString(`\r`)
+		case r == '\t':
+			quoted.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			quoted.WriteString(`\x` + hex(byte(r)))
+		default:
+			quoted.Write(b[:size])
+		}
+
+		b = b[size:]
+	}
+
+	quoted.WriteByte('"')
+	return quoted.String()
+}
+
+func hasControl(b []byte) bool {
+	for _, c := range b {
+		if c < 0x20 || c == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+func hex(b byte) string {
+	const digits = "0123456789abcdef"
+	return string([]byte{digits[b>>4], digits[b&0xf]})
+}
@@ -18,6 +18,78 @@ type ServerConfig struct {
 	Host          string `yaml:"host"`
 	UDPPort       string `yaml:"udp_port"`
 	UDPBufferSize int    `yaml:"udp_buffer_size"`
+	UDPReadOnly   bool   `yaml:"udp_read_only"`
+	RESPPort      string `yaml:"resp_port"`
+	HTTPPort      string `yaml:"http_port"`
+	GRPCPort      string `yaml:"grpc_port"`
+
+	TLSCertFile     string `yaml:"tls_cert_file"`
+	TLSKeyFile      string `yaml:"tls_key_file"`
+	TLSCAFile       string `yaml:"tls_ca_file"`
+	TLSVerifyClient bool   `yaml:"tls_verify_client"`
+
+	Users []UserConfig `yaml:"users"`
+
+	Replication ReplicationConfig `yaml:"replication,inline"`
+
+	Raft RaftConfig `yaml:"raft,inline"`
+
+	Sharding ShardingConfig `yaml:"sharding,inline"`
+}
+
+type ReplicationConfig struct {
+	Role        string `yaml:"replication_role"`
+	Port        string `yaml:"replication_port"`
+	Mode        string `yaml:"replication_mode"`
+	SyncTimeout int    `yaml:"replication_sync_timeout_in_ms"`
+	MinAcks     int    `yaml:"replication_min_acks"`
+	Leader      string `yaml:"replication_leader"`
+	User        string `yaml:"replication_user"`
+	Password    string `yaml:"replication_password"`
+	TLS         bool   `yaml:"replication_tls"`
+}
+
+type RaftConfig struct {
+	ID                string             `yaml:"raft_id"`
+	Port              string             `yaml:"raft_port"`
+	Directory         string             `yaml:"raft_directory"`
+	Members           []RaftMemberConfig `yaml:"raft_members"`
+	ElectionTimeout   int                `yaml:"raft_election_timeout_in_ms"`
+	HeartbeatInterval int                `yaml:"raft_heartbeat_interval_in_ms"`
+	CommitTimeout     int                `yaml:"raft_commit_timeout_in_ms"`
+	MaxLogEntries     int                `yaml:"raft_max_log_entries"`
+	TLS               bool               `yaml:"raft_tls"`
+}
+
+type RaftMemberConfig struct {
+	ID         string `yaml:"id"`
+	Addr       string `yaml:"addr"`
+	ClientAddr string `yaml:"client_addr"`
+}
+
+type ShardingConfig struct {
+	ID    string            `yaml:"shard_id"`
+	Port  string            `yaml:"shard_port"`
+	Nodes []ShardNodeConfig `yaml:"shard_nodes"`
+	TLS   bool              `yaml:"shard_tls"`
+}
+
+type ShardNodeConfig struct {
+	ID         string `yaml:"id"`
+	Addr       string `yaml:"addr"`
+	ClientAddr string `yaml:"client_addr"`
+}
+
+type UserConfig struct {
+	Name         string             `yaml:"name"`
+	PasswordHash string             `yaml:"password_hash"`
+	Permissions  []PermissionConfig `yaml:"permissions"`
+	Namespaces   []string           `yaml:"namespaces"`
+}
+
+type PermissionConfig struct {
+	Prefix string `yaml:"prefix"`
+	Access string `yaml:"access"`
 }
 
 type DiskStoreConfig struct {
@@ -28,12 +100,26 @@ type DBEngineConfig struct {
 	LSMTreeConfig     LSMTreeConfig     `yaml:"lsm_tree,inline"`
 	BloomFilterConfig BloomFilterConfig `yaml:"bloom_filter,inline"`
 
-	WalPath string `yaml:"wal_path"`
+	WalPath             string `yaml:"wal_path"`
+	ChangeRetention     int    `yaml:"change_retention"`
+	WalArchiveDirectory string `yaml:"wal_archive_directory"`
+	WalSegmentSize      int64  `yaml:"wal_segment_size_in_bytes"`
+	WalSegmentRetention int    `yaml:"wal_segment_retention"`
+
+	NamespaceDirectory string `yaml:"namespace_directory"`
 }
 
 type LSMTreeConfig struct {
-	MaxElementsBeforeFlush int `yaml:"max_elements_before_flush"`
-	CompactionFrequency    int `yaml:"compaction_frequency_in_ms"`
+	MaxElementsBeforeFlush      int    `yaml:"max_elements_before_flush"`
+	CompactionFrequency         int    `yaml:"compaction_frequency_in_ms"`
+	Directory                   string `yaml:"sstable_directory"`
+	Level0CompactionTrigger     int    `yaml:"level0_compaction_trigger"`
+	LevelBaseSize               int64  `yaml:"level_base_size_in_bytes"`
+	LevelSizeMultiplier         int    `yaml:"level_size_multiplier"`
+	CompactionMaxBytesPerSecond int    `yaml:"compaction_max_bytes_per_second"`
+	CompactionMaxCPUPercent     int    `yaml:"compaction_max_cpu_percent"`
+	CompactionStrategy          string `yaml:"compaction_strategy"`
+	SizeTieredMinThreshold      int    `yaml:"size_tiered_min_threshold"`
 }
 
 type BloomFilterConfig struct {
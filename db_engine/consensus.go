@@ -0,0 +1,66 @@
+package dbengine
+
+import (
+	"errors"
+
+	"github.com/Avash027/midDB/wal"
+)
+
+var (
+	ErrNotLeader     = errors.New("not the leader")
+	ErrNotReplicated = errors.New("only the default namespace is replicated")
+	ErrNoQuorum      = errors.New("no majority of the cluster answered in time")
+)
+
+// Consensus orders the writes of the default namespace through a cluster,
+// see the raft package. The engine of every member applies the same writes
+// in the same order, once a quorum of the members has them.
+type Consensus interface {
+	// Propose returns once the entries were committed by the cluster and
+	// applied to the engine. It fails with an error matching ErrNotLeader
+	// on a member that is not the leader.
+	Propose(entries []wal.Entry) error
+	// ReadBarrier returns once the engine holds every write committed
+	// before the call, so the reads that follow are linearizable.
+	ReadBarrier() error
+}
+
+// ApplyCommitted writes a batch the consensus committed, such as a chunk of
+// a snapshot, that is not in the WAL yet. The consensus applies its entries
+// one at a time and holds back the writes that depend on them, so writeLock
+// is not taken.
+func (db *DBEngine) ApplyCommitted(batch *WriteBatch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	return db.apply(batch)
+}
+
+// ApplyLogged applies a batch the consensus committed that the WAL holds
+// already, as the entry index of the log the consensus keeps there, see
+// wal.LogEntry. It is not written again.
+func (db *DBEngine) ApplyLogged(index uint64, batch *WriteBatch) error {
+	if db.closed.Load() {
+		return ErrNamespaceDropped
+	}
+
+	db.count(batch.entries)
+	db.LsmTree.ApplyBatch(toPairs(batch.entries))
+	db.Wal.Applied(index, batch.entries)
+
+	return nil
+}
+
+func (db *DBEngine) readBarrier() error {
+	if db.Consensus == nil {
+		return nil
+	}
+
+	return db.Consensus.ReadBarrier()
+}
+
+// Close persists and closes the engine, writes fail from then on.
+func (db *DBEngine) Close() error {
+	return db.close()
+}
@@ -1,17 +1,369 @@
 package dbengine
 
 import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	diskstore "github.com/Avash027/midDB/disk_store"
 	LsmTree "github.com/Avash027/midDB/lsm_tree"
 	"github.com/Avash027/midDB/wal"
 )
 
+// NO_EXPIRY is the TTL of a key that never expires.
+const NO_EXPIRY time.Duration = -1
+
 type DBEngine struct {
 	LsmTree *LsmTree.LSMTree
 	Wal     *wal.WAL
 	Store   *diskstore.DiskStore
+	// writeLock keeps the order of the WAL records the same as the order in
+	// which the writes reach the memtable, so a replay rebuilds the same state
+	writeLock sync.Mutex
+
+	watchLock sync.Mutex
+	watchers  map[*Watcher]struct{}
+
+	// Replicator, when set, holds back the writes until the followers
+	// acknowledged them, see replication.go
+	Replicator Replicator
+	// follower is set when the engine only takes the writes of a leader
+	follower atomic.Bool
+
+	// Consensus, when set, commits the writes through a cluster before they
+	// are applied, see consensus.go. The namespaces of a clustered engine
+	// are not replicated and refuse writes.
+	Consensus Consensus
+	clustered bool
+
+	// Router, when set, refuses the keys other nodes serve, see
+	// sharding.go
+	Router Router
+
+	// NamespaceOpts configure the namespaces, which are held by the
+	// default engine, see namespace.go
+	NamespaceOpts NamespaceOpts
+	namespaceLock sync.RWMutex
+	namespaces    map[string]*DBEngine
+
+	// dir and quota are set for the engine of a namespace other than the
+	// default one, quota is guarded by writeLock
+	dir    string
+	quota  Quota
+	closed atomic.Bool
+
+	gets    uint64
+	scans   uint64
+	puts    uint64
+	deletes uint64
 }
 
+// LoadFromDisk rebuilds the tree from the disk blocks, the partitions and
+// the WAL, then numbers the next WAL entries after the last one in the tree.
 func (db *DBEngine) LoadFromDisk(lsmTree *LsmTree.LSMTree, wal *wal.WAL) error {
-	return db.Store.LoadFromDisk(lsmTree, wal)
+	if err := db.Store.LoadFromDisk(lsmTree, wal); err != nil {
+		return err
+	}
+
+	wal.SetLastSeq(lsmTree.LastSeq())
+	return nil
+}
+
+// Checkpoint writes a consistent copy of the engine to dir while it keeps
+// serving, see DiskStore.Checkpoint, and returns the sequence number of the
+// last write it holds.
+func (db *DBEngine) Checkpoint(dir string) (uint64, error) {
+	if db.closed.Load() {
+		return 0, ErrNamespaceDropped
+	}
+
+	return db.Store.Checkpoint(dir, db.LsmTree, db.Wal)
+}
+
+// Get persists the WAL before reading, so a value that is returned to a
+// client is never lost in a crash.
+func (db *DBEngine) Get(key []byte) ([]byte, bool, error) {
+	if db.closed.Load() {
+		return nil, false, ErrNamespaceDropped
+	}
+
+	atomic.AddUint64(&db.gets, 1)
+
+	if err := db.Route(key, false); err != nil {
+		return nil, false, err
+	}
+
+	if err := db.readBarrier(); err != nil {
+		return nil, false, err
+	}
+
+	if err := db.Wal.Persist(); err != nil {
+		return nil, false, err
+	}
+
+	value, exist := db.LsmTree.Get(key)
+	return value, exist, nil
+}
+
+// Scan returns the live pairs with keys in [start, end) in key order, at most
+// limit of them. An empty end means there is no upper bound and a limit of 0
+// means there is no limit. Like Get it persists the WAL first. With a router
+// only the keys the node serves are returned.
+func (db *DBEngine) Scan(start []byte, end []byte, limit int) ([]LsmTree.Pair, error) {
+	if db.closed.Load() {
+		return nil, ErrNamespaceDropped
+	}
+
+	atomic.AddUint64(&db.scans, 1)
+
+	if err := db.readBarrier(); err != nil {
+		return nil, err
+	}
+
+	if err := db.Wal.Persist(); err != nil {
+		return nil, err
+	}
+
+	it := db.LsmTree.NewIterator()
+	defer it.Close()
+
+	pairs := []LsmTree.Pair{}
+
+	for it.Seek(start); it.Valid(); it.Next() {
+		if len(end) > 0 && bytes.Compare(it.Key(), end) >= 0 {
+			break
+		}
+		if limit > 0 && len(pairs) >= limit {
+			break
+		}
+		if db.Route(it.Key(), false) != nil {
+			continue
+		}
+
+		pairs = append(pairs, LsmTree.Pair{Key: it.Key(), Value: it.Value()})
+	}
+
+	return pairs, it.Err()
+}
+
+func (db *DBEngine) Put(key []byte, value []byte) error {
+	batch := NewWriteBatch()
+	batch.Put(key, value)
+	return db.Write(batch)
+}
+
+// PutWithTTL sets a value that reads as deleted once ttl has passed.
+func (db *DBEngine) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	batch := NewWriteBatch()
+	batch.PutWithTTL(key, value, ttl)
+	return db.Write(batch)
+}
+
+// Expire makes an existing key expire ttl from now, a ttl that is not
+// positive deletes it right away. It returns ErrKeyNotFound when the key does
+// not exist.
+func (db *DBEngine) Expire(key []byte, ttl time.Duration) error {
+	return db.locked(func() error {
+		if err := db.Route(key, true); err != nil {
+			return err
+		}
+
+		value, exist := db.LsmTree.Get(key)
+		if !exist {
+			return diskstore.ErrKeyNotFound
+		}
+
+		batch := NewWriteBatch()
+		if ttl <= 0 {
+			batch.Delete(key)
+		} else {
+			batch.PutWithTTL(key, value, ttl)
+		}
+		return db.write(batch)
+	})
+}
+
+// TTL returns how long the key has left to live, or NO_EXPIRY when it never
+// expires. It returns ErrKeyNotFound when the key does not exist.
+func (db *DBEngine) TTL(key []byte) (time.Duration, error) {
+	if err := db.Route(key, false); err != nil {
+		return 0, err
+	}
+
+	if err := db.readBarrier(); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	pair, exist := db.LsmTree.GetPair(key)
+
+	if !exist || pair.Tombstone || pair.Expired(now) {
+		return 0, diskstore.ErrKeyNotFound
+	}
+
+	if pair.ExpiresAt == 0 {
+		return NO_EXPIRY, nil
+	}
+
+	return time.UnixMilli(pair.ExpiresAt).Sub(now), nil
+}
+
+func (db *DBEngine) Del(key []byte) error {
+	batch := NewWriteBatch()
+	batch.Delete(key)
+	return db.Write(batch)
+}
+
+// Write logs the batch as a single WAL record and then applies all of its
+// operations to the memtable at once, so readers see either none or all of
+// them.
+func (db *DBEngine) Write(batch *WriteBatch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	return db.locked(func() error {
+		return db.write(batch)
+	})
+}
+
+// locked runs fn with writeLock held, then waits for the followers to
+// acknowledge what it wrote. Nothing is written when too few of them are
+// connected to ever acknowledge it. The lock is released first, so the next
+// writes are not held back by the round trip. In a cluster fn first waits
+// for the read barrier, so the checks of conditional writes see every
+// committed write.
+func (db *DBEngine) locked(fn func() error) error {
+	if db.Replicator != nil {
+		if err := db.Replicator.CheckReplicas(); err != nil {
+			return err
+		}
+	}
+
+	db.writeLock.Lock()
+	err := db.readBarrier()
+	if err == nil {
+		err = fn()
+	}
+	seq := db.Wal.LastSeq()
+	db.writeLock.Unlock()
+
+	if err != nil || db.Replicator == nil {
+		return err
+	}
+
+	return db.Replicator.WaitForReplicas(seq)
+}
+
+// write expects the caller to hold writeLock. In a cluster the batch is
+// applied by the consensus once it is committed.
+func (db *DBEngine) write(batch *WriteBatch) error {
+	if db.follower.Load() {
+		return ErrReadOnlyReplica
+	}
+
+	if db.clustered {
+		return ErrNotReplicated
+	}
+
+	if err := db.routeBatch(batch); err != nil {
+		return err
+	}
+
+	if db.Consensus != nil {
+		if db.closed.Load() {
+			return ErrNamespaceDropped
+		}
+		return db.Consensus.Propose(batch.entries)
+	}
+
+	return db.apply(batch)
+}
+
+// apply logs and applies a batch, it expects the caller to hold writeLock.
+func (db *DBEngine) apply(batch *WriteBatch) error {
+	if db.closed.Load() {
+		return ErrNamespaceDropped
+	}
+
+	if err := db.checkQuota(batch); err != nil {
+		return err
+	}
+
+	if err := db.Wal.WriteBatch(batch.entries); err != nil {
+		return err
+	}
+
+	db.count(batch.entries)
+	db.LsmTree.ApplyBatch(toPairs(batch.entries))
+	db.Wal.Publish(batch.entries)
+
+	return nil
+}
+
+func (db *DBEngine) count(entries []wal.Entry) {
+	var deletes uint64
+	for _, entry := range entries {
+		if entry.Delete {
+			deletes++
+		}
+	}
+	atomic.AddUint64(&db.deletes, deletes)
+	atomic.AddUint64(&db.puts, uint64(len(entries))-deletes)
+}
+
+// CompareAndSwap sets key to value only if its current value is expected. It
+// returns ErrCASConflict when the key holds anything else or does not exist.
+func (db *DBEngine) CompareAndSwap(key []byte, expected []byte, value []byte) error {
+	return db.locked(func() error {
+		if err := db.Route(key, true); err != nil {
+			return err
+		}
+
+		current, exist := db.LsmTree.Get(key)
+		if !exist || !bytes.Equal(current, expected) {
+			return diskstore.ErrCASConflict
+		}
+
+		batch := NewWriteBatch()
+		batch.Put(key, value)
+		return db.write(batch)
+	})
+}
+
+// PutIfAbsent sets key to value only if the key does not exist. It returns
+// ErrCASConflict otherwise.
+func (db *DBEngine) PutIfAbsent(key []byte, value []byte) error {
+	return db.PutIfAbsentWithTTL(key, value, 0)
+}
+
+// PutIfAbsentWithTTL is PutIfAbsent for a value that expires ttl from now.
+// A ttl of 0 means the value does not expire.
+func (db *DBEngine) PutIfAbsentWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	return db.locked(func() error {
+		if err := db.Route(key, true); err != nil {
+			return err
+		}
+
+		if _, exist := db.LsmTree.Get(key); exist {
+			return diskstore.ErrCASConflict
+		}
+
+		batch := NewWriteBatch()
+		if ttl > 0 {
+			batch.PutWithTTL(key, value, ttl)
+		} else {
+			batch.Put(key, value)
+		}
+		return db.write(batch)
+	})
+}
+
+func toPairs(entries []wal.Entry) []LsmTree.Pair {
+	pairs := make([]LsmTree.Pair, len(entries))
+	for i, entry := range entries {
+		pairs[i] = LsmTree.Pair{Key: entry.Key, Value: entry.Value, Tombstone: entry.Delete, ExpiresAt: entry.ExpiresAt}
+	}
+	return pairs
 }
@@ -0,0 +1,446 @@
+package dbengine
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	diskstore "github.com/Avash027/midDB/disk_store"
+	LsmTree "github.com/Avash027/midDB/lsm_tree"
+	"github.com/Avash027/midDB/wal"
+)
+
+// DEFAULT_NAMESPACE is the name of the engine built from the main
+// configuration, it always exists and can not be dropped.
+const DEFAULT_NAMESPACE = "default"
+const DEFAULT_NAMESPACE_DIRECTORY = "./data/namespaces"
+
+const QUOTA_FILE_NAME = "QUOTA"
+
+var (
+	ErrNamespaceNotFound = errors.New("namespace not found")
+	ErrNamespaceExists   = errors.New("namespace already exists")
+	ErrInvalidNamespace  = errors.New("namespace names are 1 to 64 letters, digits, _ or -")
+	ErrDropDefault       = errors.New("the default namespace can not be dropped")
+	ErrNamespaceDropped  = errors.New("namespace was dropped")
+	ErrQuotaExceeded     = errors.New("namespace quota exceeded")
+)
+
+var namespaceName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// NamespaceOpts describe the engines of the namespaces. Each one lives in
+// its own directory under Directory, with its own disk blocks, WAL and
+// partitions.
+type NamespaceOpts struct {
+	Directory       string
+	NumOfPartitions int
+	// LSMTreeOpts are used for every namespace, but for the directory
+	LSMTreeOpts     LsmTree.LSMTreeOpts
+	ChangeRetention int
+	// ArchiveDirectory, when set, gets a subdirectory per namespace where
+	// its WAL is archived, see wal.WAL.ArchiveDirectory
+	ArchiveDirectory string
+	// SegmentSize and SegmentRetention are set on the WAL of every
+	// namespace
+	SegmentSize      int64
+	SegmentRetention int
+}
+
+// Quota limits what a namespace may hold.
+type Quota struct {
+	// MaxBytes caps the size of the keys and values of the namespace, 0
+	// means no limit. Writes that only delete are always accepted. The size
+	// counts the versions compaction has not dropped yet, so it is larger
+	// than the live data after overwrites and deletes.
+	MaxBytes int64
+}
+
+// Stats describe a namespace. The counters start at zero when the process
+// starts.
+type Stats struct {
+	Gets    uint64
+	Scans   uint64
+	Puts    uint64
+	Deletes uint64
+
+	LastSeq       uint64
+	DiskBlocks    int
+	DiskBytes     int64
+	MemtableBytes int64
+	Quota         Quota
+}
+
+// Namespace returns the engine of a namespace, an empty name is the default
+// one. Only the default engine holds namespaces.
+func (db *DBEngine) Namespace(name string) (*DBEngine, error) {
+	if name == "" || name == DEFAULT_NAMESPACE {
+		return db, nil
+	}
+
+	db.namespaceLock.RLock()
+	defer db.namespaceLock.RUnlock()
+
+	namespace, ok := db.namespaces[name]
+	if !ok {
+		return nil, ErrNamespaceNotFound
+	}
+
+	return namespace, nil
+}
+
+// Namespaces returns the names of every namespace in order.
+func (db *DBEngine) Namespaces() []string {
+	db.namespaceLock.RLock()
+	defer db.namespaceLock.RUnlock()
+
+	names := []string{DEFAULT_NAMESPACE}
+	for name := range db.namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// OpenNamespaces opens the namespaces found in NamespaceOpts.Directory. It
+// is called once, after the default namespace was loaded.
+func (db *DBEngine) OpenNamespaces() error {
+	if err := os.MkdirAll(db.NamespaceOpts.Directory, 0755); err != nil {
+		return err
+	}
+
+	dirEntries, err := os.ReadDir(db.NamespaceOpts.Directory)
+	if err != nil {
+		return err
+	}
+
+	db.namespaceLock.Lock()
+	defer db.namespaceLock.Unlock()
+
+	if db.namespaces == nil {
+		db.namespaces = map[string]*DBEngine{}
+	}
+
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() || !namespaceName.MatchString(dirEntry.Name()) {
+			continue
+		}
+
+		namespace, err := db.openNamespace(dirEntry.Name())
+		if err != nil {
+			return fmt.Errorf("namespace %s: %w", dirEntry.Name(), err)
+		}
+
+		db.namespaces[dirEntry.Name()] = namespace
+	}
+
+	return nil
+}
+
+// CreateNamespace creates an empty namespace.
+func (db *DBEngine) CreateNamespace(name string, quota Quota) (*DBEngine, error) {
+	if db.follower.Load() {
+		return nil, ErrReadOnlyReplica
+	}
+
+	if db.Consensus != nil {
+		return nil, ErrNotReplicated
+	}
+
+	if !namespaceName.MatchString(name) {
+		return nil, ErrInvalidNamespace
+	}
+
+	if name == DEFAULT_NAMESPACE {
+		return nil, ErrNamespaceExists
+	}
+
+	db.namespaceLock.Lock()
+	defer db.namespaceLock.Unlock()
+
+	if _, ok := db.namespaces[name]; ok {
+		return nil, ErrNamespaceExists
+	}
+
+	dir := filepath.Join(db.NamespaceOpts.Directory, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if err := WriteQuota(dir, quota); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	namespace, err := db.openNamespace(name)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	if db.namespaces == nil {
+		db.namespaces = map[string]*DBEngine{}
+	}
+	db.namespaces[name] = namespace
+
+	return namespace, nil
+}
+
+// DropNamespace closes a namespace and deletes its files. Requests still
+// holding its engine fail with ErrNamespaceDropped.
+func (db *DBEngine) DropNamespace(name string) error {
+	if name == DEFAULT_NAMESPACE {
+		return ErrDropDefault
+	}
+
+	if db.follower.Load() {
+		return ErrReadOnlyReplica
+	}
+
+	if db.Consensus != nil {
+		return ErrNotReplicated
+	}
+
+	db.namespaceLock.Lock()
+	namespace, ok := db.namespaces[name]
+	delete(db.namespaces, name)
+	db.namespaceLock.Unlock()
+
+	if !ok {
+		return ErrNamespaceNotFound
+	}
+
+	if err := namespace.close(); err != nil {
+		fmt.Println("Error closing namespace", name, err)
+	}
+
+	return os.RemoveAll(namespace.dir)
+}
+
+// SetNamespaceQuota replaces the quota of a namespace, the default one has
+// no quota.
+func (db *DBEngine) SetNamespaceQuota(name string, quota Quota) error {
+	if name == DEFAULT_NAMESPACE {
+		return fmt.Errorf("the default namespace has no quota")
+	}
+
+	if db.follower.Load() {
+		return ErrReadOnlyReplica
+	}
+
+	if db.Consensus != nil {
+		return ErrNotReplicated
+	}
+
+	namespace, err := db.Namespace(name)
+	if err != nil {
+		return err
+	}
+
+	namespace.writeLock.Lock()
+	defer namespace.writeLock.Unlock()
+
+	if err := WriteQuota(namespace.dir, quota); err != nil {
+		return err
+	}
+
+	namespace.quota = quota
+	return nil
+}
+
+// CloseNamespaces persists and closes every namespace but the default one,
+// when the server shuts down.
+func (db *DBEngine) CloseNamespaces() error {
+	db.namespaceLock.Lock()
+	defer db.namespaceLock.Unlock()
+
+	var err error
+	for name, namespace := range db.namespaces {
+		if closeErr := namespace.close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("namespace %s: %w", name, closeErr)
+		}
+	}
+	db.namespaces = map[string]*DBEngine{}
+
+	return err
+}
+
+// Dropped reports whether the engine belongs to a namespace that was
+// dropped.
+func (db *DBEngine) Dropped() bool {
+	return db.closed.Load()
+}
+
+func (db *DBEngine) Stats() Stats {
+	db.writeLock.Lock()
+	quota := db.quota
+	db.writeLock.Unlock()
+
+	return Stats{
+		Gets:          atomic.LoadUint64(&db.gets),
+		Scans:         atomic.LoadUint64(&db.scans),
+		Puts:          atomic.LoadUint64(&db.puts),
+		Deletes:       atomic.LoadUint64(&db.deletes),
+		LastSeq:       db.LsmTree.LastSeq(),
+		DiskBlocks:    db.LsmTree.NumOfDiskBlocks(),
+		DiskBytes:     db.LsmTree.DiskSize(),
+		MemtableBytes: db.LsmTree.MemtableSize(),
+		Quota:         quota,
+	}
+}
+
+// openNamespace builds the engine of a namespace from its directory, loads
+// it and starts its persisting cycle.
+func (db *DBEngine) openNamespace(name string) (*DBEngine, error) {
+	dir := filepath.Join(db.NamespaceOpts.Directory, name)
+
+	quota, err := readQuota(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	lsmTreeOpts := db.NamespaceOpts.LSMTreeOpts
+	lsmTreeOpts.Directory = filepath.Join(dir, "sstables")
+	lsmTree := LsmTree.InitNewLSMTree(lsmTreeOpts)
+
+	store := diskstore.New(diskstore.DiskStoreOpts{
+		Directory:       filepath.Join(dir, "partitions"),
+		NumOfPartitions: db.NamespaceOpts.NumOfPartitions,
+	})
+	if store == nil {
+		lsmTree.Close()
+		return nil, fmt.Errorf("could not open the partitions")
+	}
+
+	walFile := wal.InitWAL(filepath.Join(dir, wal.DEFAULT_WAL_PATH))
+	walFile.ChangeRetention = db.NamespaceOpts.ChangeRetention
+	walFile.SegmentSize = db.NamespaceOpts.SegmentSize
+	walFile.SegmentRetention = db.NamespaceOpts.SegmentRetention
+	if db.NamespaceOpts.ArchiveDirectory != "" {
+		walFile.ArchiveDirectory = filepath.Join(db.NamespaceOpts.ArchiveDirectory, name)
+	}
+
+	namespace := &DBEngine{
+		LsmTree: lsmTree,
+		Wal:     walFile,
+		Store:   store,
+		dir:     dir,
+		quota:   quota,
+	}
+	// only the default namespace is replicated, the others are frozen
+	namespace.follower.Store(db.follower.Load())
+	namespace.clustered = db.Consensus != nil
+
+	if err := namespace.LoadFromDisk(lsmTree, namespace.Wal); err != nil {
+		namespace.close()
+		return nil, err
+	}
+
+	start := make(chan bool, 1)
+	start <- true
+	go store.PersistToDisk(lsmTree, namespace.Wal, start)
+
+	return namespace, nil
+}
+
+// close stops the engine of a namespace. Writes fail from then on, and the
+// watchers are closed with ErrNamespaceDropped.
+func (db *DBEngine) close() error {
+	db.writeLock.Lock()
+	db.closed.Store(true)
+	db.writeLock.Unlock()
+
+	db.watchLock.Lock()
+	for w := range db.watchers {
+		w.close(ErrNamespaceDropped)
+	}
+	db.watchLock.Unlock()
+
+	err := db.Store.Close()
+
+	if walErr := db.Wal.Close(); walErr != nil && err == nil {
+		err = walErr
+	}
+
+	if treeErr := db.LsmTree.Close(); treeErr != nil && err == nil {
+		err = treeErr
+	}
+
+	return err
+}
+
+// checkQuota must be called with writeLock held.
+func (db *DBEngine) checkQuota(batch *WriteBatch) error {
+	if db.quota.MaxBytes == 0 {
+		return nil
+	}
+
+	var size int64
+	for _, entry := range batch.entries {
+		if !entry.Delete {
+			size += int64(len(entry.Key) + len(entry.Value))
+		}
+	}
+
+	if size == 0 {
+		return nil
+	}
+
+	if db.LsmTree.DiskSize()+db.LsmTree.MemtableSize()+size > db.quota.MaxBytes {
+		return ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+// readQuota reads the QUOTA file of a namespace, which holds one
+// "<name> <value>" line per limit.
+func readQuota(dir string) (Quota, error) {
+	var quota Quota
+
+	file, err := os.Open(filepath.Join(dir, QUOTA_FILE_NAME))
+	if os.IsNotExist(err) {
+		return quota, nil
+	}
+	if err != nil {
+		return quota, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "max_bytes":
+			quota.MaxBytes, err = strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return quota, fmt.Errorf("invalid quota line %q", scanner.Text())
+			}
+		}
+	}
+
+	return quota, scanner.Err()
+}
+
+// WriteQuota replaces the QUOTA file of the namespace in dir.
+func WriteQuota(dir string, quota Quota) error {
+	path := filepath.Join(dir, QUOTA_FILE_NAME)
+	tmpPath := path + ".tmp"
+
+	if err := os.WriteFile(tmpPath, []byte(fmt.Sprintf("max_bytes %d\n", quota.MaxBytes)), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
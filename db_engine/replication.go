@@ -0,0 +1,64 @@
+package dbengine
+
+import (
+	"errors"
+
+	LsmTree "github.com/Avash027/midDB/lsm_tree"
+)
+
+var (
+	ErrReadOnlyReplica = errors.New("writes are disabled on a follower")
+	ErrReplicaTimeout  = errors.New("write applied but not acknowledged by enough followers in time")
+	ErrNoReplicas      = errors.New("not enough followers connected to write")
+)
+
+// Replicator holds back the writes of a leader until its followers have
+// them, see the replication package.
+type Replicator interface {
+	// CheckReplicas returns ErrNoReplicas when fewer followers are
+	// connected than the replication mode requires, the write is refused
+	// before it is applied then.
+	CheckReplicas() error
+	// WaitForReplicas returns once the writes up to seq were acknowledged
+	// as the replication mode requires. It returns ErrReplicaTimeout when
+	// they were not, the writes are still applied on the leader then.
+	WaitForReplicas(seq uint64) error
+}
+
+// SetFollower makes the engine refuse every write but the ones applied by
+// ApplyReplicated, namespaces can not be changed either. It is called
+// before the namespaces are opened.
+func (db *DBEngine) SetFollower(follower bool) {
+	db.follower.Store(follower)
+}
+
+// IsFollower reports whether the engine only takes the writes of a leader.
+func (db *DBEngine) IsFollower() bool {
+	return db.follower.Load()
+}
+
+// ApplyReplicated writes a batch received from the leader, even on a
+// follower. The sharding package writes the keys other nodes hand over
+// with it as well, so it does not go through the router.
+func (db *DBEngine) ApplyReplicated(batch *WriteBatch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	return db.apply(batch)
+}
+
+// Snapshot returns a snapshot of the tree. Its Seq is the sequence number of
+// the last WAL entry it holds, so the changes after it complete it. It has
+// to be released when done.
+func (db *DBEngine) Snapshot() *LsmTree.Snapshot {
+	// the WAL and the tree number the writes alike, as long as no write is
+	// in flight
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	return db.LsmTree.Snapshot()
+}
@@ -0,0 +1,72 @@
+package dbengine
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrMoved     = errors.New("the key is served by another node")
+	ErrSlotMoves = errors.New("the slot of the key is moving to another node, try again")
+	ErrNoRing    = errors.New("the node is not part of a ring yet")
+)
+
+// MovedError is returned for a key another node serves, see the sharding
+// package. It matches ErrMoved.
+type MovedError struct {
+	Slot int
+	// Addr is where clients reach the node that serves the slot
+	Addr string
+}
+
+func (e *MovedError) Error() string {
+	return fmt.Sprintf("MOVED %d %s", e.Slot, e.Addr)
+}
+
+func (e *MovedError) Is(target error) bool {
+	return target == ErrMoved
+}
+
+// Router splits the keys of the default namespace between the nodes of a
+// ring, see the sharding package. The namespaces are not sharded.
+type Router interface {
+	// Route returns nil when the node serves the key, a *MovedError when
+	// another node does, and ErrSlotMoves for a write to a slot that is
+	// being handed over.
+	Route(key []byte, write bool) error
+}
+
+// Route checks the key against the router of the engine, it returns nil
+// when there is none.
+func (db *DBEngine) Route(key []byte, write bool) error {
+	if db.Router == nil {
+		return nil
+	}
+
+	return db.Router.Route(key, write)
+}
+
+// routeBatch expects writeLock to be held, so no write to a slot that is
+// handed over slips through once the router froze it.
+func (db *DBEngine) routeBatch(batch *WriteBatch) error {
+	if db.Router == nil {
+		return nil
+	}
+
+	for _, entry := range batch.entries {
+		if err := db.Router.Route(entry.Key, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WaitForWrites returns the sequence number of the last write once the
+// writes in flight are applied.
+func (db *DBEngine) WaitForWrites() uint64 {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	return db.Wal.LastSeq()
+}
@@ -0,0 +1,127 @@
+package dbengine
+
+import (
+	"errors"
+	"time"
+
+	diskstore "github.com/Avash027/midDB/disk_store"
+	LsmTree "github.com/Avash027/midDB/lsm_tree"
+	"github.com/Avash027/midDB/wal"
+)
+
+var ErrTransactionDone = errors.New("transaction already committed or rolled back")
+
+// Transaction is an optimistic transaction. Reads come from a snapshot taken
+// by Begin and writes are buffered until Commit. Nothing is locked while the
+// transaction runs, instead Commit fails with ErrCASConflict when a key the
+// transaction read was changed by someone else in the meantime.
+//
+//	txn := db.Begin()
+//	balance, _, _ := txn.Get("balance")
+//	txn.Put("balance", next(balance))
+//	if err := txn.Commit(); err == diskstore.ErrCASConflict {
+//		// retry
+//	}
+type Transaction struct {
+	db       *DBEngine
+	snapshot *LsmTree.Snapshot
+	// reads holds the sequence number of the version each key had when it
+	// was first read, 0 when the key did not exist
+	reads  map[string]uint64
+	writes map[string]wal.Entry
+	batch  *WriteBatch
+	done   bool
+}
+
+func (db *DBEngine) Begin() *Transaction {
+	return &Transaction{
+		db:       db,
+		snapshot: db.LsmTree.Snapshot(),
+		reads:    map[string]uint64{},
+		writes:   map[string]wal.Entry{},
+		batch:    NewWriteBatch(),
+	}
+}
+
+// Get returns the value of key as of the start of the transaction, or the
+// value the transaction itself wrote.
+func (txn *Transaction) Get(key []byte) ([]byte, bool, error) {
+	if txn.done {
+		return nil, false, ErrTransactionDone
+	}
+
+	if entry, ok := txn.writes[string(key)]; ok {
+		return entry.Value, !entry.Delete, nil
+	}
+
+	pair, exist := txn.snapshot.GetPair(key)
+
+	if _, ok := txn.reads[string(key)]; !ok {
+		txn.reads[string(key)] = pair.Seq
+	}
+
+	if !exist || pair.Tombstone || pair.Expired(time.Now()) {
+		return nil, false, nil
+	}
+
+	return pair.Value, true, nil
+}
+
+func (txn *Transaction) Put(key []byte, value []byte) error {
+	if txn.done {
+		return ErrTransactionDone
+	}
+
+	txn.writes[string(key)] = wal.Entry{Key: key, Value: value}
+	txn.batch.Put(key, value)
+	return nil
+}
+
+func (txn *Transaction) Del(key []byte) error {
+	if txn.done {
+		return ErrTransactionDone
+	}
+
+	txn.writes[string(key)] = wal.Entry{Key: key, Delete: true}
+	txn.batch.Delete(key)
+	return nil
+}
+
+// Commit checks that every key read by the transaction still has the version
+// it saw and writes all buffered operations as one batch. It returns
+// ErrCASConflict, and writes nothing, if any of the keys changed.
+func (txn *Transaction) Commit() error {
+	if txn.done {
+		return ErrTransactionDone
+	}
+	defer txn.Rollback()
+
+	return txn.db.locked(func() error {
+		for key, seq := range txn.reads {
+			// a missing key reads as seq 0, so a key whose tombstone was
+			// compacted away is still reported as changed
+			pair, _ := txn.db.LsmTree.GetPair([]byte(key))
+
+			if pair.Seq != seq {
+				return diskstore.ErrCASConflict
+			}
+		}
+
+		if txn.batch.Len() == 0 {
+			return nil
+		}
+
+		return txn.db.write(txn.batch)
+	})
+}
+
+// Rollback drops the buffered writes and releases the snapshot of the
+// transaction. It is safe to call after Commit.
+func (txn *Transaction) Rollback() {
+	if txn.done {
+		return
+	}
+
+	txn.done = true
+	txn.snapshot.Release()
+}
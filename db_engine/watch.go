@@ -0,0 +1,168 @@
+package dbengine
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+
+	"github.com/Avash027/midDB/wal"
+)
+
+const DEFAULT_WATCH_BUFFER_SIZE = 1024
+
+var ErrWatcherTooSlow = errors.New("watcher fell too far behind")
+
+// Event is a committed put or delete.
+type Event struct {
+	Seq       uint64
+	Key       []byte
+	Value     []byte
+	Delete    bool
+	ExpiresAt int64
+}
+
+// Watcher receives the events for the keys starting with its prefix, in the
+// order they were committed. The events are read from the change feed of
+// the WAL, so writers never wait for a watcher. One that falls behind by
+// more changes than the WAL retains is closed and Err returns
+// ErrWatcherTooSlow.
+type Watcher struct {
+	Events <-chan Event
+
+	db        *DBEngine
+	prefix    []byte
+	events    chan Event
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// Watch starts streaming the changes to keys starting with prefix, from the
+// next write on. The watcher has to be closed when done.
+func (db *DBEngine) Watch(prefix []byte) *Watcher {
+	// the last change is always retained
+	w, _ := db.WatchAfter(prefix, db.Wal.LastSeq())
+	return w
+}
+
+// WatchAfter streams the changes with a sequence number above seq, so a
+// consumer that got the events up to seq resumes where it left off. It
+// returns wal.ErrSeqTooOld when the WAL no longer retains the changes that
+// followed seq.
+func (db *DBEngine) WatchAfter(prefix []byte, seq uint64) (*Watcher, error) {
+	if _, _, err := db.Wal.Changes(seq, 1); err != nil {
+		return nil, err
+	}
+
+	events := make(chan Event, DEFAULT_WATCH_BUFFER_SIZE)
+	w := &Watcher{
+		Events: events,
+		db:     db,
+		prefix: append([]byte{}, prefix...),
+		events: events,
+		done:   make(chan struct{}),
+	}
+
+	db.watchLock.Lock()
+	if db.watchers == nil {
+		db.watchers = map[*Watcher]struct{}{}
+	}
+	db.watchers[w] = struct{}{}
+	if db.closed.Load() {
+		w.close(ErrNamespaceDropped)
+	}
+	db.watchLock.Unlock()
+
+	go w.run(seq)
+
+	return w, nil
+}
+
+// LastSeq returns the sequence number of the last committed write.
+func (db *DBEngine) LastSeq() uint64 {
+	return db.Wal.LastSeq()
+}
+
+// Err returns why the watcher was closed by the engine, or nil.
+func (w *Watcher) Err() error {
+	w.db.watchLock.Lock()
+	defer w.db.watchLock.Unlock()
+
+	return w.err
+}
+
+func (w *Watcher) Close() {
+	w.db.watchLock.Lock()
+	defer w.db.watchLock.Unlock()
+
+	w.close(nil)
+}
+
+// close must be called with watchLock held. Events is closed by run once it
+// stops.
+func (w *Watcher) close(err error) {
+	w.closeOnce.Do(func() {
+		w.err = err
+		delete(w.db.watchers, w)
+		close(w.done)
+	})
+}
+
+// closeWithErr closes the watcher unless it was already closed.
+func (w *Watcher) closeWithErr(err error) {
+	w.db.watchLock.Lock()
+	defer w.db.watchLock.Unlock()
+
+	w.close(err)
+}
+
+// run reads the changes after seq from the WAL and sends the ones matching
+// the prefix, until the watcher is closed. The WAL is persisted before the
+// changes are sent, so no event is ever lost in a crash.
+func (w *Watcher) run(seq uint64) {
+	defer close(w.events)
+
+	for {
+		changes, written, err := w.db.Wal.Changes(seq, DEFAULT_WATCH_BUFFER_SIZE)
+		if err == wal.ErrSeqTooOld {
+			w.closeWithErr(ErrWatcherTooSlow)
+			return
+		}
+
+		if len(changes) == 0 {
+			select {
+			case <-w.done:
+				return
+			case <-written:
+				continue
+			}
+		}
+
+		if err := w.db.Wal.Persist(); err != nil {
+			w.closeWithErr(err)
+			return
+		}
+
+		for _, change := range changes {
+			seq = change.Seq
+
+			if !bytes.HasPrefix(change.Key, w.prefix) {
+				continue
+			}
+
+			event := Event{
+				Seq:       change.Seq,
+				Key:       change.Key,
+				Value:     change.Value,
+				Delete:    change.Delete,
+				ExpiresAt: change.ExpiresAt,
+			}
+
+			select {
+			case <-w.done:
+				return
+			case w.events <- event:
+			}
+		}
+	}
+}
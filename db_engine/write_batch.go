@@ -0,0 +1,44 @@
+package dbengine
+
+import (
+	"time"
+
+	"github.com/Avash027/midDB/wal"
+)
+
+// WriteBatch collects puts and deletes that are applied together. The whole
+// batch is written to the WAL as one record, so after a crash either every
+// operation of the batch is recovered or none is.
+type WriteBatch struct {
+	entries []wal.Entry
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{entries: []wal.Entry{}}
+}
+
+func (b *WriteBatch) Put(key []byte, value []byte) {
+	b.entries = append(b.entries, wal.Entry{Key: key, Value: value})
+}
+
+// PutWithTTL sets a value that expires ttl from now.
+func (b *WriteBatch) PutWithTTL(key []byte, value []byte, ttl time.Duration) {
+	b.entries = append(b.entries, wal.Entry{Key: key, Value: value, ExpiresAt: time.Now().Add(ttl).UnixMilli()})
+}
+
+// Add appends an entry as it was logged, so a put keeps its expiry time.
+func (b *WriteBatch) Add(entry wal.Entry) {
+	b.entries = append(b.entries, entry)
+}
+
+func (b *WriteBatch) Delete(key []byte) {
+	b.entries = append(b.entries, wal.Entry{Key: key, Delete: true})
+}
+
+func (b *WriteBatch) Len() int {
+	return len(b.entries)
+}
+
+func (b *WriteBatch) Reset() {
+	b.entries = b.entries[:0]
+}
@@ -3,24 +3,38 @@ package DiskStore
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/fnv"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	fileutil "github.com/Avash027/midDB/internal/file_util"
 	LsmTree "github.com/Avash027/midDB/lsm_tree"
 	"github.com/Avash027/midDB/wal"
 )
 
 var (
-	ErrKeyNotFound = errors.New("key not found")
-	ErrCASConflict = errors.New("compare-and-swap conflict")
+	ErrKeyNotFound      = errors.New("key not found")
+	ErrCASConflict      = errors.New("compare-and-swap conflict")
+	ErrCorruptPartition = errors.New("corrupt partition file")
+	ErrStoreClosed      = errors.New("disk store is closed")
 )
 
+// PARTITION_MAGIC starts every partition file written with length prefixed
+// records.
+const PARTITION_MAGIC = "midp"
+
+// TMP_EXTENSION ends the name of a partition being rewritten. One left by a
+// crash was never renamed over the partition and is removed.
+const TMP_EXTENSION = ".tmp"
+
 const DEFAULT_NUM_OF_PARTITIONS = 10
 const DEFAULT_DIRECTORY = "./data"
 
@@ -29,11 +43,18 @@ type DiskStoreOpts struct {
 	NumOfPartitions int
 }
 
+// PERSIST_INTERVAL is the time between two persisting cycles.
+const PERSIST_INTERVAL = 5 * time.Second
+
 type DiskStore struct {
 	files []*os.File
 	dir   string
 	Locks []*sync.RWMutex
 	Lock  sync.Mutex
+	// closed is set under Lock by Close, done stops the persisting cycle
+	// while it waits
+	closed bool
+	done   chan struct{}
 }
 
 func New(opts DiskStoreOpts) *DiskStore {
@@ -55,10 +76,13 @@ func New(opts DiskStoreOpts) *DiskStore {
 		files: make([]*os.File, numOfPartitions),
 		Locks: make([]*sync.RWMutex, numOfPartitions),
 		Lock:  sync.Mutex{},
+		done:  make(chan struct{}),
 	}
 
 	for i := 0; i < numOfPartitions; i++ {
 		filename := fmt.Sprintf("%s/partition_%d", dir, i)
+		os.Remove(filename + TMP_EXTENSION)
+
 		file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
 		if err != nil {
 			// Handle error and cleanup previously created files
@@ -75,182 +99,382 @@ func New(opts DiskStoreOpts) *DiskStore {
 	return ds
 }
 
-func partition(key string, numPartitions int) int {
+func partition(key []byte, numPartitions int) int {
 	hash := fnv.New32a()
-	hash.Write([]byte(key))
+	hash.Write(key)
 	return int(hash.Sum32() % uint32(numPartitions))
 }
 
-func (ds *DiskStore) PersistToDisk(wl *wal.WAL, start <-chan bool) {
+func (ds *DiskStore) PersistToDisk(lsmTree *LsmTree.LSMTree, wl *wal.WAL, start <-chan bool) {
 	<-start
 
 	fmt.Println("Starting persisting cycle")
 	for {
 
 		ds.Lock.Lock()
-		var wg sync.WaitGroup
-		entries := wl.ReadEntries()
-		wg.Add(len(entries))
+		if ds.closed {
+			ds.Lock.Unlock()
+			return
+		}
+
+		entries, end, err := wl.ReadEntries()
+		if err != nil {
+			fmt.Println("Error reading the WAL:", err)
+			ds.Lock.Unlock()
+			if !ds.wait() {
+				return
+			}
+			continue
+		}
 
+		// every partition is rewritten by a single goroutine, so the writes
+		// to a key are applied in the order they were logged
+		byPartition := make([][]wal.Entry, len(ds.files))
 		for _, entry := range entries {
-			go func(entry wal.Entry, wg *sync.WaitGroup) {
-				partition := partition(entry.Key, len(ds.files))
-				file := ds.files[partition]
+			i := partition(entry.Key, len(ds.files))
+			byPartition[i] = append(byPartition[i], entry)
+		}
 
+		var wg sync.WaitGroup
+		wg.Add(len(ds.files))
+
+		errs := make([]error, len(ds.files))
+
+		for i := range ds.files {
+			go func(i int, wg *sync.WaitGroup) {
 				defer (*wg).Done()
 
-				existingValue, err := ds.readValue(file, entry.Key, partition)
-				if err != nil {
-					fmt.Println(err)
-					existingValue = nil
-				}
-
-				if entry.Delete {
-					err = ds.DeleteFromDisk(file, entry.Key, partition)
-					if err != nil {
-						fmt.Printf("%s", err.Error())
-					}
-					return
-				}
-
-				err = ds.writeValue(file, entry.Key, []byte(entry.Value), existingValue, partition)
-				if err != nil {
-					fmt.Printf("%s", err.Error())
-				}
-			}(entry, &wg)
+				errs[i] = ds.applyEntries(i, byPartition[i])
+			}(i, &wg)
 		}
 
 		wg.Wait()
-		wl.Truncate()
+
+		err = errors.Join(errs...)
+
+		// the memtable only lives in the WAL until it is flushed, so it has
+		// to reach a disk block before the WAL can be discarded
+		if err == nil && len(entries) > 0 {
+			err = lsmTree.FlushMemtable()
+		}
+
+		// the checkpoint only moves once the partitions and the disk blocks
+		// hold the entries, so after a crash in between they are applied
+		// again, which leaves the same data
+		if err == nil {
+			err = wl.Checkpoint(end)
+		}
+
+		if err != nil {
+			fmt.Println("Error persisting the WAL:", err)
+		}
 		ds.Lock.Unlock()
 
-		time.Sleep(5 * time.Second)
+		if !ds.wait() {
+			return
+		}
 
 	}
 }
 
-func (ds *DiskStore) readValue(file *os.File, key string, partition int) ([]byte, error) {
-	// Seek to the beginning of the file
-	ds.Locks[partition].Lock()
-	defer ds.Locks[partition].Unlock()
+// Checkpoint writes a consistent copy of the store, the tree and the WAL to
+// dir, laid out like the directory of a namespace, and returns the sequence
+// number of the last write it holds. The persisting cycle waits for it, so
+// the partitions and the WAL are not rewritten meanwhile, while writes go
+// on. The disk blocks are taken before the WAL, so replaying the copy of the
+// WAL over them rebuilds the state as of its last write.
+func (ds *DiskStore) Checkpoint(dir string, lsmTree *LsmTree.LSMTree, wl *wal.WAL) (uint64, error) {
+	ds.Lock.Lock()
+	defer ds.Lock.Unlock()
+
+	if ds.closed {
+		return 0, ErrStoreClosed
+	}
 
-	_, err := file.Seek(0, io.SeekStart)
-	if err != nil {
-		return nil, err
+	partitions := filepath.Join(dir, "partitions")
+	if err := os.MkdirAll(partitions, 0755); err != nil {
+		return 0, err
 	}
 
-	// Scan the file for the key
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, ":")
-		if parts[0] == key {
-			return []byte(parts[1]), nil
+	for i := range ds.files {
+		if err := ds.copyPartition(i, filepath.Join(partitions, fmt.Sprintf("partition_%d", i))); err != nil {
+			return 0, err
 		}
 	}
 
-	// If the key wasn't found, return nil
-	return nil, nil
+	if err := lsmTree.Checkpoint(filepath.Join(dir, "sstables")); err != nil {
+		return 0, err
+	}
+
+	return wl.CopyTo(filepath.Join(dir, wal.DEFAULT_WAL_PATH))
 }
 
-func (ds *DiskStore) writeValue(file *os.File, key string, value []byte, existingValue []byte, partition int) error {
-	ds.Locks[partition].RLock()
-	defer ds.Locks[partition].RUnlock()
+func (ds *DiskStore) copyPartition(i int, path string) error {
+	ds.Locks[i].RLock()
+	defer ds.Locks[i].RUnlock()
 
-	// Seek to the beginning of the file
-	_, err := file.Seek(0, io.SeekStart)
+	info, err := ds.files[i].Stat()
 	if err != nil {
 		return err
 	}
 
-	// Write the new key-value pair to a buffer
-	var buf bytes.Buffer
-	buf.WriteString(fmt.Sprintf("%s:%s\n", key, value))
-
-	// If there was an existing value, replace it in the buffer
-	if existingValue != nil {
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			line := scanner.Text()
-			parts := strings.Split(line, ":")
-			if parts[0] == key {
-				continue
-			}
-			buf.WriteString(line + "\n")
-		}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
 	}
 
-	_, err = file.Seek(0, io.SeekEnd)
-	if err != nil {
+	// ReadAt leaves the offset of the partition alone
+	if _, err := io.Copy(file, io.NewSectionReader(ds.files[i], 0, info.Size())); err != nil {
+		file.Close()
 		return err
 	}
 
-	_, err = file.Write(buf.Bytes())
-	if err != nil {
+	if err := file.Sync(); err != nil {
+		file.Close()
 		return err
 	}
 
-	return nil
+	return file.Close()
 }
 
-func (ds *DiskStore) DeleteFromDisk(file *os.File, key string, partition int) error {
-	ds.Locks[partition].RLock()
-	defer ds.Locks[partition].RUnlock()
+// wait sleeps until the next persisting cycle and reports whether there is
+// one.
+func (ds *DiskStore) wait() bool {
+	select {
+	case <-ds.done:
+		return false
+	case <-time.After(PERSIST_INTERVAL):
+		return true
+	}
+}
+
+// Close waits for the running persisting cycle, stops the next ones and
+// closes the partitions.
+func (ds *DiskStore) Close() error {
+	ds.Lock.Lock()
+	defer ds.Lock.Unlock()
+
+	if ds.closed {
+		return nil
+	}
 
-	_, err := file.Seek(0, io.SeekStart)
+	ds.closed = true
+	close(ds.done)
 
+	var err error
+	for i, file := range ds.files {
+		ds.Locks[i].Lock()
+		if closeErr := file.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		ds.Locks[i].Unlock()
+	}
+
+	return err
+}
+
+// applyEntries applies the puts and deletes to partition i and drops the
+// values that have expired. The partition is only rewritten if it changed.
+func (ds *DiskStore) applyEntries(i int, entries []wal.Entry) error {
+	ds.Locks[i].Lock()
+	defer ds.Locks[i].Unlock()
+
+	records, err := readPartition(ds.files[i])
 	if err != nil {
 		return err
 	}
 
-	var buf bytes.Buffer
-	scanner := bufio.NewScanner(file)
+	positions := make(map[string]int, len(records))
+	for position, record := range records {
+		positions[string(record.Key)] = position
+	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, ":")
-		if parts[0] == key {
+	changed := false
+
+	for _, entry := range entries {
+		position, exist := positions[string(entry.Key)]
+
+		if entry.Delete {
+			if exist {
+				records[position].Delete = true
+				changed = true
+			}
 			continue
 		}
-		buf.WriteString(line + "\n")
+
+		if exist {
+			records[position] = entry
+		} else {
+			positions[string(entry.Key)] = len(records)
+			records = append(records, entry)
+		}
+		changed = true
 	}
 
-	if err := file.Truncate(0); err != nil {
-		return err
+	now := time.Now().UnixMilli()
+	kept := records[:0]
+
+	for _, record := range records {
+		if record.Delete || (record.ExpiresAt != 0 && record.ExpiresAt <= now) {
+			changed = true
+			continue
+		}
+		kept = append(kept, record)
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return ds.writePartition(i, kept)
+}
+
+// writePartition replaces partition i with the records. They are written to
+// a temporary file that is synced and renamed over the partition, and the
+// directory is synced too, so a crash leaves either the old or the new
+// partition and the WAL checkpoint never moves past a partition that could
+// still be lost. Every record is laid out as
+//
+//	| key length | key | value length | value | expires at |
+//
+// where the numbers are varints, so keys and values may hold any byte. It
+// must be called with the lock of the partition held.
+func (ds *DiskStore) writePartition(i int, records []wal.Entry) error {
+	var buf bytes.Buffer
+	var tmp [binary.MaxVarintLen64]byte
+
+	buf.WriteString(PARTITION_MAGIC)
+
+	for _, record := range records {
+		n := binary.PutUvarint(tmp[:], uint64(len(record.Key)))
+		buf.Write(tmp[:n])
+		buf.Write(record.Key)
+
+		n = binary.PutUvarint(tmp[:], uint64(len(record.Value)))
+		buf.Write(tmp[:n])
+		buf.Write(record.Value)
+
+		n = binary.PutVarint(tmp[:], record.ExpiresAt)
+		buf.Write(tmp[:n])
 	}
 
-	_, err = file.Seek(0, io.SeekEnd)
+	path := ds.files[i].Name()
+	tmpPath := path + TMP_EXTENSION
+
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
 	if err != nil {
 		return err
 	}
 
-	_, err = file.Write(buf.Bytes())
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
 
-	if err != nil {
+	if err := file.Sync(); err != nil {
+		file.Close()
 		return err
 	}
 
-	return nil
+	if err := os.Rename(tmpPath, path); err != nil {
+		file.Close()
+		return err
+	}
+
+	// the old file is unlinked, the partition is the new one from now on
+	err = ds.files[i].Close()
+	ds.files[i] = file
+
+	if syncErr := fileutil.SyncDir(ds.dir); syncErr != nil {
+		return syncErr
+	}
+
+	return err
+}
+
+// readPartition returns every record of the file. Partitions written before
+// the records were length prefixed hold key:value or key:value:<expires at>
+// lines and are read as such.
+func readPartition(file *os.File) ([]wal.Entry, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(bufio.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(data, []byte(PARTITION_MAGIC)) {
+		return readLegacyPartition(data), nil
+	}
+
+	data = data[len(PARTITION_MAGIC):]
+	var records []wal.Entry
+
+	for len(data) > 0 {
+		var record wal.Entry
+		var ok bool
+
+		if record.Key, data, ok = fileutil.ReadBytes(data); !ok {
+			return nil, ErrCorruptPartition
+		}
+
+		if record.Value, data, ok = fileutil.ReadBytes(data); !ok {
+			return nil, ErrCorruptPartition
+		}
+
+		expiresAt, n := binary.Varint(data)
+		if n <= 0 {
+			return nil, ErrCorruptPartition
+		}
+		record.ExpiresAt = expiresAt
+		data = data[n:]
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func readLegacyPartition(data []byte) []wal.Entry {
+	var records []wal.Entry
+
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.Split(line, ":")
+		if len(parts) < 2 {
+			continue
+		}
+
+		record := wal.Entry{Key: []byte(parts[0]), Value: []byte(parts[1])}
+		if len(parts) > 2 {
+			record.ExpiresAt, _ = strconv.ParseInt(parts[2], 10, 64)
+		}
+
+		records = append(records, record)
+	}
+
+	return records
 }
 
 func (ds *DiskStore) GetFileContents(i int) []wal.Entry {
 	ds.Locks[i].RLock()
 	defer ds.Locks[i].RUnlock()
 
-	_, err := ds.files[i].Seek(0, io.SeekStart)
+	records, err := readPartition(ds.files[i])
 	if err != nil {
+		fmt.Println(err)
 		return nil
 	}
 
-	scanner := bufio.NewScanner(ds.files[i])
+	now := time.Now().UnixMilli()
 	var entries []wal.Entry
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, ":")
-		entries = append(entries, wal.Entry{
-			Key:   parts[0],
-			Value: parts[1],
-		})
+
+	for _, record := range records {
+		if record.ExpiresAt != 0 && record.ExpiresAt <= now {
+			continue
+		}
+		entries = append(entries, record)
 	}
 
 	return entries
@@ -258,11 +482,15 @@ func (ds *DiskStore) GetFileContents(i int) []wal.Entry {
 
 func (ds *DiskStore) LoadFromDisk(lsmTree *LsmTree.LSMTree, wal *wal.WAL) error {
 
-	for i := 0; i < len(ds.files); i++ {
-		entries := ds.GetFileContents(i)
+	// the tree reopens its own disk blocks, the partitions are only replayed
+	// to seed a tree that has never been flushed
+	if lsmTree.NumOfDiskBlocks() == 0 {
+		for i := 0; i < len(ds.files); i++ {
+			entries := ds.GetFileContents(i)
 
-		for _, entry := range entries {
-			lsmTree.Put(entry.Key, entry.Value)
+			for _, entry := range entries {
+				lsmTree.ApplyBatch([]LsmTree.Pair{{Key: entry.Key, Value: entry.Value, ExpiresAt: entry.ExpiresAt}})
+			}
 		}
 	}
 
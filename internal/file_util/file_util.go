@@ -0,0 +1,36 @@
+// Package fileutil holds the helpers shared by the files of the WAL, the
+// partitions, the SSTables and the raft log.
+package fileutil
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+// SyncDir makes the files created, renamed and removed in dir durable.
+func SyncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// ReadBytes reads a uvarint length and that many bytes from buf, it returns
+// a copy of them and the rest of buf. It reports false when buf is cut
+// short.
+func ReadBytes(buf []byte) ([]byte, []byte, bool) {
+	length, n := binary.Uvarint(buf)
+	if n <= 0 || length > uint64(len(buf)-n) {
+		return nil, nil, false
+	}
+
+	end := n + int(length)
+	return append([]byte{}, buf[n:end]...), buf[end:], true
+}
@@ -60,29 +60,35 @@ func CreateBloomFilter(opts BloomFilterOpts) *BloomFilter {
 	return b
 }
 
-func (b *BloomFilter) Add(key string) {
+func (b *BloomFilter) Add(key []byte) {
 
 	for i := 0; i < len(b.bloomParameters.hashFns); i++ {
 		b.hashRWLock[i].Lock()
 		b.bloomParameters.hashFns[i].Reset()
-		b.bloomParameters.hashFns[i].Write([]byte(key))
+		b.bloomParameters.hashFns[i].Write(key)
 		hashValue := b.bloomParameters.hashFns[i].Sum64() % uint64(b.bloomParameters.numOfBits)
+		b.bloomLock.Lock()
 		setBit(&b, hashValue)
+		b.bloomLock.Unlock()
 		b.hashRWLock[i].Unlock()
 
 	}
 }
 
-func (b *BloomFilter) Contains(key string) bool {
+func (b *BloomFilter) Contains(key []byte) bool {
 
 	for i := 0; i < len(b.bloomParameters.hashFns); i++ {
 		b.hashRWLock[i].Lock()
 		b.bloomParameters.hashFns[i].Reset()
 
-		b.bloomParameters.hashFns[i].Write([]byte(key))
+		b.bloomParameters.hashFns[i].Write(key)
 		hashValue := b.bloomParameters.hashFns[i].Sum64() % uint64(b.bloomParameters.numOfBits)
 
-		if !hasBit(&b, hashValue) {
+		b.bloomLock.RLock()
+		found := hasBit(&b, hashValue)
+		b.bloomLock.RUnlock()
+
+		if !found {
 			b.hashRWLock[i].Unlock()
 			return false
 		}
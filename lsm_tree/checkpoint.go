@@ -0,0 +1,74 @@
+package LsmTree
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Checkpoint makes dir a copy of the disk blocks that are live now, with
+// their manifest. Disk blocks never change once written, so they are hard
+// linked, and copied when dir is on another file system. What is still in
+// memory is not part of the checkpoint, the WAL holds it.
+func (lsmTree *LSMTree) Checkpoint(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// the blocks are held so a compaction that replaces them meanwhile
+	// does not delete their files
+	lsmTree.diskReadWriteLock.RLock()
+	entries := []manifestEntry{}
+	diskBlocks := []*DiskBlock{}
+	for level, levelBlocks := range lsmTree.levels {
+		for _, diskBlock := range levelBlocks {
+			diskBlock.ref()
+			diskBlocks = append(diskBlocks, diskBlock)
+			entries = append(entries, manifestEntry{Level: level, Name: filepath.Base(diskBlock.Path)})
+		}
+	}
+	lsmTree.diskReadWriteLock.RUnlock()
+
+	defer func() {
+		for _, diskBlock := range diskBlocks {
+			diskBlock.unref()
+		}
+	}()
+
+	for _, diskBlock := range diskBlocks {
+		if err := linkOrCopy(diskBlock.Path, filepath.Join(dir, filepath.Base(diskBlock.Path))); err != nil {
+			return err
+		}
+	}
+
+	return writeManifest(dir, entries)
+}
+
+func linkOrCopy(src string, dst string) error {
+	if err := os.Link(src, dst); err == nil || os.IsExist(err) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
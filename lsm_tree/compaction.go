@@ -0,0 +1,372 @@
+package LsmTree
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const COMPACTION_STYLE_LEVELED = "leveled"
+const COMPACTION_STYLE_SIZE_TIERED = "size_tiered"
+const DEFAULT_COMPACTION_STYLE = COMPACTION_STYLE_LEVELED
+
+const DEFAULT_LEVEL0_COMPACTION_TRIGGER = 4
+const DEFAULT_LEVEL_BASE_SIZE = 10 * 1024 * 1024
+const DEFAULT_LEVEL_SIZE_MULTIPLIER = 10
+const DEFAULT_MAX_LEVELS = 7
+const DEFAULT_TARGET_DISK_BLOCK_SIZE = 2 * 1024 * 1024
+
+// CompactionTask describes one merge. Inputs are ordered from the newest to
+// the oldest data. The merge keeps the newest version of every key and the
+// older versions that open snapshots can still see.
+type CompactionTask struct {
+	Inputs      []*DiskBlock
+	OutputLevel int
+	// DropTombstones is only safe when no level below the output level can
+	// hold an older version of the keys being merged.
+	DropTombstones bool
+	// TargetDiskBlockSize splits the output into several blocks. Zero keeps
+	// the output in a single block.
+	TargetDiskBlockSize int64
+}
+
+// CompactionStrategy decides which disk blocks are merged next. Pick gets a
+// copy of the levels, where level 0 holds the flushed blocks from the oldest
+// to the newest and every other level holds blocks with non-overlapping key
+// ranges sorted by key. It returns nil when there is nothing to do.
+type CompactionStrategy interface {
+	Pick(levels [][]*DiskBlock) *CompactionTask
+}
+
+type CompactionOpts struct {
+	// Style selects one of the built-in policies, Strategy replaces them
+	// with a custom one when set.
+	Style             string
+	Strategy          CompactionStrategy
+	MaxBytesPerSecond int
+	MaxCPUPercent     int
+	LeveledOpts       LeveledCompactionOpts
+	SizeTieredOpts    SizeTieredCompactionOpts
+}
+
+func newCompactionStrategy(opts CompactionOpts) (CompactionStrategy, error) {
+	if opts.Strategy != nil {
+		return opts.Strategy, nil
+	}
+
+	switch opts.Style {
+	case "", COMPACTION_STYLE_LEVELED:
+		return NewLeveledCompactionStrategy(opts.LeveledOpts), nil
+	case COMPACTION_STYLE_SIZE_TIERED:
+		return NewSizeTieredCompactionStrategy(opts.SizeTieredOpts), nil
+	default:
+		return nil, fmt.Errorf("unknown compaction style %q", opts.Style)
+	}
+}
+
+type LeveledCompactionOpts struct {
+	Level0CompactionTrigger int
+	LevelBaseSize           int64
+	LevelSizeMultiplier     int
+	MaxLevels               int
+	TargetDiskBlockSize     int64
+}
+
+// LeveledCompactionStrategy merges level 0 into level 1 once enough blocks
+// have been flushed, and pushes a block of level n into level n+1 once level
+// n grows past its size budget. The budget of level 1 is LevelBaseSize and
+// every following level may hold LevelSizeMultiplier times more.
+type LeveledCompactionStrategy struct {
+	opts LeveledCompactionOpts
+	// compactionPointer remembers where the last merge of each level ended,
+	// so all key ranges of a level get their turn.
+	compactionPointer map[int][]byte
+}
+
+func NewLeveledCompactionStrategy(opts LeveledCompactionOpts) *LeveledCompactionStrategy {
+	if opts.Level0CompactionTrigger <= 0 {
+		opts.Level0CompactionTrigger = DEFAULT_LEVEL0_COMPACTION_TRIGGER
+	}
+	if opts.LevelBaseSize <= 0 {
+		opts.LevelBaseSize = DEFAULT_LEVEL_BASE_SIZE
+	}
+	if opts.LevelSizeMultiplier <= 1 {
+		opts.LevelSizeMultiplier = DEFAULT_LEVEL_SIZE_MULTIPLIER
+	}
+	if opts.MaxLevels < 2 {
+		opts.MaxLevels = DEFAULT_MAX_LEVELS
+	}
+	if opts.TargetDiskBlockSize <= 0 {
+		opts.TargetDiskBlockSize = DEFAULT_TARGET_DISK_BLOCK_SIZE
+	}
+
+	return &LeveledCompactionStrategy{
+		opts:              opts,
+		compactionPointer: map[int][]byte{},
+	}
+}
+
+func (s *LeveledCompactionStrategy) Pick(levels [][]*DiskBlock) *CompactionTask {
+	if len(levels) > 0 && len(levels[0]) >= s.opts.Level0CompactionTrigger {
+		inputs := make([]*DiskBlock, 0, len(levels[0]))
+		for i := len(levels[0]) - 1; i >= 0; i-- {
+			inputs = append(inputs, levels[0][i])
+		}
+
+		return s.taskFor(levels, inputs, 1)
+	}
+
+	bestLevel, bestScore := -1, 1.0
+	maxSize := float64(s.opts.LevelBaseSize)
+
+	for level := 1; level < len(levels) && level < s.opts.MaxLevels-1; level++ {
+		score := float64(levelSize(levels[level])) / maxSize
+		if score > bestScore {
+			bestLevel, bestScore = level, score
+		}
+		maxSize *= float64(s.opts.LevelSizeMultiplier)
+	}
+
+	if bestLevel == -1 {
+		return nil
+	}
+
+	// take the first block after the one merged last time, wrapping around
+	candidates := levels[bestLevel]
+	picked := candidates[0]
+	for _, candidate := range candidates {
+		if bytes.Compare(candidate.MinKey, s.compactionPointer[bestLevel]) > 0 {
+			picked = candidate
+			break
+		}
+	}
+	s.compactionPointer[bestLevel] = picked.MaxKey
+
+	return s.taskFor(levels, []*DiskBlock{picked}, bestLevel+1)
+}
+
+// taskFor adds the blocks of the output level that overlap the inputs, since
+// the output level has to stay free of overlapping key ranges.
+func (s *LeveledCompactionStrategy) taskFor(levels [][]*DiskBlock, inputs []*DiskBlock, outputLevel int) *CompactionTask {
+	minKey, maxKey := keyRange(inputs)
+
+	if outputLevel < len(levels) {
+		for _, diskBlock := range levels[outputLevel] {
+			if diskBlock.Overlaps(minKey, maxKey) {
+				inputs = append(inputs, diskBlock)
+			}
+		}
+	}
+
+	minKey, maxKey = keyRange(inputs)
+
+	return &CompactionTask{
+		Inputs:              inputs,
+		OutputLevel:         outputLevel,
+		DropTombstones:      !overlapsBelow(levels, outputLevel, minKey, maxKey),
+		TargetDiskBlockSize: s.opts.TargetDiskBlockSize,
+	}
+}
+
+func levelSize(diskBlocks []*DiskBlock) int64 {
+	var size int64
+	for _, diskBlock := range diskBlocks {
+		size += diskBlock.Size
+	}
+	return size
+}
+
+func keyRange(diskBlocks []*DiskBlock) ([]byte, []byte) {
+	var minKey, maxKey []byte
+	first := true
+
+	for _, diskBlock := range diskBlocks {
+		if diskBlock.Empty() {
+			continue
+		}
+		if first || bytes.Compare(diskBlock.MinKey, minKey) < 0 {
+			minKey = diskBlock.MinKey
+		}
+		if first || bytes.Compare(diskBlock.MaxKey, maxKey) > 0 {
+			maxKey = diskBlock.MaxKey
+		}
+		first = false
+	}
+
+	return minKey, maxKey
+}
+
+// overlapsBelow reports whether any level after level holds keys in range.
+func overlapsBelow(levels [][]*DiskBlock, level int, minKey []byte, maxKey []byte) bool {
+	for i := level + 1; i < len(levels); i++ {
+		for _, diskBlock := range levels[i] {
+			if diskBlock.Overlaps(minKey, maxKey) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compactionThrottle keeps a compaction under its I/O and CPU budget. The
+// I/O budget is a number of bytes read and written per second, the CPU
+// budget is the share of one core the merge may keep busy.
+type compactionThrottle struct {
+	maxBytesPerSecond int
+	maxCPUPercent     int
+	start             time.Time
+	lastWake          time.Time
+	bytes             int64
+	busy              time.Duration
+}
+
+func newCompactionThrottle(maxBytesPerSecond int, maxCPUPercent int) *compactionThrottle {
+	now := time.Now()
+	return &compactionThrottle{
+		maxBytesPerSecond: maxBytesPerSecond,
+		maxCPUPercent:     maxCPUPercent,
+		start:             now,
+		lastWake:          now,
+	}
+}
+
+// account records n bytes of compaction I/O and sleeps when the worker has
+// run ahead of its budget. A nil throttle never sleeps.
+func (t *compactionThrottle) account(n int64) {
+	if t == nil {
+		return
+	}
+
+	t.busy += time.Since(t.lastWake)
+
+	if t.maxCPUPercent > 0 && t.maxCPUPercent < 100 && t.busy >= 10*time.Millisecond {
+		time.Sleep(t.busy * time.Duration(100-t.maxCPUPercent) / time.Duration(t.maxCPUPercent))
+		t.busy = 0
+	}
+
+	if t.maxBytesPerSecond > 0 {
+		t.bytes += n
+		expected := time.Duration(float64(t.bytes) / float64(t.maxBytesPerSecond) * float64(time.Second))
+		if elapsed := time.Since(t.start); expected > elapsed {
+			time.Sleep(expected - elapsed)
+		}
+	}
+
+	t.lastWake = time.Now()
+}
+
+// runCompaction merges the inputs of the task into new blocks and installs
+// them in place of the inputs.
+func (lsmTree *LSMTree) runCompaction(task *CompactionTask) error {
+	throttle := newCompactionThrottle(lsmTree.compactionOpts.MaxBytesPerSecond, lsmTree.compactionOpts.MaxCPUPercent)
+
+	iterators := make([]*diskBlockIterator, len(task.Inputs))
+	for i, input := range task.Inputs {
+		iterators[i] = input.newIterator(throttle)
+		iterators[i].seekToFirst()
+	}
+
+	var outputs []*DiskBlock
+	var writer *diskBlockWriter
+
+	abort := func(err error) error {
+		if writer != nil {
+			writer.abort()
+		}
+		for _, output := range outputs {
+			output.Remove()
+		}
+		return err
+	}
+
+	snapshots := lsmTree.activeSnapshots()
+	now := time.Now()
+
+	for {
+		// the smallest key across the inputs
+		smallest := -1
+		for i, it := range iterators {
+			if it.err != nil {
+				return abort(it.err)
+			}
+			if it.valid() && (smallest == -1 || bytes.Compare(it.pair().Key, iterators[smallest].pair().Key) < 0) {
+				smallest = i
+			}
+		}
+
+		if smallest == -1 {
+			break
+		}
+
+		// gather every version of the key, the earliest input holds the
+		// newest ones
+		key := iterators[smallest].pair().Key
+		versions := []Pair{}
+		for _, it := range iterators {
+			for it.valid() && bytes.Equal(it.pair().Key, key) {
+				versions = append(versions, it.pair())
+				it.next()
+			}
+		}
+
+		sort.SliceStable(versions, func(i, j int) bool {
+			return versions[i].Seq > versions[j].Seq
+		})
+
+		// an expired pair reads the same as a delete, so it is turned into
+		// a tombstone that shadows older versions until it can be dropped
+		for i := range versions {
+			if versions[i].Expired(now) {
+				versions[i] = Pair{Key: versions[i].Key, Tombstone: true, Seq: versions[i].Seq}
+			}
+		}
+
+		versions = retainVersions(versions, snapshots, task.DropTombstones)
+		if len(versions) == 0 {
+			continue
+		}
+
+		if writer == nil {
+			var err error
+			writer, err = newDiskBlockWriter(lsmTree.nextDiskBlockPath(), throttle)
+			if err != nil {
+				return abort(err)
+			}
+		}
+
+		for _, version := range versions {
+			if err := writer.add(version); err != nil {
+				return abort(err)
+			}
+		}
+
+		if task.TargetDiskBlockSize > 0 && writer.size() >= task.TargetDiskBlockSize {
+			output, err := writer.finish()
+			writer = nil
+			if err != nil {
+				return abort(err)
+			}
+			outputs = append(outputs, output)
+		}
+	}
+
+	if writer != nil {
+		output, err := writer.finish()
+		writer = nil
+		if err != nil {
+			return abort(err)
+		}
+		outputs = append(outputs, output)
+	}
+
+	if err := lsmTree.installCompaction(task, outputs); err != nil {
+		return abort(err)
+	}
+
+	for _, input := range task.Inputs {
+		input.Remove()
+	}
+
+	return nil
+}
@@ -1,155 +1,505 @@
 package LsmTree
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"sync"
+
+	fileutil "github.com/Avash027/midDB/internal/file_util"
 )
 
 const (
 	MAX_ELEMENTS_IN_DISK_BLOCK = 1024
 	INDEX_RATIO                = 10
+	DISK_BLOCK_EXTENSION       = ".sst"
+	DISK_BLOCK_FOOTER_SIZE     = 16
+	DISK_BLOCK_MAGIC           = 0x6d696432 // "mid2"
 )
 
+// DiskBlock is an immutable sorted table stored in its own file.
+//
+// The file is laid out as a sequence of gob encoded groups of about
+// INDEX_RATIO pairs, followed by the gob encoded sparse index and a fixed
+// size footer:
+//
+//	| group 0 | group 1 | ... | index | index offset (8) | elements (4) | magic (4) |
+//
+// Every group is encoded with a fresh gob encoder so it can be decoded on
+// its own, starting at the offset stored for it in the index. Pairs are
+// sorted by key and then from the newest version to the oldest, and all
+// versions of a key are kept in the same group.
 type DiskBlock struct {
 	index         *TreeNode
 	NumOfElements int
-	buffer        bytes.Buffer
+	Path          string
+	MinKey        []byte
+	MaxKey        []byte
+	Size          int64
+	file          *os.File
+	dataSize      int64
+	// iterators keep a reference so a compaction does not delete the file
+	// while it is still being read
+	refLock  sync.Mutex
+	refs     int
+	obsolete bool
 }
 
-func NewDiskBlock(elements []Pair) DiskBlock {
-	diskBlock := DiskBlock{NumOfElements: len(elements)}
-	indexElements := make([]Pair, 0)
-	var encoder *gob.Encoder
+type countingWriter struct {
+	writer io.Writer
+	n      int64
+}
 
-	for i, element := range elements {
-		if i%INDEX_RATIO == 0 {
-			idx := Pair{Key: element.Key, Value: fmt.Sprintf("%d", diskBlock.buffer.Len())}
-			indexElements = append(indexElements, idx)
-			encoder = gob.NewEncoder(&diskBlock.buffer)
-		}
-		encoder.Encode(element)
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// diskBlockWriter streams sorted pairs into a new block file. The file is
+// written to a temporary name and renamed once it is synced, so a crash
+// never leaves a partially written block behind.
+type diskBlockWriter struct {
+	path          string
+	file          *os.File
+	buffered      *bufio.Writer
+	writer        *countingWriter
+	encoder       *gob.Encoder
+	indexElements []Pair
+	numOfElements int
+	groupSize     int
+	lastKey       []byte
+	throttle      *compactionThrottle
+}
+
+func newDiskBlockWriter(path string, throttle *compactionThrottle) (*diskBlockWriter, error) {
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
 	}
-	diskBlock.index = NewTreeNode(indexElements)
-	return diskBlock
 
+	buffered := bufio.NewWriter(file)
+
+	return &diskBlockWriter{
+		path:          path,
+		file:          file,
+		buffered:      buffered,
+		writer:        &countingWriter{writer: buffered},
+		indexElements: []Pair{},
+		throttle:      throttle,
+	}, nil
 }
 
-func (d *DiskBlock) GetDataFromDiskBlock(key string) (Pair, error) {
-	if d.Empty() {
-		return Pair{}, fmt.Errorf("DiskBlock is empty")
+// add appends a pair. Pairs must be added in increasing key order, and the
+// versions of a key from the newest to the oldest.
+func (w *diskBlockWriter) add(pair Pair) error {
+	before := w.writer.n
+
+	if w.numOfElements == 0 || (w.groupSize >= INDEX_RATIO && !bytes.Equal(pair.Key, w.lastKey)) {
+		idx := Pair{Key: pair.Key, Value: []byte(strconv.FormatInt(w.writer.n, 10))}
+		w.indexElements = append(w.indexElements, idx)
+		w.encoder = gob.NewEncoder(w.writer)
+		w.groupSize = 0
 	}
 
-	start_, err := d.index.GreatestKeyLessThanOrEqualTo(key)
+	if err := w.encoder.Encode(pair); err != nil {
+		return err
+	}
+
+	w.numOfElements++
+	w.groupSize++
+	w.lastKey = pair.Key
+	w.throttle.account(w.writer.n - before)
+
+	return nil
+}
+
+func (w *diskBlockWriter) size() int64 {
+	return w.writer.n
+}
+
+func (w *diskBlockWriter) finish() (*DiskBlock, error) {
+	indexOffset := w.writer.n
+	if err := gob.NewEncoder(w.writer).Encode(w.indexElements); err != nil {
+		w.abort()
+		return nil, err
+	}
+
+	footer := make([]byte, DISK_BLOCK_FOOTER_SIZE)
+	binary.LittleEndian.PutUint64(footer[0:8], uint64(indexOffset))
+	binary.LittleEndian.PutUint32(footer[8:12], uint32(w.numOfElements))
+	binary.LittleEndian.PutUint32(footer[12:16], DISK_BLOCK_MAGIC)
+
+	if _, err := w.writer.Write(footer); err != nil {
+		w.abort()
+		return nil, err
+	}
+
+	if err := w.buffered.Flush(); err != nil {
+		w.abort()
+		return nil, err
+	}
+
+	if err := w.file.Sync(); err != nil {
+		w.abort()
+		return nil, err
+	}
+
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.path + ".tmp")
+		return nil, err
+	}
+
+	if err := os.Rename(w.path+".tmp", w.path); err != nil {
+		os.Remove(w.path + ".tmp")
+		return nil, err
+	}
+
+	if err := fileutil.SyncDir(filepath.Dir(w.path)); err != nil {
+		os.Remove(w.path)
+		return nil, err
+	}
+
+	return OpenDiskBlock(w.path)
+}
+
+func (w *diskBlockWriter) abort() {
+	w.file.Close()
+	os.Remove(w.path + ".tmp")
+}
 
+// NewDiskBlock writes the sorted elements to a new file at path and returns
+// the opened block.
+func NewDiskBlock(path string, elements []Pair) (*DiskBlock, error) {
+	writer, err := newDiskBlockWriter(path, nil)
 	if err != nil {
-		return Pair{}, err
+		return nil, err
 	}
 
-	startIndex, _ := strconv.Atoi(start_.Value)
+	for _, element := range elements {
+		if err := writer.add(element); err != nil {
+			writer.abort()
+			return nil, err
+		}
+	}
 
-	end_, err := d.index.SmallestKeyGreaterThan(key)
+	return writer.finish()
+}
 
+// OpenDiskBlock opens an existing block file and loads its sparse index.
+// The data itself stays on disk and is read on demand.
+func OpenDiskBlock(path string) (*DiskBlock, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		return Pair{}, err
+		return nil, err
 	}
 
-	endIndex, _ := strconv.Atoi(end_.Value)
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
 
-	searchBuffer := bytes.NewBuffer(d.buffer.Bytes()[startIndex:endIndex])
-	dec := gob.NewDecoder(searchBuffer)
+	if stat.Size() < DISK_BLOCK_FOOTER_SIZE {
+		file.Close()
+		return nil, fmt.Errorf("disk block %s is too small", path)
+	}
 
-	for {
-		var pair Pair
-		if err := dec.Decode(&pair); err == io.EOF {
-			break
-		} else if err != nil {
-			return Pair{}, err
-		}
+	footer := make([]byte, DISK_BLOCK_FOOTER_SIZE)
+	if _, err := file.ReadAt(footer, stat.Size()-DISK_BLOCK_FOOTER_SIZE); err != nil {
+		file.Close()
+		return nil, err
+	}
 
-		if pair.Key == key {
-			return pair, nil
-		}
+	magic := binary.LittleEndian.Uint32(footer[12:16])
+	if magic != DISK_BLOCK_MAGIC {
+		file.Close()
+		return nil, fmt.Errorf("disk block %s has an invalid footer", path)
 	}
 
-	return Pair{}, fmt.Errorf("key not found")
+	indexOffset := int64(binary.LittleEndian.Uint64(footer[0:8]))
+	numOfElements := int(binary.LittleEndian.Uint32(footer[8:12]))
+	indexSize := stat.Size() - DISK_BLOCK_FOOTER_SIZE - indexOffset
 
-}
+	if indexOffset < 0 || indexSize < 0 {
+		file.Close()
+		return nil, fmt.Errorf("disk block %s has an invalid index offset", path)
+	}
 
-func (d *DiskBlock) All() []Pair {
-	indexElems := d.index.All()
-	var pairs []Pair
+	var indexElements []Pair
+	indexReader := io.NewSectionReader(file, indexOffset, indexSize)
+
+	if err := gob.NewDecoder(indexReader).Decode(&indexElements); err != nil {
+		file.Close()
+		return nil, err
+	}
 
-	for i, indexElem := range indexElems {
-		startIndex, _ := strconv.Atoi(indexElem.Value)
-		endIndex := d.buffer.Len()
+	diskBlock := &DiskBlock{
+		index:         NewTreeNode(indexElements),
+		NumOfElements: numOfElements,
+		Path:          path,
+		Size:          stat.Size(),
+		file:          file,
+		dataSize:      indexOffset,
+	}
+
+	// the key range is needed to place the block in a level, the largest key
+	// is the last pair of the last group
+	if len(indexElements) > 0 {
+		diskBlock.MinKey = indexElements[0].Key
 
-		if i < len(indexElems)-1 {
-			endIndex, _ = strconv.Atoi(indexElems[i+1].Value)
+		startIndex, _ := strconv.ParseInt(string(indexElements[len(indexElements)-1].Value), 10, 64)
+		pairs, err := diskBlock.readGroup(startIndex, indexOffset)
+		if err != nil {
+			file.Close()
+			return nil, err
 		}
-		dec := gob.NewDecoder(bytes.NewBuffer(d.buffer.Bytes()[startIndex:endIndex]))
+		diskBlock.MaxKey = pairs[len(pairs)-1].Key
+	}
+
+	return diskBlock, nil
+}
+
+// readGroup decodes the pairs stored between the two offsets using a
+// positioned read, so concurrent readers do not share a file cursor.
+func (d *DiskBlock) readGroup(startIndex int64, endIndex int64) ([]Pair, error) {
+	buf := make([]byte, endIndex-startIndex)
+
+	if _, err := d.file.ReadAt(buf, startIndex); err != nil {
+		return nil, err
+	}
+
+	dec := gob.NewDecoder(bytes.NewReader(buf))
+	var pairs []Pair
+
+	for {
 		var pair Pair
+		err := dec.Decode(&pair)
 
-		for dec.Decode(&pair) == nil {
-			pairs = append(pairs, pair)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
 		}
+		pairs = append(pairs, pair)
 	}
 
-	return pairs
+	return pairs, nil
+}
+
+func (d *DiskBlock) GetDataFromDiskBlock(key []byte) (Pair, error) {
+	return d.getVersion(key, MAX_SEQ)
 }
 
-func (d *DiskBlock) Del(key string) error {
+// getVersion returns the newest version of key written up to seq.
+func (d *DiskBlock) getVersion(key []byte, seq uint64) (Pair, error) {
 	if d.Empty() {
-		return nil
+		return Pair{}, fmt.Errorf("DiskBlock is empty")
 	}
 
 	start_, err := d.index.GreatestKeyLessThanOrEqualTo(key)
 
 	if err != nil {
-		return err
+		return Pair{}, err
 	}
 
-	startIndex, _ := strconv.Atoi(start_.Value)
+	startIndex, _ := strconv.ParseInt(string(start_.Value), 10, 64)
+	endIndex := d.dataSize
 
 	end_, err := d.index.SmallestKeyGreaterThan(key)
 
+	if err == nil {
+		endIndex, _ = strconv.ParseInt(string(end_.Value), 10, 64)
+	}
+
+	pairs, err := d.readGroup(startIndex, endIndex)
+
 	if err != nil {
-		return err
+		return Pair{}, err
 	}
 
-	endIndex, _ := strconv.Atoi(end_.Value)
+	for _, pair := range pairs {
+		if bytes.Equal(pair.Key, key) && pair.Seq <= seq {
+			return pair, nil
+		}
+	}
 
-	searchBuffer := bytes.NewBuffer(d.buffer.Bytes()[startIndex:endIndex])
-	dec := gob.NewDecoder(searchBuffer)
+	return Pair{}, fmt.Errorf("key not found")
 
-	var pairs []Pair
+}
 
-	for {
-		var pair Pair
-		if err := dec.Decode(&pair); err == io.EOF {
-			break
-		} else if err != nil {
-			return err
+// Overlaps reports whether the block may hold keys in [minKey, maxKey].
+func (d *DiskBlock) Overlaps(minKey []byte, maxKey []byte) bool {
+	return !d.Empty() && bytes.Compare(d.MinKey, maxKey) <= 0 && bytes.Compare(d.MaxKey, minKey) >= 0
+}
+
+// diskBlockIterator walks the pairs of a block in key order, reading one
+// group at a time.
+type diskBlockIterator struct {
+	block     *DiskBlock
+	index     []Pair
+	nextGroup int
+	pairs     []Pair
+	position  int
+	throttle  *compactionThrottle
+	err       error
+}
+
+// newIterator returns an unpositioned iterator, call seekToFirst or seek
+// before reading from it.
+func (d *DiskBlock) newIterator(throttle *compactionThrottle) *diskBlockIterator {
+	return &diskBlockIterator{
+		block:    d,
+		index:    d.index.All(),
+		throttle: throttle,
+	}
+}
+
+func (it *diskBlockIterator) seekToFirst() {
+	it.nextGroup = 0
+	it.err = nil
+	it.loadNextGroup()
+}
+
+// seek positions the iterator at the first pair whose key is not smaller
+// than key, starting from the group the sparse index points to.
+func (it *diskBlockIterator) seek(key []byte) {
+	it.nextGroup = sort.Search(len(it.index), func(i int) bool {
+		return bytes.Compare(it.index[i].Key, key) > 0
+	}) - 1
+	if it.nextGroup < 0 {
+		it.nextGroup = 0
+	}
+
+	it.err = nil
+	it.loadNextGroup()
+
+	for it.valid() && bytes.Compare(it.pair().Key, key) < 0 {
+		it.next()
+	}
+}
+
+func (it *diskBlockIterator) loadNextGroup() {
+	it.pairs = nil
+	it.position = 0
+
+	for it.nextGroup < len(it.index) {
+		startIndex, _ := strconv.ParseInt(string(it.index[it.nextGroup].Value), 10, 64)
+		endIndex := it.block.dataSize
+
+		if it.nextGroup < len(it.index)-1 {
+			endIndex, _ = strconv.ParseInt(string(it.index[it.nextGroup+1].Value), 10, 64)
+		}
+		it.nextGroup++
+
+		pairs, err := it.block.readGroup(startIndex, endIndex)
+		if err != nil {
+			it.err = err
+			return
 		}
+		it.throttle.account(endIndex - startIndex)
 
-		if pair.Key != key {
-			pairs = append(pairs, pair)
+		if len(pairs) > 0 {
+			it.pairs = pairs
+			return
 		}
 	}
+}
+
+func (it *diskBlockIterator) valid() bool {
+	return it.position < len(it.pairs)
+}
 
-	d.buffer.Reset()
+func (it *diskBlockIterator) pair() Pair {
+	return it.pairs[it.position]
+}
 
-	for _, pair := range pairs {
-		encoder := gob.NewEncoder(&d.buffer)
-		encoder.Encode(pair)
+func (it *diskBlockIterator) next() {
+	it.position++
+	if it.position >= len(it.pairs) {
+		it.loadNextGroup()
 	}
+}
 
-	d.NumOfElements--
-	return nil
+func (it *diskBlockIterator) status() error {
+	return it.err
+}
+
+// forEach calls fn for every pair in the block in key order. It stops early
+// if fn returns false.
+func (d *DiskBlock) forEach(fn func(Pair) bool) error {
+	it := d.newIterator(nil)
+
+	for it.seekToFirst(); it.valid(); it.next() {
+		if !fn(it.pair()) {
+			return nil
+		}
+	}
+
+	return it.err
+}
+
+func (d *DiskBlock) All() []Pair {
+	pairs := make([]Pair, 0, d.NumOfElements)
+
+	err := d.forEach(func(pair Pair) bool {
+		pairs = append(pairs, pair)
+		return true
+	})
+
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	return pairs
 }
 
 func (d *DiskBlock) Empty() bool {
 	return d.NumOfElements == 0
 }
+
+func (d *DiskBlock) Close() error {
+	return d.file.Close()
+}
+
+func (d *DiskBlock) ref() {
+	d.refLock.Lock()
+	d.refs++
+	d.refLock.Unlock()
+}
+
+func (d *DiskBlock) unref() {
+	d.refLock.Lock()
+	d.refs--
+	release := d.refs == 0 && d.obsolete
+	d.refLock.Unlock()
+
+	if release {
+		d.file.Close()
+		os.Remove(d.Path)
+	}
+}
+
+// Remove closes the block and deletes its file. It must only be called once
+// the block is no longer reachable through the levels, if an iterator still
+// holds the block the file is deleted when the iterator is closed.
+func (d *DiskBlock) Remove() error {
+	d.refLock.Lock()
+	d.obsolete = true
+	inUse := d.refs > 0
+	d.refLock.Unlock()
+
+	if inUse {
+		return nil
+	}
+
+	d.file.Close()
+	return os.Remove(d.Path)
+}
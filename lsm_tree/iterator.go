@@ -0,0 +1,292 @@
+package LsmTree
+
+import (
+	"bytes"
+	"sort"
+	"time"
+)
+
+// iteratorSource is one sorted input of an Iterator.
+type iteratorSource interface {
+	seek(key []byte)
+	valid() bool
+	pair() Pair
+	next()
+	status() error
+}
+
+// Iterator walks the live keys of the tree in increasing order. It merges
+// the memtable, the tree being flushed and every disk block, the newest
+// version of a key up to the sequence number of the iterator wins and
+// deleted keys, as well as keys that had expired when the iterator was
+// created, are skipped.
+//
+// The memtables are copied when the iterator is created and disk blocks are
+// kept alive until Close, so the iterator is not affected by later writes,
+// flushes or compactions.
+//
+//	it := lsmTree.NewIterator()
+//	defer it.Close()
+//	for it.Seek(start); it.Valid(); it.Next() {
+//		fmt.Printf("%s %s\n", it.Key(), it.Value())
+//	}
+type Iterator struct {
+	seq        uint64
+	sources    []iteratorSource
+	diskBlocks []*DiskBlock
+	current    Pair
+	valid      bool
+	err        error
+	closed     bool
+	now        time.Time
+}
+
+func (lsmTree *LSMTree) NewIterator() *Iterator {
+	return lsmTree.newIterator(MAX_SEQ)
+}
+
+func (lsmTree *LSMTree) newIterator(seq uint64) *Iterator {
+	it := &Iterator{seq: seq, now: time.Now()}
+
+	// the sources are ordered from the newest data to the oldest
+	lsmTree.treereadWriteLock.RLock()
+	it.sources = append(it.sources,
+		&sliceIterator{pairs: lsmTree.tree.AllVersions()},
+		&sliceIterator{pairs: lsmTree.secondaryTree.AllVersions()},
+	)
+	lsmTree.treereadWriteLock.RUnlock()
+
+	lsmTree.diskReadWriteLock.RLock()
+	for level, diskBlocks := range lsmTree.levels {
+		for _, diskBlock := range diskBlocks {
+			diskBlock.ref()
+			it.diskBlocks = append(it.diskBlocks, diskBlock)
+		}
+
+		if level == 0 {
+			for i := len(diskBlocks) - 1; i >= 0; i-- {
+				it.sources = append(it.sources, diskBlocks[i].newIterator(nil))
+			}
+		} else if len(diskBlocks) > 0 {
+			it.sources = append(it.sources, &levelIterator{diskBlocks: append([]*DiskBlock{}, diskBlocks...)})
+		}
+	}
+	lsmTree.diskReadWriteLock.RUnlock()
+
+	return it
+}
+
+// Seek positions the iterator at the first live key that is not smaller
+// than key.
+func (it *Iterator) Seek(key []byte) {
+	if it.closed {
+		it.valid = false
+		return
+	}
+
+	for _, source := range it.sources {
+		source.seek(key)
+	}
+
+	it.findNext()
+}
+
+func (it *Iterator) SeekToFirst() {
+	it.Seek(nil)
+}
+
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+func (it *Iterator) Next() {
+	if !it.valid {
+		return
+	}
+
+	it.findNext()
+}
+
+func (it *Iterator) Key() []byte {
+	return it.current.Key
+}
+
+func (it *Iterator) Value() []byte {
+	return it.current.Value
+}
+
+// ExpiresAt returns the expiry time of the current key in unix
+// milliseconds, 0 when it never expires.
+func (it *Iterator) ExpiresAt() int64 {
+	return it.current.ExpiresAt
+}
+
+// Err returns the first error hit while reading a disk block.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the disk blocks held by the iterator.
+func (it *Iterator) Close() {
+	if it.closed {
+		return
+	}
+
+	it.closed = true
+	it.valid = false
+
+	for _, diskBlock := range it.diskBlocks {
+		diskBlock.unref()
+	}
+	it.diskBlocks = nil
+}
+
+// findNext moves to the smallest key across the sources that has a visible
+// version which is not a tombstone. Every source is positioned after the
+// current key. The sources and the versions within a source are ordered from
+// the newest to the oldest, so the first version up to seq is the visible one.
+func (it *Iterator) findNext() {
+	for {
+		smallest := -1
+
+		for i, source := range it.sources {
+			if err := source.status(); err != nil {
+				it.err = err
+				it.valid = false
+				return
+			}
+			if source.valid() && (smallest == -1 || bytes.Compare(source.pair().Key, it.sources[smallest].pair().Key) < 0) {
+				smallest = i
+			}
+		}
+
+		if smallest == -1 {
+			it.valid = false
+			return
+		}
+
+		key := it.sources[smallest].pair().Key
+		var visible Pair
+		found := false
+
+		for _, source := range it.sources {
+			for source.valid() && bytes.Equal(source.pair().Key, key) {
+				if !found && source.pair().Seq <= it.seq {
+					visible = source.pair()
+					found = true
+				}
+				source.next()
+			}
+		}
+
+		if !found || visible.Tombstone || visible.Expired(it.now) {
+			continue
+		}
+
+		it.current = visible
+		it.valid = true
+		return
+	}
+}
+
+// PrefixEnd returns the smallest key that is greater than every key starting
+// with prefix, or nil when there is no such key.
+func PrefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	return nil
+}
+
+type sliceIterator struct {
+	pairs    []Pair
+	position int
+}
+
+func (it *sliceIterator) seek(key []byte) {
+	it.position = sort.Search(len(it.pairs), func(i int) bool {
+		return bytes.Compare(it.pairs[i].Key, key) >= 0
+	})
+}
+
+func (it *sliceIterator) valid() bool {
+	return it.position < len(it.pairs)
+}
+
+func (it *sliceIterator) pair() Pair {
+	return it.pairs[it.position]
+}
+
+func (it *sliceIterator) next() {
+	it.position++
+}
+
+func (it *sliceIterator) status() error {
+	return nil
+}
+
+// levelIterator walks a level after level 0, where the blocks are sorted and
+// do not overlap, one block after the other.
+type levelIterator struct {
+	diskBlocks []*DiskBlock
+	current    int
+	it         *diskBlockIterator
+	err        error
+}
+
+func (l *levelIterator) seek(key []byte) {
+	l.err = nil
+	l.current = sort.Search(len(l.diskBlocks), func(i int) bool {
+		return bytes.Compare(l.diskBlocks[i].MaxKey, key) >= 0
+	})
+	l.it = nil
+
+	if l.current < len(l.diskBlocks) {
+		l.it = l.diskBlocks[l.current].newIterator(nil)
+		l.it.seek(key)
+	}
+
+	l.skipExhausted()
+}
+
+// skipExhausted moves on to the next block once the current one is done.
+func (l *levelIterator) skipExhausted() {
+	for l.it != nil && !l.it.valid() {
+		if err := l.it.status(); err != nil {
+			l.err = err
+			return
+		}
+
+		l.current++
+		if l.current >= len(l.diskBlocks) {
+			l.it = nil
+			return
+		}
+
+		l.it = l.diskBlocks[l.current].newIterator(nil)
+		l.it.seekToFirst()
+	}
+}
+
+func (l *levelIterator) valid() bool {
+	return l.it != nil && l.it.valid()
+}
+
+func (l *levelIterator) pair() Pair {
+	return l.it.pair()
+}
+
+func (l *levelIterator) next() {
+	l.it.next()
+	l.skipExhausted()
+}
+
+func (l *levelIterator) status() error {
+	return l.err
+}
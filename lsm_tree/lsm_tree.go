@@ -1,7 +1,13 @@
 package LsmTree
 
 import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -9,36 +15,88 @@ const DEFAULT_MAX_ELEMENTS_BEFORE_FLUSH = 1024
 const DEFAULT_COMPACTION_FREQUENCY = 1000
 const DEFAULT_BLOOM_FILTER_ERROR_RATE = 0.0001
 const DEFAULT_BLOOM_FILTER_CAPACITY = 1000000
+const DEFAULT_SSTABLE_DIRECTORY = "./data/sstables"
 
+// Pair is one version of a key. Seq is the sequence number of the write
+// that created it, every write gets a higher one than the writes before it.
+// ExpiresAt is the unix time in milliseconds after which the pair reads as
+// deleted, zero means it never expires.
 type Pair struct {
-	Key       string
-	Value     string
+	Key       []byte
+	Value     []byte
 	Tombstone bool
+	Seq       uint64
+	ExpiresAt int64
+}
+
+// Expired reports whether the pair has an expiry time that has passed.
+func (pair Pair) Expired(now time.Time) bool {
+	return pair.ExpiresAt != 0 && pair.ExpiresAt <= now.UnixMilli()
 }
 
 type LSMTree struct {
 	treereadWriteLock      sync.RWMutex
 	diskReadWriteLock      sync.RWMutex
+	flushLock              sync.Mutex
 	tree                   *TreeNode
 	secondaryTree          *TreeNode
-	diskBlocks             []DiskBlock
+	levels                 [][]*DiskBlock
+	directory              string
+	nextBlockID            uint64
+	compactionOpts         CompactionOpts
+	compactionStrategy     CompactionStrategy
+	lastSeq                uint64
+	snapshotLock           sync.Mutex
+	snapshots              map[uint64]int
 	MaxElementsBeforeFlush int
 	BloomFilter            *BloomFilter
+	// memtableSize and secondarySize are the bytes of keys and values
+	// written to tree and secondaryTree, overwritten versions included
+	memtableSize  int64
+	secondarySize int64
+	// done stops the compaction worker, which holds compactionLock while
+	// it works
+	done           chan struct{}
+	closeOnce      sync.Once
+	compactionLock sync.Mutex
 }
 
 type LSMTreeOpts struct {
 	MaxElementsBeforeFlush int
 	CompactionPeriod       int
+	Directory              string
+	CompactionOpts         CompactionOpts
 	BloomFilterOpts        BloomFilterOpts
 }
 
 func InitNewLSMTree(opts LSMTreeOpts) *LSMTree {
+	directory := opts.Directory
+	if directory == "" {
+		directory = DEFAULT_SSTABLE_DIRECTORY
+	}
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		panic(err)
+	}
+
+	compactionStrategy, err := newCompactionStrategy(opts.CompactionOpts)
+	if err != nil {
+		panic(err)
+	}
+
 	lsmTree := &LSMTree{
-		tree:                   &TreeNode{},
-		secondaryTree:          &TreeNode{},
-		diskBlocks:             []DiskBlock{},
+		levels:                 [][]*DiskBlock{{}},
+		directory:              directory,
+		compactionOpts:         opts.CompactionOpts,
+		compactionStrategy:     compactionStrategy,
+		snapshots:              map[uint64]int{},
 		MaxElementsBeforeFlush: opts.MaxElementsBeforeFlush,
 		BloomFilter:            CreateBloomFilter(opts.BloomFilterOpts),
+		done:                   make(chan struct{}),
+	}
+
+	if err := lsmTree.openDiskBlocks(); err != nil {
+		panic(err)
 	}
 
 	go lsmTree.PeriodicCompaction(opts.CompactionPeriod)
@@ -46,155 +104,449 @@ func InitNewLSMTree(opts LSMTreeOpts) *LSMTree {
 
 }
 
+// openDiskBlocks reopens the blocks listed in the manifest and seeds the
+// bloom filter with their keys, so a restart does not need to replay the
+// whole dataset through Put. New writes continue after the highest sequence
+// number found on disk.
+func (lsmTree *LSMTree) openDiskBlocks() error {
+	entries, err := readManifest(lsmTree.directory)
+	if err != nil {
+		return err
+	}
+
+	live := make(map[string]bool, len(entries))
+
+	for _, entry := range entries {
+		diskBlock, err := OpenDiskBlock(filepath.Join(lsmTree.directory, entry.Name))
+		if err != nil {
+			return err
+		}
+
+		err = diskBlock.forEach(func(pair Pair) bool {
+			lsmTree.BloomFilter.Add(pair.Key)
+			if pair.Seq > lsmTree.lastSeq {
+				lsmTree.lastSeq = pair.Seq
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+
+		for len(lsmTree.levels) <= entry.Level {
+			lsmTree.levels = append(lsmTree.levels, []*DiskBlock{})
+		}
+		lsmTree.levels[entry.Level] = append(lsmTree.levels[entry.Level], diskBlock)
+		live[entry.Name] = true
+
+		if id, ok := diskBlockID(entry.Name); ok && id >= lsmTree.nextBlockID {
+			lsmTree.nextBlockID = id + 1
+		}
+	}
+
+	return removeOrphanedBlocks(lsmTree.directory, live)
+}
+
+func (lsmTree *LSMTree) nextDiskBlockPath() string {
+	id := atomic.AddUint64(&lsmTree.nextBlockID, 1) - 1
+	return filepath.Join(lsmTree.directory, diskBlockName(id))
+}
+
+// writeManifest must be called with diskReadWriteLock held for writing.
+func (lsmTree *LSMTree) writeManifest() error {
+	entries := []manifestEntry{}
+	for level, diskBlocks := range lsmTree.levels {
+		for _, diskBlock := range diskBlocks {
+			entries = append(entries, manifestEntry{Level: level, Name: filepath.Base(diskBlock.Path)})
+		}
+	}
+
+	return writeManifest(lsmTree.directory, entries)
+}
+
+// NumOfDiskBlocks returns the number of blocks that are currently on disk.
+func (lsmTree *LSMTree) NumOfDiskBlocks() int {
+	lsmTree.diskReadWriteLock.RLock()
+	defer lsmTree.diskReadWriteLock.RUnlock()
+
+	count := 0
+	for _, diskBlocks := range lsmTree.levels {
+		count += len(diskBlocks)
+	}
+
+	return count
+}
+
+// Levels returns a copy of the current level layout.
+func (lsmTree *LSMTree) Levels() [][]*DiskBlock {
+	lsmTree.diskReadWriteLock.RLock()
+	defer lsmTree.diskReadWriteLock.RUnlock()
+
+	levels := make([][]*DiskBlock, len(lsmTree.levels))
+	for i, diskBlocks := range lsmTree.levels {
+		levels[i] = append([]*DiskBlock{}, diskBlocks...)
+	}
+
+	return levels
+}
+
+// DiskSize returns the size of the blocks that are currently on disk.
+func (lsmTree *LSMTree) DiskSize() int64 {
+	lsmTree.diskReadWriteLock.RLock()
+	defer lsmTree.diskReadWriteLock.RUnlock()
+
+	var size int64
+	for _, diskBlocks := range lsmTree.levels {
+		for _, diskBlock := range diskBlocks {
+			size += diskBlock.Size
+		}
+	}
+
+	return size
+}
+
+// MemtableSize returns the bytes of keys and values held in memory. Every
+// version of a key counts until it is flushed, so it may overestimate.
+func (lsmTree *LSMTree) MemtableSize() int64 {
+	lsmTree.treereadWriteLock.RLock()
+	defer lsmTree.treereadWriteLock.RUnlock()
+
+	return lsmTree.memtableSize + lsmTree.secondarySize
+}
+
+// PeriodicCompaction is the background compaction worker. Every period it
+// asks the strategy for work and keeps merging until the strategy is done,
+// one task at a time so compaction never uses more than one core. It returns
+// once the tree is closed.
 func (lsmTree *LSMTree) PeriodicCompaction(compactionPeriod int) {
 
 	for {
-		time.Sleep(time.Duration(compactionPeriod) * time.Millisecond)
-		var db1, db2 DiskBlock
+		select {
+		case <-lsmTree.done:
+			return
+		case <-time.After(time.Duration(compactionPeriod) * time.Millisecond):
+		}
 
-		lsmTree.diskReadWriteLock.RLock()
+		lsmTree.compactionLock.Lock()
 
-		if len(lsmTree.diskBlocks) >= 2 {
-			db1 = lsmTree.diskBlocks[len(lsmTree.diskBlocks)-1]
-			db2 = lsmTree.diskBlocks[len(lsmTree.diskBlocks)-2]
-		}
+		for {
+			task := lsmTree.compactionStrategy.Pick(lsmTree.Levels())
+			if task == nil || len(task.Inputs) == 0 {
+				break
+			}
 
-		if db1.Empty() || db2.Empty() {
-			continue
+			if err := lsmTree.runCompaction(task); err != nil {
+				fmt.Println(err)
+				break
+			}
 		}
 
-		newDiskBlock := compact(db1, db2)
+		lsmTree.compactionLock.Unlock()
+	}
+}
+
+// Close stops the compaction worker, waits for the running compaction and
+// flush to end, and closes the disk blocks. What is left in memory is
+// dropped, so the WAL must still hold it for the data to be kept.
+func (lsmTree *LSMTree) Close() error {
+	lsmTree.closeOnce.Do(func() {
+		close(lsmTree.done)
+	})
+
+	lsmTree.compactionLock.Lock()
+	defer lsmTree.compactionLock.Unlock()
 
-		lsmTree.diskBlocks = lsmTree.diskBlocks[0 : len(lsmTree.diskBlocks)-2]
-		lsmTree.diskBlocks = append(lsmTree.diskBlocks, newDiskBlock)
-		lsmTree.diskReadWriteLock.RUnlock()
+	lsmTree.flushLock.Lock()
+	defer lsmTree.flushLock.Unlock()
 
+	lsmTree.diskReadWriteLock.Lock()
+	defer lsmTree.diskReadWriteLock.Unlock()
+
+	var err error
+	for _, diskBlocks := range lsmTree.levels {
+		for _, diskBlock := range diskBlocks {
+			if closeErr := diskBlock.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
 	}
+	lsmTree.levels = [][]*DiskBlock{{}}
+
+	return err
 }
 
-func compact(db1 DiskBlock, db2 DiskBlock) DiskBlock {
-	pairs1 := db1.All()
-	pairs2 := db2.All()
+// installCompaction replaces the inputs of the task with its outputs. Output
+// blocks of level 0 take the place of the inputs so newer flushes stay after
+// them, output blocks of other levels are kept sorted by key.
+func (lsmTree *LSMTree) installCompaction(task *CompactionTask, outputs []*DiskBlock) error {
+	lsmTree.diskReadWriteLock.Lock()
+	defer lsmTree.diskReadWriteLock.Unlock()
 
-	// merge the two arrays in the increasing order of key values
-	i, j := 0, 0
-	var newPairs []Pair
+	inputs := make(map[*DiskBlock]bool, len(task.Inputs))
+	for _, input := range task.Inputs {
+		inputs[input] = true
+	}
+
+	levels := make([][]*DiskBlock, len(lsmTree.levels))
+	for len(levels) <= task.OutputLevel {
+		levels = append(levels, []*DiskBlock{})
+	}
 
-	for i < len(pairs1) && j < len(pairs2) {
-		if pairs1[i].Key < pairs2[j].Key {
-			newPairs = append(newPairs, pairs1[i])
-			i++
-		} else {
-			newPairs = append(newPairs, pairs2[j])
-			j++
+	found := 0
+	for level := range levels {
+		kept := []*DiskBlock{}
+		insertAt := -1
+
+		if level < len(lsmTree.levels) {
+			for _, diskBlock := range lsmTree.levels[level] {
+				if inputs[diskBlock] {
+					found++
+					if insertAt == -1 {
+						insertAt = len(kept)
+					}
+					continue
+				}
+				kept = append(kept, diskBlock)
+			}
+		}
+
+		if level == task.OutputLevel {
+			if level == 0 && insertAt != -1 {
+				kept = append(kept[:insertAt], append(append([]*DiskBlock{}, outputs...), kept[insertAt:]...)...)
+			} else {
+				kept = append(kept, outputs...)
+			}
+
+			if level > 0 {
+				sort.Slice(kept, func(i, j int) bool {
+					return bytes.Compare(kept[i].MinKey, kept[j].MinKey) < 0
+				})
+			}
 		}
+
+		levels[level] = kept
 	}
 
-	for i < len(pairs1) {
-		newPairs = append(newPairs, pairs1[i])
-		i++
+	if found != len(inputs) {
+		return fmt.Errorf("disk blocks changed during compaction")
 	}
 
-	for j < len(pairs2) {
-		newPairs = append(newPairs, pairs2[j])
-		j++
+	previousLevels := lsmTree.levels
+	lsmTree.levels = levels
+
+	if err := lsmTree.writeManifest(); err != nil {
+		lsmTree.levels = previousLevels
+		return err
 	}
 
-	return NewDiskBlock(newPairs)
+	return nil
+}
 
+func (lsmTree *LSMTree) Get(key []byte) ([]byte, bool) {
+	return lsmTree.get(key, MAX_SEQ)
 }
 
-func (lsmTree *LSMTree) Get(key string) (string, bool) {
+// get returns the newest value of key written up to seq.
+func (lsmTree *LSMTree) get(key []byte, seq uint64) ([]byte, bool) {
+	pair, exist := lsmTree.getPair(key, seq)
 
-	lsmTree.treereadWriteLock.RLock()
+	if !exist || pair.Tombstone || pair.Expired(time.Now()) {
+		return nil, false
+	}
 
-	pair, err := lsmTree.tree.Find(key)
+	return pair.Value, true
+}
 
-	if err == nil {
+// GetPair returns the newest version of key, including its sequence number.
+// Unlike Get it also returns tombstones and expired pairs, so callers can
+// tell when a key was last changed.
+func (lsmTree *LSMTree) GetPair(key []byte) (Pair, bool) {
+	return lsmTree.getPair(key, MAX_SEQ)
+}
 
-		lsmTree.treereadWriteLock.RUnlock()
-		if pair.Tombstone {
-			return "", false
-		}
+func (lsmTree *LSMTree) getPair(key []byte, seq uint64) (Pair, bool) {
 
-		return pair.Value, true
+	lsmTree.treereadWriteLock.RLock()
+
+	pair, err := lsmTree.tree.FindVersion(key, seq)
+
+	if err != nil {
+		pair, err = lsmTree.secondaryTree.FindVersion(key, seq)
 	}
 
-	pair, err = lsmTree.secondaryTree.Find(key)
+	lsmTree.treereadWriteLock.RUnlock()
 
 	if err == nil {
-
-		lsmTree.treereadWriteLock.RUnlock()
-		if pair.Tombstone {
-			return "", false
-		}
-		return pair.Value, true
+		return pair, true
 	}
 
 	exist := lsmTree.BloomFilter.Contains(key)
 
 	if !exist {
-		return "", false
+		return Pair{}, false
 	}
 
-	lsmTree.treereadWriteLock.RUnlock()
 	lsmTree.diskReadWriteLock.RLock()
 	defer lsmTree.diskReadWriteLock.RUnlock()
 
-	for _, diskBlock := range lsmTree.diskBlocks {
-		pair, err = diskBlock.GetDataFromDiskBlock(key)
+	pair, err = lsmTree.getFromDiskBlocks(key, seq)
+
+	if err != nil {
+		return Pair{}, false
+	}
+
+	return pair, true
+}
+
+// getFromDiskBlocks searches the levels from the newest data to the oldest.
+// Level 0 blocks may overlap and are searched newest first, every other
+// level has at most one block whose key range can contain the key. Versions
+// in a newer block always have higher sequence numbers than the ones in an
+// older block, so the first version up to seq is the one to return. It must
+// be called with diskReadWriteLock held.
+func (lsmTree *LSMTree) getFromDiskBlocks(key []byte, seq uint64) (Pair, error) {
+	level0 := lsmTree.levels[0]
+	for i := len(level0) - 1; i >= 0; i-- {
+		pair, err := level0[i].getVersion(key, seq)
 		if err == nil {
+			return pair, nil
+		}
+	}
 
-			if pair.Tombstone {
-				continue
-			}
-			return pair.Value, true
+	for _, diskBlocks := range lsmTree.levels[1:] {
+		i := sort.Search(len(diskBlocks), func(i int) bool {
+			return bytes.Compare(diskBlocks[i].MaxKey, key) >= 0
+		})
+
+		if i == len(diskBlocks) || bytes.Compare(diskBlocks[i].MinKey, key) > 0 {
+			continue
+		}
+
+		pair, err := diskBlocks[i].getVersion(key, seq)
+		if err == nil {
+			return pair, nil
 		}
 	}
 
-	return "", false
+	return Pair{}, fmt.Errorf("key not found")
+}
+
+func (lsmTree *LSMTree) Put(key []byte, value []byte) {
+	lsmTree.ApplyBatch([]Pair{{Key: key, Value: value}})
 }
 
-func (lsmTree *LSMTree) Put(key string, value string) {
+// Del records a tombstone for the key. Disk blocks are immutable, so the
+// tombstone shadows older values until compaction drops them.
+func (lsmTree *LSMTree) Del(key []byte) {
+	lsmTree.ApplyBatch([]Pair{{Key: key, Tombstone: true}})
+}
+
+// ApplyBatch inserts the pairs in order with consecutive sequence numbers and
+// returns the sequence number of the last one.
+// The tree is locked for the whole batch, so snapshots and readers see
+// either none or all of it.
+func (lsmTree *LSMTree) ApplyBatch(pairs []Pair) uint64 {
 	lsmTree.treereadWriteLock.Lock()
 	defer lsmTree.treereadWriteLock.Unlock()
 
-	Insert(&(lsmTree.tree), Pair{key, value, false})
+	snapshots := lsmTree.activeSnapshots()
+
+	for _, pair := range pairs {
+		lsmTree.lastSeq++
+		pair.Seq = lsmTree.lastSeq
+
+		// the key has to be in the bloom filter before a flush can move it
+		// out of the memtable
+		if !pair.Tombstone {
+			lsmTree.BloomFilter.Add(pair.Key)
+		}
 
-	go lsmTree.BloomFilter.Add(key)
+		Insert(&(lsmTree.tree), pair, snapshots)
+		lsmTree.memtableSize += int64(len(pair.Key) + len(pair.Value))
+	}
 
 	if lsmTree.tree.GetSize() >= lsmTree.MaxElementsBeforeFlush && lsmTree.secondaryTree == nil {
 
 		lsmTree.secondaryTree = lsmTree.tree
+		lsmTree.secondarySize = lsmTree.memtableSize
 		lsmTree.tree = nil
+		lsmTree.memtableSize = 0
 		go lsmTree.Flush()
 	}
+
+	return lsmTree.lastSeq
 }
 
-func (lsmTree *LSMTree) Del(key string) {
-	lsmTree.treereadWriteLock.Lock()
-	defer lsmTree.treereadWriteLock.Unlock()
+func (lsmTree *LSMTree) Flush() {
+	lsmTree.flushLock.Lock()
+	defer lsmTree.flushLock.Unlock()
 
-	Delete(&(lsmTree.tree), key)
-	Delete(&(lsmTree.secondaryTree), key)
+	if err := lsmTree.flushSecondaryTree(); err != nil {
+		fmt.Println(err)
+	}
+}
 
-	for _, diskBlock := range lsmTree.diskBlocks {
-		err := diskBlock.Del(key)
-		if err == nil {
-			break
+// FlushMemtable writes everything currently held in memory to a disk block,
+// so that the write-ahead log entries covering it can be discarded.
+func (lsmTree *LSMTree) FlushMemtable() error {
+	lsmTree.flushLock.Lock()
+	defer lsmTree.flushLock.Unlock()
+
+	for {
+		// a flush started by Put may still be waiting for the lock
+		if err := lsmTree.flushSecondaryTree(); err != nil {
+			return err
 		}
-	}
 
+		lsmTree.treereadWriteLock.Lock()
+		if lsmTree.secondaryTree == nil {
+			lsmTree.secondaryTree = lsmTree.tree
+			lsmTree.secondarySize = lsmTree.memtableSize
+			lsmTree.tree = nil
+			lsmTree.memtableSize = 0
+			lsmTree.treereadWriteLock.Unlock()
+
+			return lsmTree.flushSecondaryTree()
+		}
+		lsmTree.treereadWriteLock.Unlock()
+	}
 }
 
-func (LSMTree *LSMTree) Flush() {
-	newDiskBlocks := []DiskBlock{NewDiskBlock(LSMTree.secondaryTree.All())}
+// flushSecondaryTree must be called with flushLock held. On failure the
+// secondary tree is kept in memory so no data is lost.
+func (lsmTree *LSMTree) flushSecondaryTree() error {
+	lsmTree.treereadWriteLock.RLock()
+	secondaryTree := lsmTree.secondaryTree
+	lsmTree.treereadWriteLock.RUnlock()
+
+	if secondaryTree == nil {
+		return nil
+	}
 
-	LSMTree.diskReadWriteLock.Lock()
-	LSMTree.diskBlocks = append(LSMTree.diskBlocks, newDiskBlocks...)
-	LSMTree.diskReadWriteLock.Unlock()
+	pairs := pruneVersions(secondaryTree.AllVersions(), lsmTree.activeSnapshots())
+
+	if len(pairs) > 0 {
+		newDiskBlock, err := NewDiskBlock(lsmTree.nextDiskBlockPath(), pairs)
+		if err != nil {
+			return err
+		}
+
+		lsmTree.diskReadWriteLock.Lock()
+		lsmTree.levels[0] = append(lsmTree.levels[0], newDiskBlock)
+
+		if err := lsmTree.writeManifest(); err != nil {
+			lsmTree.levels[0] = lsmTree.levels[0][:len(lsmTree.levels[0])-1]
+			lsmTree.diskReadWriteLock.Unlock()
+			newDiskBlock.Remove()
+			return err
+		}
+		lsmTree.diskReadWriteLock.Unlock()
+	}
+
+	lsmTree.treereadWriteLock.Lock()
+	lsmTree.secondaryTree = nil
+	lsmTree.secondarySize = 0
+	lsmTree.treereadWriteLock.Unlock()
 
-	LSMTree.treereadWriteLock.Lock()
-	LSMTree.secondaryTree = nil
-	LSMTree.treereadWriteLock.Unlock()
+	return nil
 }
@@ -0,0 +1,136 @@
+package LsmTree
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	fileutil "github.com/Avash027/midDB/internal/file_util"
+)
+
+const MANIFEST_FILE_NAME = "MANIFEST"
+
+// manifestEntry is one line of the manifest: the level of a live disk block
+// followed by its file name.
+type manifestEntry struct {
+	Level int
+	Name  string
+}
+
+// readManifest returns the live disk blocks level by level, in the order
+// they are kept in memory. A missing manifest means the directory holds no
+// blocks yet. Lines without a level are treated as level 0.
+func readManifest(dir string) ([]manifestEntry, error) {
+	file, err := os.Open(filepath.Join(dir, MANIFEST_FILE_NAME))
+	if os.IsNotExist(err) {
+		return []manifestEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []manifestEntry{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			entries = append(entries, manifestEntry{Level: 0, Name: fields[0]})
+		default:
+			level, err := strconv.Atoi(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid manifest line %q", scanner.Text())
+			}
+			entries = append(entries, manifestEntry{Level: level, Name: fields[1]})
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+// writeManifest atomically and durably replaces the manifest with the given
+// entries.
+func writeManifest(dir string, entries []manifestEntry) error {
+	path := filepath.Join(dir, MANIFEST_FILE_NAME)
+	tmpPath := path + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	for _, entry := range entries {
+		writer.WriteString(fmt.Sprintf("%d %s\n", entry.Level, entry.Name))
+	}
+
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	// the WAL is only released once the new manifest survives a crash
+	return fileutil.SyncDir(dir)
+}
+
+func diskBlockName(id uint64) string {
+	return fmt.Sprintf("%06d%s", id, DISK_BLOCK_EXTENSION)
+}
+
+func diskBlockID(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, DISK_BLOCK_EXTENSION) {
+		return 0, false
+	}
+
+	id, err := strconv.ParseUint(strings.TrimSuffix(name, DISK_BLOCK_EXTENSION), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return id, true
+}
+
+// removeOrphanedBlocks deletes block files that are not in the manifest,
+// which are left behind when the process dies during a flush or compaction.
+func removeOrphanedBlocks(dir string, live map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		_, isBlock := diskBlockID(name)
+		if !isBlock && !strings.HasSuffix(name, DISK_BLOCK_EXTENSION+".tmp") {
+			continue
+		}
+		if live[name] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
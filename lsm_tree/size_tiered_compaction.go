@@ -0,0 +1,94 @@
+package LsmTree
+
+const DEFAULT_SIZE_TIERED_MIN_THRESHOLD = 4
+const DEFAULT_SIZE_TIERED_BUCKET_LOW = 0.5
+const DEFAULT_SIZE_TIERED_BUCKET_HIGH = 1.5
+
+type SizeTieredCompactionOpts struct {
+	// MinThreshold is the number of similarly sized blocks that form a tier
+	// and get merged together.
+	MinThreshold int
+	// A block belongs to a tier when its size is between BucketLow and
+	// BucketHigh times the average size of the tier.
+	BucketLow  float64
+	BucketHigh float64
+}
+
+// SizeTieredCompactionStrategy keeps every block in level 0 and merges
+// MinThreshold blocks of similar size into one. Each key is rewritten about
+// once per tier, which suits workloads that write much more than they read.
+//
+// Only blocks that are next to each other in level 0 are merged, so the
+// merged block can take their place without reordering newer and older data.
+type SizeTieredCompactionStrategy struct {
+	opts SizeTieredCompactionOpts
+}
+
+func NewSizeTieredCompactionStrategy(opts SizeTieredCompactionOpts) *SizeTieredCompactionStrategy {
+	if opts.MinThreshold < 2 {
+		opts.MinThreshold = DEFAULT_SIZE_TIERED_MIN_THRESHOLD
+	}
+	if opts.BucketLow <= 0 || opts.BucketLow >= 1 {
+		opts.BucketLow = DEFAULT_SIZE_TIERED_BUCKET_LOW
+	}
+	if opts.BucketHigh <= 1 {
+		opts.BucketHigh = DEFAULT_SIZE_TIERED_BUCKET_HIGH
+	}
+
+	return &SizeTieredCompactionStrategy{opts: opts}
+}
+
+func (s *SizeTieredCompactionStrategy) Pick(levels [][]*DiskBlock) *CompactionTask {
+	if len(levels) == 0 {
+		return nil
+	}
+
+	level0 := levels[0]
+	threshold := s.opts.MinThreshold
+
+	// prefer the tier with the smallest blocks, merging them is the cheapest
+	// way to bring the number of blocks down
+	bestStart, bestSize := -1, int64(0)
+
+	for start := 0; start+threshold <= len(level0); start++ {
+		tier := level0[start : start+threshold]
+		size := levelSize(tier)
+
+		if !s.similar(tier, size) {
+			continue
+		}
+
+		if bestStart == -1 || size < bestSize {
+			bestStart, bestSize = start, size
+		}
+	}
+
+	if bestStart == -1 {
+		return nil
+	}
+
+	inputs := make([]*DiskBlock, 0, threshold)
+	for i := bestStart + threshold - 1; i >= bestStart; i-- {
+		inputs = append(inputs, level0[i])
+	}
+
+	minKey, maxKey := keyRange(inputs)
+
+	return &CompactionTask{
+		Inputs:         inputs,
+		OutputLevel:    0,
+		DropTombstones: bestStart == 0 && !overlapsBelow(levels, 0, minKey, maxKey),
+	}
+}
+
+func (s *SizeTieredCompactionStrategy) similar(tier []*DiskBlock, size int64) bool {
+	average := float64(size) / float64(len(tier))
+
+	for _, diskBlock := range tier {
+		if float64(diskBlock.Size) < average*s.opts.BucketLow || float64(diskBlock.Size) > average*s.opts.BucketHigh {
+			return false
+		}
+	}
+
+	return true
+}
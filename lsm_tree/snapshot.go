@@ -0,0 +1,162 @@
+package LsmTree
+
+import (
+	"bytes"
+	"math"
+	"sort"
+)
+
+// MAX_SEQ reads the newest version of every key.
+const MAX_SEQ = math.MaxUint64
+
+// Snapshot is a consistent read-only view of the tree. It sees every write
+// with a sequence number up to Seq and none of the writes made after it was
+// taken, no matter how many flushes and compactions run in the meantime.
+//
+// Older versions of keys are kept in memory and on disk for as long as a
+// snapshot may need them, so snapshots should be released when done.
+type Snapshot struct {
+	lsmTree  *LSMTree
+	Seq      uint64
+	released bool
+}
+
+func (lsmTree *LSMTree) Snapshot() *Snapshot {
+	// writers assign sequence numbers under the write lock, so no write up
+	// to Seq can still be in flight and no version the snapshot needs can be
+	// pruned before it is registered
+	lsmTree.treereadWriteLock.RLock()
+	defer lsmTree.treereadWriteLock.RUnlock()
+
+	seq := lsmTree.lastSeq
+
+	lsmTree.snapshotLock.Lock()
+	lsmTree.snapshots[seq]++
+	lsmTree.snapshotLock.Unlock()
+
+	return &Snapshot{lsmTree: lsmTree, Seq: seq}
+}
+
+func (s *Snapshot) Get(key []byte) ([]byte, bool) {
+	return s.lsmTree.get(key, s.Seq)
+}
+
+// GetPair returns the version of key the snapshot sees, tombstones included.
+func (s *Snapshot) GetPair(key []byte) (Pair, bool) {
+	return s.lsmTree.getPair(key, s.Seq)
+}
+
+func (s *Snapshot) NewIterator() *Iterator {
+	return s.lsmTree.newIterator(s.Seq)
+}
+
+// Release lets flushes and compactions drop the versions that were only
+// kept for this snapshot.
+func (s *Snapshot) Release() {
+	if s.released {
+		return
+	}
+	s.released = true
+
+	s.lsmTree.snapshotLock.Lock()
+	defer s.lsmTree.snapshotLock.Unlock()
+
+	s.lsmTree.snapshots[s.Seq]--
+	if s.lsmTree.snapshots[s.Seq] <= 0 {
+		delete(s.lsmTree.snapshots, s.Seq)
+	}
+}
+
+// LastSeq returns the sequence number of the latest write.
+func (lsmTree *LSMTree) LastSeq() uint64 {
+	lsmTree.treereadWriteLock.RLock()
+	defer lsmTree.treereadWriteLock.RUnlock()
+
+	return lsmTree.lastSeq
+}
+
+// activeSnapshots returns the sequence numbers of the open snapshots in
+// increasing order.
+func (lsmTree *LSMTree) activeSnapshots() []uint64 {
+	lsmTree.snapshotLock.Lock()
+	defer lsmTree.snapshotLock.Unlock()
+
+	if len(lsmTree.snapshots) == 0 {
+		return nil
+	}
+
+	seqs := make([]uint64, 0, len(lsmTree.snapshots))
+	for seq := range lsmTree.snapshots {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	return seqs
+}
+
+// retainVersions takes the versions of one key from the newest to the oldest
+// and returns the ones that are still needed. The newest version is always
+// needed, an older one only if a snapshot falls between it and the version
+// that replaced it. With dropTombstones, tombstones that have nothing older
+// left to hide are dropped as well.
+func retainVersions(versions []Pair, snapshots []uint64, dropTombstones bool) []Pair {
+	if len(versions) == 0 {
+		return versions
+	}
+
+	kept := []Pair{versions[0]}
+
+	for i := 1; i < len(versions); i++ {
+		if neededBySnapshot(snapshots, versions[i].Seq, versions[i-1].Seq) {
+			kept = append(kept, versions[i])
+		}
+	}
+
+	if dropTombstones {
+		for len(kept) > 0 && kept[len(kept)-1].Tombstone {
+			kept = kept[:len(kept)-1]
+		}
+	}
+
+	return kept
+}
+
+// neededBySnapshot reports whether a snapshot sees a version written at seq
+// that was replaced at replacedSeq.
+func neededBySnapshot(snapshots []uint64, seq uint64, replacedSeq uint64) bool {
+	i := sort.Search(len(snapshots), func(i int) bool {
+		return snapshots[i] >= seq
+	})
+
+	return i < len(snapshots) && snapshots[i] < replacedSeq
+}
+
+// visibleVersion returns the newest of the versions, ordered from the newest
+// to the oldest, that was written up to seq.
+func visibleVersion(versions []Pair, seq uint64) (Pair, bool) {
+	for _, version := range versions {
+		if version.Seq <= seq {
+			return version, true
+		}
+	}
+
+	return Pair{}, false
+}
+
+// pruneVersions drops the versions no snapshot needs from pairs that are
+// sorted by key and then from the newest version to the oldest.
+func pruneVersions(pairs []Pair, snapshots []uint64) []Pair {
+	pruned := make([]Pair, 0, len(pairs))
+
+	for start := 0; start < len(pairs); {
+		end := start + 1
+		for end < len(pairs) && bytes.Equal(pairs[end].Key, pairs[start].Key) {
+			end++
+		}
+
+		pruned = append(pruned, retainVersions(pairs[start:end], snapshots, false)...)
+		start = end
+	}
+
+	return pruned
+}
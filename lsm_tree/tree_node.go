@@ -1,22 +1,28 @@
 package LsmTree
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+)
 
 type TreeNode struct {
 	Size  int
 	Left  *TreeNode
 	Right *TreeNode
 	Data  Pair
+	// Versions holds the older versions of the key that open snapshots can
+	// still see, from the newest to the oldest.
+	Versions []Pair
 }
 
 func NewTreeNode(elements []Pair) *TreeNode {
 	// create a tree using recursion
 	if len(elements) == 0 {
-		return &TreeNode{}
+		return nil
 	}
 
 	if len(elements) == 1 {
-		return &TreeNode{Data: elements[0]}
+		return &TreeNode{Data: elements[0], Size: 1}
 	}
 
 	mid := len(elements) / 2
@@ -29,16 +35,18 @@ func NewTreeNode(elements []Pair) *TreeNode {
 	}
 }
 
-func (tree *TreeNode) Find(key string) (Pair, error) {
+func (tree *TreeNode) Find(key []byte) (Pair, error) {
 	if tree == nil {
 		return Pair{}, fmt.Errorf("key not found")
 	}
 
-	if tree.Data.Key == key {
+	cmp := bytes.Compare(tree.Data.Key, key)
+
+	if cmp == 0 {
 		return tree.Data, nil
 	}
 
-	if tree.Data.Key >= key {
+	if cmp > 0 {
 		return tree.Left.Find(key)
 	}
 
@@ -46,13 +54,13 @@ func (tree *TreeNode) Find(key string) (Pair, error) {
 
 }
 
-func Delete(tree **TreeNode, key string) {
+func Delete(tree **TreeNode, key []byte) {
 	if *tree == nil {
 		return
-	} else if key < (*tree).Data.Key {
+	} else if bytes.Compare(key, (*tree).Data.Key) < 0 {
 		Delete(&((*tree).Left), key)
 		(*tree).Size++
-	} else if key > (*tree).Data.Key {
+	} else if bytes.Compare(key, (*tree).Data.Key) > 0 {
 		Delete(&((*tree).Right), key)
 		(*tree).Size++
 	} else {
@@ -61,23 +69,58 @@ func Delete(tree **TreeNode, key string) {
 
 }
 
-func Insert(tree **TreeNode, pair Pair) {
+// Insert adds the pair to the tree. When the key is already present, the
+// replaced version is kept if one of the snapshots can still see it.
+func Insert(tree **TreeNode, pair Pair, snapshots []uint64) {
 	if *tree == nil {
 		*tree = &TreeNode{Data: pair, Size: 1}
-	} else if pair.Key < (*tree).Data.Key {
-		Insert(&((*tree).Left), pair)
+	} else if bytes.Compare(pair.Key, (*tree).Data.Key) < 0 {
+		Insert(&((*tree).Left), pair, snapshots)
 		(*tree).Size++
-	} else if pair.Key > (*tree).Data.Key {
-		Insert(&((*tree).Right), pair)
+	} else if bytes.Compare(pair.Key, (*tree).Data.Key) > 0 {
+		Insert(&((*tree).Right), pair, snapshots)
 		(*tree).Size++
 	} else {
-		(*tree).Data.Value = pair.Value
-		(*tree).Data.Tombstone = false
+		versions := append([]Pair{pair, (*tree).Data}, (*tree).Versions...)
+		versions = retainVersions(versions, snapshots, false)
+		(*tree).Data = versions[0]
+		(*tree).Versions = versions[1:]
 	}
 
 }
 
+// FindVersion returns the newest version of key written up to seq.
+func (tree *TreeNode) FindVersion(key []byte, seq uint64) (Pair, error) {
+	if tree == nil {
+		return Pair{}, fmt.Errorf("key not found")
+	}
+
+	cmp := bytes.Compare(tree.Data.Key, key)
+
+	if cmp == 0 {
+		if tree.Data.Seq <= seq {
+			return tree.Data, nil
+		}
+
+		if version, ok := visibleVersion(tree.Versions, seq); ok {
+			return version, nil
+		}
+
+		return Pair{}, fmt.Errorf("key not found")
+	}
+
+	if cmp > 0 {
+		return tree.Left.FindVersion(key, seq)
+	}
+
+	return tree.Right.FindVersion(key, seq)
+}
+
 func (tree *TreeNode) GetSize() int {
+	if tree == nil {
+		return 0
+	}
+
 	return tree.Size
 }
 
@@ -89,20 +132,34 @@ func (tree *TreeNode) All() []Pair {
 	return append(append(tree.Left.All(), tree.Data), tree.Right.All()...)
 }
 
-func (tree *TreeNode) GreatestKeyLessThanOrEqualTo(key string) (Pair, error) {
+// AllVersions returns every version in the tree, ordered by key and then
+// from the newest version to the oldest.
+func (tree *TreeNode) AllVersions() []Pair {
+	if tree == nil {
+		return []Pair{}
+	}
+
+	pairs := append(tree.Left.AllVersions(), tree.Data)
+	pairs = append(pairs, tree.Versions...)
+
+	return append(pairs, tree.Right.AllVersions()...)
+}
+
+func (tree *TreeNode) GreatestKeyLessThanOrEqualTo(key []byte) (Pair, error) {
 	if tree == nil {
-		return Pair{}, fmt.Errorf("key %s is smaller than all keys in the tree", key)
+		return Pair{}, fmt.Errorf("key %q is smaller than all keys in the tree", key)
 	}
 
 	currentData := tree.Data
+	cmp := bytes.Compare(currentData.Key, key)
 
-	if currentData.Key == key {
+	if cmp == 0 {
 		return currentData, nil
 	}
 
-	if currentData.Key <= key {
+	if cmp < 0 {
 		rightSubTree, err := tree.Right.GreatestKeyLessThanOrEqualTo(key)
-		if err == nil && rightSubTree.Key > currentData.Key {
+		if err == nil && bytes.Compare(rightSubTree.Key, currentData.Key) > 0 {
 			currentData = rightSubTree
 		}
 	} else {
@@ -117,16 +174,16 @@ func (tree *TreeNode) GreatestKeyLessThanOrEqualTo(key string) (Pair, error) {
 
 }
 
-func (tree *TreeNode) SmallestKeyGreaterThan(key string) (Pair, error) {
+func (tree *TreeNode) SmallestKeyGreaterThan(key []byte) (Pair, error) {
 	if tree == nil {
 		return Pair{}, fmt.Errorf("key not found")
 	}
 
 	currentData := tree.Data
 
-	if currentData.Key > key {
+	if bytes.Compare(currentData.Key, key) > 0 {
 		leftSubTree, err := tree.Left.SmallestKeyGreaterThan(key)
-		if err == nil && currentData.Key > leftSubTree.Key {
+		if err == nil && bytes.Compare(currentData.Key, leftSubTree.Key) > 0 {
 			currentData = leftSubTree
 		}
 	} else {
@@ -1,34 +1,78 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
 
+	"github.com/Avash027/midDB/auth"
+	"github.com/Avash027/midDB/backup"
 	"github.com/Avash027/midDB/config"
 	dbengine "github.com/Avash027/midDB/db_engine"
 	diskstore "github.com/Avash027/midDB/disk_store"
 
 	LsmTree "github.com/Avash027/midDB/lsm_tree"
+	"github.com/Avash027/midDB/raft"
+	"github.com/Avash027/midDB/replication"
 	"github.com/Avash027/midDB/server"
+	"github.com/Avash027/midDB/sharding"
 	"github.com/Avash027/midDB/wal"
+	"golang.org/x/term"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		restore(os.Args[2:])
+		return
+	}
+
 	var configFile string
+	var hashPassword bool
 	flag.StringVar(&configFile, "config", "config.yaml", "Path to config file")
+	flag.BoolVar(&hashPassword, "hash-password", false, "Read a password from stdin and print its hash for the users config")
 	flag.Parse()
 
+	if hashPassword {
+		printPasswordHash()
+		return
+	}
+
 	serverConfig, err := initServerConfig(configFile)
 
 	if err != nil {
 		panic(err)
 	}
 
+	users, err := initUsers(serverConfig.Server.Users)
+
+	if err != nil {
+		panic(err)
+	}
+
 	fmt.Println(serverConfig.DBEngineConfig.LSMTreeConfig.CompactionFrequency)
 
 	lsmTreeOpts := LsmTree.LSMTreeOpts{
 		MaxElementsBeforeFlush: serverConfig.DBEngineConfig.LSMTreeConfig.MaxElementsBeforeFlush,
 		CompactionPeriod:       serverConfig.DBEngineConfig.LSMTreeConfig.CompactionFrequency,
+		Directory:              serverConfig.DBEngineConfig.LSMTreeConfig.Directory,
+		CompactionOpts: LsmTree.CompactionOpts{
+			Style:             serverConfig.DBEngineConfig.LSMTreeConfig.CompactionStrategy,
+			MaxBytesPerSecond: serverConfig.DBEngineConfig.LSMTreeConfig.CompactionMaxBytesPerSecond,
+			MaxCPUPercent:     serverConfig.DBEngineConfig.LSMTreeConfig.CompactionMaxCPUPercent,
+			LeveledOpts: LsmTree.LeveledCompactionOpts{
+				Level0CompactionTrigger: serverConfig.DBEngineConfig.LSMTreeConfig.Level0CompactionTrigger,
+				LevelBaseSize:           serverConfig.DBEngineConfig.LSMTreeConfig.LevelBaseSize,
+				LevelSizeMultiplier:     serverConfig.DBEngineConfig.LSMTreeConfig.LevelSizeMultiplier,
+			},
+			SizeTieredOpts: LsmTree.SizeTieredCompactionOpts{
+				MinThreshold: serverConfig.DBEngineConfig.LSMTreeConfig.SizeTieredMinThreshold,
+			},
+		},
 		BloomFilterOpts: LsmTree.BloomFilterOpts{
 			ErrorRate: serverConfig.DBEngineConfig.BloomFilterConfig.ErrorRate,
 			Capacity:  serverConfig.DBEngineConfig.BloomFilterConfig.Capacity,
@@ -42,21 +86,214 @@ func main() {
 	}
 	store := diskstore.New(diskStoreOpts)
 
+	walFile := wal.InitWAL(serverConfig.DBEngineConfig.WalPath)
+	walFile.ChangeRetention = serverConfig.DBEngineConfig.ChangeRetention
+	walFile.SegmentSize = serverConfig.DBEngineConfig.WalSegmentSize
+	walFile.SegmentRetention = serverConfig.DBEngineConfig.WalSegmentRetention
+	if serverConfig.DBEngineConfig.WalArchiveDirectory != "" {
+		walFile.ArchiveDirectory = filepath.Join(serverConfig.DBEngineConfig.WalArchiveDirectory, dbengine.DEFAULT_NAMESPACE)
+	}
+
 	server := server.Server{
 		Port:          serverConfig.Server.Port,
 		Host:          serverConfig.Server.Host,
 		UDPPort:       serverConfig.Server.UDPPort,
 		UDPBufferSize: serverConfig.Server.UDPBufferSize,
+		UDPReadOnly:   serverConfig.Server.UDPReadOnly,
+		RESPPort:      serverConfig.Server.RESPPort,
+		HTTPPort:      serverConfig.Server.HTTPPort,
+		GRPCPort:      serverConfig.Server.GRPCPort,
+		TLS: server.TLSOpts{
+			CertFile:     serverConfig.Server.TLSCertFile,
+			KeyFile:      serverConfig.Server.TLSKeyFile,
+			CAFile:       serverConfig.Server.TLSCAFile,
+			VerifyClient: serverConfig.Server.TLSVerifyClient,
+		},
+		Users: users,
+		Replication: server.ReplicationOpts{
+			Role:           serverConfig.Server.Replication.Role,
+			Port:           serverConfig.Server.Replication.Port,
+			Mode:           serverConfig.Server.Replication.Mode,
+			SyncTimeout:    time.Duration(serverConfig.Server.Replication.SyncTimeout) * time.Millisecond,
+			MinAcks:        serverConfig.Server.Replication.MinAcks,
+			LeaderAddr:     serverConfig.Server.Replication.Leader,
+			User:           serverConfig.Server.Replication.User,
+			Password:       serverConfig.Server.Replication.Password,
+			TLS:            serverConfig.Server.Replication.TLS,
+			StateDirectory: serverConfig.DiskStoreConfig.Directory,
+		},
+		Raft: server.RaftOpts{
+			ID:                serverConfig.Server.Raft.ID,
+			Port:              serverConfig.Server.Raft.Port,
+			Dir:               serverConfig.Server.Raft.Directory,
+			Members:           initRaftMembers(serverConfig.Server.Raft.Members),
+			ElectionTimeout:   time.Duration(serverConfig.Server.Raft.ElectionTimeout) * time.Millisecond,
+			HeartbeatInterval: time.Duration(serverConfig.Server.Raft.HeartbeatInterval) * time.Millisecond,
+			CommitTimeout:     time.Duration(serverConfig.Server.Raft.CommitTimeout) * time.Millisecond,
+			MaxLogEntries:     serverConfig.Server.Raft.MaxLogEntries,
+			TLS:               serverConfig.Server.Raft.TLS,
+		},
+		Sharding: server.ShardingOpts{
+			ID:             serverConfig.Server.Sharding.ID,
+			Port:           serverConfig.Server.Sharding.Port,
+			Members:        initShardMembers(serverConfig.Server.Sharding.Nodes),
+			TLS:            serverConfig.Server.Sharding.TLS,
+			StateDirectory: serverConfig.DiskStoreConfig.Directory,
+		},
 		DBEngine: &dbengine.DBEngine{
 			LsmTree: lsmTree,
-			Wal:     wal.InitWAL(serverConfig.DBEngineConfig.WalPath),
+			Wal:     walFile,
 			Store:   store,
+			NamespaceOpts: dbengine.NamespaceOpts{
+				Directory:        serverConfig.DBEngineConfig.NamespaceDirectory,
+				NumOfPartitions:  serverConfig.DiskStoreConfig.NumOfPartitions,
+				LSMTreeOpts:      lsmTreeOpts,
+				ChangeRetention:  serverConfig.DBEngineConfig.ChangeRetention,
+				ArchiveDirectory: serverConfig.DBEngineConfig.WalArchiveDirectory,
+				SegmentSize:      serverConfig.DBEngineConfig.WalSegmentSize,
+				SegmentRetention: serverConfig.DBEngineConfig.WalSegmentRetention,
+			},
 		},
 	}
 
 	server.Start()
 }
 
+// initUsers returns nil when no user is configured, which turns
+// authentication off.
+func initUsers(userConfigs []config.UserConfig) (*auth.Users, error) {
+	if len(userConfigs) == 0 {
+		return nil, nil
+	}
+
+	opts := make([]auth.UserOpts, 0, len(userConfigs))
+	for _, userConfig := range userConfigs {
+		userOpts := auth.UserOpts{Name: userConfig.Name, PasswordHash: userConfig.PasswordHash, Namespaces: userConfig.Namespaces}
+		for _, permission := range userConfig.Permissions {
+			userOpts.Permissions = append(userOpts.Permissions, auth.PermissionOpts{
+				Prefix: permission.Prefix,
+				Access: permission.Access,
+			})
+		}
+		opts = append(opts, userOpts)
+	}
+
+	return auth.New(opts)
+}
+
+func initRaftMembers(memberConfigs []config.RaftMemberConfig) []raft.Member {
+	members := make([]raft.Member, 0, len(memberConfigs))
+	for _, memberConfig := range memberConfigs {
+		members = append(members, raft.Member{
+			ID:         memberConfig.ID,
+			Addr:       memberConfig.Addr,
+			ClientAddr: memberConfig.ClientAddr,
+		})
+	}
+
+	return members
+}
+
+func initShardMembers(nodeConfigs []config.ShardNodeConfig) []sharding.Member {
+	members := make([]sharding.Member, 0, len(nodeConfigs))
+	for _, nodeConfig := range nodeConfigs {
+		members = append(members, sharding.Member{
+			ID:         nodeConfig.ID,
+			Addr:       nodeConfig.Addr,
+			ClientAddr: nodeConfig.ClientAddr,
+		})
+	}
+
+	return members
+}
+
+// restore handles middb restore, which copies a backup into the
+// directories of a configuration while the server is stopped, and replays
+// the archived WAL segments up to a point when asked to.
+func restore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	configFile := flags.String("config", "config.yaml", "Path to config file")
+	from := flags.String("backup", "", "Directory of the backup to restore")
+	archive := flags.String("archive", "", "Directory of the archived WAL segments to replay, wal_archive_directory with -until-time or -until-seq")
+	untilTime := flags.String("until-time", "", "Replay the archived writes made up to this RFC 3339 time")
+	untilSeq := flags.Uint64("until-seq", 0, "Replay the archived writes of the default namespace up to this sequence number")
+	flags.Parse(args)
+
+	exit := func(err error) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *from == "" {
+		exit(fmt.Errorf("-backup is required"))
+	}
+
+	serverConfig, err := initServerConfig(*configFile)
+	if err != nil {
+		exit(err)
+	}
+
+	opts := backup.RestoreOpts{
+		Backup:             *from,
+		SSTableDirectory:   serverConfig.DBEngineConfig.LSMTreeConfig.Directory,
+		PartitionDirectory: serverConfig.DiskStoreConfig.Directory,
+		NumOfPartitions:    serverConfig.DiskStoreConfig.NumOfPartitions,
+		WalPath:            serverConfig.DBEngineConfig.WalPath,
+		NamespaceDirectory: serverConfig.DBEngineConfig.NamespaceDirectory,
+		ArchiveDirectory:   *archive,
+		UntilSeq:           *untilSeq,
+	}
+
+	if *untilTime != "" {
+		if opts.UntilTime, err = time.Parse(time.RFC3339, *untilTime); err != nil {
+			exit(err)
+		}
+	}
+
+	if opts.ArchiveDirectory == "" && (opts.UntilSeq > 0 || !opts.UntilTime.IsZero()) {
+		opts.ArchiveDirectory = serverConfig.DBEngineConfig.WalArchiveDirectory
+	}
+
+	restored, err := backup.Restore(opts)
+	if err != nil {
+		exit(err)
+	}
+
+	for _, namespace := range restored {
+		fmt.Printf("Restored %s up to seq %d, %d archived records replayed\n", namespace.Name, namespace.Seq, namespace.Records)
+	}
+}
+
+func printPasswordHash() {
+	var password []byte
+	var err error
+
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, err = term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+	} else {
+		password, err = bufio.NewReader(os.Stdin).ReadBytes('\n')
+		if err == io.EOF {
+			err = nil
+		}
+		password = bytes.TrimRight(password, "\r\n")
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Println(hash)
+}
+
 func initServerConfig(configFile string) (config.Config, error) {
 	serverConfig, err := config.ParseConfig(configFile)
 	if err != nil {
@@ -79,10 +316,78 @@ func initServerConfig(configFile string) (config.Config, error) {
 		serverConfig.Server.UDPBufferSize = server.DEFAULT_UDP_BUFFER_SIZE
 	}
 
+	if serverConfig.Server.RESPPort == "" {
+		serverConfig.Server.RESPPort = server.DEFAULT_RESP_PORT
+	}
+
+	if serverConfig.Server.HTTPPort == "" {
+		serverConfig.Server.HTTPPort = server.DEFAULT_HTTP_PORT
+	}
+
+	if serverConfig.Server.GRPCPort == "" {
+		serverConfig.Server.GRPCPort = server.DEFAULT_GRPC_PORT
+	}
+
+	if serverConfig.Server.Replication.Port == "" {
+		serverConfig.Server.Replication.Port = replication.DEFAULT_PORT
+	}
+
+	if serverConfig.Server.Replication.Mode == "" {
+		serverConfig.Server.Replication.Mode = replication.DEFAULT_MODE
+	}
+
+	if serverConfig.Server.Replication.SyncTimeout == 0 {
+		serverConfig.Server.Replication.SyncTimeout = replication.DEFAULT_SYNC_TIMEOUT_IN_MS
+	}
+
+	if serverConfig.Server.Replication.MinAcks == 0 {
+		serverConfig.Server.Replication.MinAcks = replication.DEFAULT_MIN_ACKS
+	}
+
+	if serverConfig.Server.Raft.Port == "" {
+		serverConfig.Server.Raft.Port = raft.DEFAULT_PORT
+	}
+
+	if serverConfig.Server.Raft.Directory == "" {
+		serverConfig.Server.Raft.Directory = raft.DEFAULT_DIRECTORY
+	}
+
+	if serverConfig.Server.Raft.ElectionTimeout == 0 {
+		serverConfig.Server.Raft.ElectionTimeout = raft.DEFAULT_ELECTION_TIMEOUT_IN_MS
+	}
+
+	if serverConfig.Server.Raft.HeartbeatInterval == 0 {
+		serverConfig.Server.Raft.HeartbeatInterval = raft.DEFAULT_HEARTBEAT_INTERVAL_IN_MS
+	}
+
+	if serverConfig.Server.Raft.CommitTimeout == 0 {
+		serverConfig.Server.Raft.CommitTimeout = raft.DEFAULT_COMMIT_TIMEOUT_IN_MS
+	}
+
+	if serverConfig.Server.Raft.MaxLogEntries == 0 {
+		serverConfig.Server.Raft.MaxLogEntries = raft.DEFAULT_MAX_LOG_ENTRIES
+	}
+
+	if serverConfig.Server.Sharding.Port == "" {
+		serverConfig.Server.Sharding.Port = sharding.DEFAULT_PORT
+	}
+
 	if serverConfig.DBEngineConfig.WalPath == "" {
 		serverConfig.DBEngineConfig.WalPath = wal.DEFAULT_WAL_PATH
 	}
 
+	if serverConfig.DBEngineConfig.WalSegmentSize == 0 {
+		serverConfig.DBEngineConfig.WalSegmentSize = wal.DEFAULT_SEGMENT_SIZE
+	}
+
+	if serverConfig.DBEngineConfig.ChangeRetention == 0 {
+		serverConfig.DBEngineConfig.ChangeRetention = wal.DEFAULT_CHANGE_RETENTION
+	}
+
+	if serverConfig.DBEngineConfig.NamespaceDirectory == "" {
+		serverConfig.DBEngineConfig.NamespaceDirectory = dbengine.DEFAULT_NAMESPACE_DIRECTORY
+	}
+
 	if serverConfig.DBEngineConfig.LSMTreeConfig.MaxElementsBeforeFlush == 0 {
 		serverConfig.DBEngineConfig.LSMTreeConfig.MaxElementsBeforeFlush = LsmTree.DEFAULT_MAX_ELEMENTS_BEFORE_FLUSH
 	}
@@ -91,6 +396,30 @@ func initServerConfig(configFile string) (config.Config, error) {
 		serverConfig.DBEngineConfig.LSMTreeConfig.CompactionFrequency = LsmTree.DEFAULT_COMPACTION_FREQUENCY
 	}
 
+	if serverConfig.DBEngineConfig.LSMTreeConfig.Directory == "" {
+		serverConfig.DBEngineConfig.LSMTreeConfig.Directory = LsmTree.DEFAULT_SSTABLE_DIRECTORY
+	}
+
+	if serverConfig.DBEngineConfig.LSMTreeConfig.CompactionStrategy == "" {
+		serverConfig.DBEngineConfig.LSMTreeConfig.CompactionStrategy = LsmTree.DEFAULT_COMPACTION_STYLE
+	}
+
+	if serverConfig.DBEngineConfig.LSMTreeConfig.SizeTieredMinThreshold == 0 {
+		serverConfig.DBEngineConfig.LSMTreeConfig.SizeTieredMinThreshold = LsmTree.DEFAULT_SIZE_TIERED_MIN_THRESHOLD
+	}
+
+	if serverConfig.DBEngineConfig.LSMTreeConfig.Level0CompactionTrigger == 0 {
+		serverConfig.DBEngineConfig.LSMTreeConfig.Level0CompactionTrigger = LsmTree.DEFAULT_LEVEL0_COMPACTION_TRIGGER
+	}
+
+	if serverConfig.DBEngineConfig.LSMTreeConfig.LevelBaseSize == 0 {
+		serverConfig.DBEngineConfig.LSMTreeConfig.LevelBaseSize = LsmTree.DEFAULT_LEVEL_BASE_SIZE
+	}
+
+	if serverConfig.DBEngineConfig.LSMTreeConfig.LevelSizeMultiplier == 0 {
+		serverConfig.DBEngineConfig.LSMTreeConfig.LevelSizeMultiplier = LsmTree.DEFAULT_LEVEL_SIZE_MULTIPLIER
+	}
+
 	if serverConfig.DBEngineConfig.BloomFilterConfig.ErrorRate == 0 {
 		serverConfig.DBEngineConfig.BloomFilterConfig.ErrorRate = LsmTree.DEFAULT_BLOOM_FILTER_ERROR_RATE
 	}
@@ -0,0 +1,299 @@
+package raft
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	dbengine "github.com/Avash027/midDB/db_engine"
+	diskstore "github.com/Avash027/midDB/disk_store"
+	LsmTree "github.com/Avash027/midDB/lsm_tree"
+	"github.com/Avash027/midDB/wal"
+)
+
+// Cluster runs the members of a cluster in one process, over loopback, each
+// with its own engine in a directory of its own. It is meant for tests.
+//
+//	cluster, _ := raft.NewCluster(dir, 3, raft.Opts{})
+//	defer cluster.Close()
+//	leader, _ := cluster.Leader(5 * time.Second)
+//	cluster.DB(leader).Put(key, value)
+type Cluster struct {
+	dir  string
+	opts Opts
+
+	lock    sync.Mutex
+	members map[string]*clusterMember
+}
+
+type clusterMember struct {
+	member   Member
+	node     *Node
+	db       *dbengine.DBEngine
+	listener net.Listener
+}
+
+// NewCluster starts size members named n1, n2 and so on. The timeouts and
+// the log size come from opts.
+func NewCluster(dir string, size int, opts Opts) (*Cluster, error) {
+	c := &Cluster{dir: dir, opts: opts, members: map[string]*clusterMember{}}
+
+	members := []Member{}
+	listeners := []net.Listener{}
+
+	for i := 1; i <= size; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+
+		listeners = append(listeners, listener)
+		members = append(members, Member{ID: fmt.Sprintf("n%d", i), Addr: listener.Addr().String()})
+	}
+
+	for i, member := range members {
+		if err := c.start(member, members, listeners[i]); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Join starts a member that is not in the cluster yet, add it with
+// AddMember on the leader.
+func (c *Cluster) Join(id string) (Member, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return Member{}, err
+	}
+
+	member := Member{ID: id, Addr: listener.Addr().String()}
+	return member, c.start(member, nil, listener)
+}
+
+// Node returns the node of a member, nil while it is stopped.
+func (c *Cluster) Node(id string) *Node {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if m, ok := c.members[id]; ok {
+		return m.node
+	}
+	return nil
+}
+
+// DB returns the engine of a member, nil while it is stopped.
+func (c *Cluster) DB(id string) *dbengine.DBEngine {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if m, ok := c.members[id]; ok {
+		return m.db
+	}
+	return nil
+}
+
+// Running returns the IDs of the members that run, in order.
+func (c *Cluster) Running() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ids := []string{}
+	for id, m := range c.members {
+		if m.node != nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// Leader waits until one of the running members leads in the highest term
+// among them, and returns its ID.
+func (c *Cluster) Leader(timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+		var leader string
+		var leaderTerm, maxTerm uint64
+
+		for _, id := range c.Running() {
+			node := c.Node(id)
+			if node == nil {
+				continue
+			}
+
+			status := node.Status()
+			if status.Term > maxTerm {
+				maxTerm = status.Term
+			}
+			if status.Role == ROLE_LEADER && status.Term >= leaderTerm {
+				leader, leaderTerm = id, status.Term
+			}
+		}
+
+		if leader != "" && leaderTerm == maxTerm {
+			return leader, nil
+		}
+
+		time.Sleep(TICK_INTERVAL)
+	}
+
+	return "", fmt.Errorf("no leader elected in %s", timeout)
+}
+
+// WaitApplied waits until every running member applied index.
+func (c *Cluster) WaitApplied(index uint64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for _, id := range c.Running() {
+		for {
+			node := c.Node(id)
+			if node == nil || node.Status().LastApplied >= index {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				return fmt.Errorf("%s did not apply %d in %s", id, index, timeout)
+			}
+			time.Sleep(TICK_INTERVAL)
+		}
+	}
+
+	return nil
+}
+
+// Stop stops a member and closes its engine, its files are kept for Start.
+func (c *Cluster) Stop(id string) error {
+	c.lock.Lock()
+	m, ok := c.members[id]
+	c.lock.Unlock()
+
+	if !ok || m.node == nil {
+		return fmt.Errorf("member %s is not running", id)
+	}
+
+	m.listener.Close()
+	m.node.Stop()
+	err := m.db.Close()
+
+	c.lock.Lock()
+	m.node, m.db, m.listener = nil, nil, nil
+	c.lock.Unlock()
+
+	return err
+}
+
+// Start starts a stopped member again, on the same address.
+func (c *Cluster) Start(id string) error {
+	c.lock.Lock()
+	m, ok := c.members[id]
+	c.lock.Unlock()
+
+	if !ok || m.node != nil {
+		return fmt.Errorf("member %s is not stopped", id)
+	}
+
+	listener, err := net.Listen("tcp", m.member.Addr)
+	if err != nil {
+		return err
+	}
+
+	return c.start(m.member, nil, listener)
+}
+
+// Close stops every member.
+func (c *Cluster) Close() error {
+	var err error
+
+	for _, id := range c.Running() {
+		if stopErr := c.Stop(id); stopErr != nil && err == nil {
+			err = stopErr
+		}
+	}
+
+	return err
+}
+
+func (c *Cluster) start(member Member, members []Member, listener net.Listener) error {
+	dir := filepath.Join(c.dir, member.ID)
+
+	db, err := openEngine(dir)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	opts := c.opts
+	opts.ID = member.ID
+	opts.Dir = filepath.Join(dir, "raft")
+	opts.Members = members
+
+	// the node opens its log before the WAL is replayed, see NewNode
+	node, err := NewNode(db, opts)
+	if err != nil {
+		listener.Close()
+		db.Close()
+		return err
+	}
+
+	if err := db.LoadFromDisk(db.LsmTree, db.Wal); err != nil {
+		listener.Close()
+		db.Close()
+		return err
+	}
+
+	start := make(chan bool, 1)
+	start <- true
+	go db.Store.PersistToDisk(db.LsmTree, db.Wal, start)
+
+	go node.Serve(listener)
+	node.Start()
+
+	c.lock.Lock()
+	c.members[member.ID] = &clusterMember{member: member, node: node, db: db, listener: listener}
+	c.lock.Unlock()
+
+	return nil
+}
+
+// openEngine builds an engine in dir with the default options, like the
+// engine of a namespace. It is loaded once its node is made.
+func openEngine(dir string) (*dbengine.DBEngine, error) {
+	lsmTree := LsmTree.InitNewLSMTree(LsmTree.LSMTreeOpts{
+		MaxElementsBeforeFlush: LsmTree.DEFAULT_MAX_ELEMENTS_BEFORE_FLUSH,
+		CompactionPeriod:       LsmTree.DEFAULT_COMPACTION_FREQUENCY,
+		Directory:              filepath.Join(dir, "sstables"),
+		CompactionOpts:         LsmTree.CompactionOpts{Style: LsmTree.DEFAULT_COMPACTION_STYLE},
+		BloomFilterOpts: LsmTree.BloomFilterOpts{
+			ErrorRate: LsmTree.DEFAULT_BLOOM_FILTER_ERROR_RATE,
+			Capacity:  LsmTree.DEFAULT_BLOOM_FILTER_CAPACITY,
+		},
+	})
+
+	store := diskstore.New(diskstore.DiskStoreOpts{
+		Directory:       filepath.Join(dir, "partitions"),
+		NumOfPartitions: diskstore.DEFAULT_NUM_OF_PARTITIONS,
+	})
+	if store == nil {
+		lsmTree.Close()
+		return nil, fmt.Errorf("could not open the partitions")
+	}
+
+	db := &dbengine.DBEngine{
+		LsmTree: lsmTree,
+		Wal:     wal.InitWAL(filepath.Join(dir, wal.DEFAULT_WAL_PATH)),
+		Store:   store,
+	}
+
+	return db, nil
+}
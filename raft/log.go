@@ -0,0 +1,306 @@
+package raft
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	fileutil "github.com/Avash027/midDB/internal/file_util"
+	"github.com/Avash027/midDB/wal"
+)
+
+// The types of the log entries.
+const (
+	// ENTRY_COMMAND holds a WAL record of the default namespace
+	ENTRY_COMMAND = wal.LOG_ENTRY_COMMAND
+	// ENTRY_CONFIG holds the members of the cluster from then on
+	ENTRY_CONFIG = 'M'
+	// ENTRY_NOOP is appended by every new leader, committing it commits
+	// what the previous leaders left
+	ENTRY_NOOP = 'N'
+)
+
+var errInvalidLog = errors.New("invalid raft log")
+
+// Entry is an entry of the log.
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Type  byte
+	Data  []byte
+}
+
+// raftLog is the log of a node, kept in memory and in the WAL of the engine,
+// see wal.LogEntry, so a write is on disk once. The WAL replays the entries
+// that were applied and keeps the segments holding the others.
+//
+// The entries up to snapshotIndex were applied and compacted away, the
+// engine holds them. That index, its term and the members as of then are
+// kept in SNAPSHOT_FILE_NAME.
+type raftLog struct {
+	wal  *wal.WAL
+	path string
+
+	snapshotIndex   uint64
+	snapshotTerm    uint64
+	snapshotMembers []Member
+
+	entries []Entry
+	// positions[i] is where entries[i] starts in the WAL
+	positions []wal.Position
+}
+
+// openLog reads the log from the WAL, from the entry after the snapshot on.
+// A log that does not exist is empty.
+func openLog(w *wal.WAL, path string) (*raftLog, error) {
+	l := &raftLog{wal: w, path: path}
+
+	if err := l.readSnapshot(); err != nil {
+		return nil, err
+	}
+
+	entries, positions, err := w.ReadLog()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, entry := range entries {
+		if entry.Index <= l.snapshotIndex {
+			continue
+		}
+
+		if entry.Index != l.lastIndex()+1 {
+			return nil, errInvalidLog
+		}
+
+		l.entries = append(l.entries, Entry{Index: entry.Index, Term: entry.Term, Type: entry.Type, Data: entry.Data})
+		l.positions = append(l.positions, positions[i])
+	}
+
+	l.retain()
+	return l, nil
+}
+
+func (l *raftLog) lastIndex() uint64 {
+	return l.snapshotIndex + uint64(len(l.entries))
+}
+
+func (l *raftLog) lastTerm() uint64 {
+	if len(l.entries) == 0 {
+		return l.snapshotTerm
+	}
+	return l.entries[len(l.entries)-1].Term
+}
+
+// term returns the term of the entry at index, which is false when the
+// entry was compacted away or does not exist yet. The last compacted entry
+// keeps its term.
+func (l *raftLog) term(index uint64) (uint64, bool) {
+	if index == l.snapshotIndex {
+		return l.snapshotTerm, true
+	}
+
+	if index < l.snapshotIndex || index > l.lastIndex() {
+		return 0, false
+	}
+
+	return l.entries[index-l.snapshotIndex-1].Term, true
+}
+
+// entry expects snapshotIndex < index <= lastIndex.
+func (l *raftLog) entry(index uint64) Entry {
+	return l.entries[index-l.snapshotIndex-1]
+}
+
+// slice returns at most max entries from index on.
+func (l *raftLog) slice(index uint64, max int) []Entry {
+	if index <= l.snapshotIndex || index > l.lastIndex() {
+		return nil
+	}
+
+	entries := l.entries[index-l.snapshotIndex-1:]
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+
+	return append([]Entry{}, entries...)
+}
+
+// append writes the entries after the last one and syncs the WAL.
+func (l *raftLog) append(entries ...Entry) error {
+	logEntries := make([]wal.LogEntry, len(entries))
+	for i, entry := range entries {
+		logEntries[i] = wal.LogEntry{Index: entry.Index, Term: entry.Term, Type: entry.Type, Data: entry.Data}
+	}
+
+	positions, err := l.wal.AppendLog(logEntries)
+	if err != nil {
+		return err
+	}
+
+	l.entries = append(l.entries, entries...)
+	l.positions = append(l.positions, positions...)
+	l.retain()
+
+	return nil
+}
+
+// truncate drops the entries from index on, from the WAL as well. None of
+// them was applied.
+func (l *raftLog) truncate(index uint64) error {
+	if index <= l.snapshotIndex || index > l.lastIndex() {
+		return nil
+	}
+
+	i := index - l.snapshotIndex - 1
+
+	if err := l.wal.TruncateLog(l.positions[i]); err != nil {
+		return err
+	}
+
+	l.entries = l.entries[:i]
+	l.positions = l.positions[:i]
+	l.retain()
+
+	return nil
+}
+
+// compact drops the entries up to index, which was applied with the given
+// term and members. The entries after it are kept.
+func (l *raftLog) compact(index uint64, term uint64, members []Member) error {
+	if err := writeSnapshot(l.path, index, term, members); err != nil {
+		return err
+	}
+
+	if index >= l.snapshotIndex && index < l.lastIndex() {
+		l.entries = l.entries[index-l.snapshotIndex:]
+		l.positions = l.positions[index-l.snapshotIndex:]
+	} else {
+		l.entries = nil
+		l.positions = nil
+	}
+
+	l.snapshotIndex = index
+	l.snapshotTerm = term
+	l.snapshotMembers = members
+	l.retain()
+
+	return nil
+}
+
+// retain keeps the segments of the WAL from the first entry on.
+func (l *raftLog) retain() {
+	if len(l.positions) == 0 {
+		l.wal.Retain(0)
+		return
+	}
+
+	l.wal.Retain(l.positions[0].Segment)
+}
+
+// readSnapshot reads the "<index> <term>" line and the members that follow
+// it, see encodeMembers. A missing file is the start of the log.
+func (l *raftLog) readSnapshot() error {
+	data, err := os.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	line, members, _ := strings.Cut(string(data), "\n")
+
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return fmt.Errorf("invalid raft snapshot in %s", l.path)
+	}
+
+	if l.snapshotIndex, err = strconv.ParseUint(fields[0], 10, 64); err != nil {
+		return fmt.Errorf("invalid raft snapshot in %s", l.path)
+	}
+	if l.snapshotTerm, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+		return fmt.Errorf("invalid raft snapshot in %s", l.path)
+	}
+
+	l.snapshotMembers, err = decodeMembers([]byte(members))
+	return err
+}
+
+// writeSnapshot replaces the file through a temporary one that is synced
+// before it is renamed.
+func writeSnapshot(path string, index uint64, term uint64, members []Member) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	fmt.Fprintf(writer, "%d %d\n", index, term)
+	writer.Write(encodeMembers(members))
+
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	return fileutil.SyncDir(filepath.Dir(path))
+}
+
+// encodeMembers lays out one "<id> <address> <client address>" line per
+// member, an unknown client address is written as -.
+func encodeMembers(members []Member) []byte {
+	var b strings.Builder
+
+	for _, member := range members {
+		clientAddr := member.ClientAddr
+		if clientAddr == "" {
+			clientAddr = "-"
+		}
+		fmt.Fprintf(&b, "%s %s %s\n", member.ID, member.Addr, clientAddr)
+	}
+
+	return []byte(b.String())
+}
+
+func decodeMembers(data []byte) ([]Member, error) {
+	members := []Member{}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, errInvalidLog
+		}
+
+		member := Member{ID: fields[0], Addr: fields[1], ClientAddr: fields[2]}
+		if member.ClientAddr == "-" {
+			member.ClientAddr = ""
+		}
+		members = append(members, member)
+	}
+
+	return members, nil
+}
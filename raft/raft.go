@@ -0,0 +1,1202 @@
+// Package raft makes a cluster of servers agree on the writes of the default
+// namespace with the Raft consensus algorithm.
+//
+// Every write becomes an entry of the Raft log, which the leader copies to
+// the other members. The log is kept in the WAL of the engine, the entry of
+// a write is the only record of it there. A write returns once a majority
+// of the members have it on disk and the leader applied it to its engine,
+// every member applies the same entries in the same order. Reads are served
+// by the leader only, once it made sure it is still the leader: either its
+// lease holds, because a majority acknowledged it within the last election
+// timeout and none of them votes for another member before the timeout
+// ends, or it asks them again (read-index).
+//
+// Members are added and removed one at a time through the log, see
+// AddMember and RemoveMember. The log is compacted once it holds more than
+// MaxLogEntries entries, a member that fell behind the compacted part gets
+// a snapshot of the tree of the leader instead.
+package raft
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dbengine "github.com/Avash027/midDB/db_engine"
+	"github.com/Avash027/midDB/wal"
+)
+
+const (
+	ROLE_LEADER    = "leader"
+	ROLE_FOLLOWER  = "follower"
+	ROLE_CANDIDATE = "candidate"
+)
+
+const DEFAULT_PORT = "7000"
+const DEFAULT_DIRECTORY = "./data/raft"
+const DEFAULT_ELECTION_TIMEOUT_IN_MS = 1000
+const DEFAULT_HEARTBEAT_INTERVAL_IN_MS = 100
+const DEFAULT_COMMIT_TIMEOUT_IN_MS = 5000
+const DEFAULT_MAX_LOG_ENTRIES = 10000
+
+// STATE_FILE_NAME holds the current term and vote and SNAPSHOT_FILE_NAME
+// where the log was last compacted, both in the directory of the node.
+const STATE_FILE_NAME = "RAFT_STATE"
+const SNAPSHOT_FILE_NAME = "RAFT_SNAPSHOT"
+
+// MAX_ENTRIES_PER_APPEND caps the entries sent in one AppendEntries, and
+// SNAPSHOT_BATCH_SIZE the pairs in one chunk of a snapshot.
+const MAX_ENTRIES_PER_APPEND = 512
+const SNAPSHOT_BATCH_SIZE = 1024
+
+// TICK_INTERVAL is how often a node checks its election timer.
+const TICK_INTERVAL = 10 * time.Millisecond
+
+var (
+	ErrMemberExists     = errors.New("member already exists")
+	ErrMemberNotFound   = errors.New("member not found")
+	ErrInvalidMember    = errors.New("member IDs and addresses can not be empty or hold spaces")
+	ErrChangeInProgress = errors.New("a membership change is in progress")
+	ErrLastMember       = errors.New("the last member can not be removed")
+	errStopped          = errors.New("raft node stopped")
+	errOutOfOrder       = errors.New("snapshot chunk out of order")
+)
+
+// Member is a server of the cluster. Addr is where the other members reach
+// it, ClientAddr where clients do, which is what a follower sends them to.
+type Member struct {
+	ID         string
+	Addr       string
+	ClientAddr string
+}
+
+type Opts struct {
+	ID string
+	// Dir holds the state of the node, its log is in the WAL of the engine
+	Dir string
+	// Members start a new cluster, they are ignored once the log exists. A
+	// node started without members waits for the leader to add it.
+	Members []Member
+
+	// ElectionTimeout is how long a follower waits for the leader before
+	// it runs for election, the actual wait is randomized between one and
+	// two times as long
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// CommitTimeout caps how long a write or a read waits for the cluster
+	CommitTimeout time.Duration
+	MaxLogEntries int
+	// TLSConfig, when set, secures the connections to the other members
+	TLSConfig *tls.Config
+}
+
+// NotLeaderError is returned by a node that is not the leader, with the
+// leader when it is known. It matches dbengine.ErrNotLeader.
+type NotLeaderError struct {
+	LeaderID   string
+	LeaderAddr string
+}
+
+func (e *NotLeaderError) Error() string {
+	switch {
+	case e.LeaderAddr != "":
+		return "not the leader, the leader is at " + e.LeaderAddr
+	case e.LeaderID != "":
+		return "not the leader, the leader is " + e.LeaderID
+	default:
+		return "not the leader, no leader is known"
+	}
+}
+
+func (e *NotLeaderError) Is(target error) bool {
+	return target == dbengine.ErrNotLeader
+}
+
+// Status describes a node.
+type Status struct {
+	ID            string
+	Role          string
+	Term          uint64
+	LeaderID      string
+	LastIndex     uint64
+	CommitIndex   uint64
+	LastApplied   uint64
+	SnapshotIndex uint64
+	Members       []MemberStatus
+}
+
+// MemberStatus describes a member, MatchIndex is only known by the leader.
+type MemberStatus struct {
+	Member
+	MatchIndex uint64
+}
+
+// Node is a member of the cluster, it is the Consensus of the engine of the
+// default namespace.
+type Node struct {
+	db        *dbengine.DBEngine
+	opts      Opts
+	transport *transport
+
+	// mu guards everything below, cond is broadcast whenever the commit
+	// index, the applied index, the acknowledgements or the role change
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	role     string
+	term     uint64
+	votedFor string
+	leaderID string
+	log      *raftLog
+
+	// members is the latest configuration in the log, which is in effect
+	// as soon as it is appended, configIndex is the index of its entry
+	members     []Member
+	configIndex uint64
+
+	commitIndex uint64
+	lastApplied uint64
+	// appliedMembers is the configuration as of lastApplied, which goes
+	// with a snapshot
+	appliedMembers []Member
+
+	electionDeadline  time.Time
+	lastLeaderContact time.Time
+
+	// peers are the other members, while the node leads
+	peers   map[string]*peer
+	waiters map[uint64]waiter
+	// install is the snapshot being received from the leader
+	install *install
+
+	conns   map[net.Conn]struct{}
+	stopped bool
+	done    chan struct{}
+
+	// applyLock is held while an entry or a chunk of a snapshot is applied
+	// to the engine, it is taken before mu
+	applyLock sync.Mutex
+	wg        sync.WaitGroup
+}
+
+// peer is what the leader knows of another member.
+type peer struct {
+	member     Member
+	nextIndex  uint64
+	matchIndex uint64
+	// ackedAt is when the last AppendEntries the member answered was sent
+	ackedAt time.Time
+	trigger chan struct{}
+}
+
+// waiter is a write waiting for its entry to be applied.
+type waiter struct {
+	term uint64
+	done chan error
+}
+
+// NewNode opens the log of the node and makes it the consensus of the
+// engine. It is called before the engine is loaded, so the WAL replays the
+// entries that were applied, and Start is called after.
+func NewNode(db *dbengine.DBEngine, opts Opts) (*Node, error) {
+	if !validID(opts.ID) {
+		return nil, ErrInvalidMember
+	}
+
+	for _, member := range opts.Members {
+		if !validID(member.ID) || !validID(member.Addr) {
+			return nil, ErrInvalidMember
+		}
+	}
+
+	if opts.ElectionTimeout <= 0 {
+		opts.ElectionTimeout = DEFAULT_ELECTION_TIMEOUT_IN_MS * time.Millisecond
+	}
+	if opts.HeartbeatInterval <= 0 {
+		opts.HeartbeatInterval = DEFAULT_HEARTBEAT_INTERVAL_IN_MS * time.Millisecond
+	}
+	if opts.CommitTimeout <= 0 {
+		opts.CommitTimeout = DEFAULT_COMMIT_TIMEOUT_IN_MS * time.Millisecond
+	}
+	if opts.MaxLogEntries <= 0 {
+		opts.MaxLogEntries = DEFAULT_MAX_LOG_ENTRIES
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	term, votedFor, err := readState(filepath.Join(opts.Dir, STATE_FILE_NAME))
+	if err != nil {
+		return nil, err
+	}
+
+	log, err := openLog(db.Wal, filepath.Join(opts.Dir, SNAPSHOT_FILE_NAME))
+	if err != nil {
+		return nil, err
+	}
+
+	if log.lastIndex() == 0 && len(log.snapshotMembers) == 0 && len(opts.Members) > 0 {
+		if err := log.compact(0, 0, opts.Members); err != nil {
+			return nil, err
+		}
+	}
+
+	// the entries up to the compaction were applied, and so were the ones
+	// the persistent store holds
+	applied := max(log.snapshotIndex, db.Wal.PersistedIndex())
+	if applied > log.lastIndex() {
+		applied = log.lastIndex()
+	}
+	db.Wal.Applied(applied, nil)
+
+	n := &Node{
+		db:          db,
+		opts:        opts,
+		transport:   newTransport(opts.TLSConfig),
+		role:        ROLE_FOLLOWER,
+		term:        term,
+		votedFor:    votedFor,
+		log:         log,
+		commitIndex: applied,
+		lastApplied: applied,
+		waiters:     map[uint64]waiter{},
+		conns:       map[net.Conn]struct{}{},
+		done:        make(chan struct{}),
+	}
+	n.cond = sync.NewCond(&n.mu)
+	n.members, n.configIndex = n.latestConfig()
+	n.appliedMembers, _ = n.configAt(applied)
+
+	db.Consensus = n
+
+	return n, nil
+}
+
+// Start applies the entries the cluster committed and takes part in the
+// elections, from the entry after the last one the engine replayed on.
+func (n *Node) Start() {
+	n.mu.Lock()
+	n.resetElectionTimer()
+	n.mu.Unlock()
+
+	n.wg.Add(2)
+	go n.applyLoop()
+	go n.tickLoop()
+}
+
+// Serve answers the other members until the listener is closed.
+func (n *Node) Serve(listener net.Listener) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Raft", &service{node: n}); err != nil {
+		return err
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		n.mu.Lock()
+		if n.stopped {
+			n.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		n.conns[conn] = struct{}{}
+		n.mu.Unlock()
+
+		go func() {
+			server.ServeConn(conn)
+
+			n.mu.Lock()
+			delete(n.conns, conn)
+			n.mu.Unlock()
+		}()
+	}
+}
+
+// Stop leaves the cluster until the node is started again, the engine can
+// be closed once it returns.
+func (n *Node) Stop() {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return
+	}
+
+	n.stopped = true
+	close(n.done)
+	n.cond.Broadcast()
+
+	for conn := range n.conns {
+		conn.Close()
+	}
+
+	if n.install != nil {
+		n.install.abort()
+		n.install = nil
+	}
+	n.mu.Unlock()
+
+	n.transport.close()
+	n.wg.Wait()
+}
+
+// Propose commits a write of the default namespace, see
+// dbengine.Consensus.
+func (n *Node) Propose(entries []wal.Entry) error {
+	return n.propose(ENTRY_COMMAND, wal.EncodeRecord(entries))
+}
+
+// ReadBarrier waits until the node knows it is still the leader and has
+// applied every entry committed before the call, see dbengine.Consensus.
+func (n *Node) ReadBarrier() error {
+	deadline := time.Now().Add(n.opts.CommitTimeout)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.role != ROLE_LEADER {
+		return n.notLeader()
+	}
+	term := n.term
+
+	// a new leader only knows what was committed before it once an entry
+	// of its own term is
+	for {
+		if n.role != ROLE_LEADER || n.term != term {
+			return n.notLeader()
+		}
+		if t, _ := n.log.term(n.commitIndex); t == term {
+			break
+		}
+		if !n.waitUntil(deadline) {
+			return dbengine.ErrNoQuorum
+		}
+	}
+
+	readIndex := n.commitIndex
+
+	if time.Now().After(n.quorumContact().Add(n.lease())) {
+		start := time.Now()
+		n.triggerPeers()
+
+		for n.quorumContact().Before(start) {
+			if n.role != ROLE_LEADER || n.term != term {
+				return n.notLeader()
+			}
+			if !n.waitUntil(deadline) {
+				return dbengine.ErrNoQuorum
+			}
+		}
+	}
+
+	for n.lastApplied < readIndex {
+		if n.stopped {
+			return n.notLeader()
+		}
+		if !n.waitUntil(deadline) {
+			return dbengine.ErrNoQuorum
+		}
+	}
+
+	return nil
+}
+
+// AddMember adds a member to the cluster, it is called on the leader. The
+// new member is started without members and catches up from the leader.
+func (n *Node) AddMember(member Member) error {
+	if !validID(member.ID) || !validID(member.Addr) || strings.ContainsAny(member.ClientAddr, " \t\n") {
+		return ErrInvalidMember
+	}
+
+	return n.changeMembers(func(members []Member) ([]Member, error) {
+		for _, m := range members {
+			if m.ID == member.ID {
+				return nil, ErrMemberExists
+			}
+		}
+
+		return append(members, member), nil
+	})
+}
+
+// RemoveMember removes a member from the cluster, it is called on the
+// leader. A leader that removes itself steps down once the change is
+// committed.
+func (n *Node) RemoveMember(id string) error {
+	return n.changeMembers(func(members []Member) ([]Member, error) {
+		for i, m := range members {
+			if m.ID == id {
+				if len(members) == 1 {
+					return nil, ErrLastMember
+				}
+				return append(members[:i], members[i+1:]...), nil
+			}
+		}
+
+		return nil, ErrMemberNotFound
+	})
+}
+
+// changeMembers appends the configuration change makes of the current one,
+// one change at a time.
+func (n *Node) changeMembers(change func([]Member) ([]Member, error)) error {
+	n.mu.Lock()
+
+	if n.role != ROLE_LEADER {
+		n.mu.Unlock()
+		return n.notLeader()
+	}
+
+	if t, _ := n.log.term(n.commitIndex); t != n.term || n.configIndex > n.commitIndex {
+		n.mu.Unlock()
+		return ErrChangeInProgress
+	}
+
+	members, err := change(append([]Member{}, n.members...))
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+
+	w, err := n.appendEntry(ENTRY_CONFIG, encodeMembers(members))
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return n.wait(w)
+}
+
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	status := Status{
+		ID:            n.opts.ID,
+		Role:          n.role,
+		Term:          n.term,
+		LeaderID:      n.leaderID,
+		LastIndex:     n.log.lastIndex(),
+		CommitIndex:   n.commitIndex,
+		LastApplied:   n.lastApplied,
+		SnapshotIndex: n.log.snapshotIndex,
+		Members:       []MemberStatus{},
+	}
+
+	for _, member := range n.members {
+		s := MemberStatus{Member: member}
+		if member.ID == n.opts.ID {
+			s.MatchIndex = n.log.lastIndex()
+		} else if p, ok := n.peers[member.ID]; ok {
+			s.MatchIndex = p.matchIndex
+		}
+		status.Members = append(status.Members, s)
+	}
+
+	return status
+}
+
+// propose appends an entry on the leader and waits until it is applied.
+func (n *Node) propose(entryType byte, data []byte) error {
+	n.mu.Lock()
+
+	if n.role != ROLE_LEADER {
+		n.mu.Unlock()
+		return n.notLeader()
+	}
+
+	w, err := n.appendEntry(entryType, data)
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return n.wait(w)
+}
+
+// appendEntry expects mu to be held by the leader.
+func (n *Node) appendEntry(entryType byte, data []byte) (waiter, error) {
+	entry := Entry{Index: n.log.lastIndex() + 1, Term: n.term, Type: entryType, Data: data}
+
+	if err := n.log.append(entry); err != nil {
+		return waiter{}, err
+	}
+
+	if entryType == ENTRY_CONFIG {
+		members, err := decodeMembers(data)
+		if err != nil {
+			return waiter{}, err
+		}
+		n.setMembers(members, entry.Index)
+	}
+
+	w := waiter{term: n.term, done: make(chan error, 1)}
+	n.waiters[entry.Index] = w
+
+	n.advanceCommit()
+	n.triggerPeers()
+
+	return w, nil
+}
+
+// wait returns the outcome of an entry, a write that is neither committed
+// nor dropped in time fails with ErrNoQuorum, it may still be committed
+// later.
+func (n *Node) wait(w waiter) error {
+	timer := time.NewTimer(n.opts.CommitTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-w.done:
+		return err
+	case <-timer.C:
+		return dbengine.ErrNoQuorum
+	case <-n.done:
+		return errStopped
+	}
+}
+
+// applyLoop applies the committed entries in order.
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+
+	for {
+		n.mu.Lock()
+		for !n.stopped && (n.install != nil || n.lastApplied >= n.commitIndex) {
+			n.cond.Wait()
+		}
+
+		if n.stopped {
+			n.mu.Unlock()
+			return
+		}
+
+		count := n.commitIndex - n.lastApplied
+		if count > MAX_ENTRIES_PER_APPEND {
+			count = MAX_ENTRIES_PER_APPEND
+		}
+		entries := n.log.slice(n.lastApplied+1, int(count))
+		n.mu.Unlock()
+
+		for _, entry := range entries {
+			if !n.applyEntry(entry) {
+				break
+			}
+		}
+
+		n.maybeCompact()
+	}
+}
+
+// applyEntry applies the entry after lastApplied. It reports false when
+// the entry is not that one anymore, because a snapshot was installed in
+// the meantime.
+func (n *Node) applyEntry(entry Entry) bool {
+	n.applyLock.Lock()
+	defer n.applyLock.Unlock()
+
+	n.mu.Lock()
+	next := !n.stopped && n.install == nil && n.lastApplied+1 == entry.Index
+	n.mu.Unlock()
+
+	if !next {
+		return false
+	}
+
+	var err error
+	var members []Member
+
+	switch entry.Type {
+	case ENTRY_COMMAND:
+		err = n.applyCommand(entry.Index, entry.Data)
+		if err != nil {
+			fmt.Println("Error applying raft entry", entry.Index, err)
+		}
+	case ENTRY_CONFIG:
+		members, err = decodeMembers(entry.Data)
+	}
+
+	if entry.Type != ENTRY_COMMAND || err != nil {
+		n.db.Wal.Applied(entry.Index, nil)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.lastApplied = entry.Index
+	if members != nil {
+		n.appliedMembers = members
+	}
+
+	if w, ok := n.waiters[entry.Index]; ok {
+		delete(n.waiters, entry.Index)
+
+		if w.term == entry.Term {
+			w.done <- err
+		} else {
+			w.done <- n.notLeader()
+		}
+	}
+
+	n.cond.Broadcast()
+	return true
+}
+
+// applyCommand applies the record of an entry, which the WAL holds as the
+// entry itself.
+func (n *Node) applyCommand(index uint64, data []byte) error {
+	entries, err := wal.DecodeRecord(data)
+	if err != nil {
+		return err
+	}
+
+	batch := dbengine.NewWriteBatch()
+	for _, entry := range entries {
+		batch.Add(entry)
+	}
+
+	return n.db.ApplyLogged(index, batch)
+}
+
+// maybeCompact drops the applied entries once the log holds more than
+// MaxLogEntries. The WAL keeps the ones that are not in the persistent store
+// yet and replays them after a restart.
+func (n *Node) maybeCompact() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.stopped || len(n.log.entries) <= n.opts.MaxLogEntries || n.lastApplied <= n.log.snapshotIndex {
+		return
+	}
+
+	term, _ := n.log.term(n.lastApplied)
+	if err := n.log.compact(n.lastApplied, term, n.appliedMembers); err != nil {
+		fmt.Println("Error compacting the raft log:", err)
+	}
+}
+
+// tickLoop starts an election when the leader is not heard from in time,
+// and makes a leader that lost its majority step down.
+func (n *Node) tickLoop() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(TICK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		switch n.role {
+		case ROLE_LEADER:
+			if time.Since(n.quorumContact()) > n.opts.ElectionTimeout {
+				fmt.Println("Raft leader", n.opts.ID, "lost its majority, stepping down")
+				n.becomeFollower(n.term, "")
+			}
+		default:
+			if time.Now().After(n.electionDeadline) && n.isMember(n.opts.ID) && n.install == nil {
+				n.campaign()
+			}
+		}
+		n.mu.Unlock()
+	}
+}
+
+// campaign expects mu to be held.
+func (n *Node) campaign() {
+	n.role = ROLE_CANDIDATE
+	n.term++
+	n.votedFor = n.opts.ID
+	n.leaderID = ""
+	n.resetElectionTimer()
+
+	if err := n.saveState(); err != nil {
+		fmt.Println("Error saving raft state:", err)
+		return
+	}
+
+	args := RequestVoteArgs{
+		Term:         n.term,
+		CandidateID:  n.opts.ID,
+		LastLogIndex: n.log.lastIndex(),
+		LastLogTerm:  n.log.lastTerm(),
+	}
+	members := n.members
+
+	votes := 0
+	vote := func() {
+		votes++
+		if votes > len(members)/2 && n.role == ROLE_CANDIDATE && n.term == args.Term {
+			n.becomeLeader()
+		}
+	}
+
+	for _, member := range members {
+		if member.ID == n.opts.ID {
+			vote()
+			continue
+		}
+
+		go func(member Member) {
+			var reply RequestVoteReply
+			err := n.transport.call(member.Addr, "RequestVote", &args, &reply, n.opts.ElectionTimeout)
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+
+			if err != nil || n.stopped {
+				return
+			}
+
+			if reply.Term > n.term {
+				n.becomeFollower(reply.Term, "")
+				return
+			}
+
+			if reply.VoteGranted {
+				vote()
+			}
+		}(member)
+	}
+}
+
+// becomeLeader expects mu to be held. The new leader appends a no-op entry,
+// committing it commits every entry before it.
+func (n *Node) becomeLeader() {
+	n.role = ROLE_LEADER
+	n.leaderID = n.opts.ID
+	n.peers = map[string]*peer{}
+
+	fmt.Println("Raft node", n.opts.ID, "is the leader of term", n.term)
+
+	for _, member := range n.members {
+		if member.ID != n.opts.ID {
+			n.addPeer(member)
+		}
+	}
+
+	if _, err := n.appendEntry(ENTRY_NOOP, nil); err != nil {
+		fmt.Println("Error appending to the raft log:", err)
+		n.becomeFollower(n.term, "")
+	}
+}
+
+// becomeFollower expects mu to be held.
+func (n *Node) becomeFollower(term uint64, leaderID string) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+
+		if err := n.saveState(); err != nil {
+			fmt.Println("Error saving raft state:", err)
+		}
+	}
+
+	n.role = ROLE_FOLLOWER
+	n.leaderID = leaderID
+	n.peers = nil
+	n.cond.Broadcast()
+}
+
+// heardFromLeader expects mu to be held and term to be at least the
+// current one.
+func (n *Node) heardFromLeader(term uint64, leaderID string) {
+	if term > n.term || n.role != ROLE_FOLLOWER {
+		n.becomeFollower(term, leaderID)
+	}
+
+	n.leaderID = leaderID
+	n.lastLeaderContact = time.Now()
+	n.resetElectionTimer()
+}
+
+func (n *Node) resetElectionTimer() {
+	timeout := n.opts.ElectionTimeout + time.Duration(rand.Int63n(int64(n.opts.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// lease is how long after a majority acknowledged the leader no other
+// member can have been elected. The members refuse to vote for an election
+// timeout after they heard from the leader, the margin covers clocks that
+// run at different rates.
+func (n *Node) lease() time.Duration {
+	return n.opts.ElectionTimeout * 9 / 10
+}
+
+// quorumContact returns when the last AppendEntries a majority of the
+// members answered was sent, it expects mu to be held by the leader.
+func (n *Node) quorumContact() time.Time {
+	times := []time.Time{}
+
+	for _, member := range n.members {
+		if member.ID == n.opts.ID {
+			times = append(times, time.Now())
+		} else if p, ok := n.peers[member.ID]; ok {
+			times = append(times, p.ackedAt)
+		} else {
+			times = append(times, time.Time{})
+		}
+	}
+
+	if len(times) == 0 {
+		return time.Time{}
+	}
+
+	sort.Slice(times, func(i, j int) bool { return times[i].After(times[j]) })
+	return times[len(times)/2]
+}
+
+// advanceCommit commits the entries a majority has, it expects mu to be
+// held by the leader. Only an entry of the current term is committed by
+// counting, the ones before it are committed with it.
+func (n *Node) advanceCommit() {
+	matches := []uint64{}
+
+	for _, member := range n.members {
+		if member.ID == n.opts.ID {
+			matches = append(matches, n.log.lastIndex())
+		} else if p, ok := n.peers[member.ID]; ok {
+			matches = append(matches, p.matchIndex)
+		} else {
+			matches = append(matches, 0)
+		}
+	}
+
+	if len(matches) == 0 {
+		return
+	}
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+	index := matches[len(matches)/2]
+
+	if index > n.commitIndex {
+		if t, _ := n.log.term(index); t == n.term {
+			n.commitIndex = index
+			n.cond.Broadcast()
+			n.triggerPeers()
+		}
+	}
+
+	if n.commitIndex >= n.configIndex && !n.isMember(n.opts.ID) {
+		fmt.Println("Raft node", n.opts.ID, "was removed from the cluster, stepping down")
+		n.becomeFollower(n.term, "")
+	}
+}
+
+// setMembers expects mu to be held. A leader starts and stops replicating
+// to the members that come and go.
+func (n *Node) setMembers(members []Member, index uint64) {
+	n.members = members
+	n.configIndex = index
+
+	if n.role != ROLE_LEADER {
+		return
+	}
+
+	for _, member := range members {
+		if _, ok := n.peers[member.ID]; !ok && member.ID != n.opts.ID {
+			n.addPeer(member)
+		}
+	}
+
+	for id := range n.peers {
+		if !n.isMember(id) {
+			delete(n.peers, id)
+		}
+	}
+}
+
+// latestConfig returns the last configuration in the log and its index.
+func (n *Node) latestConfig() ([]Member, uint64) {
+	return n.configAt(n.log.lastIndex())
+}
+
+// configAt returns the configuration as of the entry at index and the index
+// of the entry that made it.
+func (n *Node) configAt(index uint64) ([]Member, uint64) {
+	for i := len(n.log.entries) - 1; i >= 0; i-- {
+		entry := n.log.entries[i]
+		if entry.Type != ENTRY_CONFIG || entry.Index > index {
+			continue
+		}
+
+		members, err := decodeMembers(entry.Data)
+		if err != nil {
+			fmt.Println("Error reading raft configuration", entry.Index, err)
+			continue
+		}
+		return members, entry.Index
+	}
+
+	return n.log.snapshotMembers, n.log.snapshotIndex
+}
+
+func (n *Node) isMember(id string) bool {
+	_, ok := n.member(id)
+	return ok
+}
+
+func (n *Node) member(id string) (Member, bool) {
+	for _, member := range n.members {
+		if member.ID == id {
+			return member, true
+		}
+	}
+	return Member{}, false
+}
+
+// notLeader expects mu to be held.
+func (n *Node) notLeader() error {
+	err := &NotLeaderError{LeaderID: n.leaderID}
+	if member, ok := n.member(n.leaderID); ok {
+		err.LeaderAddr = member.ClientAddr
+	}
+	return err
+}
+
+// waitUntil waits for cond until deadline, it expects mu to be held and
+// reports false once the deadline passed or the node stopped.
+func (n *Node) waitUntil(deadline time.Time) bool {
+	d := time.Until(deadline)
+	if d <= 0 || n.stopped {
+		return false
+	}
+
+	timer := time.AfterFunc(d, func() {
+		n.mu.Lock()
+		n.cond.Broadcast()
+		n.mu.Unlock()
+	})
+	n.cond.Wait()
+	timer.Stop()
+
+	return !n.stopped
+}
+
+func (n *Node) handleRequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.stopped {
+		return errStopped
+	}
+
+	reply.Term = n.term
+
+	if args.Term < n.term {
+		return nil
+	}
+
+	// while the leader is heard from no vote is given, so a member that was
+	// removed or cut off can not disrupt the cluster, and the lease of the
+	// leader holds
+	if n.role == ROLE_LEADER || (n.leaderID != "" && time.Since(n.lastLeaderContact) < n.opts.ElectionTimeout) {
+		return nil
+	}
+
+	if args.Term > n.term {
+		n.becomeFollower(args.Term, "")
+		reply.Term = n.term
+	}
+
+	upToDate := args.LastLogTerm > n.log.lastTerm() ||
+		(args.LastLogTerm == n.log.lastTerm() && args.LastLogIndex >= n.log.lastIndex())
+
+	if (n.votedFor == "" || n.votedFor == args.CandidateID) && upToDate {
+		n.votedFor = args.CandidateID
+		if err := n.saveState(); err != nil {
+			return err
+		}
+
+		n.resetElectionTimer()
+		reply.VoteGranted = true
+	}
+
+	return nil
+}
+
+func (n *Node) handleAppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.stopped {
+		return errStopped
+	}
+
+	reply.Term = n.term
+
+	if args.Term < n.term {
+		return nil
+	}
+
+	n.heardFromLeader(args.Term, args.LeaderID)
+	reply.Term = n.term
+
+	// the leader gave up on a snapshot it was sending
+	if n.install != nil {
+		n.install.abort()
+		n.install = nil
+		n.cond.Broadcast()
+	}
+
+	prevIndex := args.PrevLogIndex
+	entries := args.Entries
+
+	if prevIndex < n.log.snapshotIndex {
+		// the entries up to the snapshot were committed, so they match
+		skip := n.log.snapshotIndex - prevIndex
+		if skip > uint64(len(entries)) {
+			skip = uint64(len(entries))
+		}
+		entries = entries[skip:]
+		prevIndex += skip
+	}
+
+	if prevIndex > n.log.lastIndex() {
+		reply.NextIndex = n.log.lastIndex() + 1
+		return nil
+	}
+
+	if t, _ := n.log.term(prevIndex); prevIndex > n.log.snapshotIndex && t != args.PrevLogTerm {
+		// skip back over the whole conflicting term at once
+		next := prevIndex
+		for next > n.log.snapshotIndex+1 {
+			if previous, _ := n.log.term(next - 1); previous != t {
+				break
+			}
+			next--
+		}
+		reply.NextIndex = next
+		return nil
+	}
+
+	for i, entry := range entries {
+		if entry.Index <= n.log.lastIndex() {
+			if t, _ := n.log.term(entry.Index); t == entry.Term {
+				continue
+			}
+
+			if err := n.log.truncate(entry.Index); err != nil {
+				return err
+			}
+			n.dropWaiters(entry.Index)
+		}
+
+		if err := n.log.append(entries[i:]...); err != nil {
+			return err
+		}
+
+		n.members, n.configIndex = n.latestConfig()
+		break
+	}
+
+	last := prevIndex + uint64(len(entries))
+	if args.LeaderCommit > n.commitIndex && last > n.commitIndex {
+		n.commitIndex = args.LeaderCommit
+		if n.commitIndex > last {
+			n.commitIndex = last
+		}
+		n.cond.Broadcast()
+	}
+
+	reply.Success = true
+	return nil
+}
+
+// dropWaiters fails the writes whose entries were replaced by the ones of
+// another leader, it expects mu to be held.
+func (n *Node) dropWaiters(index uint64) {
+	for i, w := range n.waiters {
+		if i >= index {
+			delete(n.waiters, i)
+			w.done <- n.notLeader()
+		}
+	}
+}
+
+// readState returns term 0 and no vote when the file does not exist.
+func readState(path string) (uint64, string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return 0, "", fmt.Errorf("invalid raft state in %s", path)
+	}
+
+	term, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid raft state in %s", path)
+	}
+
+	votedFor := fields[1]
+	if votedFor == "-" {
+		votedFor = ""
+	}
+
+	return term, votedFor, nil
+}
+
+// saveState persists the term and the vote before the node acts on them, a
+// node must not vote twice in a term even across a crash.
+func (n *Node) saveState() error {
+	path := filepath.Join(n.opts.Dir, STATE_FILE_NAME)
+	tmp := filepath.Join(n.opts.Dir, "."+STATE_FILE_NAME+".tmp")
+
+	votedFor := n.votedFor
+	if votedFor == "" {
+		votedFor = "-"
+	}
+
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	fmt.Fprintf(writer, "%d %s\n", n.term, votedFor)
+
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func validID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, " \t\n")
+}
@@ -0,0 +1,124 @@
+package raft
+
+import (
+	"time"
+)
+
+// addPeer starts replicating to a member, it expects mu to be held by the
+// leader.
+func (n *Node) addPeer(member Member) {
+	p := &peer{
+		member:    member,
+		nextIndex: n.log.lastIndex() + 1,
+		// a new peer counts as heard from, so the leader does not step down
+		// before it had a chance to answer
+		ackedAt: time.Now(),
+		trigger: make(chan struct{}, 1),
+	}
+
+	n.peers[member.ID] = p
+	go n.replicate(p, n.term)
+}
+
+// triggerPeers makes every replicating goroutine send right away, it
+// expects mu to be held.
+func (n *Node) triggerPeers() {
+	for _, p := range n.peers {
+		select {
+		case p.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// replicate sends the entries a member misses, or a heartbeat when it has
+// them all, until the node stops leading in term or the member is removed.
+func (n *Node) replicate(p *peer, term uint64) {
+	ticker := time.NewTicker(n.opts.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		n.mu.Lock()
+		if n.stopped || n.role != ROLE_LEADER || n.term != term || n.peers[p.member.ID] != p {
+			n.mu.Unlock()
+			return
+		}
+
+		var err error
+		if p.nextIndex <= n.log.snapshotIndex {
+			n.mu.Unlock()
+			err = n.sendSnapshot(p, term)
+		} else {
+			args := AppendEntriesArgs{
+				Term:         term,
+				LeaderID:     n.opts.ID,
+				PrevLogIndex: p.nextIndex - 1,
+				Entries:      n.log.slice(p.nextIndex, MAX_ENTRIES_PER_APPEND),
+				LeaderCommit: n.commitIndex,
+			}
+			args.PrevLogTerm, _ = n.log.term(args.PrevLogIndex)
+			n.mu.Unlock()
+
+			sentAt := time.Now()
+
+			var reply AppendEntriesReply
+			err = n.transport.call(p.member.Addr, "AppendEntries", &args, &reply, n.opts.ElectionTimeout)
+			if err == nil {
+				n.mu.Lock()
+				n.handleAppendEntriesReply(p, term, &args, &reply, sentAt)
+				n.mu.Unlock()
+			}
+		}
+
+		n.mu.Lock()
+		behind := p.nextIndex <= n.log.lastIndex()
+		n.mu.Unlock()
+
+		if err == nil && behind {
+			continue
+		}
+
+		select {
+		case <-n.done:
+			return
+		case <-p.trigger:
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleAppendEntriesReply expects mu to be held.
+func (n *Node) handleAppendEntriesReply(p *peer, term uint64, args *AppendEntriesArgs, reply *AppendEntriesReply, sentAt time.Time) {
+	if reply.Term > n.term {
+		n.becomeFollower(reply.Term, "")
+		return
+	}
+
+	if n.role != ROLE_LEADER || n.term != term {
+		return
+	}
+
+	if sentAt.After(p.ackedAt) {
+		p.ackedAt = sentAt
+	}
+
+	if reply.Success {
+		match := args.PrevLogIndex + uint64(len(args.Entries))
+		if match > p.matchIndex {
+			p.matchIndex = match
+		}
+		p.nextIndex = match + 1
+
+		n.advanceCommit()
+	} else {
+		p.nextIndex = reply.NextIndex
+		if p.nextIndex < 1 {
+			p.nextIndex = 1
+		}
+		if p.nextIndex > n.log.lastIndex()+1 {
+			p.nextIndex = n.log.lastIndex() + 1
+		}
+	}
+
+	n.cond.Broadcast()
+}
@@ -0,0 +1,189 @@
+package raft
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// RPC_TIMEOUT caps how long a node waits for the answer of another.
+const RPC_TIMEOUT = time.Second
+
+var errRPCTimeout = errors.New("raft rpc timed out")
+
+type RequestVoteArgs struct {
+	Term         uint64
+	CandidateID  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type RequestVoteReply struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+type AppendEntriesArgs struct {
+	Term         uint64
+	LeaderID     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+type AppendEntriesReply struct {
+	Term    uint64
+	Success bool
+	// NextIndex is where the leader should go on from when Success is
+	// false, the first index of the conflicting term or the end of the log
+	NextIndex uint64
+}
+
+// InstallSnapshotArgs carry a chunk of the tree of the leader as of
+// LastIncludedIndex. The chunks come in key order, the first one has First
+// set and the last one Done.
+type InstallSnapshotArgs struct {
+	Term              uint64
+	LeaderID          string
+	LastIncludedIndex uint64
+	LastIncludedTerm  uint64
+	Members           []Member
+	Pairs             []SnapshotPair
+	First             bool
+	Done              bool
+}
+
+type SnapshotPair struct {
+	Key       []byte
+	Value     []byte
+	ExpiresAt int64
+}
+
+type InstallSnapshotReply struct {
+	Term uint64
+}
+
+// service is what the node serves over net/rpc, under the name Raft.
+type service struct {
+	node *Node
+}
+
+func (s *service) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	return s.node.handleRequestVote(args, reply)
+}
+
+func (s *service) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	return s.node.handleAppendEntries(args, reply)
+}
+
+func (s *service) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	return s.node.handleInstallSnapshot(args, reply)
+}
+
+// transport keeps one connection per member. A connection that fails or
+// times out is closed and dialed again by the next call.
+type transport struct {
+	tlsConfig *tls.Config
+
+	lock    sync.Mutex
+	clients map[string]*rpc.Client
+	closed  bool
+}
+
+func newTransport(tlsConfig *tls.Config) *transport {
+	return &transport{tlsConfig: tlsConfig, clients: map[string]*rpc.Client{}}
+}
+
+func (t *transport) call(addr string, method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	client, err := t.client(addr, timeout)
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	call := client.Go("Raft."+method, args, reply, make(chan *rpc.Call, 1))
+
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			t.drop(addr, client)
+		}
+		return call.Error
+	case <-timer.C:
+		t.drop(addr, client)
+		return errRPCTimeout
+	}
+}
+
+func (t *transport) client(addr string, timeout time.Duration) (*rpc.Client, error) {
+	t.lock.Lock()
+	client, ok := t.clients[addr]
+	closed := t.closed
+	t.lock.Unlock()
+
+	if closed {
+		return nil, rpc.ErrShutdown
+	}
+	if ok {
+		return client, nil
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+
+	var conn net.Conn
+	var err error
+	if t.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, t.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client = rpc.NewClient(conn)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// another call may have dialed in the meantime
+	if existing, ok := t.clients[addr]; ok {
+		client.Close()
+		return existing, nil
+	}
+
+	if t.closed {
+		client.Close()
+		return nil, rpc.ErrShutdown
+	}
+
+	t.clients[addr] = client
+	return client, nil
+}
+
+func (t *transport) drop(addr string, client *rpc.Client) {
+	t.lock.Lock()
+	if t.clients[addr] == client {
+		delete(t.clients, addr)
+	}
+	t.lock.Unlock()
+
+	client.Close()
+}
+
+func (t *transport) close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.closed = true
+	for addr, client := range t.clients {
+		client.Close()
+		delete(t.clients, addr)
+	}
+}
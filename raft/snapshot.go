@@ -0,0 +1,307 @@
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+
+	dbengine "github.com/Avash027/midDB/db_engine"
+	LsmTree "github.com/Avash027/midDB/lsm_tree"
+	"github.com/Avash027/midDB/wal"
+)
+
+var errInstallAborted = errors.New("snapshot install aborted")
+
+// sendSnapshot sends the tree of the leader as of lastApplied in chunks,
+// then goes on with the entries after it.
+func (n *Node) sendSnapshot(p *peer, term uint64) error {
+	// no entry is half applied while the tree is captured
+	n.applyLock.Lock()
+	n.mu.Lock()
+	index := n.lastApplied
+	indexTerm, _ := n.log.term(index)
+	members := n.appliedMembers
+	n.mu.Unlock()
+	snapshot := n.db.LsmTree.Snapshot()
+	n.applyLock.Unlock()
+
+	defer snapshot.Release()
+
+	it := snapshot.NewIterator()
+	defer it.Close()
+	it.SeekToFirst()
+
+	first := true
+	for {
+		args := InstallSnapshotArgs{
+			Term:              term,
+			LeaderID:          n.opts.ID,
+			LastIncludedIndex: index,
+			LastIncludedTerm:  indexTerm,
+			Members:           members,
+			First:             first,
+		}
+
+		for ; it.Valid() && len(args.Pairs) < SNAPSHOT_BATCH_SIZE; it.Next() {
+			args.Pairs = append(args.Pairs, SnapshotPair{
+				Key:       append([]byte{}, it.Key()...),
+				Value:     append([]byte{}, it.Value()...),
+				ExpiresAt: it.ExpiresAt(),
+			})
+		}
+
+		if err := it.Err(); err != nil {
+			return err
+		}
+		args.Done = !it.Valid()
+
+		var reply InstallSnapshotReply
+		if err := n.transport.call(p.member.Addr, "InstallSnapshot", &args, &reply, n.opts.ElectionTimeout); err != nil {
+			return err
+		}
+
+		n.mu.Lock()
+		if reply.Term > n.term {
+			n.becomeFollower(reply.Term, "")
+		}
+		leading := n.role == ROLE_LEADER && n.term == term
+		n.mu.Unlock()
+
+		if !leading {
+			return nil
+		}
+
+		if args.Done {
+			break
+		}
+		first = false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.role == ROLE_LEADER && n.term == term {
+		if index > p.matchIndex {
+			p.matchIndex = index
+		}
+		p.nextIndex = index + 1
+		n.advanceCommit()
+	}
+
+	return nil
+}
+
+func (n *Node) handleInstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	n.mu.Lock()
+
+	if n.stopped {
+		n.mu.Unlock()
+		return errStopped
+	}
+
+	reply.Term = n.term
+
+	if args.Term < n.term {
+		n.mu.Unlock()
+		return nil
+	}
+
+	n.heardFromLeader(args.Term, args.LeaderID)
+	reply.Term = n.term
+
+	// the node has it all already, the leader goes on from there
+	if args.LastIncludedIndex <= n.lastApplied {
+		n.mu.Unlock()
+		return nil
+	}
+
+	if args.First {
+		if n.install != nil {
+			n.install.abort()
+			n.install = nil
+		}
+		n.mu.Unlock()
+
+		// waits for the entry being applied, the applier waits for the
+		// install from then on
+		n.applyLock.Lock()
+		n.mu.Lock()
+
+		// the entries that were not applied go, so the WAL replays the
+		// ones that were before the snapshot and none after it
+		if err := n.log.truncate(n.lastApplied + 1); err != nil {
+			n.mu.Unlock()
+			n.applyLock.Unlock()
+			return err
+		}
+		n.dropWaiters(n.lastApplied + 1)
+		n.members, n.configIndex = n.latestConfig()
+		if n.commitIndex > n.lastApplied {
+			n.commitIndex = n.lastApplied
+		}
+
+		if !n.stopped {
+			n.install = newInstall(n.db, args.LastIncludedIndex, args.LastIncludedTerm)
+		}
+		n.applyLock.Unlock()
+	}
+
+	inst := n.install
+	n.mu.Unlock()
+
+	if inst == nil || inst.index != args.LastIncludedIndex || inst.term != args.LastIncludedTerm {
+		return errOutOfOrder
+	}
+
+	if err := inst.apply(args.Pairs, args.Done); err != nil {
+		return err
+	}
+
+	if !args.Done {
+		return nil
+	}
+
+	if err := n.db.Wal.Persist(); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.install != inst {
+		return errInstallAborted
+	}
+	n.install = nil
+
+	if err := n.log.compact(args.LastIncludedIndex, args.LastIncludedTerm, args.Members); err != nil {
+		return err
+	}
+	n.db.Wal.Applied(args.LastIncludedIndex, nil)
+
+	n.members, n.configIndex = n.latestConfig()
+	n.appliedMembers = args.Members
+	n.lastApplied = args.LastIncludedIndex
+	if n.commitIndex < args.LastIncludedIndex {
+		n.commitIndex = args.LastIncludedIndex
+	}
+	n.cond.Broadcast()
+
+	return nil
+}
+
+// install turns the tree of a follower into a snapshot of the leader. The
+// pairs arrive in key order, so they are merged with the keys of the tree
+// and the keys the leader does not have are deleted on the way.
+type install struct {
+	db    *dbengine.DBEngine
+	index uint64
+	term  uint64
+
+	lock     sync.Mutex
+	snapshot *LsmTree.Snapshot
+	it       *LsmTree.Iterator
+	batch    *dbengine.WriteBatch
+	aborted  bool
+}
+
+// newInstall expects applyLock to be held, so the local tree does not
+// change but for the writes of the install.
+func newInstall(db *dbengine.DBEngine, index uint64, term uint64) *install {
+	snapshot := db.LsmTree.Snapshot()
+	it := snapshot.NewIterator()
+	it.SeekToFirst()
+
+	return &install{
+		db:       db,
+		index:    index,
+		term:     term,
+		snapshot: snapshot,
+		it:       it,
+		batch:    dbengine.NewWriteBatch(),
+	}
+}
+
+// apply merges a chunk, the last one deletes the local keys that are left.
+func (i *install) apply(pairs []SnapshotPair, done bool) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if i.aborted {
+		return errInstallAborted
+	}
+
+	for _, pair := range pairs {
+		if err := i.deleteUntil(pair.Key); err != nil {
+			return err
+		}
+		if i.it.Valid() && bytes.Equal(i.it.Key(), pair.Key) {
+			i.it.Next()
+		}
+
+		i.batch.Add(wal.Entry{Key: pair.Key, Value: pair.Value, ExpiresAt: pair.ExpiresAt})
+
+		if i.batch.Len() >= SNAPSHOT_BATCH_SIZE {
+			if err := i.flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if done {
+		if err := i.deleteUntil(nil); err != nil {
+			return err
+		}
+
+		if err := i.it.Err(); err != nil {
+			return err
+		}
+
+		i.release()
+	}
+
+	return i.flush()
+}
+
+// deleteUntil deletes the local keys below key, or all that are left when
+// key is nil.
+func (i *install) deleteUntil(key []byte) error {
+	for ; i.it.Valid() && (key == nil || bytes.Compare(i.it.Key(), key) < 0); i.it.Next() {
+		i.batch.Delete(i.it.Key())
+
+		if i.batch.Len() >= SNAPSHOT_BATCH_SIZE {
+			if err := i.flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (i *install) flush() error {
+	if err := i.db.ApplyCommitted(i.batch); err != nil {
+		return err
+	}
+
+	i.batch.Reset()
+	return nil
+}
+
+// abort stops an install the leader gave up on. The tree is a mix of both
+// until the node catches up again, it is never read in the meantime since
+// only the leader serves reads.
+func (i *install) abort() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.aborted = true
+	i.release()
+}
+
+func (i *install) release() {
+	if i.it != nil {
+		i.it.Close()
+		i.snapshot.Release()
+		i.it = nil
+	}
+}
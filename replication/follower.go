@@ -0,0 +1,370 @@
+package replication
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	dbengine "github.com/Avash027/midDB/db_engine"
+	"github.com/Avash027/midDB/wal"
+)
+
+type FollowerOpts struct {
+	// LeaderAddr is the host:port of the replication port of the leader
+	LeaderAddr string
+	// User and Password authenticate the follower when the leader has
+	// users, the user has to be an admin
+	User     string
+	Password string
+	// TLSConfig, when set, secures the connection to the leader
+	TLSConfig *tls.Config
+	// StateFile is where the follower keeps what it has of the leader
+	StateFile string
+}
+
+// Follower applies the changes of a leader to the default namespace. The
+// engine is set as a follower, so the changes of the leader are the only
+// writes it takes.
+type Follower struct {
+	db   *dbengine.DBEngine
+	opts FollowerOpts
+
+	lock      sync.Mutex
+	state     state
+	connected bool
+	leaderSeq uint64
+}
+
+func NewFollower(db *dbengine.DBEngine, opts FollowerOpts) (*Follower, error) {
+	s, err := readState(opts.StateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetFollower(true)
+
+	return &Follower{db: db, opts: opts, state: s}, nil
+}
+
+// Run follows the leader, connecting again whenever the connection breaks.
+// It never returns.
+func (f *Follower) Run() {
+	for {
+		err := f.follow()
+
+		f.lock.Lock()
+		f.connected = false
+		f.lock.Unlock()
+
+		fmt.Println("Replication from", f.opts.LeaderAddr, "stopped:", err)
+		time.Sleep(RETRY_INTERVAL)
+	}
+}
+
+func (f *Follower) Status() Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return Status{
+		Role:      ROLE_FOLLOWER,
+		RunID:     f.state.runID,
+		Seq:       f.state.seq,
+		Leader:    f.opts.LeaderAddr,
+		Connected: f.connected,
+		LeaderSeq: f.leaderSeq,
+	}
+}
+
+// follow applies the messages of the leader until the connection breaks.
+// The changes are acknowledged once there is nothing left to read, so one
+// WAL sync covers all of them.
+func (f *Follower) follow() error {
+	conn, err := f.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	f.lock.Lock()
+	s := f.state
+	f.lock.Unlock()
+
+	runID := s.runID
+	if runID == "" {
+		runID = "-"
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
+	fmt.Fprintf(writer, "FOLLOW %s %d %d %d\n", runID, s.seq, len(f.opts.User), len(f.opts.Password))
+	writer.WriteString(f.opts.User)
+	writer.WriteString(f.opts.Password)
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	// unacked is set when changes were applied or the leader pinged since
+	// the last ACK
+	unacked := false
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(TIMEOUT))
+
+		fields, err := readHeader(reader)
+		if err != nil {
+			return err
+		}
+
+		switch string(fields[0]) {
+		case "ERROR":
+			return errors.New(string(bytes.Join(fields[1:], []byte(" "))))
+		case "CONTINUE":
+			if len(fields) != 3 {
+				return errInvalidMessage
+			}
+
+			f.lock.Lock()
+			f.connected = true
+			f.lock.Unlock()
+		case "SNAPSHOT":
+			if len(fields) != 3 {
+				return errInvalidMessage
+			}
+
+			seq, err := strconv.ParseUint(string(fields[2]), 10, 64)
+			if err != nil {
+				return errInvalidMessage
+			}
+
+			if err := f.applySnapshot(conn, reader, writer); err != nil {
+				return err
+			}
+
+			s = state{runID: string(fields[1]), seq: seq}
+			if err := f.save(s, seq); err != nil {
+				return err
+			}
+
+			f.lock.Lock()
+			f.connected = true
+			f.lock.Unlock()
+
+			unacked = true
+		case "RECORD":
+			if len(fields) != 3 {
+				return errInvalidMessage
+			}
+
+			numbers, err := parseUints(fields[1:])
+			if err != nil {
+				return err
+			}
+
+			record, err := readBody(reader, numbers[1], MAX_MESSAGE_SIZE)
+			if err != nil {
+				return err
+			}
+
+			entries, err := wal.DecodeRecord(record)
+			if err != nil {
+				return err
+			}
+
+			// a record applied before a crash may be sent again
+			if numbers[0] > s.seq {
+				batch := dbengine.NewWriteBatch()
+				for _, entry := range entries {
+					batch.Add(entry)
+				}
+
+				if err := f.db.ApplyReplicated(batch); err != nil {
+					return err
+				}
+				s.seq = numbers[0]
+			}
+
+			unacked = true
+		case "PING":
+			if len(fields) != 2 {
+				return errInvalidMessage
+			}
+
+			seq, err := strconv.ParseUint(string(fields[1]), 10, 64)
+			if err != nil {
+				return errInvalidMessage
+			}
+
+			f.lock.Lock()
+			f.leaderSeq = seq
+			f.lock.Unlock()
+
+			unacked = true
+		default:
+			return errInvalidMessage
+		}
+
+		if unacked && reader.Buffered() == 0 {
+			if err := f.save(s, s.seq); err != nil {
+				return err
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
+			fmt.Fprintf(writer, "ACK %d\n", s.seq)
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+
+			unacked = false
+		}
+	}
+}
+
+// save persists the WAL and then the state, so the state is never ahead of
+// the data.
+func (f *Follower) save(s state, leaderSeq uint64) error {
+	if err := f.db.Wal.Persist(); err != nil {
+		return err
+	}
+
+	if err := writeState(f.opts.StateFile, s); err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	f.state = s
+	if leaderSeq > f.leaderSeq {
+		f.leaderSeq = leaderSeq
+	}
+	f.lock.Unlock()
+
+	return nil
+}
+
+// applySnapshot turns the tree into the snapshot that follows, up to END.
+// The pairs arrive in key order, so they are merged with the keys of the
+// tree and the keys the leader does not have are deleted on the way. The
+// state is removed first, since the tree is a mix of both until END.
+func (f *Follower) applySnapshot(conn net.Conn, reader *bufio.Reader, writer *bufio.Writer) error {
+	if err := os.Remove(f.opts.StateFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	f.lock.Lock()
+	f.state = state{}
+	f.lock.Unlock()
+
+	// the follower is the only writer, so the local keys do not change
+	// but for the writes below
+	snapshot := f.db.LsmTree.Snapshot()
+	defer snapshot.Release()
+
+	it := snapshot.NewIterator()
+	defer it.Close()
+	it.SeekToFirst()
+
+	batch := dbengine.NewWriteBatch()
+	apply := func() error {
+		if err := f.db.ApplyReplicated(batch); err != nil {
+			return err
+		}
+		batch.Reset()
+
+		// keeps the leader from dropping a follower busy with a large
+		// snapshot, 0 acknowledges nothing
+		conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
+		fmt.Fprintf(writer, "ACK 0\n")
+		return writer.Flush()
+	}
+
+	// deleteUntil deletes the local keys below key, or all that are left
+	// when key is nil
+	deleteUntil := func(key []byte) error {
+		for ; it.Valid() && (key == nil || bytes.Compare(it.Key(), key) < 0); it.Next() {
+			batch.Delete(it.Key())
+
+			if batch.Len() >= SNAPSHOT_BATCH_SIZE {
+				if err := apply(); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(TIMEOUT))
+
+		fields, err := readHeader(reader)
+		if err != nil {
+			return err
+		}
+
+		if string(fields[0]) == "END" {
+			break
+		}
+
+		if len(fields) != 4 || string(fields[0]) != "PAIR" {
+			return errInvalidMessage
+		}
+
+		numbers, err := parseUints(fields[1:])
+		if err != nil {
+			return err
+		}
+
+		key, err := readBody(reader, numbers[0], MAX_MESSAGE_SIZE)
+		if err != nil {
+			return err
+		}
+
+		value, err := readBody(reader, numbers[1], MAX_MESSAGE_SIZE)
+		if err != nil {
+			return err
+		}
+
+		if err := deleteUntil(key); err != nil {
+			return err
+		}
+		if it.Valid() && bytes.Equal(it.Key(), key) {
+			it.Next()
+		}
+
+		batch.Add(wal.Entry{Key: key, Value: value, ExpiresAt: int64(numbers[2])})
+
+		if batch.Len() >= SNAPSHOT_BATCH_SIZE {
+			if err := apply(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := deleteUntil(nil); err != nil {
+		return err
+	}
+
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	return apply()
+}
+
+func (f *Follower) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: TIMEOUT}
+
+	if f.opts.TLSConfig != nil {
+		return tls.DialWithDialer(dialer, "tcp", f.opts.LeaderAddr, f.opts.TLSConfig)
+	}
+
+	return dialer.Dial("tcp", f.opts.LeaderAddr)
+}
@@ -0,0 +1,362 @@
+package replication
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Avash027/midDB/auth"
+	dbengine "github.com/Avash027/midDB/db_engine"
+	"github.com/Avash027/midDB/wal"
+)
+
+type LeaderOpts struct {
+	// Mode is MODE_ASYNC or MODE_SYNC
+	Mode        string
+	SyncTimeout time.Duration
+	MinAcks     int
+	// Users, when set, only lets admins follow
+	Users *auth.Users
+}
+
+// Leader streams the WAL of the default namespace to its followers. In
+// MODE_SYNC it is the Replicator of the engine.
+type Leader struct {
+	db    *dbengine.DBEngine
+	opts  LeaderOpts
+	runID string
+
+	lock      sync.Mutex
+	followers map[*followerConn]struct{}
+	// acked is closed when a follower acknowledges, see WaitForReplicas
+	acked chan struct{}
+}
+
+// followerConn is a connection of a follower. acked is guarded by the lock
+// of the leader.
+type followerConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	acked  uint64
+	// done is closed when the follower goes away
+	done chan struct{}
+}
+
+func NewLeader(db *dbengine.DBEngine, opts LeaderOpts) (*Leader, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	l := &Leader{
+		db:        db,
+		opts:      opts,
+		runID:     hex.EncodeToString(id),
+		followers: map[*followerConn]struct{}{},
+	}
+
+	if opts.Mode == MODE_SYNC {
+		db.Replicator = l
+	}
+
+	return l, nil
+}
+
+// Serve accepts followers until the listener is closed.
+func (l *Leader) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go l.serve(conn)
+	}
+}
+
+// CheckReplicas refuses writes while fewer than MinAcks followers are
+// connected, they would only wait for SyncTimeout to fail.
+func (l *Leader) CheckReplicas() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if len(l.followers) < l.opts.MinAcks {
+		return dbengine.ErrNoReplicas
+	}
+
+	return nil
+}
+
+// WaitForReplicas waits until MinAcks followers acknowledged seq, for at
+// most SyncTimeout. The write is already applied when it times out, which
+// happens when a follower goes away or falls behind after CheckReplicas.
+func (l *Leader) WaitForReplicas(seq uint64) error {
+	timer := time.NewTimer(l.opts.SyncTimeout)
+	defer timer.Stop()
+
+	for {
+		l.lock.Lock()
+		acks := 0
+		for f := range l.followers {
+			if f.acked >= seq {
+				acks++
+			}
+		}
+
+		if l.acked == nil {
+			l.acked = make(chan struct{})
+		}
+		acked := l.acked
+		l.lock.Unlock()
+
+		if acks >= l.opts.MinAcks {
+			return nil
+		}
+
+		select {
+		case <-acked:
+		case <-timer.C:
+			return dbengine.ErrReplicaTimeout
+		}
+	}
+}
+
+func (l *Leader) Status() Status {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	status := Status{
+		Role:      ROLE_LEADER,
+		RunID:     l.runID,
+		Seq:       l.db.LastSeq(),
+		Mode:      l.opts.Mode,
+		Followers: []FollowerStatus{},
+	}
+
+	for f := range l.followers {
+		status.Followers = append(status.Followers, FollowerStatus{Addr: f.conn.RemoteAddr().String(), Acked: f.acked})
+	}
+
+	return status
+}
+
+func (l *Leader) serve(conn net.Conn) {
+	defer conn.Close()
+
+	f := &followerConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+		done:   make(chan struct{}),
+	}
+
+	conn.SetDeadline(time.Now().Add(TIMEOUT))
+
+	runID, seq, err := l.handshake(f.reader)
+	if err != nil {
+		fmt.Fprintf(f.writer, "ERROR %s\n", err)
+		f.writer.Flush()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	l.lock.Lock()
+	l.followers[f] = struct{}{}
+	l.lock.Unlock()
+
+	defer func() {
+		l.lock.Lock()
+		delete(l.followers, f)
+		l.lock.Unlock()
+	}()
+
+	go l.readAcks(f)
+
+	if err := l.stream(f, runID, seq); err != nil {
+		fmt.Println("Replication to", conn.RemoteAddr(), "stopped:", err)
+	}
+}
+
+// handshake reads FOLLOW and checks the credentials of the follower.
+func (l *Leader) handshake(reader *bufio.Reader) (string, uint64, error) {
+	fields, err := readHeader(reader)
+	if err != nil || len(fields) != 5 || string(fields[0]) != "FOLLOW" {
+		return "", 0, errInvalidMessage
+	}
+
+	numbers, err := parseUints(fields[2:])
+	if err != nil {
+		return "", 0, err
+	}
+
+	user, err := readBody(reader, numbers[1], MAX_CREDENTIAL_SIZE)
+	if err != nil {
+		return "", 0, err
+	}
+
+	password, err := readBody(reader, numbers[2], MAX_CREDENTIAL_SIZE)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if l.opts.Users != nil {
+		u, ok := l.opts.Users.Authenticate(string(user), password)
+		if !ok || !u.IsAdmin() {
+			return "", 0, fmt.Errorf("permission denied")
+		}
+	}
+
+	return string(fields[1]), numbers[0], nil
+}
+
+// readAcks records the acknowledgements of the follower until it goes away.
+func (l *Leader) readAcks(f *followerConn) {
+	defer close(f.done)
+	// the stream may be blocked writing to a follower that is gone
+	defer f.conn.Close()
+
+	for {
+		f.conn.SetReadDeadline(time.Now().Add(TIMEOUT))
+
+		fields, err := readHeader(f.reader)
+		if err != nil || len(fields) != 2 || string(fields[0]) != "ACK" {
+			return
+		}
+
+		seq, err := strconv.ParseUint(string(fields[1]), 10, 64)
+		if err != nil {
+			return
+		}
+
+		l.lock.Lock()
+		if seq > f.acked {
+			f.acked = seq
+		}
+		if l.acked != nil {
+			close(l.acked)
+			l.acked = nil
+		}
+		l.lock.Unlock()
+	}
+}
+
+// stream sends the changes after seq, starting with a snapshot when the
+// follower comes from another run of the leader or is too far behind.
+func (l *Leader) stream(f *followerConn, runID string, seq uint64) error {
+	resume := runID == l.runID
+	if resume {
+		if _, _, err := l.db.Wal.Changes(seq, 1); err != nil {
+			resume = false
+		}
+	}
+
+	var err error
+	if resume {
+		f.conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
+		fmt.Fprintf(f.writer, "CONTINUE %s %d\n", l.runID, seq)
+	} else if seq, err = l.sendSnapshot(f); err != nil {
+		return err
+	}
+
+	ping := time.NewTicker(PING_INTERVAL)
+	defer ping.Stop()
+
+	// entries holds the first entries of a record that was only read in
+	// part
+	entries := []wal.Entry{}
+
+	for {
+		select {
+		case <-f.done:
+			return nil
+		default:
+		}
+
+		changes, written, err := l.db.Wal.Changes(seq, MAX_CHANGES_PER_READ)
+		if err == wal.ErrSeqTooOld {
+			entries = entries[:0]
+			if seq, err = l.sendSnapshot(f); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if len(changes) == 0 {
+			if err := f.writer.Flush(); err != nil {
+				return err
+			}
+
+			select {
+			case <-f.done:
+				return nil
+			case <-written:
+			case <-ping.C:
+				f.conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
+				fmt.Fprintf(f.writer, "PING %d\n", seq)
+			}
+			continue
+		}
+
+		// a follower never holds a write the leader could lose
+		if err := l.db.Wal.Persist(); err != nil {
+			return err
+		}
+
+		f.conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
+
+		for _, change := range changes {
+			seq = change.Seq
+			entries = append(entries, change.Entry)
+
+			if change.LastInRecord {
+				record := wal.EncodeRecord(entries)
+				fmt.Fprintf(f.writer, "RECORD %d %d\n", seq, len(record))
+				f.writer.Write(record)
+				entries = entries[:0]
+			}
+		}
+	}
+}
+
+// sendSnapshot sends every live pair of the tree and returns the sequence
+// number the snapshot was taken at.
+func (l *Leader) sendSnapshot(f *followerConn) (uint64, error) {
+	snapshot := l.db.Snapshot()
+	defer snapshot.Release()
+
+	if err := l.db.Wal.Persist(); err != nil {
+		return 0, err
+	}
+
+	it := snapshot.NewIterator()
+	defer it.Close()
+
+	f.conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
+	fmt.Fprintf(f.writer, "SNAPSHOT %s %d\n", l.runID, snapshot.Seq)
+
+	count := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if count++; count%SNAPSHOT_BATCH_SIZE == 0 {
+			f.conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
+		}
+
+		fmt.Fprintf(f.writer, "PAIR %d %d %d\n", len(it.Key()), len(it.Value()), it.ExpiresAt())
+		f.writer.Write(it.Key())
+		if _, err := f.writer.Write(it.Value()); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := it.Err(); err != nil {
+		return 0, err
+	}
+
+	fmt.Fprintf(f.writer, "END\n")
+	return snapshot.Seq, f.writer.Flush()
+}
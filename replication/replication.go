@@ -0,0 +1,222 @@
+// Package replication copies the default namespace of a leader to its
+// followers.
+//
+// A follower connects to the replication port of the leader and sends the
+// run ID and the sequence number it has. The run ID is drawn each time the
+// leader starts. When it matches and the leader still retains the changes
+// that came after the sequence number, the leader streams those changes,
+// one message per WAL record. Otherwise it first sends a full snapshot of
+// its tree, which the follower turns its own tree into.
+//
+// Every message is a header line of space separated fields, some followed
+// by raw bytes:
+//
+//	follower -> leader
+//	FOLLOW <run id or -> <seq> <user length> <password length>\n<user><password>
+//	ACK <seq>\n
+//
+//	leader -> follower
+//	CONTINUE <run id> <seq>\n
+//	SNAPSHOT <run id> <seq>\n
+//	PAIR <key length> <value length> <expires at>\n<key><value>
+//	END\n
+//	RECORD <seq of the last entry> <length>\n<WAL record>
+//	PING <last seq>\n
+//	ERROR <message>\n
+//
+// The leader persists its WAL before sending what it holds, and a follower
+// persists its own before acknowledging, so an acknowledged write survives
+// a crash of either.
+package replication
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	fileutil "github.com/Avash027/midDB/internal/file_util"
+)
+
+const (
+	ROLE_LEADER   = "leader"
+	ROLE_FOLLOWER = "follower"
+)
+
+// In MODE_ASYNC writes return as soon as the leader applied them, in
+// MODE_SYNC they also wait for the acknowledgement of MinAcks followers.
+const (
+	MODE_ASYNC = "async"
+	MODE_SYNC  = "sync"
+)
+
+const DEFAULT_PORT = "7070"
+const DEFAULT_MODE = MODE_ASYNC
+const DEFAULT_SYNC_TIMEOUT_IN_MS = 1000
+const DEFAULT_MIN_ACKS = 1
+
+// STATE_FILE_NAME is the file in the data directory of a follower that holds
+// the run ID of its leader and the sequence number it has applied.
+const STATE_FILE_NAME = "REPLICATION"
+
+// PING_INTERVAL is how often an idle leader tells its followers its last
+// sequence number, the followers acknowledge every ping.
+const PING_INTERVAL = time.Second
+
+// TIMEOUT is how long either side waits for the other before dropping the
+// connection.
+const TIMEOUT = 5 * time.Second
+
+// RETRY_INTERVAL is how long a follower waits before connecting again.
+const RETRY_INTERVAL = time.Second
+
+// MAX_CHANGES_PER_READ caps how many changes the leader reads from the WAL
+// at once, and SNAPSHOT_BATCH_SIZE how many pairs of a snapshot a follower
+// applies as one batch.
+const MAX_CHANGES_PER_READ = 1024
+const SNAPSHOT_BATCH_SIZE = 1024
+
+// MAX_MESSAGE_SIZE caps the length a message may announce, and
+// MAX_CREDENTIAL_SIZE the length of the user and password a follower sends
+// before it is authenticated.
+const MAX_MESSAGE_SIZE = 256 * 1024 * 1024
+const MAX_CREDENTIAL_SIZE = 1024
+
+var errInvalidMessage = errors.New("invalid replication message")
+
+// Status describes the replication of a node.
+type Status struct {
+	Role  string
+	RunID string
+	// Seq is the last sequence number of a leader, or the last sequence
+	// number of the leader a follower has applied
+	Seq uint64
+
+	// Mode and Followers are set on a leader
+	Mode      string
+	Followers []FollowerStatus
+
+	// Leader, Connected and LeaderSeq are set on a follower
+	Leader    string
+	Connected bool
+	LeaderSeq uint64
+}
+
+// FollowerStatus describes a follower connected to the leader.
+type FollowerStatus struct {
+	Addr  string
+	Acked uint64
+}
+
+// state is what a follower has of its leader.
+type state struct {
+	runID string
+	seq   uint64
+}
+
+// readState returns the empty state when the file does not exist.
+func readState(path string) (state, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state{}, nil
+	}
+	if err != nil {
+		return state{}, err
+	}
+
+	fields := bytes.Fields(data)
+	if len(fields) != 2 {
+		return state{}, fmt.Errorf("invalid replication state in %s", path)
+	}
+
+	seq, err := strconv.ParseUint(string(fields[1]), 10, 64)
+	if err != nil {
+		return state{}, fmt.Errorf("invalid replication state in %s", path)
+	}
+
+	return state{runID: string(fields[0]), seq: seq}, nil
+}
+
+// writeState replaces the file in one rename, once the new file is synced,
+// so a crash leaves either state whole. It is only called once the WAL
+// holding the changes up to the sequence number was persisted, so the
+// state is never ahead of the data. A state lost in a crash is behind,
+// and the changes it misses are applied again.
+func writeState(path string, s state) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(file, "%s %d\n", s.runID, s.seq); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	return fileutil.SyncDir(filepath.Dir(path))
+}
+
+// readHeader reads the next header line and splits it into its fields.
+func readHeader(reader *bufio.Reader) ([][]byte, error) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	fields := bytes.Fields(line)
+	if len(fields) == 0 {
+		return nil, errInvalidMessage
+	}
+
+	return fields, nil
+}
+
+// readBody reads the bytes that follow a header, which may not be longer
+// than limit.
+func readBody(reader *bufio.Reader, length uint64, limit uint64) ([]byte, error) {
+	if length > limit {
+		return nil, errInvalidMessage
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
+
+// parseUints parses every field as a number.
+func parseUints(fields [][]byte) ([]uint64, error) {
+	numbers := make([]uint64, len(fields))
+
+	for i, field := range fields {
+		number, err := strconv.ParseUint(string(field), 10, 64)
+		if err != nil {
+			return nil, errInvalidMessage
+		}
+		numbers[i] = number
+	}
+
+	return numbers, nil
+}
@@ -0,0 +1,4 @@
+// Package rpc holds the protobuf messages and the gRPC service of midDB.
+package rpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative middb.proto
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/Avash027/midDB/backup"
+)
+
+// backup handles BACKUP path, which writes a consistent copy of every
+// namespace to a directory of the server while it keeps serving.
+func (s *session) backup(cmd [][]byte) reply {
+	if len(cmd) != 2 {
+		return invalidReply("Invalid command")
+	}
+
+	manifest, err := backup.Create(s.root, string(cmd[1]))
+	if errors.Is(err, backup.ErrNotEmpty) {
+		return invalidReply(err.Error())
+	} else if err != nil {
+		return errorReply(err.Error())
+	}
+
+	return backupReply(manifest)
+}
+
+// backupReply lists the time of the backup, its number of files and one
+// namespace:<name> pair per namespace with the sequence number of the last
+// write it holds.
+func backupReply(manifest *backup.Manifest) reply {
+	fields := [][2]string{
+		{"time", strconv.FormatInt(manifest.Time, 10)},
+		{"files", strconv.Itoa(len(manifest.Files))},
+	}
+
+	for _, namespace := range manifest.Namespaces {
+		fields = append(fields, [2]string{"namespace:" + namespace.Name, strconv.FormatUint(namespace.Seq, 10)})
+	}
+
+	r := reply{status: STATUS_OK, pairs: true}
+	for _, field := range fields {
+		r.values = append(r.values, []byte(field[0]), []byte(field[1]))
+	}
+
+	return r
+}
@@ -0,0 +1,415 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Avash027/midDB/auth"
+	dbengine "github.com/Avash027/midDB/db_engine"
+	LsmTree "github.com/Avash027/midDB/lsm_tree"
+	"github.com/Avash027/midDB/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const DEFAULT_GRPC_PORT = "9090"
+
+// GRPC_SCAN_PAGE_SIZE is how many pairs a streaming Scan reads from the
+// engine at a time.
+const GRPC_SCAN_PAGE_SIZE = 1000
+
+// grpcServer implements the KV service described in rpc/middb.proto. When
+// authentication is on every call carries an authorization metadata entry
+// holding "Basic " and the base64 of user:password, as with HTTP. A
+// namespace metadata entry runs the call in that namespace.
+type grpcServer struct {
+	rpc.UnimplementedKVServer
+
+	db    *dbengine.DBEngine
+	users *auth.Users
+}
+
+type grpcUserKey struct{}
+
+// authenticatedStream is a stream whose context holds the user.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+func newGRPCServer(db *dbengine.DBEngine, users *auth.Users) *grpcServer {
+	return &grpcServer{db: db, users: users}
+}
+
+func (s *grpcServer) authenticateUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+func (s *grpcServer) authenticateStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+}
+
+// authenticate checks the user and password of a call and adds the user to
+// its context.
+func (s *grpcServer) authenticate(ctx context.Context) (context.Context, error) {
+	if s.users == nil {
+		return ctx, nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "authentication required")
+	}
+
+	name, password, ok := parseBasicAuth(values[0])
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "invalid authorization")
+	}
+
+	user, ok := s.users.Authenticate(name, []byte(password))
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "invalid user or password")
+	}
+
+	return context.WithValue(ctx, grpcUserKey{}, user), nil
+}
+
+// authorize returns a PermissionDenied error unless check passes for the
+// user of the call.
+func (s *grpcServer) authorize(ctx context.Context, check func(user *auth.User) bool) error {
+	if s.users == nil || check(ctx.Value(grpcUserKey{}).(*auth.User)) {
+		return nil
+	}
+
+	return status.Error(codes.PermissionDenied, "permission denied")
+}
+
+// namespace returns the engine of the namespace named by the metadata of
+// the call, the default one when there is none. The user must be allowed to
+// use it.
+func (s *grpcServer) namespace(ctx context.Context) (*dbengine.DBEngine, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("namespace")
+	if len(values) == 0 {
+		return s.db, nil
+	}
+
+	if err := s.authorize(ctx, func(user *auth.User) bool { return user.CanSelect(values[0]) }); err != nil {
+		return nil, err
+	}
+
+	db, err := s.db.Namespace(values[0])
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "unknown namespace")
+	}
+
+	return db, nil
+}
+
+// grpcWriteError maps the errors of a write to a status.
+func grpcWriteError(err error) error {
+	switch err {
+	case dbengine.ErrQuotaExceeded:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case dbengine.ErrNamespaceDropped:
+		return status.Error(codes.NotFound, err.Error())
+	case dbengine.ErrReadOnlyReplica:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case dbengine.ErrReplicaTimeout:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case dbengine.ErrNoReplicas:
+		return status.Error(codes.Unavailable, err.Error())
+	case dbengine.ErrNotReplicated:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return grpcReadError(err)
+	}
+}
+
+// grpcReadError maps the errors of a read to a status, a member of a
+// cluster that is not the leader and a node that does not serve the key
+// answer Unavailable with the node to ask in the message.
+func grpcReadError(err error) error {
+	switch {
+	case errors.Is(err, dbengine.ErrNotLeader), errors.Is(err, dbengine.ErrMoved),
+		err == dbengine.ErrNoQuorum, err == dbengine.ErrSlotMoves, err == dbengine.ErrNoRing:
+		return status.Error(codes.Unavailable, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func parseBasicAuth(value string) (string, string, bool) {
+	encoded, ok := strings.CutPrefix(value, "Basic ")
+	if !ok {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", false
+	}
+
+	return strings.Cut(string(decoded), ":")
+}
+
+func (s *grpcServer) Get(ctx context.Context, req *rpc.GetRequest) (*rpc.GetResponse, error) {
+	if len(req.Key) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "empty key")
+	}
+
+	if err := s.authorize(ctx, func(user *auth.User) bool { return user.Can(req.Key, auth.ACCESS_READ) }); err != nil {
+		return nil, err
+	}
+
+	db, err := s.namespace(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	value, exist, err := db.Get(req.Key)
+	if err != nil {
+		return nil, grpcReadError(err)
+	}
+
+	if !exist {
+		return nil, status.Error(codes.NotFound, "key not found")
+	}
+
+	return &rpc.GetResponse{Value: value}, nil
+}
+
+func (s *grpcServer) Put(ctx context.Context, req *rpc.PutRequest) (*rpc.PutResponse, error) {
+	if len(req.Key) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "empty key")
+	}
+
+	if req.TtlSeconds < 0 {
+		return nil, status.Error(codes.InvalidArgument, "invalid ttl")
+	}
+
+	if err := s.authorize(ctx, func(user *auth.User) bool { return user.Can(req.Key, auth.ACCESS_WRITE) }); err != nil {
+		return nil, err
+	}
+
+	db, err := s.namespace(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.TtlSeconds > 0 {
+		err = db.PutWithTTL(req.Key, req.Value, time.Duration(req.TtlSeconds)*time.Second)
+	} else {
+		err = db.Put(req.Key, req.Value)
+	}
+
+	if err != nil {
+		return nil, grpcWriteError(err)
+	}
+
+	return &rpc.PutResponse{}, nil
+}
+
+func (s *grpcServer) Delete(ctx context.Context, req *rpc.DeleteRequest) (*rpc.DeleteResponse, error) {
+	if len(req.Key) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "empty key")
+	}
+
+	if err := s.authorize(ctx, func(user *auth.User) bool { return user.Can(req.Key, auth.ACCESS_WRITE) }); err != nil {
+		return nil, err
+	}
+
+	db, err := s.namespace(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Del(req.Key); err != nil {
+		return nil, grpcWriteError(err)
+	}
+
+	return &rpc.DeleteResponse{}, nil
+}
+
+func (s *grpcServer) BatchWrite(ctx context.Context, req *rpc.BatchWriteRequest) (*rpc.BatchWriteResponse, error) {
+	batch := dbengine.NewWriteBatch()
+
+	for i, op := range req.Operations {
+		if len(op.Key) == 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "empty key in operation %d", i)
+		}
+
+		if err := s.authorize(ctx, func(user *auth.User) bool { return user.Can(op.Key, auth.ACCESS_WRITE) }); err != nil {
+			return nil, err
+		}
+
+		switch op.Type {
+		case rpc.WriteOperation_PUT:
+			if op.TtlSeconds < 0 {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid ttl in operation %d", i)
+			}
+
+			if op.TtlSeconds > 0 {
+				batch.PutWithTTL(op.Key, op.Value, time.Duration(op.TtlSeconds)*time.Second)
+			} else {
+				batch.Put(op.Key, op.Value)
+			}
+		case rpc.WriteOperation_DELETE:
+			batch.Delete(op.Key)
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "unknown type in operation %d", i)
+		}
+	}
+
+	db, err := s.namespace(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Write(batch); err != nil {
+		return nil, grpcWriteError(err)
+	}
+
+	return &rpc.BatchWriteResponse{}, nil
+}
+
+// Scan reads the range a page at a time, so a long scan does not hold a
+// large slice of pairs and stops as soon as the client goes away.
+func (s *grpcServer) Scan(req *rpc.ScanRequest, stream rpc.KV_ScanServer) error {
+	if req.Limit < 0 {
+		return status.Error(codes.InvalidArgument, "invalid limit")
+	}
+
+	start, end := req.Start, req.End
+
+	// the prefix narrows the range given by start and end
+	if bytes.Compare(start, req.Prefix) < 0 {
+		start = req.Prefix
+	}
+	if prefixEnd := LsmTree.PrefixEnd(req.Prefix); prefixEnd != nil && (len(end) == 0 || bytes.Compare(prefixEnd, end) < 0) {
+		end = prefixEnd
+	}
+
+	if err := s.authorize(stream.Context(), func(user *auth.User) bool { return user.CanRange(start, end, auth.ACCESS_READ) }); err != nil {
+		return err
+	}
+
+	db, err := s.namespace(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	remaining := req.Limit
+
+	for {
+		if err := stream.Context().Err(); err != nil {
+			return status.FromContextError(err).Err()
+		}
+
+		pageSize := GRPC_SCAN_PAGE_SIZE
+		if remaining > 0 && remaining < int64(pageSize) {
+			pageSize = int(remaining)
+		}
+
+		pairs, err := db.Scan(start, end, pageSize)
+		if err != nil {
+			return grpcReadError(err)
+		}
+
+		for _, pair := range pairs {
+			if err := stream.Send(&rpc.KeyValue{Key: pair.Key, Value: pair.Value}); err != nil {
+				return err
+			}
+		}
+
+		if req.Limit > 0 {
+			remaining -= int64(len(pairs))
+			if remaining == 0 {
+				return nil
+			}
+		}
+
+		if len(pairs) < pageSize {
+			return nil
+		}
+
+		// the smallest key after the last one sent
+		start = append(append([]byte{}, pairs[len(pairs)-1].Key...), 0)
+	}
+}
+
+func (s *grpcServer) Watch(req *rpc.WatchRequest, stream rpc.KV_WatchServer) error {
+	if err := s.authorize(stream.Context(), func(user *auth.User) bool {
+		return user.CanRange(req.Prefix, LsmTree.PrefixEnd(req.Prefix), auth.ACCESS_READ)
+	}); err != nil {
+		return err
+	}
+
+	db, err := s.namespace(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	var watcher *dbengine.Watcher
+	if req.AfterSeq != nil {
+		if watcher, err = db.WatchAfter(req.Prefix, *req.AfterSeq); err != nil {
+			return status.Error(codes.OutOfRange, err.Error())
+		}
+	} else {
+		watcher = db.Watch(req.Prefix)
+	}
+	defer watcher.Close()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case event, ok := <-watcher.Events:
+			if !ok {
+				switch err := watcher.Err(); err {
+				case dbengine.ErrWatcherTooSlow:
+					return status.Error(codes.ResourceExhausted, err.Error())
+				case dbengine.ErrNamespaceDropped:
+					return status.Error(codes.NotFound, err.Error())
+				}
+				return nil
+			}
+
+			eventType := rpc.WatchEvent_PUT
+			if event.Delete {
+				eventType = rpc.WatchEvent_DELETE
+			}
+
+			err := stream.Send(&rpc.WatchEvent{
+				Seq:       event.Seq,
+				Type:      eventType,
+				Key:       event.Key,
+				Value:     event.Value,
+				ExpiresAt: event.ExpiresAt,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
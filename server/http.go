@@ -0,0 +1,418 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Avash027/midDB/auth"
+	dbengine "github.com/Avash027/midDB/db_engine"
+	LsmTree "github.com/Avash027/midDB/lsm_tree"
+)
+
+const DEFAULT_HTTP_PORT = "8081"
+const DEFAULT_HTTP_SCAN_LIMIT = 1000
+
+// MAX_HTTP_BODY_SIZE caps the size of a value or batch sent over HTTP.
+const MAX_HTTP_BODY_SIZE = 64 * 1024 * 1024
+
+// httpHandler serves the REST API:
+//
+//	GET    /kv/{key}                              the raw value
+//	PUT    /kv/{key}[?ttl=seconds]                the body is the raw value
+//	DELETE /kv/{key}
+//	GET    /kv?prefix=&start=&end=&limit=         a JSON list of pairs
+//	POST   /batch                                 a JSON list of operations
+//
+// Keys and values in JSON bodies are plain strings, or base64 when the
+// request has ?encoding=base64, which is needed for binary data. Every
+// route takes ?ns= to run in a namespace other than the default one.
+//
+// When authentication is on every request carries the user and password
+// with HTTP basic authentication.
+type httpHandler struct {
+	db    *dbengine.DBEngine
+	users *auth.Users
+}
+
+type httpUserKey struct{}
+
+type httpPair struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type httpScanResponse struct {
+	Items []httpPair `json:"items"`
+	// Next is the start of the following page, set when the limit was hit
+	Next string `json:"next,omitempty"`
+}
+
+type httpOperation struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	TTL   int    `json:"ttl,omitempty"`
+}
+
+type httpBatchRequest struct {
+	Ops []httpOperation `json:"ops"`
+}
+
+type httpBatchResponse struct {
+	Applied int `json:"applied"`
+}
+
+type httpError struct {
+	Error string `json:"error"`
+}
+
+func newHTTPHandler(db *dbengine.DBEngine, users *auth.Users) http.Handler {
+	h := &httpHandler{db: db, users: users}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/kv", h.handleScan)
+	mux.HandleFunc("/kv/", h.handleKey)
+	mux.HandleFunc("/batch", h.handleBatch)
+
+	if users == nil {
+		return mux
+	}
+
+	return h.authenticate(mux)
+}
+
+// authenticate passes on the requests with a valid user and password,
+// adding the user to their context.
+func (h *httpHandler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, password, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="middb"`)
+			writeHTTPError(w, http.StatusUnauthorized, "authentication required")
+			return
+		}
+
+		user, ok := h.users.Authenticate(name, []byte(password))
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="middb"`)
+			writeHTTPError(w, http.StatusUnauthorized, "invalid user or password")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), httpUserKey{}, user)))
+	})
+}
+
+// allowed reports whether check passes for the user of the request, and
+// writes the error when it does not.
+func (h *httpHandler) allowed(w http.ResponseWriter, r *http.Request, check func(user *auth.User) bool) bool {
+	if h.users == nil {
+		return true
+	}
+
+	if check(r.Context().Value(httpUserKey{}).(*auth.User)) {
+		return true
+	}
+
+	writeHTTPError(w, http.StatusForbidden, "permission denied")
+	return false
+}
+
+// namespace returns the engine of the namespace of the request, and writes
+// the error when there is no such namespace or the user may not use it.
+func (h *httpHandler) namespace(w http.ResponseWriter, r *http.Request) (*dbengine.DBEngine, bool) {
+	name := r.URL.Query().Get("ns")
+	if !h.allowed(w, r, func(user *auth.User) bool { return user.CanSelect(name) }) {
+		return nil, false
+	}
+
+	db, err := h.db.Namespace(name)
+	if err != nil {
+		writeHTTPError(w, http.StatusNotFound, "unknown namespace")
+		return nil, false
+	}
+
+	return db, true
+}
+
+func (h *httpHandler) handleKey(w http.ResponseWriter, r *http.Request) {
+	// the escaped path keeps an encoded / inside the key apart from the
+	// separators
+	key, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/kv/"))
+	if err != nil || key == "" {
+		writeHTTPError(w, http.StatusBadRequest, "invalid key")
+		return
+	}
+
+	access := auth.ACCESS_WRITE
+	if r.Method == http.MethodGet {
+		access = auth.ACCESS_READ
+	}
+
+	if !h.allowed(w, r, func(user *auth.User) bool { return user.Can([]byte(key), access) }) {
+		return
+	}
+
+	db, ok := h.namespace(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		value, exist, err := db.Get([]byte(key))
+		if err != nil {
+			writeHTTPReadError(w, err)
+			return
+		}
+
+		if !exist {
+			writeHTTPError(w, http.StatusNotFound, "key not found")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(value)
+	case http.MethodPut:
+		value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_HTTP_BODY_SIZE))
+		if err != nil {
+			writeHTTPError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var ttl int
+		if param := r.URL.Query().Get("ttl"); param != "" {
+			ttl, err = strconv.Atoi(param)
+			if err != nil || ttl <= 0 {
+				writeHTTPError(w, http.StatusBadRequest, "invalid ttl")
+				return
+			}
+		}
+
+		if ttl > 0 {
+			err = db.PutWithTTL([]byte(key), value, time.Duration(ttl)*time.Second)
+		} else {
+			err = db.Put([]byte(key), value)
+		}
+
+		if err != nil {
+			writeHTTPWriteError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := db.Del([]byte(key)); err != nil {
+			writeHTTPWriteError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (h *httpHandler) handleScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	base64Encoded := query.Get("encoding") == "base64"
+
+	var params [3][]byte
+	for i, name := range []string{"prefix", "start", "end"} {
+		param, err := decodeHTTPString(query.Get(name), base64Encoded)
+		if err != nil {
+			writeHTTPError(w, http.StatusBadRequest, "invalid "+name)
+			return
+		}
+		params[i] = param
+	}
+	prefix, start, end := params[0], params[1], params[2]
+
+	// the prefix narrows the range given by start and end
+	if bytes.Compare(start, prefix) < 0 {
+		start = prefix
+	}
+	if prefixEnd := LsmTree.PrefixEnd(prefix); prefixEnd != nil && (len(end) == 0 || bytes.Compare(prefixEnd, end) < 0) {
+		end = prefixEnd
+	}
+
+	if !h.allowed(w, r, func(user *auth.User) bool { return user.CanRange(start, end, auth.ACCESS_READ) }) {
+		return
+	}
+
+	limit := DEFAULT_HTTP_SCAN_LIMIT
+	if param := query.Get("limit"); param != "" {
+		var err error
+		limit, err = strconv.Atoi(param)
+		if err != nil || limit <= 0 {
+			writeHTTPError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+
+	db, ok := h.namespace(w, r)
+	if !ok {
+		return
+	}
+
+	pairs, err := db.Scan(start, end, limit)
+	if err != nil {
+		writeHTTPReadError(w, err)
+		return
+	}
+
+	response := httpScanResponse{Items: make([]httpPair, 0, len(pairs))}
+	for _, pair := range pairs {
+		response.Items = append(response.Items, httpPair{
+			Key:   encodeHTTPString(pair.Key, base64Encoded),
+			Value: encodeHTTPString(pair.Value, base64Encoded),
+		})
+	}
+
+	if len(pairs) == limit {
+		// the smallest key after the last one returned
+		next := append(append([]byte{}, pairs[len(pairs)-1].Key...), 0)
+		response.Next = encodeHTTPString(next, base64Encoded)
+	}
+
+	writeHTTPJSON(w, http.StatusOK, response)
+}
+
+// handleBatch applies a list of operations atomically:
+//
+//	{"ops": [{"op": "put", "key": "a", "value": "1", "ttl": 60},
+//	         {"op": "delete", "key": "b"}]}
+func (h *httpHandler) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	base64Encoded := r.URL.Query().Get("encoding") == "base64"
+
+	var request httpBatchRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_HTTP_BODY_SIZE))
+	if err := decoder.Decode(&request); err != nil {
+		writeHTTPError(w, http.StatusBadRequest, "invalid batch: "+err.Error())
+		return
+	}
+
+	batch := dbengine.NewWriteBatch()
+
+	for i, op := range request.Ops {
+		key, err := decodeHTTPString(op.Key, base64Encoded)
+		if err != nil || len(key) == 0 {
+			writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("invalid key in operation %d", i))
+			return
+		}
+
+		if !h.allowed(w, r, func(user *auth.User) bool { return user.Can(key, auth.ACCESS_WRITE) }) {
+			return
+		}
+
+		switch op.Op {
+		case "put":
+			value, err := decodeHTTPString(op.Value, base64Encoded)
+			if err != nil {
+				writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("invalid value in operation %d", i))
+				return
+			}
+
+			if op.TTL > 0 {
+				batch.PutWithTTL(key, value, time.Duration(op.TTL)*time.Second)
+			} else {
+				batch.Put(key, value)
+			}
+		case "delete":
+			batch.Delete(key)
+		default:
+			writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("unknown op %q in operation %d", op.Op, i))
+			return
+		}
+	}
+
+	db, ok := h.namespace(w, r)
+	if !ok {
+		return
+	}
+
+	if err := db.Write(batch); err != nil {
+		writeHTTPWriteError(w, err)
+		return
+	}
+
+	writeHTTPJSON(w, http.StatusOK, httpBatchResponse{Applied: batch.Len()})
+}
+
+func encodeHTTPString(b []byte, base64Encoded bool) string {
+	if base64Encoded {
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	return string(b)
+}
+
+func decodeHTTPString(s string, base64Encoded bool) ([]byte, error) {
+	if base64Encoded {
+		return base64.StdEncoding.DecodeString(s)
+	}
+	return []byte(s), nil
+}
+
+func writeHTTPJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, message string) {
+	writeHTTPJSON(w, status, httpError{Error: message})
+}
+
+// writeHTTPWriteError maps the errors of a write to a status.
+func writeHTTPWriteError(w http.ResponseWriter, err error) {
+	switch err {
+	case dbengine.ErrQuotaExceeded:
+		writeHTTPError(w, http.StatusInsufficientStorage, err.Error())
+	case dbengine.ErrNamespaceDropped:
+		writeHTTPError(w, http.StatusNotFound, err.Error())
+	case dbengine.ErrReadOnlyReplica:
+		writeHTTPError(w, http.StatusForbidden, err.Error())
+	case dbengine.ErrReplicaTimeout:
+		writeHTTPError(w, http.StatusGatewayTimeout, err.Error())
+	case dbengine.ErrNoReplicas:
+		writeHTTPError(w, http.StatusServiceUnavailable, err.Error())
+	case dbengine.ErrNotReplicated:
+		writeHTTPError(w, http.StatusForbidden, err.Error())
+	default:
+		writeHTTPReadError(w, err)
+	}
+}
+
+// writeHTTPReadError maps the errors of a read to a status, a member of a
+// cluster that is not the leader and a node that does not serve the key
+// answer 421 with the node to ask in the message.
+func writeHTTPReadError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, dbengine.ErrNotLeader), errors.Is(err, dbengine.ErrMoved):
+		writeHTTPError(w, http.StatusMisdirectedRequest, err.Error())
+	case err == dbengine.ErrNoQuorum, err == dbengine.ErrSlotMoves, err == dbengine.ErrNoRing:
+		writeHTTPError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeHTTPError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"strconv"
+
+	dbengine "github.com/Avash027/midDB/db_engine"
+)
+
+// selectNamespace handles SELECT ns, the following commands of the
+// connection run in that namespace.
+func (s *session) selectNamespace(cmd [][]byte) reply {
+	if len(cmd) != 2 {
+		return invalidReply("Invalid command")
+	}
+
+	db, err := s.root.Namespace(string(cmd[1]))
+	if err != nil {
+		return invalidReply("Unknown namespace")
+	}
+
+	s.db = db
+	return okReply()
+}
+
+// namespace handles the NAMESPACE subcommands:
+//
+//	NAMESPACE CREATE ns [MAXBYTES n]
+//	NAMESPACE DROP ns
+//	NAMESPACE QUOTA ns MAXBYTES n
+//	NAMESPACE LIST
+//	NAMESPACE STATS [ns]
+//
+// STATS without a namespace describes the selected one.
+func (s *session) namespace(cmd [][]byte) reply {
+	if len(cmd) < 2 {
+		return invalidReply("Invalid command")
+	}
+
+	switch string(cmd[1]) {
+	case "CREATE":
+		if len(cmd) != 3 && len(cmd) != 5 {
+			return invalidReply("Invalid command")
+		}
+
+		quota, ok := parseQuota(cmd[3:])
+		if !ok {
+			return invalidReply("Invalid command")
+		}
+
+		if _, err := s.root.CreateNamespace(string(cmd[2]), quota); err != nil {
+			return namespaceErrorReply(err)
+		}
+
+		return okReply()
+	case "DROP":
+		if len(cmd) != 3 {
+			return invalidReply("Invalid command")
+		}
+
+		if err := s.root.DropNamespace(string(cmd[2])); err != nil {
+			return namespaceErrorReply(err)
+		}
+
+		return okReply()
+	case "QUOTA":
+		if len(cmd) != 5 {
+			return invalidReply("Invalid command")
+		}
+
+		quota, ok := parseQuota(cmd[3:])
+		if !ok {
+			return invalidReply("Invalid command")
+		}
+
+		if err := s.root.SetNamespaceQuota(string(cmd[2]), quota); err != nil {
+			return namespaceErrorReply(err)
+		}
+
+		return okReply()
+	case "LIST":
+		if len(cmd) != 2 {
+			return invalidReply("Invalid command")
+		}
+
+		names := s.root.Namespaces()
+
+		r := reply{status: STATUS_OK, list: true, found: make([]bool, len(names))}
+		for i, name := range names {
+			r.values = append(r.values, []byte(name))
+			r.found[i] = true
+		}
+
+		return r
+	case "STATS":
+		db := s.db
+
+		if len(cmd) == 3 {
+			var err error
+			if db, err = s.root.Namespace(string(cmd[2])); err != nil {
+				return namespaceErrorReply(err)
+			}
+		} else if len(cmd) != 2 {
+			return invalidReply("Invalid command")
+		}
+
+		return namespaceStatsReply(db.Stats())
+	default:
+		return invalidReply("Invalid command")
+	}
+}
+
+// isNamespaceRead reports whether a NAMESPACE subcommand only reads.
+func isNamespaceRead(subcommand []byte) bool {
+	switch string(subcommand) {
+	case "LIST", "STATS":
+		return true
+	default:
+		return false
+	}
+}
+
+// parseQuota parses an empty list or MAXBYTES n.
+func parseQuota(args [][]byte) (dbengine.Quota, bool) {
+	var quota dbengine.Quota
+
+	if len(args) == 0 {
+		return quota, true
+	}
+
+	if len(args) != 2 || string(args[0]) != "MAXBYTES" {
+		return quota, false
+	}
+
+	maxBytes, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil || maxBytes < 0 {
+		return quota, false
+	}
+
+	quota.MaxBytes = maxBytes
+	return quota, true
+}
+
+func namespaceErrorReply(err error) reply {
+	switch err {
+	case dbengine.ErrNamespaceNotFound:
+		return invalidReply("Unknown namespace")
+	case dbengine.ErrNamespaceExists, dbengine.ErrInvalidNamespace, dbengine.ErrDropDefault:
+		return invalidReply(err.Error())
+	case dbengine.ErrReadOnlyReplica:
+		return deniedReply("Writes are disabled on a follower")
+	case dbengine.ErrNotReplicated:
+		return deniedReply("Only the default namespace is replicated")
+	default:
+		return errorReply(err.Error())
+	}
+}
+
+// namespaceStatsReply lists the stats as pairs of a name and a number.
+func namespaceStatsReply(stats dbengine.Stats) reply {
+	fields := []struct {
+		name  string
+		value int64
+	}{
+		{"gets", int64(stats.Gets)},
+		{"scans", int64(stats.Scans)},
+		{"puts", int64(stats.Puts)},
+		{"deletes", int64(stats.Deletes)},
+		{"last_seq", int64(stats.LastSeq)},
+		{"disk_blocks", int64(stats.DiskBlocks)},
+		{"disk_bytes", stats.DiskBytes},
+		{"memtable_bytes", stats.MemtableBytes},
+		{"max_bytes", stats.Quota.MaxBytes},
+	}
+
+	r := reply{status: STATUS_OK, pairs: true}
+	for _, field := range fields {
+		r.values = append(r.values, []byte(field.name), []byte(strconv.FormatInt(field.value, 10)))
+	}
+
+	return r
+}
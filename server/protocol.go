@@ -0,0 +1,311 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+
+	dbengine "github.com/Avash027/midDB/db_engine"
+)
+
+// MAX_ARGUMENT_SIZE caps the length a framed argument may announce.
+const MAX_ARGUMENT_SIZE = 64 * 1024 * 1024
+
+// MAX_REQUEST_ID_SIZE caps the length of a request ID.
+const MAX_REQUEST_ID_SIZE = 64
+
+var errInvalidFrame = errors.New("invalid frame")
+
+// request is a command and the form it was sent in, which decides the form
+// of the reply.
+type request struct {
+	args   [][]byte
+	framed bool
+	// id is set when the framed request carried a request ID, its reply is
+	// then framed as well
+	id []byte
+}
+
+// readCommand reads the next request and splits it into its arguments.
+//
+// Inline requests are a line of arguments separated by spaces, which is
+// handy for telnet but cannot carry spaces or newlines. Framed requests
+// announce the number of arguments and the length of each, so the
+// arguments may hold any byte:
+//
+//	*<number of arguments>[ <request id>]\n
+//	$<length>\n<argument>\n
+//	...
+//
+// Lines may also end with \r\n. The reply to a framed request prefixes
+// values with their length as well, and a request ID asks for the framed
+// reply described at appendReply.
+func readCommand(reader *bufio.Reader) (req request, err error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return req, err
+	}
+
+	if len(line) == 0 || line[0] != '*' {
+		req.args = bytes.Split(line, []byte(" "))
+		return req, nil
+	}
+
+	req.framed = true
+
+	header := line[1:]
+	if i := bytes.IndexByte(header, ' '); i >= 0 {
+		req.id = append([]byte{}, header[i+1:]...)
+		header = header[:i]
+
+		if len(req.id) == 0 || len(req.id) > MAX_REQUEST_ID_SIZE || bytes.IndexByte(req.id, ' ') >= 0 {
+			req.id = nil
+			return req, errInvalidFrame
+		}
+	}
+
+	argc, err := strconv.Atoi(string(header))
+	if err != nil || argc <= 0 {
+		return req, errInvalidFrame
+	}
+
+	req.args = make([][]byte, 0, argc)
+
+	for i := 0; i < argc; i++ {
+		header, err := readLine(reader)
+		if err != nil {
+			return req, err
+		}
+
+		if len(header) == 0 || header[0] != '$' {
+			return req, errInvalidFrame
+		}
+
+		length, err := strconv.Atoi(string(header[1:]))
+		if err != nil || length < 0 || length > MAX_ARGUMENT_SIZE {
+			return req, errInvalidFrame
+		}
+
+		arg := make([]byte, length)
+		if _, err := io.ReadFull(reader, arg); err != nil {
+			return req, err
+		}
+
+		// the argument is followed by a line ending
+		if rest, err := readLine(reader); err != nil {
+			return req, err
+		} else if len(rest) != 0 {
+			return req, errInvalidFrame
+		}
+
+		req.args = append(req.args, arg)
+	}
+
+	return req, nil
+}
+
+// readLine returns the next line without its line ending. The last line of
+// the input does not need one.
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadBytes('\n')
+
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+
+	return line, nil
+}
+
+// appendValue appends a value to a reply, as $<length>\n<value>\n for framed
+// requests and as a plain line otherwise.
+func appendValue(reply []byte, value []byte, framed bool) []byte {
+	if framed {
+		reply = append(reply, '$')
+		reply = strconv.AppendInt(reply, int64(len(value)), 10)
+		reply = append(reply, '\n')
+	}
+
+	reply = append(reply, value...)
+	return append(reply, '\n')
+}
+
+// The status codes of framed replies.
+const (
+	STATUS_OK        = "OK"
+	STATUS_QUEUED    = "QUEUED"
+	STATUS_NOT_FOUND = "NOT_FOUND"
+	STATUS_CONFLICT  = "CONFLICT"
+	// STATUS_INVALID is a malformed or unknown command
+	STATUS_INVALID = "INVALID"
+	// STATUS_DENIED is a command the server is configured to refuse
+	STATUS_DENIED = "DENIED"
+	// STATUS_ERROR is a failure of the server, such as a WAL write error
+	STATUS_ERROR = "ERROR"
+	// STATUS_EVENT is a change streamed by WATCH
+	STATUS_EVENT = "EVENT"
+	// STATUS_MOVED is a key served by another node, see the sharding
+	// package
+	STATUS_MOVED = "MOVED"
+)
+
+// reply is the outcome of a command, appendReply writes it in the form the
+// request asked for.
+type reply struct {
+	status string
+	// message is the text of an error, and the whole reply to inline and
+	// framed requests without an ID when there are no values
+	message string
+	values  [][]byte
+	// pairs is set when values alternate keys and values, as for SCAN
+	pairs bool
+	// line is set when the value is sent as a plain line even to framed
+	// requests without an ID, as for TTL
+	line bool
+	// list is set when there is a value per key, as for MGET, and found
+	// tells which keys exist
+	list  bool
+	found []bool
+	// words is set when the values are sent on a single line, separated by
+	// spaces, to inline requests, as for the events of WATCH
+	words bool
+}
+
+func okReply() reply {
+	return reply{status: STATUS_OK, message: "OK"}
+}
+
+func queuedReply() reply {
+	return reply{status: STATUS_QUEUED, message: "QUEUED"}
+}
+
+func valueReply(value []byte) reply {
+	return reply{status: STATUS_OK, values: [][]byte{value}}
+}
+
+func lineReply(value []byte) reply {
+	return reply{status: STATUS_OK, values: [][]byte{value}, line: true}
+}
+
+func notFoundReply() reply {
+	return reply{status: STATUS_NOT_FOUND, message: "Data not found"}
+}
+
+func conflictReply() reply {
+	return reply{status: STATUS_CONFLICT, message: "Conflict"}
+}
+
+func invalidReply(message string) reply {
+	return reply{status: STATUS_INVALID, message: message}
+}
+
+func deniedReply(message string) reply {
+	return reply{status: STATUS_DENIED, message: message}
+}
+
+func errorReply(message string) reply {
+	return reply{status: STATUS_ERROR, message: message}
+}
+
+// movedReply is MOVED <slot> <addr> on a line, and the slot and the address
+// as values of a framed reply.
+func movedReply(err *dbengine.MovedError) reply {
+	return reply{
+		status:  STATUS_MOVED,
+		message: err.Error(),
+		values:  [][]byte{[]byte(strconv.Itoa(err.Slot)), []byte(err.Addr)},
+	}
+}
+
+// appendReply appends the reply to a request. Requests with an ID get a
+// framed reply that can always be parsed the same way, whatever the
+// command:
+//
+//	=<request id> <status> <number of values>\n
+//	$<length>\n<value>\n
+//	...
+//
+// GET answers one value, TTL one value holding the number of seconds,
+// MGET a value per key, with $-1 for keys that do not exist, and SCAN and
+// PREFIX a key and a value per pair, and the EVENT replies of WATCH the
+// fields of an event. INVALID, DENIED and ERROR carry the error message as
+// their only value, MOVED the slot and the address of the node to ask. Other requests get the replies of the
+// inline protocol.
+func appendReply(buf []byte, req request, r reply) []byte {
+	if req.id != nil {
+		values := r.values
+		if r.status == STATUS_INVALID || r.status == STATUS_DENIED || r.status == STATUS_ERROR {
+			values = [][]byte{[]byte(r.message)}
+		}
+
+		buf = append(buf, '=')
+		buf = append(buf, req.id...)
+		buf = append(buf, ' ')
+		buf = append(buf, r.status...)
+		buf = append(buf, ' ')
+		buf = strconv.AppendInt(buf, int64(len(values)), 10)
+		buf = append(buf, '\n')
+
+		for i, value := range values {
+			if r.found != nil && !r.found[i] {
+				buf = append(buf, "$-1\n"...)
+				continue
+			}
+			buf = appendValue(buf, value, true)
+		}
+
+		return buf
+	}
+
+	switch {
+	case r.status == STATUS_MOVED:
+		return append(append(buf, r.message...), '\n')
+	case r.list:
+		// a line per key, Data not found for the missing ones
+		for i, value := range r.values {
+			if !r.found[i] {
+				buf = append(buf, "Data not found\n"...)
+				continue
+			}
+			buf = appendValue(buf, value, req.framed)
+		}
+		return buf
+	case r.pairs:
+		for i := 0; i+1 < len(r.values); i += 2 {
+			if req.framed {
+				buf = appendValue(appendValue(buf, r.values[i], true), r.values[i+1], true)
+			} else {
+				buf = append(append(buf, r.values[i]...), ' ')
+				buf = appendValue(buf, r.values[i+1], false)
+			}
+		}
+		return append(buf, "END\n"...)
+	case r.words:
+		for i, value := range r.values {
+			if req.framed {
+				buf = appendValue(buf, value, true)
+				continue
+			}
+
+			if i > 0 {
+				buf = append(buf, ' ')
+			}
+			buf = append(buf, value...)
+		}
+		if !req.framed {
+			buf = append(buf, '\n')
+		}
+		return buf
+	case len(r.values) > 0:
+		return appendValue(buf, r.values[0], req.framed && !r.line)
+	default:
+		return append(append(buf, r.message...), '\n')
+	}
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	dbengine "github.com/Avash027/midDB/db_engine"
+	"github.com/Avash027/midDB/raft"
+	"github.com/Avash027/midDB/replication"
+)
+
+// RaftOpts make the server a member of a Raft cluster, see the raft
+// package. Raft is off when ID is empty.
+type RaftOpts struct {
+	ID string
+	// Port is where the other members reach this one, behind TLS like the
+	// other listeners
+	Port string
+	Dir  string
+	// Members start a new cluster, see raft.Opts
+	Members []raft.Member
+
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	CommitTimeout     time.Duration
+	MaxLogEntries     int
+
+	// TLS makes the member connect to the others over TLS, checked against
+	// TLSOpts.CAFile like a follower checks its leader
+	TLS bool
+}
+
+// startRaft makes the engine a member of the cluster before the data is
+// loaded, and returns a function that starts the member once it is.
+func (s *Server) startRaft(certs *certStore) (func(), error) {
+	opts := s.Raft
+
+	if opts.ID == "" {
+		return func() {}, nil
+	}
+
+	if s.Replication.Role == replication.ROLE_FOLLOWER {
+		return nil, fmt.Errorf("a raft member can not be a replication follower")
+	}
+
+	var tlsConfig *tls.Config
+	if opts.TLS {
+		var err error
+		if tlsConfig, err = clientTLSConfig(s.TLS, certs); err != nil {
+			return nil, err
+		}
+	}
+
+	node, err := raft.NewNode(s.DBEngine, raft.Opts{
+		ID:                opts.ID,
+		Dir:               opts.Dir,
+		Members:           opts.Members,
+		ElectionTimeout:   opts.ElectionTimeout,
+		HeartbeatInterval: opts.HeartbeatInterval,
+		CommitTimeout:     opts.CommitTimeout,
+		MaxLogEntries:     opts.MaxLogEntries,
+		TLSConfig:         tlsConfig,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := listen(fmt.Sprintf("%s:%s", s.Host, opts.Port), certs)
+	if err != nil {
+		return nil, err
+	}
+
+	s.raft = node
+
+	return func() {
+		go func() {
+			if err := node.Serve(listener); err != nil {
+				fmt.Println("Error serving raft:", err)
+			}
+		}()
+
+		node.Start()
+	}, nil
+}
+
+// cluster handles CLUSTER, which describes the Raft cluster and changes its
+// members on the leader.
+//
+//	CLUSTER STATUS
+//	CLUSTER ADD id addr [client_addr]
+//	CLUSTER REMOVE id
+func (s *session) cluster(cmd [][]byte) reply {
+	if len(cmd) < 2 {
+		return invalidReply("Invalid command")
+	}
+
+	if s.raft == nil {
+		return invalidReply("Raft is not enabled")
+	}
+
+	switch string(cmd[1]) {
+	case "STATUS":
+		if len(cmd) != 2 {
+			return invalidReply("Invalid command")
+		}
+
+		return clusterStatusReply(s.raft.Status())
+	case "ADD":
+		if len(cmd) != 4 && len(cmd) != 5 {
+			return invalidReply("Invalid command")
+		}
+
+		member := raft.Member{ID: string(cmd[2]), Addr: string(cmd[3])}
+		if len(cmd) == 5 {
+			member.ClientAddr = string(cmd[4])
+		}
+
+		return clusterErrorReply(s.raft.AddMember(member))
+	case "REMOVE":
+		if len(cmd) != 3 {
+			return invalidReply("Invalid command")
+		}
+
+		return clusterErrorReply(s.raft.RemoveMember(string(cmd[2])))
+	default:
+		return invalidReply("Invalid command")
+	}
+}
+
+// clusterStatusReply lists the status as pairs of a name and a value, with
+// one member:<id> pair per member holding its addresses and, on the leader,
+// the last index it has.
+func clusterStatusReply(status raft.Status) reply {
+	fields := [][2]string{
+		{"id", status.ID},
+		{"role", status.Role},
+		{"term", strconv.FormatUint(status.Term, 10)},
+		{"leader", status.LeaderID},
+		{"last_index", strconv.FormatUint(status.LastIndex, 10)},
+		{"commit_index", strconv.FormatUint(status.CommitIndex, 10)},
+		{"last_applied", strconv.FormatUint(status.LastApplied, 10)},
+		{"snapshot_index", strconv.FormatUint(status.SnapshotIndex, 10)},
+		{"members", strconv.Itoa(len(status.Members))},
+	}
+
+	for _, member := range status.Members {
+		clientAddr := member.ClientAddr
+		if clientAddr == "" {
+			clientAddr = "-"
+		}
+
+		fields = append(fields, [2]string{
+			"member:" + member.ID,
+			fmt.Sprintf("%s %s %d", member.Addr, clientAddr, member.MatchIndex),
+		})
+	}
+
+	r := reply{status: STATUS_OK, pairs: true}
+	for _, field := range fields {
+		r.values = append(r.values, []byte(field[0]), []byte(field[1]))
+	}
+
+	return r
+}
+
+func clusterErrorReply(err error) reply {
+	switch {
+	case err == nil:
+		return okReply()
+	case errors.Is(err, dbengine.ErrNotLeader):
+		return notLeaderReply(err)
+	case err == raft.ErrMemberExists, err == raft.ErrMemberNotFound, err == raft.ErrInvalidMember,
+		err == raft.ErrChangeInProgress, err == raft.ErrLastMember:
+		return invalidReply(err.Error())
+	case err == dbengine.ErrNoQuorum:
+		return errorReply("No majority of the cluster answered")
+	default:
+		return errorReply(err.Error())
+	}
+}
+
+// notLeaderReply sends the client to the leader when it is known.
+func notLeaderReply(err error) reply {
+	message := err.Error()
+	return deniedReply(strings.ToUpper(message[:1]) + message[1:])
+}
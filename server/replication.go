@@ -0,0 +1,185 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/Avash027/midDB/replication"
+)
+
+// ReplicationOpts make the server a leader or a follower, see the
+// replication package. The server stands alone when Role is empty.
+type ReplicationOpts struct {
+	Role string
+	// Port is where a leader takes followers, behind TLS like the other
+	// listeners
+	Port string
+
+	Mode        string
+	SyncTimeout time.Duration
+	MinAcks     int
+
+	// LeaderAddr, User and Password tell a follower where its leader is
+	// and how to authenticate
+	LeaderAddr string
+	User       string
+	Password   string
+	// TLS makes a follower connect to its leader over TLS. The certificate
+	// of the leader is checked against TLSOpts.CAFile, and the follower
+	// presents its own certificate when it has one.
+	TLS bool
+	// StateDirectory holds the replication state of a follower
+	StateDirectory string
+}
+
+// replicationNode is a replication.Leader or a replication.Follower.
+type replicationNode interface {
+	Status() replication.Status
+}
+
+// startReplication sets the engine up for its role before the data is
+// loaded, and returns a function that starts replicating once it is.
+func (s *Server) startReplication(certs *certStore) (func(), error) {
+	opts := s.Replication
+
+	switch opts.Role {
+	case "":
+		return func() {}, nil
+	case replication.ROLE_LEADER:
+		if opts.Mode != replication.MODE_ASYNC && opts.Mode != replication.MODE_SYNC {
+			return nil, fmt.Errorf("unknown replication mode %q", opts.Mode)
+		}
+
+		leader, err := replication.NewLeader(s.DBEngine, replication.LeaderOpts{
+			Mode:        opts.Mode,
+			SyncTimeout: opts.SyncTimeout,
+			MinAcks:     opts.MinAcks,
+			Users:       s.Users,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		listener, err := listen(fmt.Sprintf("%s:%s", s.Host, opts.Port), certs)
+		if err != nil {
+			return nil, err
+		}
+
+		s.replication = leader
+
+		return func() {
+			go func() {
+				if err := leader.Serve(listener); err != nil {
+					fmt.Println("Error serving replication:", err)
+				}
+			}()
+		}, nil
+	case replication.ROLE_FOLLOWER:
+		if opts.LeaderAddr == "" {
+			return nil, fmt.Errorf("replication_leader is required for a follower")
+		}
+
+		var tlsConfig *tls.Config
+		if opts.TLS {
+			var err error
+			if tlsConfig, err = clientTLSConfig(s.TLS, certs); err != nil {
+				return nil, err
+			}
+		}
+
+		follower, err := replication.NewFollower(s.DBEngine, replication.FollowerOpts{
+			LeaderAddr: opts.LeaderAddr,
+			User:       opts.User,
+			Password:   opts.Password,
+			TLSConfig:  tlsConfig,
+			StateFile:  filepath.Join(opts.StateDirectory, replication.STATE_FILE_NAME),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		s.replication = follower
+
+		return func() {
+			go follower.Run()
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown replication role %q", opts.Role)
+	}
+}
+
+// clientTLSConfig is the configuration a follower connects to its leader
+// with, and a Raft member to the others. The server name is taken from the
+// address dialed. The client certificate is the one of the listeners, so it
+// follows their reloads.
+func clientTLSConfig(opts TLSOpts, certs *certStore) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", opts.CAFile)
+		}
+	}
+
+	if certs != nil {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			certs.mu.RLock()
+			defer certs.mu.RUnlock()
+
+			return &certs.config.Certificates[0], nil
+		}
+	}
+
+	return config, nil
+}
+
+// replicationReply handles REPLICATION, which describes the role of the
+// server as pairs of a name and a value.
+func (s *session) replicationReply(cmd [][]byte) reply {
+	if len(cmd) != 1 {
+		return invalidReply("Invalid command")
+	}
+
+	if s.replication == nil {
+		return reply{status: STATUS_OK, pairs: true, values: [][]byte{[]byte("role"), []byte("standalone")}}
+	}
+
+	status := s.replication.Status()
+
+	fields := [][2]string{
+		{"role", status.Role},
+		{"run_id", status.RunID},
+		{"seq", strconv.FormatUint(status.Seq, 10)},
+	}
+
+	switch status.Role {
+	case replication.ROLE_LEADER:
+		fields = append(fields, [2]string{"mode", status.Mode})
+		fields = append(fields, [2]string{"followers", strconv.Itoa(len(status.Followers))})
+		for _, follower := range status.Followers {
+			fields = append(fields, [2]string{"follower:" + follower.Addr, strconv.FormatUint(follower.Acked, 10)})
+		}
+	case replication.ROLE_FOLLOWER:
+		fields = append(fields, [2]string{"leader", status.Leader})
+		fields = append(fields, [2]string{"connected", strconv.FormatBool(status.Connected)})
+		fields = append(fields, [2]string{"leader_seq", strconv.FormatUint(status.LeaderSeq, 10)})
+	}
+
+	r := reply{status: STATUS_OK, pairs: true}
+	for _, field := range fields {
+		r.values = append(r.values, []byte(field[0]), []byte(field[1]))
+	}
+
+	return r
+}
@@ -0,0 +1,789 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Avash027/midDB/auth"
+	dbengine "github.com/Avash027/midDB/db_engine"
+	diskstore "github.com/Avash027/midDB/disk_store"
+	LsmTree "github.com/Avash027/midDB/lsm_tree"
+	"github.com/Avash027/midDB/replication"
+)
+
+const DEFAULT_RESP_PORT = "6379"
+
+// RESP_SERVER_VERSION is the Redis version reported to clients. Some clients
+// pick the commands they send based on it.
+const RESP_SERVER_VERSION = "7.0.0"
+
+const RESP_DEFAULT_SCAN_COUNT = 10
+
+var respConnID int64
+
+// respConn is one connection speaking the Redis protocol. Requests are RESP
+// arrays of bulk strings, which use the same framing as the framed requests
+// of the line protocol, or inline commands. Replies are RESP2 until the
+// client switches to RESP3 with HELLO. SELECT takes 0 or the name of a
+// namespace.
+type respConn struct {
+	id int64
+	// db is the selected namespace, root the default one, see session
+	db     *dbengine.DBEngine
+	root   *dbengine.DBEngine
+	writer *bufio.Writer
+	proto  int
+	// cursors are shared by every RESP connection of the server
+	cursors *respCursors
+	// users is nil when authentication is off, see session
+	users *auth.Users
+	user  *auth.User
+	// replication is nil when the server stands alone
+	replication replicationNode
+}
+
+func handleRESPConnection(conn net.Conn, db *dbengine.DBEngine, cursors *respCursors, users *auth.Users, node replicationNode) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	c := &respConn{
+		id:          atomic.AddInt64(&respConnID, 1),
+		db:          db,
+		root:        db,
+		writer:      bufio.NewWriter(conn),
+		proto:       2,
+		cursors:     cursors,
+		users:       users,
+		replication: node,
+	}
+
+	for {
+		req, err := readCommand(reader)
+		cmd := req.args
+
+		if err == errInvalidFrame {
+			c.writeError("ERR Protocol error")
+			c.writer.Flush()
+			return
+		}
+
+		if err != nil {
+			return
+		}
+
+		// redis-cli and telnet users may send empty inline lines
+		if len(cmd) == 1 && len(cmd[0]) == 0 {
+			continue
+		}
+
+		quit := c.execute(cmd)
+
+		// keep pipelined replies together
+		if reader.Buffered() == 0 || quit {
+			c.writer.Flush()
+		}
+
+		if quit {
+			return
+		}
+	}
+}
+
+// execute runs one command and reports whether the connection should be
+// closed afterwards.
+func (c *respConn) execute(cmd [][]byte) bool {
+	name := strings.ToUpper(string(cmd[0]))
+	args := cmd[1:]
+
+	if !c.authorize(name, args) {
+		return false
+	}
+
+	switch name {
+	case "AUTH":
+		c.auth(args)
+	case "PING":
+		if len(args) > 1 {
+			c.writeArityError(name)
+		} else if len(args) == 1 {
+			c.writeBulk(args[0])
+		} else {
+			c.writeSimple("PONG")
+		}
+	case "ECHO":
+		if len(args) != 1 {
+			c.writeArityError(name)
+			break
+		}
+		c.writeBulk(args[0])
+	case "QUIT":
+		c.writeSimple("OK")
+		return true
+	case "HELLO":
+		c.hello(args)
+	case "SELECT":
+		if len(args) != 1 {
+			c.writeArityError(name)
+		} else {
+			c.selectNamespace(args[0])
+		}
+	case "CLIENT":
+		c.client(args)
+	case "COMMAND":
+		// clients only use it to discover commands, an empty list makes
+		// them fall back to their defaults
+		c.writeArray(0)
+	case "INFO":
+		c.info()
+	case "GET":
+		if len(args) != 1 {
+			c.writeArityError(name)
+			break
+		}
+
+		value, exist, err := c.db.Get(args[0])
+		if err != nil {
+			c.writeReadError(err)
+		} else if !exist {
+			c.writeNull()
+		} else {
+			c.writeBulk(value)
+		}
+	case "SET":
+		c.set(args)
+	case "DEL":
+		if len(args) == 0 {
+			c.writeArityError(name)
+			break
+		}
+
+		deleted := 0
+		for _, key := range args {
+			_, exist, err := c.db.Get(key)
+			if err == nil && exist {
+				err = c.db.Del(key)
+				if err == nil {
+					deleted++
+				}
+			}
+
+			if err != nil {
+				c.writeWriteError(err)
+				return false
+			}
+		}
+		c.writeInteger(int64(deleted))
+	case "EXISTS":
+		if len(args) == 0 {
+			c.writeArityError(name)
+			break
+		}
+
+		count := 0
+		for _, key := range args {
+			_, exist, err := c.db.Get(key)
+			if err != nil {
+				c.writeReadError(err)
+				return false
+			}
+			if exist {
+				count++
+			}
+		}
+		c.writeInteger(int64(count))
+	case "MGET":
+		if len(args) == 0 {
+			c.writeArityError(name)
+			break
+		}
+
+		values := make([][]byte, len(args))
+		found := make([]bool, len(args))
+		for i, key := range args {
+			value, exist, err := c.db.Get(key)
+			if err != nil {
+				c.writeReadError(err)
+				return false
+			}
+			values[i], found[i] = value, exist
+		}
+
+		c.writeArray(len(args))
+		for i := range args {
+			if found[i] {
+				c.writeBulk(values[i])
+			} else {
+				c.writeNull()
+			}
+		}
+	case "MSET":
+		if len(args) == 0 || len(args)%2 != 0 {
+			c.writeArityError(name)
+			break
+		}
+
+		batch := dbengine.NewWriteBatch()
+		for i := 0; i < len(args); i += 2 {
+			batch.Put(args[i], args[i+1])
+		}
+
+		if err := c.db.Write(batch); err != nil {
+			c.writeWriteError(err)
+			break
+		}
+		c.writeSimple("OK")
+	case "SCAN":
+		c.scan(args)
+	default:
+		c.writeError(fmt.Sprintf("ERR unknown command '%s'", cmd[0]))
+	}
+
+	return false
+}
+
+// selectNamespace switches the connection to a namespace, index 0 being the
+// default one. The SCAN cursors of the previous namespace are refused in
+// the new one.
+func (c *respConn) selectNamespace(name []byte) {
+	if string(name) == "0" {
+		name = nil
+	}
+
+	if c.users != nil && !c.user.CanSelect(string(name)) {
+		c.writeError(fmt.Sprintf("NOPERM User %s has no permissions to select this DB", c.user.Name))
+		return
+	}
+
+	db, err := c.root.Namespace(string(name))
+	if err != nil {
+		c.writeError("ERR DB index is out of range")
+		return
+	}
+
+	c.db = db
+	c.writeSimple("OK")
+}
+
+// authorize checks that the user of the connection may run the command,
+// and writes the error when it may not.
+func (c *respConn) authorize(name string, args [][]byte) bool {
+	if c.users == nil {
+		return true
+	}
+
+	if c.user == nil {
+		switch name {
+		case "AUTH", "HELLO", "QUIT":
+			return true
+		default:
+			c.writeError("NOAUTH Authentication required.")
+			return false
+		}
+	}
+
+	allowed := true
+
+	switch name {
+	case "GET", "EXISTS", "MGET":
+		for _, key := range args {
+			allowed = allowed && c.user.Can(key, auth.ACCESS_READ)
+		}
+	case "SET":
+		if len(args) > 0 {
+			allowed = c.user.Can(args[0], auth.ACCESS_WRITE)
+		}
+	case "DEL":
+		for _, key := range args {
+			allowed = allowed && c.user.Can(key, auth.ACCESS_WRITE)
+		}
+	case "MSET":
+		for i := 0; i < len(args); i += 2 {
+			allowed = allowed && c.user.Can(args[i], auth.ACCESS_WRITE)
+		}
+	case "SCAN":
+		prefix := globPrefix(scanPattern(args))
+		allowed = c.user.CanRange(prefix, LsmTree.PrefixEnd(prefix), auth.ACCESS_READ)
+	case "INFO":
+		allowed = c.user.IsAdmin()
+	}
+
+	if !allowed {
+		c.writeError(fmt.Sprintf("NOPERM User %s has no permissions to run the '%s' command on these keys", c.user.Name, strings.ToLower(name)))
+	}
+
+	return allowed
+}
+
+// auth handles AUTH [username] password, the user is "default" when there
+// is none as with Redis.
+func (c *respConn) auth(args [][]byte) {
+	if len(args) != 1 && len(args) != 2 {
+		c.writeArityError("AUTH")
+		return
+	}
+
+	if c.login(args) {
+		c.writeSimple("OK")
+	}
+}
+
+// login authenticates with [username] password, and writes the error when
+// it fails.
+func (c *respConn) login(args [][]byte) bool {
+	if c.users == nil {
+		c.writeError("ERR AUTH called without any password configured for the default user")
+		return false
+	}
+
+	name, password := "default", args[0]
+	if len(args) == 2 {
+		name, password = string(args[0]), args[1]
+	}
+
+	user, ok := c.users.Authenticate(name, password)
+	if !ok {
+		c.writeError("WRONGPASS invalid username-password pair or user is disabled.")
+		return false
+	}
+
+	// the namespace selected by the previous user may be out of reach of
+	// this one
+	c.user = user
+	c.db = c.root
+	return true
+}
+
+// hello switches the protocol version and describes the server. It is
+// given as HELLO [protover [AUTH username password] [SETNAME name]].
+func (c *respConn) hello(args [][]byte) {
+	proto := c.proto
+
+	if len(args) > 0 {
+		var err error
+		proto, err = strconv.Atoi(string(args[0]))
+		if err != nil || (proto != 2 && proto != 3) {
+			c.writeError("NOPROTO unsupported protocol version")
+			return
+		}
+	}
+
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "AUTH":
+			if i+2 >= len(args) {
+				c.writeError("ERR syntax error")
+				return
+			}
+
+			if !c.login(args[i+1 : i+3]) {
+				return
+			}
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(args) {
+				c.writeError("ERR syntax error")
+				return
+			}
+			i++
+		default:
+			c.writeError("ERR syntax error")
+			return
+		}
+	}
+
+	if c.users != nil && c.user == nil {
+		c.writeError("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+		return
+	}
+
+	c.proto = proto
+
+	c.writeMap(7)
+	c.writeBulk([]byte("server"))
+	c.writeBulk([]byte("middb"))
+	c.writeBulk([]byte("version"))
+	c.writeBulk([]byte(RESP_SERVER_VERSION))
+	c.writeBulk([]byte("proto"))
+	c.writeInteger(int64(c.proto))
+	c.writeBulk([]byte("id"))
+	c.writeInteger(c.id)
+	c.writeBulk([]byte("mode"))
+	c.writeBulk([]byte("standalone"))
+	c.writeBulk([]byte("role"))
+	c.writeBulk([]byte("master"))
+	c.writeBulk([]byte("modules"))
+	c.writeArray(0)
+}
+
+// client answers the CLIENT subcommands clients send while connecting.
+func (c *respConn) client(args [][]byte) {
+	if len(args) == 0 {
+		c.writeArityError("CLIENT")
+		return
+	}
+
+	switch strings.ToUpper(string(args[0])) {
+	case "ID":
+		c.writeInteger(c.id)
+	case "GETNAME":
+		c.writeNull()
+	case "SETNAME", "SETINFO":
+		c.writeSimple("OK")
+	default:
+		c.writeError(fmt.Sprintf("ERR unknown subcommand '%s'", args[0]))
+	}
+}
+
+func (c *respConn) info() {
+	var info strings.Builder
+
+	info.WriteString("# Server\r\n")
+	info.WriteString("redis_version:" + RESP_SERVER_VERSION + "\r\n")
+	info.WriteString("redis_mode:standalone\r\n")
+	info.WriteString("\r\n# Replication\r\n")
+	var status replication.Status
+	if c.replication != nil {
+		status = c.replication.Status()
+	}
+
+	if status.Role == replication.ROLE_FOLLOWER {
+		linkStatus := "down"
+		if status.Connected {
+			linkStatus = "up"
+		}
+
+		info.WriteString("role:slave\r\n")
+		info.WriteString("master_link_status:" + linkStatus + "\r\n")
+	} else {
+		info.WriteString("role:master\r\n")
+	}
+	info.WriteString("\r\n# Storage\r\n")
+	info.WriteString(fmt.Sprintf("last_seq:%d\r\n", c.db.LsmTree.LastSeq()))
+	info.WriteString(fmt.Sprintf("disk_blocks:%d\r\n", c.db.LsmTree.NumOfDiskBlocks()))
+
+	for level, diskBlocks := range c.db.LsmTree.Levels() {
+		var size int64
+		for _, diskBlock := range diskBlocks {
+			size += diskBlock.Size
+		}
+		info.WriteString(fmt.Sprintf("level%d:blocks=%d,bytes=%d\r\n", level, len(diskBlocks), size))
+	}
+
+	c.writeBulk([]byte(info.String()))
+}
+
+// set handles SET key value [NX] [EX seconds | PX milliseconds].
+func (c *respConn) set(args [][]byte) {
+	if len(args) < 2 {
+		c.writeArityError("SET")
+		return
+	}
+
+	key, value := args[0], args[1]
+	var ttl time.Duration
+	onlyIfAbsent := false
+
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NX":
+			onlyIfAbsent = true
+		case "EX", "PX":
+			if i+1 >= len(args) || ttl != 0 {
+				c.writeError("ERR syntax error")
+				return
+			}
+
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil || n <= 0 {
+				c.writeError("ERR invalid expire time in 'set' command")
+				return
+			}
+
+			if strings.ToUpper(string(args[i])) == "EX" {
+				ttl = time.Duration(n) * time.Second
+			} else {
+				ttl = time.Duration(n) * time.Millisecond
+			}
+			i++
+		default:
+			c.writeError("ERR syntax error")
+			return
+		}
+	}
+
+	var err error
+
+	switch {
+	case onlyIfAbsent:
+		err = c.db.PutIfAbsentWithTTL(key, value, ttl)
+	case ttl > 0:
+		err = c.db.PutWithTTL(key, value, ttl)
+	default:
+		err = c.db.Put(key, value)
+	}
+
+	if err == diskstore.ErrCASConflict {
+		c.writeNull()
+	} else if err != nil {
+		c.writeWriteError(err)
+	} else {
+		c.writeSimple("OK")
+	}
+}
+
+// scan handles SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]. Keys
+// are returned in order, COUNT keys are looked at per call.
+func (c *respConn) scan(args [][]byte) {
+	if len(args) == 0 {
+		c.writeArityError("SCAN")
+		return
+	}
+
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		c.writeError("ERR invalid cursor")
+		return
+	}
+
+	var pattern []byte
+	count := RESP_DEFAULT_SCAN_COUNT
+	onlyStrings := true
+
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			c.writeError("ERR syntax error")
+			return
+		}
+
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count <= 0 {
+				c.writeError("ERR syntax error")
+				return
+			}
+		case "TYPE":
+			onlyStrings = strings.EqualFold(string(args[i+1]), "string")
+		default:
+			c.writeError("ERR syntax error")
+			return
+		}
+	}
+
+	var start []byte
+	if cursor != 0 {
+		var ok bool
+		if start, ok = c.cursors.get(cursor, c.db); !ok {
+			c.writeError("ERR invalid cursor")
+			return
+		}
+	}
+
+	// only keys starting with the literal prefix of the pattern can match
+	prefix := globPrefix(pattern)
+	if bytes.Compare(start, prefix) < 0 {
+		start = prefix
+	}
+
+	pairs, err := c.db.Scan(start, LsmTree.PrefixEnd(prefix), count)
+	if err != nil {
+		c.writeReadError(err)
+		return
+	}
+
+	next := uint64(0)
+	if len(pairs) == count {
+		// the smallest key after the last one returned
+		next = c.cursors.add(c.db, append(append([]byte{}, pairs[len(pairs)-1].Key...), 0))
+	}
+
+	keys := [][]byte{}
+	for _, pair := range pairs {
+		if onlyStrings && (pattern == nil || globMatch(pattern, pair.Key)) {
+			keys = append(keys, pair.Key)
+		}
+	}
+
+	c.writeArray(2)
+	c.writeBulk([]byte(strconv.FormatUint(next, 10)))
+	c.writeArray(len(keys))
+	for _, key := range keys {
+		c.writeBulk(key)
+	}
+}
+
+// scanPattern returns the MATCH pattern of the arguments of SCAN, or nil.
+func scanPattern(args [][]byte) []byte {
+	for i := 1; i+1 < len(args); i += 2 {
+		if strings.EqualFold(string(args[i]), "MATCH") {
+			return args[i+1]
+		}
+	}
+
+	return nil
+}
+
+// globPrefix returns the part of a glob pattern before its first special
+// character.
+func globPrefix(pattern []byte) []byte {
+	if i := bytes.IndexAny(pattern, "*?[\\"); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// globMatch matches str against a Redis style glob pattern, which supports
+// *, ?, [abc], [^abc], [a-z] and \ to escape the next character.
+func globMatch(pattern []byte, str []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(str); i++ {
+				if globMatch(pattern[1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+			pattern, str = pattern[1:], str[1:]
+		case '[':
+			if len(str) == 0 {
+				return false
+			}
+
+			pattern = pattern[1:]
+			negate := len(pattern) > 0 && pattern[0] == '^'
+			if negate {
+				pattern = pattern[1:]
+			}
+
+			matched := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				if pattern[0] == '\\' && len(pattern) > 1 {
+					matched = matched || pattern[1] == str[0]
+					pattern = pattern[2:]
+				} else if len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']' {
+					low, high := pattern[0], pattern[2]
+					if low > high {
+						low, high = high, low
+					}
+					matched = matched || (str[0] >= low && str[0] <= high)
+					pattern = pattern[3:]
+				} else {
+					matched = matched || pattern[0] == str[0]
+					pattern = pattern[1:]
+				}
+			}
+
+			// skip the closing bracket
+			if len(pattern) > 0 {
+				pattern = pattern[1:]
+			}
+
+			if matched == negate {
+				return false
+			}
+			str = str[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(str) == 0 || pattern[0] != str[0] {
+				return false
+			}
+			pattern, str = pattern[1:], str[1:]
+		}
+	}
+
+	return len(str) == 0
+}
+
+func (c *respConn) writeSimple(s string) {
+	c.writer.WriteString("+" + s + "\r\n")
+}
+
+func (c *respConn) writeError(s string) {
+	c.writer.WriteString("-" + s + "\r\n")
+}
+
+// writeWriteError answers a write the engine refused, a follower answers
+// like a Redis replica so clients know to write to the leader.
+func (c *respConn) writeWriteError(err error) {
+	switch err {
+	case dbengine.ErrReadOnlyReplica:
+		c.writeError("READONLY You can't write against a read only replica.")
+	case dbengine.ErrSlotMoves:
+		c.writeError("TRYAGAIN " + err.Error())
+	case dbengine.ErrNoReplicas:
+		c.writeError("NOREPLICAS Not enough good replicas to write.")
+	default:
+		c.writeReadError(err)
+	}
+}
+
+// writeReadError answers a read the engine could not serve, a node that
+// does not serve the key answers like a Redis cluster node.
+func (c *respConn) writeReadError(err error) {
+	var moved *dbengine.MovedError
+	if errors.As(err, &moved) {
+		c.writeError(moved.Error())
+		return
+	}
+
+	c.writeError("ERR " + err.Error())
+}
+
+func (c *respConn) writeArityError(name string) {
+	c.writeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+}
+
+func (c *respConn) writeInteger(n int64) {
+	c.writer.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (c *respConn) writeBulk(b []byte) {
+	c.writer.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	c.writer.Write(b)
+	c.writer.WriteString("\r\n")
+}
+
+func (c *respConn) writeNull() {
+	if c.proto == 3 {
+		c.writer.WriteString("_\r\n")
+	} else {
+		c.writer.WriteString("$-1\r\n")
+	}
+}
+
+func (c *respConn) writeArray(n int) {
+	c.writer.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// writeMap starts a map of n pairs, which RESP2 sends as a flat array.
+func (c *respConn) writeMap(n int) {
+	if c.proto == 3 {
+		c.writer.WriteString("%" + strconv.Itoa(n) + "\r\n")
+	} else {
+		c.writeArray(2 * n)
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+
+	dbengine "github.com/Avash027/midDB/db_engine"
+)
+
+// RESP_MAX_CURSORS bounds the SCAN cursors the server keeps, the least
+// recently used one is dropped first.
+const RESP_MAX_CURSORS = 65536
+
+// respCursor is where a SCAN continues, in the namespace it was started in.
+type respCursor struct {
+	id   uint64
+	db   *dbengine.DBEngine
+	next []byte
+}
+
+// respCursors holds the SCAN cursors of every RESP connection. Pooled
+// clients continue a SCAN on whichever connection is free, so a cursor is
+// not tied to the connection that got it. As with Redis, a cursor may be
+// used again until it is dropped.
+type respCursors struct {
+	lock    sync.Mutex
+	nextID  uint64
+	entries map[uint64]*list.Element
+	// order holds the cursors from the most to the least recently used
+	order *list.List
+}
+
+func newRESPCursors() *respCursors {
+	return &respCursors{
+		nextID:  1,
+		entries: map[uint64]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// add returns a new cursor continuing from next in db.
+func (c *respCursors) add(db *dbengine.DBEngine, next []byte) uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.order.Len() >= RESP_MAX_CURSORS {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*respCursor).id)
+	}
+
+	id := c.nextID
+	c.nextID++
+	c.entries[id] = c.order.PushFront(&respCursor{id: id, db: db, next: next})
+
+	return id
+}
+
+// get returns where the cursor continues, it reports false when the cursor
+// was dropped or belongs to another namespace than db.
+func (c *respCursors) get(id uint64, db *dbengine.DBEngine) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.entries[id]
+	if !ok || element.Value.(*respCursor).db != db {
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	return element.Value.(*respCursor).next, true
+}
@@ -2,16 +2,25 @@ package server
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
-	"strings"
+	"strconv"
 	"syscall"
+	"time"
 
+	"github.com/Avash027/midDB/auth"
 	dbengine "github.com/Avash027/midDB/db_engine"
+	diskstore "github.com/Avash027/midDB/disk_store"
 	LsmTree "github.com/Avash027/midDB/lsm_tree"
-	"github.com/Avash027/midDB/wal"
+	"github.com/Avash027/midDB/raft"
+	"github.com/Avash027/midDB/rpc"
+	"github.com/Avash027/midDB/sharding"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 const DEFAULT_TCP_PORT = "8080"
@@ -25,11 +34,41 @@ type Server struct {
 	DBEngine      *dbengine.DBEngine
 	UDPPort       string
 	UDPBufferSize int
+	// UDPReadOnly turns off the commands that write over UDP
+	UDPReadOnly bool
+	RESPPort    string
+	HTTPPort    string
+	GRPCPort    string
+	// TLS secures every listener but UDP, the certificates are read again
+	// on SIGHUP
+	TLS TLSOpts
+	// Users must authenticate before running commands when set, see the
+	// auth package
+	Users *auth.Users
+	// Replication makes the server a leader or a follower
+	Replication ReplicationOpts
+	replication replicationNode
+	// Raft makes the server a member of a cluster
+	Raft RaftOpts
+	raft *raft.Node
+	// Sharding makes the server a node of a ring
+	Sharding ShardingOpts
+	sharding *sharding.Node
 }
 
 func (s *Server) Start() {
 
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%s", s.Host, s.Port))
+	var certs *certStore
+	if s.TLS.Enabled() {
+		var err error
+		certs, err = newCertStore(s.TLS)
+		if err != nil {
+			fmt.Println("Error loading TLS certificates:", err)
+			return
+		}
+	}
+
+	listener, err := listen(fmt.Sprintf("%s:%s", s.Host, s.Port), certs)
 	if err != nil {
 		fmt.Println("Error listening")
 		return
@@ -43,6 +82,45 @@ func (s *Server) Start() {
 	}
 	defer udpServer.Close()
 
+	respListener, err := listen(fmt.Sprintf("%s:%s", s.Host, s.RESPPort), certs)
+	if err != nil {
+		fmt.Println("Error listening RESP")
+		return
+	}
+	defer respListener.Close()
+
+	httpListener, err := listen(fmt.Sprintf("%s:%s", s.Host, s.HTTPPort), certs, "http/1.1")
+	if err != nil {
+		fmt.Println("Error listening HTTP")
+		return
+	}
+	defer httpListener.Close()
+
+	grpcListener, err := net.Listen("tcp", fmt.Sprintf("%s:%s", s.Host, s.GRPCPort))
+	if err != nil {
+		fmt.Println("Error listening gRPC")
+		return
+	}
+	defer grpcListener.Close()
+
+	startReplicating, err := s.startReplication(certs)
+	if err != nil {
+		fmt.Println("Error setting up replication:", err)
+		return
+	}
+
+	startRaft, err := s.startRaft(certs)
+	if err != nil {
+		fmt.Println("Error setting up raft:", err)
+		return
+	}
+
+	startSharding, err := s.startSharding(certs)
+	if err != nil {
+		fmt.Println("Error setting up sharding:", err)
+		return
+	}
+
 	dataLoadSignal := make(chan bool, 1)
 	startPersistingCycleSignal := make(chan bool, 1)
 
@@ -59,13 +137,22 @@ func (s *Server) Start() {
 
 		fmt.Println("Data loaded from disk")
 
+		if err := s.DBEngine.OpenNamespaces(); err != nil {
+			fmt.Println("Error opening namespaces")
+			panic(err)
+		}
+
 		dataLoadSignal <- true
 		startPersistingCycleSignal <- true
 	}()
 
 	<-dataLoadSignal
 
-	go s.DBEngine.Store.PersistToDisk(s.DBEngine.Wal, startPersistingCycleSignal)
+	startReplicating()
+	startRaft()
+	startSharding()
+
+	go s.DBEngine.Store.PersistToDisk(s.DBEngine.LsmTree, s.DBEngine.Wal, startPersistingCycleSignal)
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
@@ -79,9 +166,29 @@ func (s *Server) Start() {
 			fmt.Printf("Error persisting WAL\n")
 		}
 
+		if err := s.DBEngine.CloseNamespaces(); err != nil {
+			fmt.Println("Error closing namespaces:", err)
+		}
+
 		os.Exit(0)
 	}()
 
+	if certs != nil {
+		reloadCh := make(chan os.Signal, 1)
+		signal.Notify(reloadCh, syscall.SIGHUP)
+
+		go func() {
+			for range reloadCh {
+				if err := certs.reload(); err != nil {
+					fmt.Println("Error reloading TLS certificates:", err)
+					continue
+				}
+
+				fmt.Println("TLS certificates reloaded")
+			}
+		}()
+	}
+
 	go func() {
 		for {
 			conn, err := listener.Accept()
@@ -90,13 +197,60 @@ func (s *Server) Start() {
 				continue
 			}
 
-			go handleConnection(conn, s.DBEngine.LsmTree, s.DBEngine.Wal)
+			go handleConnection(conn, s.DBEngine, s.Users, s.replication, s.raft, s.sharding)
+		}
+	}()
+
+	cursors := newRESPCursors()
+	go func() {
+		for {
+			conn, err := respListener.Accept()
+			if err != nil {
+				fmt.Printf("Error accepting (RESP)")
+				continue
+			}
+
+			go handleRESPConnection(conn, s.DBEngine, cursors, s.Users, s.replication)
+		}
+	}()
+
+	go func() {
+		err := http.Serve(httpListener, newHTTPHandler(s.DBEngine, s.Users))
+		if err != nil {
+			fmt.Println("Error serving HTTP")
+		}
+	}()
+
+	go func() {
+		kvServer := newGRPCServer(s.DBEngine, s.Users)
+
+		opts := []grpc.ServerOption{
+			grpc.UnaryInterceptor(kvServer.authenticateUnary),
+			grpc.StreamInterceptor(kvServer.authenticateStream),
+		}
+		if certs != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(certs.tlsConfig())))
+		}
+
+		grpcServer := grpc.NewServer(opts...)
+		rpc.RegisterKVServer(grpcServer, kvServer)
+
+		err := grpcServer.Serve(grpcListener)
+		if err != nil {
+			fmt.Println("Error serving gRPC")
 		}
 	}()
 
 	// UDP packets handler
 	go func() {
-		buf := make([]byte, s.UDPBufferSize)
+		maxSize := s.UDPBufferSize
+		if maxSize <= 0 {
+			maxSize = DEFAULT_UDP_BUFFER_SIZE
+		}
+
+		// datagrams are read whole, so those above maxSize are refused
+		// rather than cut off
+		buf := make([]byte, MAX_UDP_PACKET_SIZE)
 		for {
 			n, addr, err := udpServer.ReadFrom(buf)
 			if err != nil {
@@ -104,7 +258,11 @@ func (s *Server) Start() {
 				continue
 			}
 
-			go handleUDPPacket(udpServer, buf[:n], addr, s.DBEngine.LsmTree, s.DBEngine.Wal)
+			// buf is reused by the next read while the packet is handled
+			packet := make([]byte, n)
+			copy(packet, buf[:n])
+
+			go handleUDPPacket(udpServer, packet, maxSize, addr, s.DBEngine, s.UDPReadOnly, s.Users, s.replication, s.raft, s.sharding)
 		}
 	}()
 
@@ -113,125 +271,606 @@ func (s *Server) Start() {
 
 }
 
-func handleConnection(conn net.Conn, ltree *LsmTree.LSMTree, wal *wal.WAL) {
+// MAX_PIPELINED_WRITES caps how many pipelined PUT and DEL requests are
+// applied together as one batch.
+const MAX_PIPELINED_WRITES = 1024
+
+// session is the state of a TCP connection, or of a single UDP request.
+//
+// Clients may pipeline requests, sending many before reading the replies.
+// Replies are always sent in request order, and are only flushed once every
+// request that already arrived has been answered. PUT and DEL requests in a
+// pipeline are applied together as one batch, so they share a single WAL
+// record.
+type session struct {
+	// db is the engine of the selected namespace, root the default one
+	db   *dbengine.DBEngine
+	root *dbengine.DBEngine
+	// readOnly refuses every write, see Server.UDPReadOnly
+	readOnly bool
+
+	// users is nil when authentication is off, otherwise only AUTH is
+	// accepted until user is set
+	users *auth.Users
+	user  *auth.User
+
+	// replication is nil when the server stands alone, raft when it is not
+	// a member of a cluster and sharding when it is not a node of a ring
+	replication replicationNode
+	raft        *raft.Node
+	sharding    *sharding.Node
+
+	// batch is set between MULTI and EXEC, writes are queued in it instead
+	// of being applied
+	batch *dbengine.WriteBatch
+
+	// pending holds the pipelined writes not applied yet, and pendingReqs
+	// the requests they came from
+	pending     *dbengine.WriteBatch
+	pendingReqs []request
+}
+
+func handleConnection(conn net.Conn, db *dbengine.DBEngine, users *auth.Users, node replicationNode, member *raft.Node, shard *sharding.Node) {
 	defer conn.Close()
 
-	scanner := bufio.NewScanner(conn)
+	reader := bufio.NewReader(conn)
 	writer := bufio.NewWriter(conn)
 
-	for scanner.Scan() {
-		text := scanner.Text()
+	s := &session{db: db, root: db, users: users, replication: node, raft: member, sharding: shard, pending: dbengine.NewWriteBatch()}
+
+	for {
+		req, err := readCommand(reader)
 
-		cmd := strings.Split(text, " ")
+		if err != nil {
+			s.applyPending(writer)
+
+			if err == errInvalidFrame {
+				// the rest of the stream can not be trusted after a bad frame
+				writer.Write(appendReply(nil, req, invalidReply("Invalid command")))
+			}
 
-		if len(cmd) == 0 {
-			writer.WriteString("Invalid command\n")
+			writer.Flush()
+			return
 		}
 
-		switch cmd[0] {
-		case "PUT":
-			if len(cmd) != 3 {
-				writer.WriteString("Invalid command\n")
-				writer.Flush()
-				continue
+		if string(req.args[0]) == "WATCH" && s.batch == nil {
+			s.applyPending(writer)
+
+			watcher, r := s.watch(req.args)
+			if watcher != nil {
+				s.stream(reader, writer, req, r, watcher)
+				return
 			}
 
-			err := wal.Write([]byte("+"), []byte(cmd[1]), []byte(cmd[2]))
+			writer.Write(appendReply(nil, req, r))
+		} else if !s.deferWrite(req) {
+			s.applyPending(writer)
+			writer.Write(appendReply(nil, req, s.execute(req.args)))
+		} else if reader.Buffered() == 0 || s.pending.Len() >= MAX_PIPELINED_WRITES {
+			s.applyPending(writer)
+		}
 
-			if err != nil {
-				writer.WriteString("Error writing to WAL\n")
-				writer.Flush()
-				continue
+		// requests that already arrived are answered before flushing
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return
 			}
+		}
+	}
+}
 
-			ltree.Put(cmd[1], cmd[2])
-			writer.WriteString("OK\n")
-			writer.Flush()
-		case "GET":
+// deferWrite adds a valid PUT or DEL outside of MULTI to the pending batch
+// and reports whether it did.
+func (s *session) deferWrite(req request) bool {
+	cmd := req.args
 
-			err := wal.Persist()
+	if s.batch != nil {
+		return false
+	}
 
-			if err != nil {
-				writer.WriteString("Error persisting WAL\n")
-				writer.Flush()
-				continue
-			}
+	if _, ok := s.authorize(cmd); !ok {
+		return false
+	}
 
-			val, exist := ltree.Get(cmd[1])
-			if !exist {
-				writer.WriteString("Data not found\n")
-				writer.Flush()
-			} else {
-				writer.WriteString(val + "\n")
-				writer.Flush()
-			}
-		case "DEL":
+	// a key served by another node gets a reply of its own
+	if len(cmd) >= 2 && s.db.Route(cmd[1], true) != nil {
+		return false
+	}
 
-			err := wal.Write([]byte("-"), []byte(cmd[1]))
+	switch string(cmd[0]) {
+	case "PUT":
+		ttl, ok := parseExpiry(cmd)
+		if !ok {
+			return false
+		}
 
-			if err != nil {
-				writer.WriteString("Error writing to WAL\n")
-				writer.Flush()
-				continue
-			}
+		if ttl > 0 {
+			s.pending.PutWithTTL(cmd[1], cmd[2], ttl)
+		} else {
+			s.pending.Put(cmd[1], cmd[2])
+		}
+	case "DEL":
+		if len(cmd) != 2 {
+			return false
+		}
 
-			ltree.Del(cmd[1])
-			writer.WriteString("OK\n")
-			writer.Flush()
+		s.pending.Delete(cmd[1])
+	default:
+		return false
+	}
+
+	s.pendingReqs = append(s.pendingReqs, req)
+	return true
+}
+
+// applyPending writes the pending batch and the replies of its requests.
+// The requests are unrelated, so when the batch is refused, for instance
+// because it goes over the quota, each one is run again on its own and gets
+// its own reply.
+func (s *session) applyPending(writer *bufio.Writer) {
+	if len(s.pendingReqs) == 0 {
+		return
+	}
+
+	err := s.db.Write(s.pending)
+
+	for _, req := range s.pendingReqs {
+		switch err {
+		case nil:
+			writer.Write(appendReply(nil, req, okReply()))
+		case dbengine.ErrReplicaTimeout:
+			// the batch was applied, only the followers are late
+			writer.Write(appendReply(nil, req, writeErrorReply(err)))
 		default:
-			writer.WriteString("Invalid command\n")
-			writer.Flush()
+			writer.Write(appendReply(nil, req, s.execute(req.args)))
 		}
-
 	}
 
+	s.pending.Reset()
+	s.pendingReqs = s.pendingReqs[:0]
 }
 
-func handleUDPPacket(udpConn net.PacketConn, packet []byte, addr net.Addr, ltree *LsmTree.LSMTree, wal *wal.WAL) {
+func (s *session) execute(cmd [][]byte) reply {
+	db := s.db
 
-	response := ""
+	if s.readOnly && isWrite(cmd) {
+		return deniedReply("Writes are disabled")
+	}
+
+	if r, ok := s.authorize(cmd); !ok {
+		return r
+	}
 
-	// Convert the received packet to a string
-	request := string(packet)
+	if s.db.Dropped() {
+		switch string(cmd[0]) {
+		case "AUTH", "SELECT", "NAMESPACE":
+		default:
+			return errorReply("Namespace was dropped")
+		}
+	}
 
-	// Split the request into command and arguments
-	cmd := strings.Split(request, " ")
+	if s.batch != nil {
+		switch string(cmd[0]) {
+		case "PUT", "DEL", "EXEC", "DISCARD", "MULTI":
+		default:
+			return invalidReply("Only PUT and DEL can be queued")
+		}
+	}
+
+	switch string(cmd[0]) {
+	case "AUTH":
+		// AUTH user password
+		if len(cmd) != 3 {
+			return invalidReply("Invalid command")
+		}
+
+		if s.users == nil {
+			return invalidReply("Authentication is not enabled")
+		}
+
+		user, ok := s.users.Authenticate(string(cmd[1]), cmd[2])
+		if !ok {
+			return deniedReply("Invalid user or password")
+		}
 
-	if len(cmd) == 0 {
-		response = "Invalid command"
-	} else {
-		switch cmd[0] {
-		case "GET":
-			if len(cmd) != 2 {
-				response = "Invalid command"
-				break
+		// the namespace selected by the previous user may be out of
+		// reach of this one
+		s.user = user
+		s.db = s.root
+		return okReply()
+	case "PUT":
+		// PUT key value [EX seconds]
+		ttl, ok := parseExpiry(cmd)
+		if !ok {
+			return invalidReply("Invalid command")
+		}
+
+		if s.batch != nil {
+			if ttl > 0 {
+				s.batch.PutWithTTL(cmd[1], cmd[2], ttl)
+			} else {
+				s.batch.Put(cmd[1], cmd[2])
 			}
+			return queuedReply()
+		}
+
+		var err error
+		if ttl > 0 {
+			err = db.PutWithTTL(cmd[1], cmd[2], ttl)
+		} else {
+			err = db.Put(cmd[1], cmd[2])
+		}
+
+		if err != nil {
+			return writeErrorReply(err)
+		}
+
+		return okReply()
+	case "GET":
+		if len(cmd) != 2 {
+			return invalidReply("Invalid command")
+		}
+
+		val, exist, err := db.Get(cmd[1])
 
-			err := wal.Persist()
+		if err != nil {
+			return readErrorReply(err, "Error persisting WAL")
+		}
+
+		if !exist {
+			return notFoundReply()
+		}
+
+		return valueReply(val)
+	case "MGET":
+		// MGET key [key ...]
+		if len(cmd) < 2 {
+			return invalidReply("Invalid command")
+		}
+
+		r := reply{status: STATUS_OK, list: true, found: make([]bool, 0, len(cmd)-1)}
+
+		for _, key := range cmd[1:] {
+			val, exist, err := db.Get(key)
 
 			if err != nil {
-				response = "Error persisting WAL"
-				break
+				return readErrorReply(err, "Error persisting WAL")
 			}
 
-			cmd[1] = strings.Trim(cmd[1], "\n")
+			r.values = append(r.values, val)
+			r.found = append(r.found, exist)
+		}
 
-			val, exist := ltree.Get(cmd[1])
+		return r
+	case "SCAN":
+		// SCAN start end [LIMIT n]
+		limit, ok := parseLimit(cmd, 3)
+		if !ok {
+			return invalidReply("Invalid command")
+		}
 
-			if !exist {
-				response = "Data not found"
-			} else {
-				response = val
-			}
-		default:
-			response = "Invalid command"
+		return scanReply(db, cmd[1], cmd[2], limit)
+	case "PREFIX":
+		// PREFIX p [LIMIT n]
+		limit, ok := parseLimit(cmd, 2)
+		if !ok {
+			return invalidReply("Invalid command")
+		}
+
+		return scanReply(db, cmd[1], LsmTree.PrefixEnd(cmd[1]), limit)
+	case "DEL":
+		if len(cmd) != 2 {
+			return invalidReply("Invalid command")
+		}
+
+		if s.batch != nil {
+			s.batch.Delete(cmd[1])
+			return queuedReply()
+		}
+
+		if err := db.Del(cmd[1]); err != nil {
+			return writeErrorReply(err)
 		}
+
+		return okReply()
+	case "EXPIRE":
+		// EXPIRE key seconds
+		if len(cmd) != 3 {
+			return invalidReply("Invalid command")
+		}
+
+		seconds, err := strconv.Atoi(string(cmd[2]))
+		if err != nil {
+			return invalidReply("Invalid command")
+		}
+
+		err = db.Expire(cmd[1], time.Duration(seconds)*time.Second)
+
+		if err == diskstore.ErrKeyNotFound {
+			return notFoundReply()
+		} else if err != nil {
+			return writeErrorReply(err)
+		}
+
+		return okReply()
+	case "TTL":
+		if len(cmd) != 2 {
+			return invalidReply("Invalid command")
+		}
+
+		ttl, err := db.TTL(cmd[1])
+
+		if err == diskstore.ErrKeyNotFound {
+			return notFoundReply()
+		} else if err != nil {
+			return readErrorReply(err, "Error reading data")
+		}
+
+		if ttl == dbengine.NO_EXPIRY {
+			return lineReply([]byte("-1"))
+		}
+
+		// round up, so a key that is still there never reports 0
+		seconds := (ttl + time.Second - 1) / time.Second
+		return lineReply([]byte(strconv.FormatInt(int64(seconds), 10)))
+	case "CAS":
+		// CAS key expected new
+		if len(cmd) != 4 {
+			return invalidReply("Invalid command")
+		}
+
+		return conditionalReply(db.CompareAndSwap(cmd[1], cmd[2], cmd[3]))
+	case "PUTIFABSENT":
+		if len(cmd) != 3 {
+			return invalidReply("Invalid command")
+		}
+
+		return conditionalReply(db.PutIfAbsent(cmd[1], cmd[2]))
+	case "MULTI":
+		if s.batch != nil {
+			return invalidReply("MULTI calls can not be nested")
+		}
+
+		s.batch = dbengine.NewWriteBatch()
+		return okReply()
+	case "EXEC":
+		if s.batch == nil {
+			return invalidReply("EXEC without MULTI")
+		}
+
+		err := db.Write(s.batch)
+		s.batch = nil
+
+		if err != nil {
+			return writeErrorReply(err)
+		}
+
+		return okReply()
+	case "DISCARD":
+		if s.batch == nil {
+			return invalidReply("DISCARD without MULTI")
+		}
+
+		s.batch = nil
+		return okReply()
+	case "SELECT":
+		return s.selectNamespace(cmd)
+	case "NAMESPACE":
+		return s.namespace(cmd)
+	case "REPLICATION":
+		return s.replicationReply(cmd)
+	case "CLUSTER":
+		return s.cluster(cmd)
+	case "SHARD":
+		return s.shard(cmd)
+	case "BACKUP":
+		return s.backup(cmd)
+	default:
+		return invalidReply("Invalid command")
 	}
+}
+
+// authorize checks that the user of the session may run cmd, it is left to
+// execute to reject malformed commands.
+func (s *session) authorize(cmd [][]byte) (reply, bool) {
+	name := string(cmd[0])
+
+	if s.users == nil || name == "AUTH" {
+		return reply{}, true
+	}
+
+	if s.user == nil {
+		return deniedReply("Authentication required"), false
+	}
+
+	allowed := true
+
+	switch name {
+	case "GET", "TTL", "MGET":
+		for _, key := range cmd[1:] {
+			allowed = allowed && s.user.Can(key, auth.ACCESS_READ)
+		}
+	case "SCAN":
+		if len(cmd) >= 3 {
+			allowed = s.user.CanRange(cmd[1], cmd[2], auth.ACCESS_READ)
+		}
+	case "PREFIX", "WATCH":
+		if len(cmd) >= 2 {
+			allowed = s.user.CanRange(cmd[1], LsmTree.PrefixEnd(cmd[1]), auth.ACCESS_READ)
+		}
+	case "PUT", "DEL", "EXPIRE", "CAS", "PUTIFABSENT":
+		if len(cmd) >= 2 {
+			allowed = s.user.Can(cmd[1], auth.ACCESS_WRITE)
+		}
+	case "SELECT":
+		if len(cmd) >= 2 {
+			allowed = s.user.CanSelect(string(cmd[1]))
+		}
+	case "NAMESPACE":
+		if len(cmd) < 2 || !isNamespaceRead(cmd[1]) {
+			allowed = s.user.IsAdmin()
+		} else if len(cmd) >= 3 {
+			allowed = s.user.CanSelect(string(cmd[2]))
+		}
+	case "CLUSTER":
+		if len(cmd) < 2 || string(cmd[1]) != "STATUS" {
+			allowed = s.user.IsAdmin()
+		}
+	case "SHARD":
+		if len(cmd) < 2 || !isShardRead(cmd[1]) {
+			allowed = s.user.IsAdmin()
+		}
+	case "BACKUP":
+		allowed = s.user.IsAdmin()
+	}
+
+	if !allowed {
+		return deniedReply("Permission denied"), false
+	}
+
+	return reply{}, true
+}
+
+// isWrite reports whether the command changes data, or writes files on the
+// server like BACKUP.
+func isWrite(cmd [][]byte) bool {
+	switch string(cmd[0]) {
+	case "PUT", "DEL", "EXPIRE", "CAS", "PUTIFABSENT", "MULTI", "EXEC", "BACKUP":
+		return true
+	case "NAMESPACE":
+		return len(cmd) < 2 || !isNamespaceRead(cmd[1])
+	case "CLUSTER":
+		return len(cmd) < 2 || string(cmd[1]) != "STATUS"
+	case "SHARD":
+		return len(cmd) < 2 || !isShardRead(cmd[1])
+	default:
+		return false
+	}
+}
+
+// conditionalReply is the reply of a conditional write, which either
+// applies or fails because the key did not hold what the client expected.
+func conditionalReply(err error) reply {
+	switch err {
+	case nil:
+		return okReply()
+	case diskstore.ErrCASConflict:
+		return conflictReply()
+	default:
+		return writeErrorReply(err)
+	}
+}
+
+// redirectReply is the reply of a command another node has to run, the
+// leader of the cluster or the node that serves the key.
+func redirectReply(err error) (reply, bool) {
+	var moved *dbengine.MovedError
+
+	switch {
+	case errors.As(err, &moved):
+		return movedReply(moved), true
+	case errors.Is(err, dbengine.ErrNotLeader):
+		return notLeaderReply(err), true
+	case err == dbengine.ErrNoRing:
+		return errorReply("The node is not part of a ring yet"), true
+	default:
+		return reply{}, false
+	}
+}
 
-	responseBytes := []byte(response)
+// readErrorReply is the reply of a read the engine could not serve, message
+// describes any other failure.
+func readErrorReply(err error, message string) reply {
+	if r, ok := redirectReply(err); ok {
+		return r
+	}
+
+	if err == dbengine.ErrNoQuorum {
+		return errorReply("No majority of the cluster answered")
+	}
+
+	return errorReply(message)
+}
+
+// writeErrorReply is the reply of a write the engine refused.
+func writeErrorReply(err error) reply {
+	if r, ok := redirectReply(err); ok {
+		return r
+	}
+
+	switch err {
+	case dbengine.ErrQuotaExceeded:
+		return deniedReply("Namespace quota exceeded")
+	case dbengine.ErrNamespaceDropped:
+		return errorReply("Namespace was dropped")
+	case dbengine.ErrReadOnlyReplica:
+		return deniedReply("Writes are disabled on a follower")
+	case dbengine.ErrReplicaTimeout:
+		return errorReply("Write applied but not acknowledged by enough followers")
+	case dbengine.ErrNoReplicas:
+		return errorReply("Not enough followers connected to write")
+	case dbengine.ErrNotReplicated:
+		return deniedReply("Only the default namespace is replicated")
+	case dbengine.ErrNoQuorum:
+		return errorReply("No majority of the cluster answered")
+	case dbengine.ErrSlotMoves:
+		return errorReply("Slot is moving to another node, try again")
+	default:
+		return errorReply("Error writing to WAL")
+	}
+}
+
+// parseExpiry checks that cmd is PUT key value, optionally followed by
+// EX seconds, and returns the TTL or 0 when there is none.
+func parseExpiry(cmd [][]byte) (time.Duration, bool) {
+	if len(cmd) == 3 {
+		return 0, true
+	}
+
+	if len(cmd) != 5 || string(cmd[3]) != "EX" {
+		return 0, false
+	}
+
+	seconds, err := strconv.Atoi(string(cmd[4]))
+	if err != nil || seconds <= 0 {
+		return 0, false
+	}
+
+	return time.Duration(seconds) * time.Second, true
+}
+
+// parseLimit checks that cmd has numOfArgs arguments, optionally followed by
+// LIMIT n, and returns n or 0 when there is no limit.
+func parseLimit(cmd [][]byte, numOfArgs int) (int, bool) {
+	if len(cmd) == numOfArgs {
+		return 0, true
+	}
+
+	if len(cmd) != numOfArgs+2 || string(cmd[numOfArgs]) != "LIMIT" {
+		return 0, false
+	}
+
+	limit, err := strconv.Atoi(string(cmd[numOfArgs+1]))
+	if err != nil || limit <= 0 {
+		return 0, false
+	}
+
+	return limit, true
+}
+
+// scanReply lists every live key in [start, end) with its value. An empty
+// end means there is no upper bound.
+func scanReply(db *dbengine.DBEngine, start []byte, end []byte, limit int) reply {
+	pairs, err := db.Scan(start, end, limit)
 
-	_, err := udpConn.WriteTo(responseBytes, addr)
 	if err != nil {
-		fmt.Println("Error sending UDP response")
+		return readErrorReply(err, "Error reading data")
 	}
+
+	r := reply{status: STATUS_OK, values: make([][]byte, 0, 2*len(pairs)), pairs: true}
+	for _, pair := range pairs {
+		r.values = append(r.values, pair.Key, pair.Value)
+	}
+
+	return r
 }
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"github.com/Avash027/midDB/replication"
+	"github.com/Avash027/midDB/sharding"
+)
+
+// ShardingOpts make the server a node of a ring that splits the default
+// namespace between its nodes, see the sharding package. Sharding is off
+// when ID is empty.
+type ShardingOpts struct {
+	ID string
+	// Port is where the other nodes reach this one, behind TLS like the
+	// other listeners
+	Port string
+	// Members start a new ring, see sharding.Opts
+	Members []sharding.Member
+	// TLS makes the node connect to the others over TLS, checked against
+	// TLSOpts.CAFile like a follower checks its leader
+	TLS bool
+	// StateDirectory holds the ring of the node
+	StateDirectory string
+}
+
+// startSharding makes the node the router of the engine before the data is
+// loaded, and returns a function that starts the node once it is.
+func (s *Server) startSharding(certs *certStore) (func(), error) {
+	opts := s.Sharding
+
+	if opts.ID == "" {
+		return func() {}, nil
+	}
+
+	if s.Replication.Role == replication.ROLE_FOLLOWER || s.Raft.ID != "" {
+		return nil, fmt.Errorf("a sharded node can not be a replication follower or a raft member")
+	}
+
+	var tlsConfig *tls.Config
+	if opts.TLS {
+		var err error
+		if tlsConfig, err = clientTLSConfig(s.TLS, certs); err != nil {
+			return nil, err
+		}
+	}
+
+	node, err := sharding.NewNode(s.DBEngine, sharding.Opts{
+		ID:        opts.ID,
+		Members:   opts.Members,
+		StateFile: filepath.Join(opts.StateDirectory, sharding.STATE_FILE_NAME),
+		TLSConfig: tlsConfig,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := listen(fmt.Sprintf("%s:%s", s.Host, opts.Port), certs)
+	if err != nil {
+		return nil, err
+	}
+
+	s.sharding = node
+
+	return func() {
+		go func() {
+			if err := node.Serve(listener); err != nil {
+				fmt.Println("Error serving sharding:", err)
+			}
+		}()
+
+		node.Start()
+	}, nil
+}
+
+// shard handles SHARD, which describes the ring and changes its nodes.
+//
+//	SHARD STATUS
+//	SHARD SLOT key
+//	SHARD ADD id addr client_addr
+//	SHARD REMOVE id [FORCE]
+func (s *session) shard(cmd [][]byte) reply {
+	if len(cmd) < 2 {
+		return invalidReply("Invalid command")
+	}
+
+	if s.sharding == nil {
+		return invalidReply("Sharding is not enabled")
+	}
+
+	switch string(cmd[1]) {
+	case "STATUS":
+		if len(cmd) != 2 {
+			return invalidReply("Invalid command")
+		}
+
+		return shardStatusReply(s.sharding.Status())
+	case "SLOT":
+		if len(cmd) != 3 {
+			return invalidReply("Invalid command")
+		}
+
+		slot := sharding.Slot(cmd[2])
+		r := reply{status: STATUS_OK, pairs: true, values: [][]byte{[]byte("slot"), []byte(strconv.Itoa(slot))}}
+
+		if owner, ok := s.sharding.Owner(slot); ok {
+			r.values = append(r.values, []byte("node"), []byte(owner.ID), []byte("addr"), []byte(owner.ClientAddr))
+		}
+
+		return r
+	case "ADD":
+		if len(cmd) != 5 {
+			return invalidReply("Invalid command")
+		}
+
+		member := sharding.Member{ID: string(cmd[2]), Addr: string(cmd[3]), ClientAddr: string(cmd[4])}
+		return shardErrorReply(s.sharding.AddMember(member))
+	case "REMOVE":
+		force := len(cmd) == 4 && string(cmd[3]) == "FORCE"
+		if len(cmd) != 3 && !force {
+			return invalidReply("Invalid command")
+		}
+
+		return shardErrorReply(s.sharding.RemoveMember(string(cmd[2]), force))
+	default:
+		return invalidReply("Invalid command")
+	}
+}
+
+// isShardRead reports whether the SHARD subcommand only reads.
+func isShardRead(subcommand []byte) bool {
+	switch string(subcommand) {
+	case "STATUS", "SLOT":
+		return true
+	default:
+		return false
+	}
+}
+
+// shardStatusReply lists the status as pairs of a name and a value, with
+// one node:<id> pair per member of the ring holding its addresses and the
+// number of slots it owns.
+func shardStatusReply(status sharding.Status) reply {
+	fields := [][2]string{
+		{"id", status.ID},
+		{"epoch", strconv.FormatUint(status.Epoch, 10)},
+		{"slots", strconv.Itoa(status.Slots)},
+		{"moving", strconv.Itoa(status.Moving)},
+		{"importing", strconv.Itoa(status.Importing)},
+		{"nodes", strconv.Itoa(len(status.Members))},
+	}
+
+	for _, member := range status.Members {
+		fields = append(fields, [2]string{
+			"node:" + member.ID,
+			fmt.Sprintf("%s %s %d", member.Addr, member.ClientAddr, member.Slots),
+		})
+	}
+
+	r := reply{status: STATUS_OK, pairs: true}
+	for _, field := range fields {
+		r.values = append(r.values, []byte(field[0]), []byte(field[1]))
+	}
+
+	return r
+}
+
+func shardErrorReply(err error) reply {
+	switch err {
+	case nil:
+		return okReply()
+	case sharding.ErrMemberExists, sharding.ErrMemberNotFound, sharding.ErrInvalidMember,
+		sharding.ErrLastMember, sharding.ErrRebalancing:
+		return invalidReply(err.Error())
+	default:
+		if r, ok := redirectReply(err); ok {
+			return r
+		}
+		return errorReply(err.Error())
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+// TLSOpts configure TLS on the TCP, RESP, HTTP and gRPC listeners. TLS is
+// off when CertFile is empty.
+type TLSOpts struct {
+	CertFile string
+	KeyFile  string
+	// CAFile holds the certificates that client certificates are checked
+	// against, in PEM
+	CAFile string
+	// VerifyClient requires every client to present a certificate signed
+	// by a certificate of CAFile
+	VerifyClient bool
+}
+
+func (o TLSOpts) Enabled() bool {
+	return o.CertFile != ""
+}
+
+// certStore holds the certificate of the server and the pool of client CAs.
+// They are read again from disk by reload, new handshakes use them while
+// open connections keep the certificate they were set up with.
+type certStore struct {
+	opts TLSOpts
+
+	mu     sync.RWMutex
+	config *tls.Config
+}
+
+func newCertStore(opts TLSOpts) (*certStore, error) {
+	if opts.KeyFile == "" {
+		return nil, fmt.Errorf("tls_key_file is required with tls_cert_file")
+	}
+
+	if opts.VerifyClient && opts.CAFile == "" {
+		return nil, fmt.Errorf("tls_ca_file is required with tls_verify_client")
+	}
+
+	c := &certStore{opts: opts}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// reload reads the files again, the previous certificates are kept when one
+// of them is invalid.
+func (c *certStore) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.opts.CertFile, c.opts.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.opts.CAFile != "" {
+		pem, err := os.ReadFile(c.opts.CAFile)
+		if err != nil {
+			return err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %s", c.opts.CAFile)
+		}
+
+		config.ClientCAs = pool
+		if c.opts.VerifyClient {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	c.mu.Lock()
+	c.config = config
+	c.mu.Unlock()
+
+	return nil
+}
+
+// tlsConfig returns the configuration of a listener that offers nextProtos
+// through ALPN. Each handshake picks up the certificates current at the time.
+func (c *certStore) tlsConfig(nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: nextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mu.RLock()
+			config := c.config.Clone()
+			c.mu.RUnlock()
+
+			config.NextProtos = nextProtos
+			return config, nil
+		},
+	}
+}
+
+// listen opens a TCP listener, behind TLS when certs is set.
+func listen(addr string, certs *certStore, nextProtos ...string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if certs == nil {
+		return listener, nil
+	}
+
+	return tls.NewListener(listener, certs.tlsConfig(nextProtos...)), nil
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/Avash027/midDB/auth"
+	dbengine "github.com/Avash027/midDB/db_engine"
+	"github.com/Avash027/midDB/raft"
+	"github.com/Avash027/midDB/sharding"
+)
+
+// MAX_UDP_REPLY_SIZE is the largest payload of a UDP datagram.
+const MAX_UDP_REPLY_SIZE = 65507
+
+// MAX_UDP_PACKET_SIZE is the size of the buffer datagrams are read into,
+// which holds any of them.
+const MAX_UDP_PACKET_SIZE = 65535
+
+// handleUDPPacket answers a packet holding a single request, inline or
+// framed. Every command that does not need the state of a connection is
+// supported, which leaves out MULTI, EXEC, DISCARD, SELECT, WATCH and AUTH,
+// so requests run in the default namespace and nothing but a DENIED reply is
+// sent back when authentication is on. A request ID is
+// echoed in the framed reply, so clients can match replies to requests and
+// tell which ones were lost. Packets longer than maxSize are refused with
+// an INVALID reply and never run.
+func handleUDPPacket(udpConn net.PacketConn, packet []byte, maxSize int, addr net.Addr, db *dbengine.DBEngine, readOnly bool, users *auth.Users, node replicationNode, member *raft.Node, shard *sharding.Node) {
+
+	var r reply
+
+	req, err := readCommand(bufio.NewReader(bytes.NewReader(packet)))
+
+	if len(packet) > maxSize {
+		r = invalidReply("Request too large for UDP")
+	} else if err != nil {
+		r = invalidReply("Invalid command")
+	} else {
+		switch string(req.args[0]) {
+		case "MULTI", "EXEC", "DISCARD":
+			r = invalidReply("MULTI is not supported over UDP")
+		case "AUTH":
+			r = invalidReply("AUTH is not supported over UDP")
+		case "SELECT":
+			r = invalidReply("SELECT is not supported over UDP")
+		case "WATCH":
+			r = invalidReply("WATCH is not supported over UDP")
+		default:
+			s := &session{db: db, root: db, readOnly: readOnly, users: users, replication: node, raft: member, sharding: shard}
+			r = s.execute(req.args)
+		}
+	}
+
+	response := appendReply(nil, req, r)
+
+	if len(response) > MAX_UDP_REPLY_SIZE {
+		response = appendReply(nil, req, errorReply("Reply too large for UDP"))
+	}
+
+	// without an ID, only framed values end with a line ending over UDP
+	if req.id == nil && !(req.framed && len(r.values) > 0) {
+		response = bytes.TrimSuffix(response, []byte("\n"))
+	}
+
+	_, err = udpConn.WriteTo(response, addr)
+	if err != nil {
+		fmt.Println("Error sending UDP response")
+	}
+}
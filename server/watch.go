@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bufio"
+	"strconv"
+
+	dbengine "github.com/Avash027/midDB/db_engine"
+)
+
+// watch handles WATCH prefix [AFTER seq] and returns the watcher along with
+// the first reply of the stream, which holds the sequence number the events
+// follow. On failure the watcher is nil and the reply is the error.
+func (s *session) watch(cmd [][]byte) (*dbengine.Watcher, reply) {
+	if r, ok := s.authorize(cmd); !ok {
+		return nil, r
+	}
+
+	if s.db.Dropped() {
+		return nil, errorReply("Namespace was dropped")
+	}
+
+	// a fresh watch starts after the last change, which is always retained
+	seq := s.db.LastSeq()
+
+	switch {
+	case len(cmd) == 2:
+	case len(cmd) == 4 && string(cmd[2]) == "AFTER":
+		var err error
+		if seq, err = strconv.ParseUint(string(cmd[3]), 10, 64); err != nil {
+			return nil, invalidReply("Invalid command")
+		}
+	default:
+		return nil, invalidReply("Invalid command")
+	}
+
+	watcher, err := s.db.WatchAfter(cmd[1], seq)
+	if err != nil {
+		return nil, invalidReply("Sequence number is no longer retained")
+	}
+
+	return watcher, lineReply([]byte(strconv.FormatUint(seq, 10)))
+}
+
+// stream writes the first reply and then an EVENT reply per event of the
+// watcher, until the client sends anything or goes away. When the engine
+// ends the watcher, an ERROR reply tells why and the connection is closed.
+func (s *session) stream(reader *bufio.Reader, writer *bufio.Writer, req request, first reply, watcher *dbengine.Watcher) {
+	defer watcher.Close()
+
+	writer.Write(appendReply(nil, req, first))
+	if err := writer.Flush(); err != nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		// returns once the connection is closed at the latest
+		reader.ReadByte()
+		close(stop)
+	}()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				if err := watcher.Err(); err != nil {
+					writer.Write(appendReply(nil, req, watchErrorReply(err)))
+					writer.Flush()
+				}
+				return
+			}
+
+			writer.Write(appendReply(nil, req, eventReply(event)))
+
+			// events that are already waiting are sent together
+			if len(watcher.Events) == 0 {
+				if err := writer.Flush(); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// eventReply lists the sequence number, PUT or DEL, the key and, for puts,
+// the value and the unix time in milliseconds it expires at, 0 for never.
+func eventReply(event dbengine.Event) reply {
+	seq := []byte(strconv.FormatUint(event.Seq, 10))
+
+	if event.Delete {
+		return reply{status: STATUS_EVENT, values: [][]byte{seq, []byte("DEL"), event.Key}, words: true}
+	}
+
+	expiresAt := []byte(strconv.FormatInt(event.ExpiresAt, 10))
+	return reply{status: STATUS_EVENT, values: [][]byte{seq, []byte("PUT"), event.Key, event.Value, expiresAt}, words: true}
+}
+
+func watchErrorReply(err error) reply {
+	switch err {
+	case dbengine.ErrWatcherTooSlow:
+		return errorReply("Watcher fell too far behind")
+	case dbengine.ErrNamespaceDropped:
+		return errorReply("Namespace was dropped")
+	default:
+		return errorReply(err.Error())
+	}
+}
@@ -0,0 +1,351 @@
+package sharding
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Avash027/midDB/wal"
+)
+
+// migrate hands the slots moving to target over, and logs why it could not.
+// The next exchange of rings starts it again.
+func (n *Node) migrate(target Member) {
+	defer n.wg.Done()
+
+	err := n.handOver(target)
+
+	n.mu.Lock()
+	delete(n.migrating, target.ID)
+	stopped := n.stopped
+	n.mu.Unlock()
+
+	if err != nil && !stopped {
+		fmt.Println("Error handing slots over to", target.ID+":", err)
+	}
+}
+
+func (n *Node) handOver(target Member) error {
+	n.mu.Lock()
+	epoch := n.ring.Epoch
+	sync := SyncArgs{Ring: *n.ring, Previous: *n.previous}
+
+	slots := map[int]bool{}
+	for slot, member := range n.moving {
+		if member.ID == target.ID {
+			slots[slot] = true
+		}
+	}
+	n.mu.Unlock()
+
+	if len(slots) == 0 {
+		return nil
+	}
+
+	args := ImportArgs{From: n.opts.ID, Epoch: epoch}
+	for slot := range slots {
+		args.Slots = append(args.Slots, slot)
+	}
+	sort.Ints(args.Slots)
+
+	// the target waits for the slots once it has the ring
+	var reply SyncReply
+	if err := n.transport.call(target.Addr, "Sync", &sync, &reply); err != nil {
+		return err
+	}
+
+	seq, err := n.copySlots(target, args, slots)
+	if err != nil {
+		return err
+	}
+
+	defer n.unfreeze(slots)
+
+	n.mu.Lock()
+	if n.ring.Epoch != epoch {
+		n.mu.Unlock()
+		return errRingChanged
+	}
+	for slot := range slots {
+		n.frozen[slot] = true
+	}
+	n.mu.Unlock()
+
+	// no write to the slots is in flight once the ones before are applied
+	last := n.db.WaitForWrites()
+
+	err = n.copyChanges(target, args, slots, seq, last)
+	if err == wal.ErrSeqTooOld {
+		// the changes are gone, but the slots do not change anymore so a
+		// second copy is complete
+		_, err = n.copySlots(target, args, slots)
+	}
+	if err != nil {
+		return err
+	}
+
+	// once the target serves the slots they must not be written here
+	// again, so the hand over is retried until the target answers
+	for {
+		var reply ImportReply
+		err := n.transport.call(target.Addr, "Handover", &args, &reply)
+		if err == nil {
+			break
+		}
+
+		fmt.Println("Error handing slots over to", target.ID+":", err)
+
+		select {
+		case <-n.done:
+			return errStopped
+		case <-time.After(SYNC_INTERVAL):
+		}
+
+		n.mu.Lock()
+		changed := n.ring.Epoch != epoch
+		n.mu.Unlock()
+
+		if changed {
+			return errRingChanged
+		}
+	}
+
+	n.mu.Lock()
+	for slot := range slots {
+		if n.moving[slot].ID == target.ID {
+			delete(n.moving, slot)
+			delete(n.frozen, slot)
+		}
+	}
+	err = n.saveState()
+	n.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return n.dropSlots(slots)
+}
+
+func (n *Node) unfreeze(slots map[int]bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for slot := range slots {
+		delete(n.frozen, slot)
+	}
+}
+
+// copySlots makes the target drop what it has of the slots, then sends the
+// pairs of the slots as of a snapshot and returns its sequence number.
+func (n *Node) copySlots(target Member, args ImportArgs, slots map[int]bool) (uint64, error) {
+	var reply ImportReply
+	if err := n.transport.call(target.Addr, "BeginImport", &args, &reply); err != nil {
+		return 0, err
+	}
+
+	snapshot := n.db.Snapshot()
+	defer snapshot.Release()
+
+	it := snapshot.NewIterator()
+	defer it.Close()
+
+	args.Pairs = nil
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if !slots[Slot(it.Key())] {
+			continue
+		}
+
+		args.Pairs = append(args.Pairs, Pair{
+			Key:       append([]byte{}, it.Key()...),
+			Value:     append([]byte{}, it.Value()...),
+			ExpiresAt: it.ExpiresAt(),
+		})
+
+		if len(args.Pairs) >= IMPORT_BATCH_SIZE {
+			if err := n.transport.call(target.Addr, "Import", &args, &reply); err != nil {
+				return 0, err
+			}
+			args.Pairs = nil
+		}
+	}
+
+	if err := it.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(args.Pairs) > 0 {
+		if err := n.transport.call(target.Addr, "Import", &args, &reply); err != nil {
+			return 0, err
+		}
+	}
+
+	return snapshot.Seq, nil
+}
+
+// copyChanges sends the writes to the slots after seq up to last.
+func (n *Node) copyChanges(target Member, args ImportArgs, slots map[int]bool, seq uint64, last uint64) error {
+	for seq < last {
+		changes, _, err := n.db.Wal.Changes(seq, IMPORT_BATCH_SIZE)
+		if err != nil {
+			return err
+		}
+		if len(changes) == 0 {
+			return nil
+		}
+
+		args.Pairs = nil
+		for _, change := range changes {
+			seq = change.Seq
+
+			if slots[Slot(change.Key)] {
+				args.Pairs = append(args.Pairs, Pair{
+					Key:       change.Key,
+					Value:     change.Value,
+					ExpiresAt: change.ExpiresAt,
+					Delete:    change.Delete,
+				})
+			}
+		}
+
+		if len(args.Pairs) > 0 {
+			var reply ImportReply
+			if err := n.transport.call(target.Addr, "Import", &args, &reply); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// dropSlots deletes the keys of the slots from the tree.
+func (n *Node) dropSlots(slots map[int]bool) error {
+	snapshot := n.db.Snapshot()
+	defer snapshot.Release()
+
+	it := snapshot.NewIterator()
+	defer it.Close()
+
+	pairs := []Pair{}
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if !slots[Slot(it.Key())] {
+			continue
+		}
+
+		pairs = append(pairs, Pair{Key: append([]byte{}, it.Key()...), Delete: true})
+		if len(pairs) >= IMPORT_BATCH_SIZE {
+			if err := n.applyPairs(pairs); err != nil {
+				return err
+			}
+			pairs = pairs[:0]
+		}
+	}
+
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	return n.applyPairs(pairs)
+}
+
+// checkImport checks that the node waits for the slots of args, from any
+// member since the one it expects may have handed them on.
+func (n *Node) checkImport(args *ImportArgs) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.stopped {
+		return errStopped
+	}
+
+	if n.ring.Epoch != args.Epoch {
+		return errRingChanged
+	}
+
+	for _, slot := range args.Slots {
+		if slot < 0 || slot >= NUM_OF_SLOTS {
+			return errNotImporting
+		}
+		if _, ok := n.importing[slot]; !ok {
+			return errNotImporting
+		}
+	}
+
+	return nil
+}
+
+func (n *Node) handleBeginImport(args *ImportArgs) error {
+	if err := n.checkImport(args); err != nil {
+		return err
+	}
+
+	slots := map[int]bool{}
+	for _, slot := range args.Slots {
+		slots[slot] = true
+	}
+
+	return n.dropSlots(slots)
+}
+
+func (n *Node) handleImport(args *ImportArgs) error {
+	if err := n.checkImport(args); err != nil {
+		return err
+	}
+
+	slots := map[int]bool{}
+	for _, slot := range args.Slots {
+		slots[slot] = true
+	}
+
+	for _, pair := range args.Pairs {
+		if !slots[Slot(pair.Key)] {
+			return errNotImporting
+		}
+	}
+
+	if len(args.Pairs) == 0 {
+		return nil
+	}
+
+	return n.applyPairs(args.Pairs)
+}
+
+// handleHandover makes the node serve the slots. It is safe to repeat, the
+// slots the node serves already are skipped.
+func (n *Node) handleHandover(args *ImportArgs) error {
+	// the pairs are on disk before the node serves them
+	if err := n.db.Wal.Persist(); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.stopped {
+		return errStopped
+	}
+
+	if n.ring.Epoch != args.Epoch {
+		return errRingChanged
+	}
+
+	for _, slot := range args.Slots {
+		if slot < 0 || slot >= NUM_OF_SLOTS || !n.owns(slot) {
+			return errNotImporting
+		}
+	}
+
+	for _, slot := range args.Slots {
+		delete(n.importing, slot)
+	}
+
+	return n.saveState()
+}
+
+// owns reports whether the slot is the node's in its ring, it expects mu to
+// be held.
+func (n *Node) owns(slot int) bool {
+	owner, ok := n.ring.Owner(slot)
+	return ok && owner.ID == n.opts.ID
+}
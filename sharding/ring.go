@@ -0,0 +1,153 @@
+package sharding
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// NUM_OF_SLOTS is the number of virtual partitions the keys are hashed into,
+// the unit the ring hands from one node to another.
+const NUM_OF_SLOTS = 1024
+
+// VIRTUAL_NODES is how many points every member has on the ring, so the
+// slots are spread evenly and a member that joins or leaves takes or gives
+// a little from each of the others.
+const VIRTUAL_NODES = 128
+
+// Slot returns the slot of a key, hashed the same way as the partitions of
+// the disk store.
+func Slot(key []byte) int {
+	hash := fnv.New32a()
+	hash.Write(key)
+	return int(hash.Sum32() % NUM_OF_SLOTS)
+}
+
+// Member is a node of the ring.
+type Member struct {
+	ID string
+	// Addr is the sharding port of the member
+	Addr string
+	// ClientAddr is where clients reach the member, the address of the
+	// MOVED replies
+	ClientAddr string
+}
+
+// Ring assigns every slot to a member: the slots and the virtual nodes of
+// the members are hashed onto the same circle, and a slot belongs to the
+// first virtual node that follows it. Epoch grows with every change, the
+// nodes adopt the ring with the highest epoch they hear of.
+type Ring struct {
+	Epoch   uint64
+	Members []Member
+	// Lost are the members removed without handing their slots over, the
+	// members that take the slots start them empty
+	Lost []string
+
+	owners []int
+}
+
+// NewRing sorts the members by ID and assigns the slots.
+func NewRing(epoch uint64, members []Member, lost []string) *Ring {
+	r := &Ring{Epoch: epoch, Members: append([]Member{}, members...), Lost: lost}
+	sort.Slice(r.Members, func(i, j int) bool { return r.Members[i].ID < r.Members[j].ID })
+
+	r.assign()
+	return r
+}
+
+type point struct {
+	hash   uint32
+	member int
+}
+
+func (r *Ring) assign() {
+	r.owners = make([]int, NUM_OF_SLOTS)
+
+	if len(r.Members) == 0 {
+		for slot := range r.owners {
+			r.owners[slot] = -1
+		}
+		return
+	}
+
+	points := make([]point, 0, len(r.Members)*VIRTUAL_NODES)
+	for i, member := range r.Members {
+		for v := 0; v < VIRTUAL_NODES; v++ {
+			points = append(points, point{hash: hash32([]byte(member.ID + "#" + strconv.Itoa(v))), member: i})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+	var key [4]byte
+	for slot := range r.owners {
+		binary.BigEndian.PutUint32(key[:], uint32(slot))
+		hash := hash32(key[:])
+
+		i := sort.Search(len(points), func(i int) bool { return points[i].hash >= hash })
+		if i == len(points) {
+			i = 0
+		}
+		r.owners[slot] = points[i].member
+	}
+}
+
+// Owner returns the member a slot belongs to, false when the ring is empty.
+func (r *Ring) Owner(slot int) (Member, bool) {
+	if r.owners[slot] < 0 {
+		return Member{}, false
+	}
+
+	return r.Members[r.owners[slot]], true
+}
+
+// Member returns the member with the ID.
+func (r *Ring) Member(id string) (Member, bool) {
+	for _, member := range r.Members {
+		if member.ID == id {
+			return member, true
+		}
+	}
+
+	return Member{}, false
+}
+
+// Slots returns how many slots each member owns.
+func (r *Ring) Slots() map[string]int {
+	slots := map[string]int{}
+	for _, owner := range r.owners {
+		if owner >= 0 {
+			slots[r.Members[owner].ID]++
+		}
+	}
+
+	return slots
+}
+
+// isLost reports whether the member was removed without handing over.
+func (r *Ring) isLost(id string) bool {
+	for _, lost := range r.Lost {
+		if lost == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hash32 places the points on the circle. FNV alone keeps short inputs
+// that differ in one byte close together, the finalizer of murmur3 spreads
+// them.
+func hash32(data []byte) uint32 {
+	hash := fnv.New32a()
+	hash.Write(data)
+
+	h := hash.Sum32()
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
@@ -0,0 +1,177 @@
+package sharding
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// RPC_TIMEOUT caps how long a node waits for the answer of another, which
+// may have to apply a batch of pairs first.
+const RPC_TIMEOUT = 5 * time.Second
+
+var errRPCTimeout = errors.New("sharding rpc timed out")
+
+// SyncArgs carry the ring of a node and the one before it, which tells the
+// members that take slots where the slots are served until they are
+// handed over.
+type SyncArgs struct {
+	Ring     Ring
+	Previous Ring
+}
+
+type SyncReply struct {
+	Ring     Ring
+	Previous Ring
+	// Pending is set while the node hands slots over or waits for some
+	Pending bool
+}
+
+// ImportArgs hand the slots from one member to another. BeginImport drops
+// what the target holds of the slots, Import writes pairs of them, and
+// Handover makes the target serve them.
+type ImportArgs struct {
+	From  string
+	Epoch uint64
+	Slots []int
+	Pairs []Pair
+}
+
+// Pair is a put, or a delete when Delete is set.
+type Pair struct {
+	Key       []byte
+	Value     []byte
+	ExpiresAt int64
+	Delete    bool
+}
+
+type ImportReply struct{}
+
+// service is what the node serves over net/rpc, under the name Sharding.
+type service struct {
+	node *Node
+}
+
+func (s *service) Sync(args *SyncArgs, reply *SyncReply) error {
+	return s.node.handleSync(args, reply)
+}
+
+func (s *service) BeginImport(args *ImportArgs, reply *ImportReply) error {
+	return s.node.handleBeginImport(args)
+}
+
+func (s *service) Import(args *ImportArgs, reply *ImportReply) error {
+	return s.node.handleImport(args)
+}
+
+func (s *service) Handover(args *ImportArgs, reply *ImportReply) error {
+	return s.node.handleHandover(args)
+}
+
+// transport keeps one connection per member. A connection that fails or
+// times out is closed and dialed again by the next call.
+type transport struct {
+	tlsConfig *tls.Config
+
+	lock    sync.Mutex
+	clients map[string]*rpc.Client
+	closed  bool
+}
+
+func newTransport(tlsConfig *tls.Config) *transport {
+	return &transport{tlsConfig: tlsConfig, clients: map[string]*rpc.Client{}}
+}
+
+func (t *transport) call(addr string, method string, args interface{}, reply interface{}) error {
+	client, err := t.client(addr)
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(RPC_TIMEOUT)
+	defer timer.Stop()
+
+	call := client.Go("Sharding."+method, args, reply, make(chan *rpc.Call, 1))
+
+	select {
+	case <-call.Done:
+		// errors returned by the handler leave the connection usable
+		if _, ok := call.Error.(rpc.ServerError); call.Error != nil && !ok {
+			t.drop(addr, client)
+		}
+		return call.Error
+	case <-timer.C:
+		t.drop(addr, client)
+		return errRPCTimeout
+	}
+}
+
+func (t *transport) client(addr string) (*rpc.Client, error) {
+	t.lock.Lock()
+	client, ok := t.clients[addr]
+	closed := t.closed
+	t.lock.Unlock()
+
+	if closed {
+		return nil, rpc.ErrShutdown
+	}
+	if ok {
+		return client, nil
+	}
+
+	dialer := &net.Dialer{Timeout: RPC_TIMEOUT}
+
+	var conn net.Conn
+	var err error
+	if t.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, t.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client = rpc.NewClient(conn)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// another call may have dialed in the meantime
+	if existing, ok := t.clients[addr]; ok {
+		client.Close()
+		return existing, nil
+	}
+
+	if t.closed {
+		client.Close()
+		return nil, rpc.ErrShutdown
+	}
+
+	t.clients[addr] = client
+	return client, nil
+}
+
+func (t *transport) drop(addr string, client *rpc.Client) {
+	t.lock.Lock()
+	if t.clients[addr] == client {
+		delete(t.clients, addr)
+	}
+	t.lock.Unlock()
+
+	client.Close()
+}
+
+func (t *transport) close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.closed = true
+	for addr, client := range t.clients {
+		client.Close()
+		delete(t.clients, addr)
+	}
+}
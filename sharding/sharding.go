@@ -0,0 +1,751 @@
+// Package sharding splits the default namespace between the nodes of a
+// ring.
+//
+// Keys are hashed into NUM_OF_SLOTS slots with FNV, like the partitions of
+// the disk store, and the slots are spread over the members with
+// consistent hashing, see Ring. A node serves the keys of its slots and
+// answers the others with a MOVED error naming the slot and the client
+// address of the node that serves it.
+//
+// Every change to the members makes a new ring with a higher epoch, which
+// the nodes pass on to each other. A node that loses slots keeps serving
+// them while it copies them to their new owner: first a snapshot, then the
+// writes made since, read from the change feed of the WAL with the writes
+// to the slots refused for the time it takes. It then hands them over and
+// drops its copy. The new owner answers MOVED to the old one until then.
+// Rings change one member at a time, once every node is done with the last
+// change.
+package sharding
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dbengine "github.com/Avash027/midDB/db_engine"
+	"github.com/Avash027/midDB/wal"
+)
+
+const DEFAULT_PORT = "7100"
+
+// STATE_FILE_NAME is the file in the data directory that holds the ring of
+// the node and the slots it is handing over or waiting for.
+const STATE_FILE_NAME = "SHARDING"
+
+// SYNC_INTERVAL is how often a node exchanges its ring with the others and
+// retries the hand overs that failed.
+const SYNC_INTERVAL = time.Second
+
+// IMPORT_BATCH_SIZE caps how many pairs are sent and applied as one batch.
+const IMPORT_BATCH_SIZE = 1024
+
+var (
+	ErrMemberExists   = errors.New("the node is already in the ring")
+	ErrMemberNotFound = errors.New("the node is not in the ring")
+	ErrInvalidMember  = errors.New("invalid node")
+	ErrLastMember     = errors.New("the last node can not be removed")
+	ErrRebalancing    = errors.New("the ring is still rebalancing")
+)
+
+var (
+	errStopped      = errors.New("sharding node stopped")
+	errRingChanged  = errors.New("the ring changed during the hand over")
+	errNotImporting = errors.New("the slots are not waiting for this node")
+)
+
+type Opts struct {
+	ID string
+	// Members start a new ring, they are ignored once the node has a
+	// state file. A node started without members waits to be added.
+	Members   []Member
+	StateFile string
+	// TLSConfig, when set, makes the node connect to the others over TLS
+	TLSConfig *tls.Config
+}
+
+// Node is a member of a ring, it is the router of the engine.
+type Node struct {
+	db        *dbengine.DBEngine
+	opts      Opts
+	transport *transport
+
+	mu       sync.Mutex
+	ring     *Ring
+	previous *Ring
+	// moving are the slots the node serves until it hands them to the
+	// member, frozen the ones it refuses writes to while it does
+	moving map[int]Member
+	frozen map[int]bool
+	// importing are the slots of the node the member serves until it
+	// hands them over
+	importing map[int]Member
+	// migrating are the members a hand over runs to
+	migrating map[string]bool
+
+	conns   map[net.Conn]struct{}
+	stopped bool
+	trigger chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Status describes a node.
+type Status struct {
+	ID    string
+	Epoch uint64
+	// Slots is how many slots the node serves
+	Slots     int
+	Moving    int
+	Importing int
+	Members   []MemberStatus
+}
+
+// MemberStatus is a member of the ring and the number of slots it owns.
+type MemberStatus struct {
+	Member
+	Slots int
+}
+
+// NewNode reads the state of the node and makes it the router of the
+// engine. It is called before the engine is loaded, Start is called after.
+func NewNode(db *dbengine.DBEngine, opts Opts) (*Node, error) {
+	if !validField(opts.ID) {
+		return nil, ErrInvalidMember
+	}
+
+	for _, member := range opts.Members {
+		if !validMember(member) {
+			return nil, ErrInvalidMember
+		}
+	}
+
+	n := &Node{
+		db:        db,
+		opts:      opts,
+		transport: newTransport(opts.TLSConfig),
+		ring:      NewRing(0, nil, nil),
+		previous:  NewRing(0, nil, nil),
+		moving:    map[int]Member{},
+		frozen:    map[int]bool{},
+		importing: map[int]Member{},
+		migrating: map[string]bool{},
+		conns:     map[net.Conn]struct{}{},
+		trigger:   make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+
+	exist, err := n.readState()
+	if err != nil {
+		return nil, err
+	}
+
+	if !exist && len(opts.Members) > 0 {
+		n.ring = NewRing(1, opts.Members, nil)
+		if err := n.saveState(); err != nil {
+			return nil, err
+		}
+	}
+
+	db.Router = n
+
+	return n, nil
+}
+
+// Start exchanges the ring with the other members and hands the slots the
+// node lost over.
+func (n *Node) Start() {
+	n.wg.Add(1)
+	go n.run()
+}
+
+// Serve answers the other members until the listener is closed.
+func (n *Node) Serve(listener net.Listener) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Sharding", &service{node: n}); err != nil {
+		return err
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		n.mu.Lock()
+		if n.stopped {
+			n.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		n.conns[conn] = struct{}{}
+		n.mu.Unlock()
+
+		go func() {
+			server.ServeConn(conn)
+
+			n.mu.Lock()
+			delete(n.conns, conn)
+			n.mu.Unlock()
+		}()
+	}
+}
+
+// Stop stops the node, the engine can be closed once it returns. A hand
+// over that was cut short starts again with the node.
+func (n *Node) Stop() {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return
+	}
+	n.stopped = true
+	close(n.done)
+
+	for conn := range n.conns {
+		conn.Close()
+	}
+	n.mu.Unlock()
+
+	n.transport.close()
+	n.wg.Wait()
+}
+
+// Route is called by the engine for every key it reads or writes.
+func (n *Node) Route(key []byte, write bool) error {
+	slot := Slot(key)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.moving[slot]; ok {
+		if write && n.frozen[slot] {
+			return dbengine.ErrSlotMoves
+		}
+		return nil
+	}
+
+	if source, ok := n.importing[slot]; ok {
+		return &dbengine.MovedError{Slot: slot, Addr: source.ClientAddr}
+	}
+
+	owner, ok := n.ring.Owner(slot)
+	if !ok {
+		return dbengine.ErrNoRing
+	}
+
+	if owner.ID != n.opts.ID {
+		return &dbengine.MovedError{Slot: slot, Addr: owner.ClientAddr}
+	}
+
+	return nil
+}
+
+// Owner returns the member that serves the slot as far as the node knows,
+// which is the member it is handed from while it moves.
+func (n *Node) Owner(slot int) (Member, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if source, ok := n.importing[slot]; ok {
+		return source, true
+	}
+
+	if _, ok := n.moving[slot]; ok {
+		member, _ := n.ring.Member(n.opts.ID)
+		if member.ID == "" {
+			member, _ = n.previous.Member(n.opts.ID)
+		}
+		return member, true
+	}
+
+	return n.ring.Owner(slot)
+}
+
+// AddMember adds a node started without members to the ring, the slots it
+// takes are handed over to it by their owners.
+func (n *Node) AddMember(member Member) error {
+	if !validMember(member) {
+		return ErrInvalidMember
+	}
+
+	n.mu.Lock()
+	ring := n.ring
+	n.mu.Unlock()
+
+	if ring.Epoch == 0 {
+		return dbengine.ErrNoRing
+	}
+
+	if _, ok := ring.Member(member.ID); ok {
+		return ErrMemberExists
+	}
+
+	next := NewRing(ring.Epoch+1, append(append([]Member{}, ring.Members...), member), nil)
+	return n.change(ring, next, "")
+}
+
+// RemoveMember removes a node from the ring, it hands its slots over to the
+// others and serves nothing from then on. With force the node is not
+// waited for, which is the way to remove a node that is gone: its slots
+// start empty on their new owners.
+func (n *Node) RemoveMember(id string, force bool) error {
+	n.mu.Lock()
+	ring := n.ring
+	n.mu.Unlock()
+
+	if _, ok := ring.Member(id); !ok {
+		return ErrMemberNotFound
+	}
+
+	if len(ring.Members) == 1 {
+		return ErrLastMember
+	}
+
+	members := []Member{}
+	for _, member := range ring.Members {
+		if member.ID != id {
+			members = append(members, member)
+		}
+	}
+
+	var lost []string
+	skip := ""
+	if force {
+		lost = []string{id}
+		skip = id
+	}
+
+	return n.change(ring, NewRing(ring.Epoch+1, members, lost), skip)
+}
+
+// change makes next the ring once every member, but skip, has the current
+// ring and is done with the last change. The others learn of it right away
+// when they can be reached, and from the periodic exchange otherwise.
+func (n *Node) change(ring *Ring, next *Ring, skip string) error {
+	members := n.others(ring, next, skip)
+
+	for _, member := range members {
+		var reply SyncReply
+		if err := n.transport.call(member.Addr, "Sync", &SyncArgs{Ring: *ring, Previous: *n.previousOf(ring)}, &reply); err != nil {
+			return fmt.Errorf("node %s did not answer: %v", member.ID, err)
+		}
+
+		if reply.Ring.Epoch != ring.Epoch || reply.Pending {
+			return ErrRebalancing
+		}
+	}
+
+	n.mu.Lock()
+	if n.ring != ring || n.pending() {
+		n.mu.Unlock()
+		return ErrRebalancing
+	}
+
+	if err := n.adopt(next, ring); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	n.mu.Unlock()
+
+	for _, member := range members {
+		var reply SyncReply
+		if err := n.transport.call(member.Addr, "Sync", &SyncArgs{Ring: *next, Previous: *ring}, &reply); err != nil {
+			fmt.Println("Error sending the ring to", member.ID+":", err)
+		}
+	}
+
+	return nil
+}
+
+func (n *Node) previousOf(ring *Ring) *Ring {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.ring == ring {
+		return n.previous
+	}
+	return NewRing(0, nil, nil)
+}
+
+// others returns the members of both rings but the node itself and skip.
+func (n *Node) others(ring *Ring, next *Ring, skip string) []Member {
+	seen := map[string]bool{n.opts.ID: true, skip: true}
+	members := []Member{}
+
+	for _, r := range []*Ring{ring, next} {
+		for _, member := range r.Members {
+			if !seen[member.ID] {
+				seen[member.ID] = true
+				members = append(members, member)
+			}
+		}
+	}
+
+	return members
+}
+
+// Status describes the node and the ring it has.
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	status := Status{
+		ID:        n.opts.ID,
+		Epoch:     n.ring.Epoch,
+		Moving:    len(n.moving),
+		Importing: len(n.importing),
+	}
+
+	for slot := 0; slot < NUM_OF_SLOTS; slot++ {
+		if n.serves(slot) {
+			status.Slots++
+		}
+	}
+
+	slots := n.ring.Slots()
+	for _, member := range n.ring.Members {
+		status.Members = append(status.Members, MemberStatus{Member: member, Slots: slots[member.ID]})
+	}
+
+	return status
+}
+
+// serves reports whether the node serves the slot, it expects mu to be
+// held.
+func (n *Node) serves(slot int) bool {
+	if _, ok := n.moving[slot]; ok {
+		return true
+	}
+
+	if _, ok := n.importing[slot]; ok {
+		return false
+	}
+
+	owner, ok := n.ring.Owner(slot)
+	return ok && owner.ID == n.opts.ID
+}
+
+// pending reports whether the node hands slots over or waits for some, it
+// expects mu to be held.
+func (n *Node) pending() bool {
+	return len(n.moving) > 0 || len(n.importing) > 0
+}
+
+// adopt makes ring the ring of the node when it is newer. The slots the
+// node serves and no longer owns are handed over, and the slots it gets
+// are waited for from their owner in previous, unless that one was lost.
+// It expects mu to be held.
+func (n *Node) adopt(ring *Ring, previous *Ring) error {
+	if ring.Epoch <= n.ring.Epoch {
+		return nil
+	}
+
+	if previous == nil || previous.Epoch == 0 {
+		previous = n.ring
+	}
+
+	for slot := 0; slot < NUM_OF_SLOTS; slot++ {
+		owner, _ := ring.Owner(slot)
+		mine := owner.ID == n.opts.ID
+
+		if n.serves(slot) {
+			if mine {
+				delete(n.moving, slot)
+				delete(n.frozen, slot)
+			} else {
+				n.moving[slot] = owner
+			}
+			continue
+		}
+
+		if !mine {
+			delete(n.importing, slot)
+			continue
+		}
+
+		if _, ok := n.importing[slot]; ok {
+			continue
+		}
+
+		source, ok := previous.Owner(slot)
+		if ok && source.ID != n.opts.ID && !ring.isLost(source.ID) {
+			n.importing[slot] = source
+		}
+	}
+
+	n.previous, n.ring = previous, ring
+
+	if err := n.saveState(); err != nil {
+		return err
+	}
+
+	select {
+	case n.trigger <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (n *Node) run() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(SYNC_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		n.sync()
+		n.startHandovers()
+
+		select {
+		case <-n.done:
+			return
+		case <-n.trigger:
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync exchanges the ring with every other member, the newest one wins on
+// both sides.
+func (n *Node) sync() {
+	n.mu.Lock()
+	args := SyncArgs{Ring: *n.ring, Previous: *n.previous}
+	members := n.others(n.ring, n.previous, "")
+	n.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, member := range members {
+		wg.Add(1)
+		go func(member Member) {
+			defer wg.Done()
+
+			var reply SyncReply
+			if err := n.transport.call(member.Addr, "Sync", &args, &reply); err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+
+			if err := n.adopt(rebuild(reply.Ring), rebuild(reply.Previous)); err != nil {
+				fmt.Println("Error saving the ring:", err)
+			}
+		}(member)
+	}
+	wg.Wait()
+}
+
+func (n *Node) handleSync(args *SyncArgs, reply *SyncReply) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.stopped {
+		return errStopped
+	}
+
+	if err := n.adopt(rebuild(args.Ring), rebuild(args.Previous)); err != nil {
+		return err
+	}
+
+	reply.Ring = *n.ring
+	reply.Previous = *n.previous
+	reply.Pending = n.pending()
+
+	return nil
+}
+
+// startHandovers starts handing the moving slots to each member that does
+// not have a hand over running.
+func (n *Node) startHandovers() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.stopped {
+		return
+	}
+
+	for _, target := range n.moving {
+		if n.migrating[target.ID] {
+			continue
+		}
+
+		n.migrating[target.ID] = true
+		n.wg.Add(1)
+		go n.migrate(target)
+	}
+}
+
+// rebuild assigns the slots of a ring received from another node.
+func rebuild(r Ring) *Ring {
+	return NewRing(r.Epoch, r.Members, r.Lost)
+}
+
+func validField(field string) bool {
+	return field != "" && !strings.ContainsAny(field, " \t\r\n")
+}
+
+func validMember(member Member) bool {
+	return validField(member.ID) && validField(member.Addr) && validField(member.ClientAddr)
+}
+
+// readState reports whether the state file exists.
+func (n *Node) readState() (bool, error) {
+	file, err := os.Open(n.opts.StateFile)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	invalid := fmt.Errorf("invalid sharding state in %s", n.opts.StateFile)
+
+	var epoch, previousEpoch uint64
+	var members, previousMembers []Member
+	var lost, previousLost []string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch {
+		case (fields[0] == "epoch" || fields[0] == "previous_epoch") && len(fields) == 2:
+			number, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return false, invalid
+			}
+			if fields[0] == "epoch" {
+				epoch = number
+			} else {
+				previousEpoch = number
+			}
+		case fields[0] == "member" && len(fields) == 4:
+			members = append(members, Member{ID: fields[1], Addr: fields[2], ClientAddr: fields[3]})
+		case fields[0] == "previous_member" && len(fields) == 4:
+			previousMembers = append(previousMembers, Member{ID: fields[1], Addr: fields[2], ClientAddr: fields[3]})
+		case fields[0] == "lost" && len(fields) == 2:
+			lost = append(lost, fields[1])
+		case fields[0] == "previous_lost" && len(fields) == 2:
+			previousLost = append(previousLost, fields[1])
+		case (fields[0] == "moving" || fields[0] == "importing") && len(fields) == 5:
+			slot, err := strconv.Atoi(fields[1])
+			if err != nil || slot < 0 || slot >= NUM_OF_SLOTS {
+				return false, invalid
+			}
+
+			member := Member{ID: fields[2], Addr: fields[3], ClientAddr: fields[4]}
+			if fields[0] == "moving" {
+				n.moving[slot] = member
+			} else {
+				n.importing[slot] = member
+			}
+		default:
+			return false, invalid
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+
+	n.ring = NewRing(epoch, members, lost)
+	n.previous = NewRing(previousEpoch, previousMembers, previousLost)
+
+	return true, nil
+}
+
+// saveState replaces the state file in one rename, it expects mu to be
+// held. The slots that were frozen are not, a hand over starts again from
+// the beginning.
+func (n *Node) saveState() error {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "epoch %d\n", n.ring.Epoch)
+	for _, member := range n.ring.Members {
+		fmt.Fprintf(&buf, "member %s %s %s\n", member.ID, member.Addr, member.ClientAddr)
+	}
+	for _, id := range n.ring.Lost {
+		fmt.Fprintf(&buf, "lost %s\n", id)
+	}
+
+	fmt.Fprintf(&buf, "previous_epoch %d\n", n.previous.Epoch)
+	for _, member := range n.previous.Members {
+		fmt.Fprintf(&buf, "previous_member %s %s %s\n", member.ID, member.Addr, member.ClientAddr)
+	}
+	for _, id := range n.previous.Lost {
+		fmt.Fprintf(&buf, "previous_lost %s\n", id)
+	}
+
+	for _, slot := range sortedSlots(n.moving) {
+		member := n.moving[slot]
+		fmt.Fprintf(&buf, "moving %d %s %s %s\n", slot, member.ID, member.Addr, member.ClientAddr)
+	}
+	for _, slot := range sortedSlots(n.importing) {
+		member := n.importing[slot]
+		fmt.Fprintf(&buf, "importing %d %s %s %s\n", slot, member.ID, member.Addr, member.ClientAddr)
+	}
+
+	path := n.opts.StateFile
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func sortedSlots(slots map[int]Member) []int {
+	sorted := make([]int, 0, len(slots))
+	for slot := range slots {
+		sorted = append(sorted, slot)
+	}
+	sort.Ints(sorted)
+
+	return sorted
+}
+
+// applyPairs writes pairs straight to the tree, around the router.
+func (n *Node) applyPairs(pairs []Pair) error {
+	batch := dbengine.NewWriteBatch()
+	for _, pair := range pairs {
+		if pair.Delete {
+			batch.Delete(pair.Key)
+		} else {
+			batch.Add(wal.Entry{Key: pair.Key, Value: pair.Value, ExpiresAt: pair.ExpiresAt})
+		}
+	}
+
+	return n.db.ApplyReplicated(batch)
+}
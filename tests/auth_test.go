@@ -0,0 +1,143 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/Avash027/midDB/auth"
+)
+
+func newUsers(t *testing.T, opts ...auth.UserOpts) *auth.Users {
+	t.Helper()
+
+	hash, err := auth.HashPassword([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range opts {
+		opts[i].PasswordHash = hash
+	}
+
+	users, err := auth.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return users
+}
+
+func TestAuthRejectsWrongPasswords(t *testing.T) {
+	users := newUsers(t, auth.UserOpts{Name: "app"})
+
+	if _, ok := users.Authenticate("app", []byte("wrong")); ok {
+		t.Fatal("a wrong password was accepted")
+	}
+	if _, ok := users.Authenticate("nobody", []byte("secret")); ok {
+		t.Fatal("an unknown user was accepted")
+	}
+
+	user, ok := users.Authenticate("app", []byte("secret"))
+	if !ok || user.Name != "app" {
+		t.Fatalf("the right password returned %v, %v", user, ok)
+	}
+
+	// the password that authenticated last is cached, other ones must still
+	// be checked
+	if _, ok := users.Authenticate("app", []byte("secret")); !ok {
+		t.Fatal("the cached password was refused")
+	}
+	if _, ok := users.Authenticate("app", []byte("wrong")); ok {
+		t.Fatal("a wrong password was accepted after the right one")
+	}
+}
+
+func TestAuthPrefixRules(t *testing.T) {
+	users := newUsers(t, auth.UserOpts{
+		Name: "app",
+		Permissions: []auth.PermissionOpts{
+			{Prefix: "", Access: "read"},
+			{Prefix: "orders:", Access: "write"},
+			{Prefix: "secret:", Access: "none"},
+		},
+		Namespaces: []string{"reports"},
+	})
+
+	user, ok := users.Authenticate("app", []byte("secret"))
+	if !ok {
+		t.Fatal("the user was refused")
+	}
+
+	tests := []struct {
+		key    string
+		access auth.Access
+		want   bool
+	}{
+		{key: "users:1", access: auth.ACCESS_READ, want: true},
+		{key: "users:1", access: auth.ACCESS_WRITE, want: false},
+		{key: "orders:1", access: auth.ACCESS_WRITE, want: true},
+		{key: "orders:1", access: auth.ACCESS_ADMIN, want: false},
+		{key: "secret:1", access: auth.ACCESS_READ, want: false},
+		{key: "secret", access: auth.ACCESS_READ, want: true},
+	}
+
+	for _, test := range tests {
+		if got := user.Can([]byte(test.key), test.access); got != test.want {
+			t.Errorf("%s access on %s is %v, want %v", test.access, test.key, got, test.want)
+		}
+	}
+
+	ranges := []struct {
+		start string
+		end   string
+		want  bool
+	}{
+		{start: "users:", end: "users;", want: true},
+		// the range holds the keys under secret:
+		{start: "s", end: "t", want: false},
+		{start: "", end: "", want: false},
+	}
+
+	for _, r := range ranges {
+		if got := user.CanRange([]byte(r.start), []byte(r.end), auth.ACCESS_READ); got != r.want {
+			t.Errorf("read access on [%q, %q) is %v, want %v", r.start, r.end, got, r.want)
+		}
+	}
+
+	if !user.CanRange([]byte("orders:"), []byte("orders;"), auth.ACCESS_WRITE) {
+		t.Error("write access on the keys under orders: was refused")
+	}
+
+	if user.IsAdmin() {
+		t.Error("the user is an admin")
+	}
+
+	for namespace, want := range map[string]bool{"": true, "default": true, "reports": true, "billing": false} {
+		if got := user.CanSelect(namespace); got != want {
+			t.Errorf("selecting %q is %v, want %v", namespace, got, want)
+		}
+	}
+}
+
+func TestAuthAdmin(t *testing.T) {
+	users := newUsers(t, auth.UserOpts{
+		Name:        "root",
+		Permissions: []auth.PermissionOpts{{Prefix: "", Access: "admin"}},
+	}, auth.UserOpts{Name: "guest"})
+
+	root, ok := users.Authenticate("root", []byte("secret"))
+	if !ok {
+		t.Fatal("root was refused")
+	}
+	if !root.IsAdmin() || !root.CanSelect("billing") {
+		t.Fatal("root is not an admin")
+	}
+
+	// a user without rules has no access at all
+	guest, ok := users.Authenticate("guest", []byte("secret"))
+	if !ok {
+		t.Fatal("guest was refused")
+	}
+	if guest.Can([]byte("key"), auth.ACCESS_READ) || guest.CanSelect("billing") {
+		t.Fatal("guest has access")
+	}
+}
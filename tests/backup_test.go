@@ -0,0 +1,250 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Avash027/midDB/backup"
+	dbengine "github.com/Avash027/midDB/db_engine"
+	diskstore "github.com/Avash027/midDB/disk_store"
+	"github.com/Avash027/midDB/wal"
+)
+
+func restoreOpts(from string, dir string) backup.RestoreOpts {
+	return backup.RestoreOpts{
+		Backup:             from,
+		SSTableDirectory:   filepath.Join(dir, "sstables"),
+		PartitionDirectory: filepath.Join(dir, "partitions"),
+		NumOfPartitions:    diskstore.DEFAULT_NUM_OF_PARTITIONS,
+		WalPath:            filepath.Join(dir, wal.DEFAULT_WAL_PATH),
+		NamespaceDirectory: filepath.Join(dir, "namespaces"),
+	}
+}
+
+// checkKeyRange checks db holds key<0> to key<n-1> and none of the keys up
+// to key<total-1>.
+func checkKeyRange(t *testing.T, db *dbengine.DBEngine, n int, total int) {
+	t.Helper()
+
+	for i := 0; i < total; i++ {
+		key := fmt.Sprintf("key%d", i)
+		value, exist, err := db.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i < n && (!exist || string(value) != fmt.Sprintf("value%d", i)) {
+			t.Fatalf("%s is %q, %v, want value%d", key, value, exist, i)
+		}
+		if i >= n && exist {
+			t.Fatalf("%s should not be restored, %d keys were", key, n)
+		}
+	}
+}
+
+// waitArchived waits until the persisting cycle archived the writes up to
+// seq.
+func waitArchived(t *testing.T, archive string, seq uint64) {
+	deadline := time.Now().Add(3 * diskstore.PERSIST_INTERVAL)
+	for time.Now().Before(deadline) {
+		records, err := wal.ReadArchive(filepath.Join(archive, dbengine.DEFAULT_NAMESPACE))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(records) > 0 {
+			last := records[len(records)-1]
+			if last.Seq+uint64(len(last.Entries))-1 >= seq {
+				return
+			}
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Fatalf("the writes up to seq %d were not archived", seq)
+}
+
+func TestBackupWhileWriting(t *testing.T) {
+	db := openEngine(t, t.TempDir(), "")
+
+	namespace, err := db.CreateNamespace("users", dbengine.Quota{MaxBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := namespace.Put([]byte("alice"), []byte("admin")); err != nil {
+		t.Fatal(err)
+	}
+
+	const TOTAL = 5000
+	putKeys(t, db, 0, 100)
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		putKeys(t, db, 100, TOTAL)
+	}()
+
+	from := filepath.Join(t.TempDir(), "backup")
+	manifest, err := backup.Create(db, from)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := backup.Create(db, from); !errors.Is(err, backup.ErrNotEmpty) {
+		t.Fatalf("a second backup to the same path returned %v", err)
+	}
+
+	seqs := map[string]uint64{}
+	for _, namespace := range manifest.Namespaces {
+		seqs[namespace.Name] = namespace.Seq
+	}
+	if len(seqs) != 2 || seqs["users"] != 1 {
+		t.Fatalf("the backup holds %v", manifest.Namespaces)
+	}
+
+	closeEngine(db)
+
+	dir := t.TempDir()
+	restored, err := backup.Restore(restoreOpts(from, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 2 {
+		t.Fatalf("restored %v", restored)
+	}
+
+	if _, err := backup.Restore(restoreOpts(from, dir)); !errors.Is(err, backup.ErrNotEmpty) {
+		t.Fatalf("restoring over data returned %v", err)
+	}
+
+	db = openEngine(t, dir, "")
+
+	// the keys were written in order, so a consistent backup holds exactly
+	// the ones written up to its seq
+	checkKeyRange(t, db, int(seqs[dbengine.DEFAULT_NAMESPACE]), TOTAL)
+
+	namespace, err = db.Namespace("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, exist, err := namespace.Get([]byte("alice")); err != nil || !exist || string(value) != "admin" {
+		t.Fatalf("alice is %q, %v, %v", value, exist, err)
+	}
+	if quota := namespace.Stats().Quota.MaxBytes; quota != 1<<20 {
+		t.Fatalf("the quota is %d", quota)
+	}
+}
+
+func TestRestorePointInTime(t *testing.T) {
+	archive := t.TempDir()
+	db := openEngine(t, t.TempDir(), archive)
+
+	putKeys(t, db, 0, 100)
+
+	from := filepath.Join(t.TempDir(), "backup")
+	manifest, err := backup.Create(db, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Namespaces[0].Seq != 100 {
+		t.Fatalf("the backup holds %v", manifest.Namespaces)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	putKeys(t, db, 100, 200)
+	time.Sleep(10 * time.Millisecond)
+	until := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	putKeys(t, db, 200, 300)
+
+	// the persisting cycle only archives what reached the log file
+	if err := db.Wal.Persist(); err != nil {
+		t.Fatal(err)
+	}
+	waitArchived(t, archive, 300)
+	closeEngine(db)
+
+	tooEarly := restoreOpts(from, t.TempDir())
+	tooEarly.ArchiveDirectory = archive
+	tooEarly.UntilSeq = 50
+	if _, err := backup.Restore(tooEarly); !errors.Is(err, backup.ErrTooEarly) {
+		t.Fatalf("restoring to before the backup returned %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		untilSeq  uint64
+		untilTime time.Time
+		want      int
+	}{
+		{name: "seq", untilSeq: 150, want: 150},
+		{name: "time", untilTime: until, want: 200},
+		{name: "end", want: 300},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := restoreOpts(from, dir)
+			opts.ArchiveDirectory = archive
+			opts.UntilSeq = test.untilSeq
+			opts.UntilTime = test.untilTime
+
+			restored, err := backup.Restore(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if restored[0].Seq != uint64(test.want) {
+				t.Fatalf("restored up to seq %d, want %d", restored[0].Seq, test.want)
+			}
+
+			db := openEngine(t, dir, "")
+			checkKeyRange(t, db, test.want, 300)
+		})
+	}
+}
+
+func TestManifestWithSpaces(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("data")
+
+	if err := os.MkdirAll(filepath.Join(dir, "default"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "default", "a file"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := fmt.Sprintf("time 1\nnamespace default 0\nfile %s %d %d\n", strconv.Quote("default/a file"), len(data), crc32.ChecksumIEEE(data))
+	if err := os.WriteFile(filepath.Join(dir, backup.MANIFEST_FILE_NAME), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := backup.ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read.Files) != 1 || read.Files[0].Path != "default/a file" {
+		t.Fatalf("the manifest lists %v", read.Files)
+	}
+	if err := backup.Verify(dir, read); err != nil {
+		t.Fatal(err)
+	}
+
+	// an unquoted path with a space does not parse
+	manifest = fmt.Sprintf("time 1\nnamespace default 0\nfile default/a file %d %d\n", len(data), crc32.ChecksumIEEE(data))
+	if err := os.WriteFile(filepath.Join(dir, backup.MANIFEST_FILE_NAME), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backup.ReadManifest(dir); !errors.Is(err, backup.ErrInvalidManifest) {
+		t.Fatalf("reading an unquoted path with a space returned %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package tests
+
+import (
+	"path/filepath"
+	"testing"
+
+	LsmTree "github.com/Avash027/midDB/lsm_tree"
+	"github.com/Avash027/midDB/wal"
+)
+
+// binaryPairs holds the bytes the text formats used to split on.
+var binaryPairs = map[string]string{
+	"with space":     "a value with spaces",
+	"with|pipe":      "a|b|c|",
+	"with:colon":     "1:2:3",
+	"with\nnewline":  "line1\nline2\n",
+	"+|fake|record|": "\r\n",
+	"\x00\xff":       "\x00\x01\xfe\xff",
+	"nul value":      "\x00",
+}
+
+func binaryEntries() []wal.Entry {
+	entries := []wal.Entry{}
+	for key, value := range binaryPairs {
+		entries = append(entries, wal.Entry{Key: []byte(key), Value: []byte(value)})
+	}
+	return entries
+}
+
+func TestBinarySafeWAL(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), wal.DEFAULT_WAL_PATH)
+
+	w := wal.InitWAL(dir)
+	if err := w.WriteBatch(binaryEntries()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w = wal.InitWAL(dir)
+	defer w.Close()
+
+	lsmTree := openTree(t, t.TempDir(), LsmTree.CompactionOpts{Style: LsmTree.COMPACTION_STYLE_LEVELED})
+	if err := w.InitDB(lsmTree); err != nil {
+		t.Fatal(err)
+	}
+
+	checkTree(t, lsmTree, binaryPairs)
+}
+
+func TestBinarySafePartitions(t *testing.T) {
+	dir := t.TempDir()
+
+	persistEntries(t, dir, binaryEntries())
+
+	pairs := readPartitions(dir)
+	if len(pairs) != len(binaryPairs) {
+		t.Fatalf("the partitions hold %d pairs, want %d", len(pairs), len(binaryPairs))
+	}
+	for key, want := range binaryPairs {
+		if pairs[key] != want {
+			t.Fatalf("%q is %q in the partitions, want %q", key, pairs[key], want)
+		}
+	}
+}
+
+func TestBinarySafeSSTables(t *testing.T) {
+	dir := t.TempDir()
+	lsmTree := openTree(t, dir, LsmTree.CompactionOpts{Style: LsmTree.COMPACTION_STYLE_LEVELED})
+
+	for key, value := range binaryPairs {
+		lsmTree.Put([]byte(key), []byte(value))
+	}
+	flushTree(t, lsmTree)
+	if err := lsmTree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lsmTree = openTree(t, dir, LsmTree.CompactionOpts{Style: LsmTree.COMPACTION_STYLE_LEVELED})
+	checkTree(t, lsmTree, binaryPairs)
+}
@@ -0,0 +1,114 @@
+package tests
+
+import (
+	"bytes"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// buildCLI builds middb-cli and returns the path of the binary.
+func buildCLI(t *testing.T) string {
+	t.Helper()
+
+	bin := filepath.Join(t.TempDir(), "middb-cli")
+	out, err := exec.Command("go", "build", "-o", bin, "github.com/Avash027/midDB/cmd/middb-cli").CombinedOutput()
+	if err != nil {
+		t.Fatalf("building middb-cli: %v\n%s", err, out)
+	}
+
+	return bin
+}
+
+// runCLI runs the binary with the input on stdin and returns what it wrote
+// to stdout and whether it exited with 0.
+func runCLI(t *testing.T, bin string, input string, args ...string) (string, bool) {
+	t.Helper()
+
+	cmd := exec.Command(bin, args...)
+	cmd.Stdin = strings.NewReader(input)
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	err := cmd.Run()
+	if _, exited := err.(*exec.ExitError); err != nil && !exited {
+		t.Fatal(err)
+	}
+
+	return stdout.String(), err == nil
+}
+
+func TestCLI(t *testing.T) {
+	ts := startServer(t, nil)
+	bin := buildCLI(t)
+
+	// the arguments are one command, already split by the shell
+	if out, ok := runCLI(t, bin, "", "-addr", ts.tcp, "PUT", "greeting", "hello world"); !ok || out != "OK\n" {
+		t.Fatalf("PUT printed %q", out)
+	}
+	if value, _, _ := ts.db.Get([]byte("greeting")); string(value) != "hello world" {
+		t.Fatalf("greeting is %q", value)
+	}
+
+	script := `# a comment and a blank line are skipped
+
+PUT "with\nnewline" 'single "quoted"'
+GET "with\nnewline"
+MULTI
+PUT a 1
+PUT b 2
+EXEC
+PREFIX ""
+GET missing
+`
+	out, ok := runCLI(t, bin, script, "-addr", ts.tcp)
+	want := `OK
+"single \"quoted\""
+OK
+QUEUED
+QUEUED
+OK
+a 1
+b 2
+greeting "hello world"
+"with\nnewline" "single \"quoted\""
+(not found)
+`
+	if !ok || out != want {
+		t.Fatalf("the script printed\n%s\nwant\n%s", out, want)
+	}
+
+	out, ok = runCLI(t, bin, "", "-addr", ts.tcp, "-json", "MGET", "a", "missing")
+	if !ok || out != `{"items":[{"value":"1"},{"value":null}]}`+"\n" {
+		t.Fatalf("MGET printed %q", out)
+	}
+}
+
+func TestCLIScriptFailures(t *testing.T) {
+	ts := startServer(t, nil)
+	bin := buildCLI(t)
+
+	script := "PUT a 1\nNOSUCH\nPUT b 2\n"
+
+	// the script stops at the first failed command
+	if _, ok := runCLI(t, bin, script, "-addr", ts.tcp); ok {
+		t.Fatal("the failed script exited with 0")
+	}
+	if _, exist, _ := ts.db.Get([]byte("b")); exist {
+		t.Fatal("the script went on after the failed command")
+	}
+
+	// -k runs every command, but still reports the failure
+	if _, ok := runCLI(t, bin, script, "-addr", ts.tcp, "-k"); ok {
+		t.Fatal("the failed script exited with 0 with -k")
+	}
+	if value, _, _ := ts.db.Get([]byte("b")); string(value) != "2" {
+		t.Fatalf("b is %q after running with -k", value)
+	}
+
+	if out, ok := runCLI(t, bin, "", "-addr", ts.tcp, "GET"); ok || !strings.Contains(out, "usage: GET key") {
+		t.Fatalf("GET without a key printed %q", out)
+	}
+}
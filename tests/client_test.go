@@ -0,0 +1,138 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Avash027/midDB/client"
+)
+
+func newClient(t *testing.T, opts client.Options) *client.Client {
+	t.Helper()
+
+	c := client.New(opts)
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+func TestClient(t *testing.T) {
+	ts := startServer(t, nil)
+	c := newClient(t, client.Options{Addr: ts.tcp})
+
+	value := []byte("a value\nwith | and spaces")
+	if err := c.Put([]byte("key one"), value); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Get([]byte("key one")); err != nil || string(got) != string(value) {
+		t.Fatalf("Get returned %q: %v", got, err)
+	}
+	if _, err := c.Get([]byte("missing")); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("Get on a missing key returned %v", err)
+	}
+
+	values, err := c.MGet([]byte("key one"), []byte("missing"))
+	if err != nil || len(values) != 2 || string(values[0]) != string(value) || values[1] != nil {
+		t.Fatalf("MGet returned %q: %v", values, err)
+	}
+
+	if err := c.PutIfAbsent([]byte("key one"), []byte("other")); !errors.Is(err, client.ErrConflict) {
+		t.Fatalf("PutIfAbsent on an existing key returned %v", err)
+	}
+	if err := c.CompareAndSwap([]byte("key one"), []byte("wrong"), []byte("other")); !errors.Is(err, client.ErrConflict) {
+		t.Fatalf("CompareAndSwap from the wrong value returned %v", err)
+	}
+	if err := c.CompareAndSwap([]byte("key one"), value, []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl, err := c.TTL([]byte("key one")); err != nil || ttl != client.NO_EXPIRY {
+		t.Fatalf("TTL returned %v: %v", ttl, err)
+	}
+	if err := c.PutWithTTL([]byte("expiring"), []byte("value"), 90*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := c.TTL([]byte("expiring")); err != nil || ttl < 80*time.Second || ttl > 90*time.Second {
+		t.Fatalf("TTL returned %v: %v", ttl, err)
+	}
+	if err := c.Expire([]byte("missing"), time.Minute); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("Expire on a missing key returned %v", err)
+	}
+
+	batch := client.NewBatch()
+	batch.Put([]byte("batch1"), []byte("1"))
+	batch.Put([]byte("batch2"), []byte("2"))
+	batch.Delete([]byte("key one"))
+	if err := c.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get([]byte("key one")); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("the batch did not delete key one: %v", err)
+	}
+	if got, _ := c.Get([]byte("batch2")); string(got) != "2" {
+		t.Fatalf("batch2 is %q", got)
+	}
+}
+
+func TestClientScan(t *testing.T) {
+	ts := startServer(t, nil)
+	c := newClient(t, client.Options{Addr: ts.tcp})
+
+	putKeys(t, ts.db, 0, 25)
+
+	// pages of 4 keys are fetched until the range ends
+	scanner := c.Prefix([]byte("key1"), 4)
+	keys := []string{}
+	for scanner.Next() {
+		keys = append(keys, string(scanner.Key()))
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[key1 key10 key11 key12 key13 key14 key15 key16 key17 key18 key19]"; fmt.Sprint(keys) != want {
+		t.Fatalf("the prefix key1 holds %v, want %s", keys, want)
+	}
+
+	pairs, err := c.ScanAll([]byte("key20"), []byte("key23"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 3 || string(pairs[0].Key) != "key20" || string(pairs[2].Value) != "value22" {
+		t.Fatalf("the range key20 to key23 holds %v", pairs)
+	}
+}
+
+func TestClientPool(t *testing.T) {
+	ts := startServer(t, nil)
+	c := newClient(t, client.Options{Addr: ts.tcp, PoolSize: 2})
+
+	// more writers than connections wait for one to be released
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < 20; i++ {
+				key := []byte(fmt.Sprintf("w%d-%d", w, i))
+				if err := c.Put(key, key); err != nil {
+					t.Error(err)
+					return
+				}
+				if value, err := c.Get(key); err != nil || string(value) != string(key) {
+					t.Errorf("%s is %q: %v", key, value, err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	c.Close()
+	if _, err := c.Get([]byte("w0-0")); !errors.Is(err, client.ErrClosed) {
+		t.Fatalf("Get on a closed client returned %v", err)
+	}
+}
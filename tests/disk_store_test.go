@@ -0,0 +1,126 @@
+package tests
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	diskstore "github.com/Avash027/midDB/disk_store"
+	LsmTree "github.com/Avash027/midDB/lsm_tree"
+	"github.com/Avash027/midDB/wal"
+)
+
+// persistEntries runs persisting cycles of a store in dir until the entries
+// are in its partitions, and closes it.
+func persistEntries(t *testing.T, dir string, entries []wal.Entry) {
+	t.Helper()
+
+	store := diskstore.New(diskstore.DiskStoreOpts{Directory: filepath.Join(dir, "partitions"), NumOfPartitions: 4})
+	lsmTree := LsmTree.InitNewLSMTree(LsmTree.LSMTreeOpts{
+		MaxElementsBeforeFlush: LsmTree.DEFAULT_MAX_ELEMENTS_BEFORE_FLUSH,
+		CompactionPeriod:       LsmTree.DEFAULT_COMPACTION_FREQUENCY,
+		Directory:              filepath.Join(dir, "sstables"),
+		CompactionOpts:         LsmTree.CompactionOpts{Style: LsmTree.DEFAULT_COMPACTION_STYLE},
+		BloomFilterOpts: LsmTree.BloomFilterOpts{
+			ErrorRate: LsmTree.DEFAULT_BLOOM_FILTER_ERROR_RATE,
+			Capacity:  LsmTree.DEFAULT_BLOOM_FILTER_CAPACITY,
+		},
+	})
+	defer lsmTree.Close()
+
+	w := wal.InitWAL(filepath.Join(dir, wal.DEFAULT_WAL_PATH))
+	defer w.Close()
+
+	if err := w.WriteBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+
+	start := make(chan bool, 1)
+	start <- true
+	go store.PersistToDisk(lsmTree, w, start)
+
+	deadline := time.Now().Add(3 * diskstore.PERSIST_INTERVAL)
+	for {
+		pending, _, err := w.ReadEntries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d entries were not persisted", len(pending))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readPartitions returns the pairs held by the partitions in dir.
+func readPartitions(dir string) map[string]string {
+	store := diskstore.New(diskstore.DiskStoreOpts{Directory: filepath.Join(dir, "partitions"), NumOfPartitions: 4})
+	defer store.Close()
+
+	pairs := map[string]string{}
+	for i := 0; i < 4; i++ {
+		for _, entry := range store.GetFileContents(i) {
+			pairs[string(entry.Key)] = string(entry.Value)
+		}
+	}
+
+	return pairs
+}
+
+func TestPartitionSurvivesTornRewrite(t *testing.T) {
+	dir := t.TempDir()
+
+	entries := []wal.Entry{}
+	for i := 0; i < 100; i++ {
+		entries = append(entries, wal.Entry{Key: []byte(fmt.Sprintf("key%d", i)), Value: []byte(fmt.Sprintf("value%d", i))})
+	}
+	persistEntries(t, dir, entries)
+
+	// a crash in the middle of a rewrite leaves part of the new partition
+	// next to the old one
+	for i := 0; i < 4; i++ {
+		path := filepath.Join(dir, "partitions", fmt.Sprintf("partition_%d", i))
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path+diskstore.TMP_EXTENSION, data[:len(data)/2], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pairs := readPartitions(dir)
+	if len(pairs) != 100 {
+		t.Fatalf("the partitions hold %d pairs after a torn rewrite, want 100", len(pairs))
+	}
+	for i := 0; i < 100; i++ {
+		if value := pairs[fmt.Sprintf("key%d", i)]; value != fmt.Sprintf("value%d", i) {
+			t.Fatalf("key%d is %q", i, value)
+		}
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, "partitions", "*"+diskstore.TMP_EXTENSION))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 0 {
+		t.Fatalf("the torn rewrites %v were left", matches)
+	}
+
+	// the next rewrite replaces the partitions whole
+	persistEntries(t, dir, []wal.Entry{{Key: []byte("key0"), Delete: true}, {Key: []byte("key1"), Value: []byte("changed")}})
+
+	pairs = readPartitions(dir)
+	if _, exist := pairs["key0"]; exist || pairs["key1"] != "changed" || len(pairs) != 99 {
+		t.Fatalf("the partitions hold %d pairs, key1 is %q", len(pairs), pairs["key1"])
+	}
+}
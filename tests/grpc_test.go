@@ -0,0 +1,155 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Avash027/midDB/rpc"
+	"github.com/Avash027/midDB/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func dialGRPC(t *testing.T, ts *testServer) rpc.KVClient {
+	t.Helper()
+
+	conn, err := grpc.NewClient(ts.grpc, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return rpc.NewKVClient(conn)
+}
+
+// scanGRPC returns the keys the scan streams.
+func scanGRPC(t *testing.T, kv rpc.KVClient, req *rpc.ScanRequest) []string {
+	t.Helper()
+
+	stream, err := kv.Scan(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{}
+	for {
+		pair, err := stream.Recv()
+		if err == io.EOF {
+			return keys
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, string(pair.Key))
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	ts := startServer(t, nil)
+	kv := dialGRPC(t, ts)
+	ctx := context.Background()
+
+	if _, err := kv.Put(ctx, &rpc.PutRequest{Key: []byte("key"), Value: []byte("\x00value")}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := kv.Get(ctx, &rpc.GetRequest{Key: []byte("key")})
+	if err != nil || string(resp.Value) != "\x00value" {
+		t.Fatalf("Get returned %v: %v", resp, err)
+	}
+
+	if _, err := kv.Delete(ctx, &rpc.DeleteRequest{Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.Get(ctx, &rpc.GetRequest{Key: []byte("key")}); status.Code(err) != codes.NotFound {
+		t.Fatalf("Get after Delete returned %v", err)
+	}
+	if _, err := kv.Put(ctx, &rpc.PutRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Put without a key returned %v", err)
+	}
+
+	// a batch with a bad operation is not applied at all
+	_, err = kv.BatchWrite(ctx, &rpc.BatchWriteRequest{Operations: []*rpc.WriteOperation{
+		{Type: rpc.WriteOperation_PUT, Key: []byte("bad"), Value: []byte("value")},
+		{Type: rpc.WriteOperation_PUT, Value: []byte("value")},
+	}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("the bad batch returned %v", err)
+	}
+	if _, exist, _ := ts.db.Get([]byte("bad")); exist {
+		t.Fatal("the bad batch was partly applied")
+	}
+
+	// more keys than a page, so the scan is streamed over several
+	operations := []*rpc.WriteOperation{}
+	for i := 0; i < server.GRPC_SCAN_PAGE_SIZE+10; i++ {
+		key := []byte(fmt.Sprintf("a%04d", i))
+		operations = append(operations, &rpc.WriteOperation{Type: rpc.WriteOperation_PUT, Key: key, Value: key})
+	}
+	operations = append(operations,
+		&rpc.WriteOperation{Type: rpc.WriteOperation_PUT, Key: []byte("b1"), Value: []byte("1")},
+		&rpc.WriteOperation{Type: rpc.WriteOperation_DELETE, Key: []byte("a0000")},
+	)
+	if _, err := kv.BatchWrite(ctx, &rpc.BatchWriteRequest{Operations: operations}); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := scanGRPC(t, kv, &rpc.ScanRequest{Prefix: []byte("a")})
+	if len(keys) != server.GRPC_SCAN_PAGE_SIZE+9 || keys[0] != "a0001" {
+		t.Fatalf("the prefix a holds %d keys from %s", len(keys), keys[0])
+	}
+
+	keys = scanGRPC(t, kv, &rpc.ScanRequest{Start: []byte("a0005"), End: []byte("b2"), Limit: 3})
+	if fmt.Sprint(keys) != "[a0005 a0006 a0007]" {
+		t.Fatalf("the limited scan returned %v", keys)
+	}
+}
+
+func TestGRPCWatch(t *testing.T) {
+	ts := startServer(t, nil)
+	kv := dialGRPC(t, ts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the changes are written before the watch starts, so they are replayed
+	after := ts.db.Wal.LastSeq()
+	ts.db.Put([]byte("other"), []byte("value"))
+	ts.db.Put([]byte("watched/a"), []byte("1"))
+	ts.db.Del([]byte("watched/a"))
+
+	stream, err := kv.Watch(ctx, &rpc.WatchRequest{Prefix: []byte("watched/"), AfterSeq: &after})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Type != rpc.WatchEvent_PUT || string(first.Key) != "watched/a" || string(first.Value) != "1" {
+		t.Fatalf("the first event is %v", first)
+	}
+
+	second, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Type != rpc.WatchEvent_DELETE || string(second.Key) != "watched/a" || second.Seq != first.Seq+1 {
+		t.Fatalf("the second event is %v after seq %d", second, first.Seq)
+	}
+
+	// the watch goes on with the changes written from then on
+	ts.db.Put([]byte("watched/b"), []byte("2"))
+	third, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Type != rpc.WatchEvent_PUT || string(third.Key) != "watched/b" || third.Seq != second.Seq+1 {
+		t.Fatalf("the third event is %v after seq %d", third, second.Seq)
+	}
+}
@@ -0,0 +1,88 @@
+package tests
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	dbengine "github.com/Avash027/midDB/db_engine"
+	diskstore "github.com/Avash027/midDB/disk_store"
+	LsmTree "github.com/Avash027/midDB/lsm_tree"
+	"github.com/Avash027/midDB/wal"
+)
+
+// newEngine returns an engine laid out in dir like a server, archiving its
+// WAL under archive when it is not empty. It is not loaded yet.
+func newEngine(dir string, archive string) *dbengine.DBEngine {
+	lsmTreeOpts := LsmTree.LSMTreeOpts{
+		MaxElementsBeforeFlush: LsmTree.DEFAULT_MAX_ELEMENTS_BEFORE_FLUSH,
+		CompactionPeriod:       LsmTree.DEFAULT_COMPACTION_FREQUENCY,
+		Directory:              filepath.Join(dir, "sstables"),
+		CompactionOpts:         LsmTree.CompactionOpts{Style: LsmTree.DEFAULT_COMPACTION_STYLE},
+		BloomFilterOpts: LsmTree.BloomFilterOpts{
+			ErrorRate: LsmTree.DEFAULT_BLOOM_FILTER_ERROR_RATE,
+			Capacity:  LsmTree.DEFAULT_BLOOM_FILTER_CAPACITY,
+		},
+	}
+	lsmTree := LsmTree.InitNewLSMTree(lsmTreeOpts)
+
+	store := diskstore.New(diskstore.DiskStoreOpts{
+		Directory:       filepath.Join(dir, "partitions"),
+		NumOfPartitions: diskstore.DEFAULT_NUM_OF_PARTITIONS,
+	})
+
+	walFile := wal.InitWAL(filepath.Join(dir, wal.DEFAULT_WAL_PATH))
+	if archive != "" {
+		walFile.ArchiveDirectory = filepath.Join(archive, dbengine.DEFAULT_NAMESPACE)
+	}
+
+	return &dbengine.DBEngine{
+		LsmTree: lsmTree,
+		Wal:     walFile,
+		Store:   store,
+		NamespaceOpts: dbengine.NamespaceOpts{
+			Directory:        filepath.Join(dir, "namespaces"),
+			NumOfPartitions:  diskstore.DEFAULT_NUM_OF_PARTITIONS,
+			LSMTreeOpts:      lsmTreeOpts,
+			ArchiveDirectory: archive,
+		},
+	}
+}
+
+// openEngine opens the engine of newEngine, starts persisting it and closes
+// it with the test.
+func openEngine(t *testing.T, dir string, archive string) *dbengine.DBEngine {
+	db := newEngine(dir, archive)
+
+	if err := db.LoadFromDisk(db.LsmTree, db.Wal); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.OpenNamespaces(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := make(chan bool, 1)
+	start <- true
+	go db.Store.PersistToDisk(db.LsmTree, db.Wal, start)
+
+	t.Cleanup(func() { closeEngine(db) })
+
+	return db
+}
+
+// closeEngine persists and closes the namespaces and then db.
+func closeEngine(db *dbengine.DBEngine) {
+	db.CloseNamespaces()
+	db.Close()
+}
+
+// putKeys writes key<from> to key<to-1> one at a time, so key i gets the
+// sequence number right after key i-1.
+func putKeys(t *testing.T, db *dbengine.DBEngine, from int, to int) {
+	for i := from; i < to; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package tests
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// httpDo sends a request to the HTTP API of ts and returns the status and
+// the body of the response.
+func httpDo(t *testing.T, ts *testServer, method string, path string, body string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, "http://"+ts.http+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, string(data)
+}
+
+type httpScan struct {
+	Items []struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	} `json:"items"`
+	Next string `json:"next"`
+}
+
+func scanHTTP(t *testing.T, ts *testServer, query string) httpScan {
+	t.Helper()
+
+	status, body := httpDo(t, ts, http.MethodGet, "/kv?"+query, "")
+	if status != http.StatusOK {
+		t.Fatalf("the scan %s answered %d: %s", query, status, body)
+	}
+
+	var scan httpScan
+	if err := json.Unmarshal([]byte(body), &scan); err != nil {
+		t.Fatal(err)
+	}
+	return scan
+}
+
+func TestHTTP(t *testing.T) {
+	ts := startServer(t, nil)
+
+	// the key holds an escaped slash and the value is binary
+	key := "/kv/" + url.PathEscape("dir/file")
+	if status, body := httpDo(t, ts, http.MethodPut, key, "\x00binary\n"); status != http.StatusNoContent {
+		t.Fatalf("PUT answered %d: %s", status, body)
+	}
+	if status, body := httpDo(t, ts, http.MethodGet, key, ""); status != http.StatusOK || body != "\x00binary\n" {
+		t.Fatalf("GET answered %d: %q", status, body)
+	}
+	if value, _, _ := ts.db.Get([]byte("dir/file")); string(value) != "\x00binary\n" {
+		t.Fatalf("the engine holds %q", value)
+	}
+
+	if status, _ := httpDo(t, ts, http.MethodPut, "/kv/key?ttl=-1", "value"); status != http.StatusBadRequest {
+		t.Fatalf("a negative ttl answered %d", status)
+	}
+
+	if status, _ := httpDo(t, ts, http.MethodDelete, key, ""); status != http.StatusNoContent {
+		t.Fatalf("DELETE answered %d", status)
+	}
+	if status, _ := httpDo(t, ts, http.MethodGet, key, ""); status != http.StatusNotFound {
+		t.Fatalf("GET after DELETE answered %d", status)
+	}
+
+	batch := `{"ops": [
+		{"op": "put", "key": "a1", "value": "1"},
+		{"op": "put", "key": "a2", "value": "2"},
+		{"op": "put", "key": "b1", "value": "3"},
+		{"op": "delete", "key": "a2"}
+	]}`
+	if status, body := httpDo(t, ts, http.MethodPost, "/batch", batch); status != http.StatusOK || !strings.Contains(body, `"applied":4`) {
+		t.Fatalf("the batch answered %d: %s", status, body)
+	}
+
+	// a batch with a bad operation is not applied at all
+	bad := `{"ops": [{"op": "put", "key": "c1", "value": "1"}, {"op": "rename", "key": "a1"}]}`
+	if status, _ := httpDo(t, ts, http.MethodPost, "/batch", bad); status != http.StatusBadRequest {
+		t.Fatalf("the bad batch answered %d", status)
+	}
+	if _, exist, _ := ts.db.Get([]byte("c1")); exist {
+		t.Fatal("the bad batch was partly applied")
+	}
+
+	scan := scanHTTP(t, ts, "prefix=a")
+	if len(scan.Items) != 1 || scan.Items[0].Key != "a1" || scan.Items[0].Value != "1" || scan.Next != "" {
+		t.Fatalf("the prefix a holds %+v", scan)
+	}
+
+	// pages follow each other through next
+	scan = scanHTTP(t, ts, "limit=1")
+	if len(scan.Items) != 1 || scan.Items[0].Key != "a1" || scan.Next == "" {
+		t.Fatalf("the first page is %+v", scan)
+	}
+	scan = scanHTTP(t, ts, "limit=1&start="+url.QueryEscape(scan.Next))
+	if len(scan.Items) != 1 || scan.Items[0].Key != "b1" {
+		t.Fatalf("the second page is %+v", scan)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString([]byte("b"))
+	scan = scanHTTP(t, ts, "encoding=base64&prefix="+url.QueryEscape(encoded))
+	if len(scan.Items) != 1 || scan.Items[0].Key != base64.StdEncoding.EncodeToString([]byte("b1")) {
+		t.Fatalf("the base64 scan is %+v", scan)
+	}
+
+	if status, _ := httpDo(t, ts, http.MethodPost, "/kv/key", "value"); status != http.StatusMethodNotAllowed {
+		t.Fatalf("POST on a key answered %d", status)
+	}
+	if status, _ := httpDo(t, ts, http.MethodGet, "/kv/key?ns=missing", ""); status != http.StatusNotFound {
+		t.Fatalf("an unknown namespace answered %d", status)
+	}
+}
@@ -0,0 +1,489 @@
+package tests
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	LsmTree "github.com/Avash027/midDB/lsm_tree"
+)
+
+// openTree opens the tree in dir, which only flushes when told to and
+// looks for compactions every 10ms.
+func openTree(t *testing.T, dir string, compactionOpts LsmTree.CompactionOpts) *LsmTree.LSMTree {
+	t.Helper()
+
+	lsmTree := LsmTree.InitNewLSMTree(LsmTree.LSMTreeOpts{
+		MaxElementsBeforeFlush: LsmTree.DEFAULT_MAX_ELEMENTS_BEFORE_FLUSH,
+		CompactionPeriod:       10,
+		Directory:              dir,
+		CompactionOpts:         compactionOpts,
+		BloomFilterOpts: LsmTree.BloomFilterOpts{
+			ErrorRate: LsmTree.DEFAULT_BLOOM_FILTER_ERROR_RATE,
+			Capacity:  LsmTree.DEFAULT_BLOOM_FILTER_CAPACITY,
+		},
+	})
+	t.Cleanup(func() { lsmTree.Close() })
+
+	return lsmTree
+}
+
+// flushTree writes the memtable of the tree to a new block.
+func flushTree(t *testing.T, lsmTree *LsmTree.LSMTree) {
+	t.Helper()
+
+	if err := lsmTree.FlushMemtable(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkTree checks the keys hold the values, an empty one meaning the key
+// must not be found.
+func checkTree(t *testing.T, lsmTree *LsmTree.LSMTree, pairs map[string]string) {
+	t.Helper()
+
+	for key, want := range pairs {
+		value, exist := lsmTree.Get([]byte(key))
+		if want == "" {
+			if exist {
+				t.Fatalf("%s is %q, want it deleted", key, value)
+			}
+			continue
+		}
+
+		if !exist || string(value) != want {
+			t.Fatalf("%s is %q, want %q", key, value, want)
+		}
+	}
+}
+
+func TestLSMTreeReopensSSTables(t *testing.T) {
+	dir := t.TempDir()
+	lsmTree := openTree(t, dir, LsmTree.CompactionOpts{Style: LsmTree.COMPACTION_STYLE_LEVELED})
+
+	pairs := map[string]string{}
+	for i := 0; i < 100; i++ {
+		key, value := fmt.Sprintf("key%03d", i), fmt.Sprintf("value%d", i)
+		lsmTree.Put([]byte(key), []byte(value))
+		pairs[key] = value
+	}
+	flushTree(t, lsmTree)
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		lsmTree.Del([]byte(key))
+		pairs[key] = ""
+	}
+	lsmTree.Put([]byte("key050"), []byte("changed"))
+	pairs["key050"] = "changed"
+	flushTree(t, lsmTree)
+
+	lastSeq := lsmTree.LastSeq()
+	blocks := lsmTree.NumOfDiskBlocks()
+	if err := lsmTree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a block written by a crash before it made it to the manifest
+	orphan := filepath.Join(dir, "999999"+LsmTree.DISK_BLOCK_EXTENSION)
+	if err := os.WriteFile(orphan, []byte("torn"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lsmTree = openTree(t, dir, LsmTree.CompactionOpts{Style: LsmTree.COMPACTION_STYLE_LEVELED})
+
+	if n := lsmTree.NumOfDiskBlocks(); n != blocks {
+		t.Fatalf("%d blocks after reopening, want %d", n, blocks)
+	}
+	if _, err := os.Stat(filepath.Join(dir, LsmTree.MANIFEST_FILE_NAME)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatalf("the block missing from the manifest was kept: %v", err)
+	}
+
+	checkTree(t, lsmTree, pairs)
+
+	// new writes are numbered after the ones on disk
+	if seq := lsmTree.LastSeq(); seq != lastSeq {
+		t.Fatalf("the tree reopened at seq %d, want %d", seq, lastSeq)
+	}
+	lsmTree.Put([]byte("key000"), []byte("back"))
+	if pair, _ := lsmTree.GetPair([]byte("key000")); pair.Seq != lastSeq+1 {
+		t.Fatalf("the next write got seq %d, want %d", pair.Seq, lastSeq+1)
+	}
+}
+
+// waitBottom waits until the blocks of the tree are all in its last level,
+// and returns the levels.
+func waitBottom(t *testing.T, lsmTree *LsmTree.LSMTree, bottom int) [][]*LsmTree.DiskBlock {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		levels := lsmTree.Levels()
+
+		moved := len(levels) == bottom+1 && len(levels[bottom]) > 0
+		for level := 0; level < bottom && moved; level++ {
+			moved = len(levels[level]) == 0
+		}
+		if moved {
+			return levels
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("the blocks did not reach level %d: %v", bottom, levels)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// versionsOf returns the versions of key held by the blocks.
+func versionsOf(levels [][]*LsmTree.DiskBlock, key string) []LsmTree.Pair {
+	versions := []LsmTree.Pair{}
+
+	for _, diskBlocks := range levels {
+		for _, diskBlock := range diskBlocks {
+			for _, pair := range diskBlock.All() {
+				if string(pair.Key) == key {
+					versions = append(versions, pair)
+				}
+			}
+		}
+	}
+
+	return versions
+}
+
+func TestLeveledCompaction(t *testing.T) {
+	dir := t.TempDir()
+	// every block is pushed down to level 2 at once
+	opts := LsmTree.CompactionOpts{
+		Style: LsmTree.COMPACTION_STYLE_LEVELED,
+		LeveledOpts: LsmTree.LeveledCompactionOpts{
+			Level0CompactionTrigger: 2,
+			LevelBaseSize:           1,
+			MaxLevels:               3,
+		},
+	}
+	lsmTree := openTree(t, dir, opts)
+
+	lsmTree.Put([]byte("deleted"), []byte("old"))
+	lsmTree.Put([]byte("updated"), []byte("v1"))
+	flushTree(t, lsmTree)
+	lsmTree.Put([]byte("updated"), []byte("v2"))
+	flushTree(t, lsmTree)
+	waitBottom(t, lsmTree, 2)
+
+	lsmTree.Del([]byte("deleted"))
+	lsmTree.Put([]byte("updated"), []byte("v3"))
+	flushTree(t, lsmTree)
+	lsmTree.Put([]byte("other"), []byte("value"))
+	flushTree(t, lsmTree)
+	levels := waitBottom(t, lsmTree, 2)
+
+	pairs := map[string]string{"deleted": "", "updated": "v3", "other": "value"}
+	checkTree(t, lsmTree, pairs)
+
+	// the tombstone went down with the value it hides and both were
+	// dropped at the bottom, only the newest version is left
+	if versions := versionsOf(levels, "deleted"); len(versions) != 0 {
+		t.Fatalf("the deleted key is still on disk: %v", versions)
+	}
+	if versions := versionsOf(levels, "updated"); len(versions) != 1 || string(versions[0].Value) != "v3" {
+		t.Fatalf("the versions of the updated key are %v", versions)
+	}
+
+	if err := lsmTree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lsmTree = openTree(t, dir, opts)
+	reopened := lsmTree.Levels()
+	if len(reopened) != len(levels) || len(reopened[2]) != len(levels[2]) {
+		t.Fatalf("the levels are %v after reopening, want %v", reopened, levels)
+	}
+	checkTree(t, lsmTree, pairs)
+}
+
+func TestLeveledCompactionKeepsTombstonesAboveData(t *testing.T) {
+	dir := t.TempDir()
+
+	block := func(name string, pairs ...LsmTree.Pair) *LsmTree.DiskBlock {
+		diskBlock, err := LsmTree.NewDiskBlock(filepath.Join(dir, name+LsmTree.DISK_BLOCK_EXTENSION), pairs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { diskBlock.Close() })
+		return diskBlock
+	}
+
+	tombstone := block("000001", LsmTree.Pair{Key: []byte("key"), Tombstone: true, Seq: 2})
+	value := block("000002", LsmTree.Pair{Key: []byte("key"), Value: []byte("old"), Seq: 1})
+	elsewhere := block("000003", LsmTree.Pair{Key: []byte("other"), Value: []byte("old"), Seq: 1})
+
+	strategy := LsmTree.NewLeveledCompactionStrategy(LsmTree.LeveledCompactionOpts{Level0CompactionTrigger: 1})
+
+	// a level below still holds the key, the tombstone has to go on hiding it
+	task := strategy.Pick([][]*LsmTree.DiskBlock{{tombstone}, {}, {value}})
+	if task == nil || task.OutputLevel != 1 || task.DropTombstones {
+		t.Fatalf("merging above the value picked %+v", task)
+	}
+
+	task = strategy.Pick([][]*LsmTree.DiskBlock{{tombstone}, {}, {elsewhere}})
+	if task == nil || task.OutputLevel != 1 || !task.DropTombstones {
+		t.Fatalf("merging above other keys picked %+v", task)
+	}
+}
+
+// waitBlocks waits until the tree is down to n blocks and returns its levels.
+func waitBlocks(t *testing.T, lsmTree *LsmTree.LSMTree, n int) [][]*LsmTree.DiskBlock {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for lsmTree.NumOfDiskBlocks() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d blocks are left, want %d", lsmTree.NumOfDiskBlocks(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return lsmTree.Levels()
+}
+
+func TestSizeTieredCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opts := LsmTree.CompactionOpts{
+		Style:          LsmTree.COMPACTION_STYLE_SIZE_TIERED,
+		SizeTieredOpts: LsmTree.SizeTieredCompactionOpts{MinThreshold: 2},
+	}
+	lsmTree := openTree(t, dir, opts)
+
+	lsmTree.Put([]byte("deleted"), []byte("old"))
+	lsmTree.Put([]byte("updated"), []byte("v1"))
+	flushTree(t, lsmTree)
+	lsmTree.Del([]byte("deleted"))
+	lsmTree.Put([]byte("updated"), []byte("v2"))
+	flushTree(t, lsmTree)
+
+	levels := waitBlocks(t, lsmTree, 1)
+	if len(levels) != 1 {
+		t.Fatalf("the blocks were merged into %d levels, want them all in level 0", len(levels))
+	}
+
+	pairs := map[string]string{"deleted": "", "updated": "v2"}
+	checkTree(t, lsmTree, pairs)
+
+	// nothing is older than the merged blocks, the tombstone is dropped
+	if versions := versionsOf(levels, "deleted"); len(versions) != 0 {
+		t.Fatalf("the deleted key is still on disk: %v", versions)
+	}
+	if versions := versionsOf(levels, "updated"); len(versions) != 1 || string(versions[0].Value) != "v2" {
+		t.Fatalf("the versions of the updated key are %v", versions)
+	}
+
+	if err := lsmTree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lsmTree = openTree(t, dir, opts)
+	if n := lsmTree.NumOfDiskBlocks(); n != 1 {
+		t.Fatalf("%d blocks after reopening, want 1", n)
+	}
+	checkTree(t, lsmTree, pairs)
+}
+
+func TestSizeTieredCompactionPicksSimilarBlocks(t *testing.T) {
+	dir := t.TempDir()
+
+	block := func(name string, from int, to int) *LsmTree.DiskBlock {
+		pairs := []LsmTree.Pair{}
+		for i := from; i < to; i++ {
+			pairs = append(pairs, LsmTree.Pair{Key: []byte(fmt.Sprintf("key%04d", i)), Value: []byte("value"), Seq: uint64(i + 1)})
+		}
+
+		diskBlock, err := LsmTree.NewDiskBlock(filepath.Join(dir, name+LsmTree.DISK_BLOCK_EXTENSION), pairs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { diskBlock.Close() })
+		return diskBlock
+	}
+
+	big := block("000001", 0, 1000)
+	small := []*LsmTree.DiskBlock{block("000002", 0, 10), block("000003", 10, 20), block("000004", 20, 30)}
+
+	strategy := LsmTree.NewSizeTieredCompactionStrategy(LsmTree.SizeTieredCompactionOpts{MinThreshold: 3})
+
+	// the big block is older and holds the same keys, the tombstones of the
+	// small ones still hide its values
+	task := strategy.Pick([][]*LsmTree.DiskBlock{append([]*LsmTree.DiskBlock{big}, small...)})
+	if task == nil || len(task.Inputs) != 3 || task.DropTombstones {
+		t.Fatalf("merging after the big block picked %+v", task)
+	}
+	for i, diskBlock := range task.Inputs {
+		// the newest block comes first
+		if diskBlock != small[len(small)-1-i] {
+			t.Fatalf("input %d is %s", i, diskBlock.Path)
+		}
+	}
+
+	task = strategy.Pick([][]*LsmTree.DiskBlock{append(append([]*LsmTree.DiskBlock{}, small...), big)})
+	if task == nil || len(task.Inputs) != 3 || !task.DropTombstones {
+		t.Fatalf("merging the oldest blocks picked %+v", task)
+	}
+
+	if task := strategy.Pick([][]*LsmTree.DiskBlock{{big, small[0]}}); task != nil {
+		t.Fatalf("too few blocks picked %+v", task)
+	}
+}
+
+// iterate returns the "key=value" pairs of the iterator from start on, up to
+// end when it is not nil.
+func iterate(it *LsmTree.Iterator, start []byte, end []byte) []string {
+	pairs := []string{}
+
+	for it.Seek(start); it.Valid(); it.Next() {
+		if end != nil && string(it.Key()) >= string(end) {
+			break
+		}
+		pairs = append(pairs, string(it.Key())+"="+string(it.Value()))
+	}
+
+	return pairs
+}
+
+func TestLSMTreeIterator(t *testing.T) {
+	lsmTree := openTree(t, t.TempDir(), LsmTree.CompactionOpts{Style: LsmTree.COMPACTION_STYLE_LEVELED})
+
+	// the versions are spread over two blocks and the memtable
+	lsmTree.Put([]byte("a1"), []byte("old"))
+	lsmTree.Put([]byte("b1"), []byte("old"))
+	lsmTree.Put([]byte("b3"), []byte("old"))
+	flushTree(t, lsmTree)
+	lsmTree.Put([]byte("b2"), []byte("new"))
+	lsmTree.Del([]byte("b3"))
+	flushTree(t, lsmTree)
+	lsmTree.Put([]byte("b1"), []byte("new"))
+	lsmTree.Put([]byte("c1"), []byte("new"))
+
+	it := lsmTree.NewIterator()
+	defer it.Close()
+
+	all := fmt.Sprint(iterate(it, nil, nil))
+	if want := "[a1=old b1=new b2=new c1=new]"; all != want {
+		t.Fatalf("the tree holds %s, want %s", all, want)
+	}
+
+	prefix := fmt.Sprint(iterate(it, []byte("b"), LsmTree.PrefixEnd([]byte("b"))))
+	if want := "[b1=new b2=new]"; prefix != want {
+		t.Fatalf("the keys starting with b are %s, want %s", prefix, want)
+	}
+
+	if end := LsmTree.PrefixEnd([]byte{'a', 0xff}); string(end) != "b" {
+		t.Fatalf("the prefix a\\xff ends at %q, want b", end)
+	}
+	if end := LsmTree.PrefixEnd([]byte{0xff, 0xff}); end != nil {
+		t.Fatalf("a prefix of 0xff bytes ends at %q, want no bound", end)
+	}
+}
+
+func TestScan(t *testing.T) {
+	db := openEngine(t, t.TempDir(), "")
+
+	putKeys(t, db, 0, 20)
+	if err := db.Del([]byte("key5")); err != nil {
+		t.Fatal(err)
+	}
+
+	pairs, err := db.Scan([]byte("key1"), []byte("key3"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{}
+	for _, pair := range pairs {
+		keys = append(keys, string(pair.Key))
+	}
+	if got, want := fmt.Sprint(keys), "[key1 key10 key11 key12 key13 key14 key15 key16 key17 key18 key19 key2]"; got != want {
+		t.Fatalf("the scan returned %s, want %s", got, want)
+	}
+
+	pairs, err = db.Scan([]byte("key4"), nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 2 || string(pairs[0].Key) != "key4" || string(pairs[1].Key) != "key6" {
+		t.Fatalf("the scan from key4 returned %v, want key4 and key6", pairs)
+	}
+}
+
+func TestSnapshotKeepsItsView(t *testing.T) {
+	// every block is pushed down to level 2 at once
+	lsmTree := openTree(t, t.TempDir(), LsmTree.CompactionOpts{
+		Style: LsmTree.COMPACTION_STYLE_LEVELED,
+		LeveledOpts: LsmTree.LeveledCompactionOpts{
+			Level0CompactionTrigger: 2,
+			LevelBaseSize:           1,
+			MaxLevels:               3,
+		},
+	})
+
+	lsmTree.Put([]byte("deleted"), []byte("old"))
+	lsmTree.Put([]byte("updated"), []byte("v1"))
+
+	snapshot := lsmTree.Snapshot()
+	defer snapshot.Release()
+	it := lsmTree.NewIterator()
+	defer it.Close()
+
+	lsmTree.Del([]byte("deleted"))
+	lsmTree.Put([]byte("updated"), []byte("v2"))
+	flushTree(t, lsmTree)
+	lsmTree.Put([]byte("added"), []byte("new"))
+	flushTree(t, lsmTree)
+	levels := waitBottom(t, lsmTree, 2)
+
+	checkTree(t, lsmTree, map[string]string{"deleted": "", "updated": "v2", "added": "new"})
+
+	for key, want := range map[string]string{"deleted": "old", "updated": "v1"} {
+		if value, exist := snapshot.Get([]byte(key)); !exist || string(value) != want {
+			t.Fatalf("the snapshot reads %s as %q, want %q", key, value, want)
+		}
+	}
+	if _, exist := snapshot.Get([]byte("added")); exist {
+		t.Fatal("the snapshot reads a key written after it")
+	}
+
+	want := "[deleted=old updated=v1]"
+	if pairs := fmt.Sprint(iterate(snapshot.NewIterator(), nil, nil)); pairs != want {
+		t.Fatalf("the snapshot iterates over %s, want %s", pairs, want)
+	}
+	if pairs := fmt.Sprint(iterate(it, nil, nil)); pairs != want {
+		t.Fatalf("the iterator walks %s, want %s", pairs, want)
+	}
+
+	// the compaction at the bottom kept the versions the snapshot reads
+	if versions := versionsOf(levels, "updated"); len(versions) != 2 {
+		t.Fatalf("the versions of the updated key are %v, want v2 and v1", versions)
+	}
+
+	snapshot.Release()
+	it.Close()
+
+	// the next compaction rewrites every key and drops the old versions
+	lsmTree.Put([]byte("a"), []byte("first"))
+	flushTree(t, lsmTree)
+	lsmTree.Put([]byte("z"), []byte("last"))
+	flushTree(t, lsmTree)
+	levels = waitBottom(t, lsmTree, 2)
+
+	if versions := versionsOf(levels, "updated"); len(versions) != 1 || string(versions[0].Value) != "v2" {
+		t.Fatalf("the versions of the updated key are %v after the release, want v2", versions)
+	}
+	if versions := versionsOf(levels, "deleted"); len(versions) != 0 {
+		t.Fatalf("the deleted key is still on disk after the release: %v", versions)
+	}
+}
@@ -0,0 +1,165 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Avash027/midDB/client"
+	dbengine "github.com/Avash027/midDB/db_engine"
+)
+
+func TestNamespaces(t *testing.T) {
+	dir := t.TempDir()
+	db := openEngine(t, dir, "")
+
+	users, err := db.CreateNamespace("users", dbengine.Quota{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateNamespace("users", dbengine.Quota{}); err != dbengine.ErrNamespaceExists {
+		t.Fatalf("creating users twice returned %v", err)
+	}
+	for _, name := range []string{"", "a/b", dbengine.DEFAULT_NAMESPACE} {
+		if _, err := db.CreateNamespace(name, dbengine.Quota{}); err == nil {
+			t.Fatalf("the namespace %q was created", name)
+		}
+	}
+
+	// the same key holds a value per namespace
+	if err := db.Put([]byte("key"), []byte("default")); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Put([]byte("key"), []byte("users")); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Put([]byte("only in users"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if value, _, _ := db.Get([]byte("key")); string(value) != "default" {
+		t.Fatalf("key is %q in the default namespace", value)
+	}
+	if _, exist, _ := db.Get([]byte("only in users")); exist {
+		t.Fatal("a key of users is seen in the default namespace")
+	}
+
+	stats := users.Stats()
+	// the memtable may have been flushed already
+	if stats.Puts != 2 || stats.LastSeq == 0 || stats.MemtableBytes+stats.DiskBytes == 0 {
+		t.Fatalf("the stats of users are %+v", stats)
+	}
+	if names := db.Namespaces(); fmt.Sprint(names) != "[default users]" {
+		t.Fatalf("the namespaces are %v", names)
+	}
+
+	// namespaces are opened again with their data on restart
+	closeEngine(db)
+	db = openEngine(t, dir, "")
+
+	users, err = db.Namespace("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _, _ := users.Get([]byte("key")); string(value) != "users" {
+		t.Fatalf("key is %q in users after a restart", value)
+	}
+
+	// dropping a namespace deletes its files, its engine is no longer used
+	if err := db.DropNamespace(dbengine.DEFAULT_NAMESPACE); err != dbengine.ErrDropDefault {
+		t.Fatalf("dropping the default namespace returned %v", err)
+	}
+	if err := db.DropNamespace("users"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "namespaces", "users")); !os.IsNotExist(err) {
+		t.Fatalf("the directory of users is still there: %v", err)
+	}
+	if err := users.Put([]byte("key"), []byte("value")); err != dbengine.ErrNamespaceDropped {
+		t.Fatalf("a write to a dropped namespace returned %v", err)
+	}
+	if _, err := db.Namespace("users"); err != dbengine.ErrNamespaceNotFound {
+		t.Fatalf("the dropped namespace is found: %v", err)
+	}
+}
+
+func TestNamespaceQuota(t *testing.T) {
+	dir := t.TempDir()
+	db := openEngine(t, dir, "")
+
+	small, err := db.CreateNamespace("small", dbengine.Quota{MaxBytes: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := small.Put([]byte("key"), make([]byte, 50)); err != nil {
+		t.Fatal(err)
+	}
+	if err := small.Put([]byte("other"), make([]byte, 50)); err != dbengine.ErrQuotaExceeded {
+		t.Fatalf("a write over the quota returned %v", err)
+	}
+
+	// deletes are accepted over the quota
+	if err := small.Del([]byte("key")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.SetNamespaceQuota("small", dbengine.Quota{MaxBytes: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := small.Put([]byte("other"), make([]byte, 50)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the quota is kept across restarts
+	closeEngine(db)
+	db = openEngine(t, dir, "")
+
+	small, err = db.Namespace("small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota := small.Stats().Quota; quota.MaxBytes != 1000 {
+		t.Fatalf("the quota of small is %+v after a restart", quota)
+	}
+}
+
+func TestClientNamespaces(t *testing.T) {
+	ts := startServer(t, nil)
+	c := newClient(t, client.Options{Addr: ts.tcp})
+
+	if err := c.CreateNamespace("users", 0); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := c.Namespaces(); err != nil || fmt.Sprint(names) != "[default users]" {
+		t.Fatalf("Namespaces returned %v: %v", names, err)
+	}
+
+	users := newClient(t, client.Options{Addr: ts.tcp, Namespace: "users"})
+	if err := users.Put([]byte("key"), []byte("users")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get([]byte("key")); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("the key of users is seen in the default namespace: %v", err)
+	}
+
+	stats, err := c.NamespaceStats("users")
+	if err != nil || stats.Puts != 1 {
+		t.Fatalf("NamespaceStats returned %+v: %v", stats, err)
+	}
+
+	if err := c.DropNamespace("users"); err != nil {
+		t.Fatal(err)
+	}
+	var serverErr *client.ServerError
+	if _, err := users.Get([]byte("key")); !errors.As(err, &serverErr) {
+		t.Fatalf("a read in a dropped namespace returned %v", err)
+	}
+
+	// a client of a namespace that does not exist fails to connect
+	missing := newClient(t, client.Options{Addr: ts.tcp, Namespace: "missing"})
+	if _, err := missing.Get([]byte("key")); err == nil || errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("a client of a missing namespace got %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package tests
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Avash027/midDB/client"
+	dbengine "github.com/Avash027/midDB/db_engine"
+	"github.com/Avash027/midDB/wal"
+)
+
+// framed lays out a framed request, with an ID when id is not empty.
+func framed(id string, args ...string) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "*%d", len(args))
+	if id != "" {
+		b.WriteString(" " + id)
+	}
+	b.WriteString("\n")
+
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\n%s\n", len(arg), arg)
+	}
+
+	return b.String()
+}
+
+// countWALRecords returns the number of records in the WAL in dir.
+func countWALRecords(t *testing.T, dir string) int {
+	t.Helper()
+
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+wal.SEGMENT_EXTENSION))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	for _, segment := range segments {
+		records, err := wal.ReadRecords(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += len(records)
+	}
+
+	return n
+}
+
+func TestFramedReplies(t *testing.T) {
+	ts := startServer(t, nil)
+
+	conn, err := net.Dial("tcp", ts.tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// every kind of request in a single write, the replies come back in
+	// the same order
+	requests := framed("r1", "PUT", "key", "two\nlines") +
+		framed("r2", "GET", "key") +
+		framed("r3", "GET", "missing") +
+		framed("", "GET", "key") +
+		"GET key\n" +
+		framed("r4", "NOSUCH")
+	if _, err := conn.Write([]byte(requests)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "=r1 OK 0\n" +
+		"=r2 OK 1\n$9\ntwo\nlines\n" +
+		"=r3 NOT_FOUND 0\n" +
+		"$9\ntwo\nlines\n" +
+		"two\nlines\n" +
+		"=r4 INVALID 1\n$15\nInvalid command\n"
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read %q: %v", got, err)
+	}
+	if string(got) != want {
+		t.Fatalf("the replies are\n%q\nwant\n%q", got, want)
+	}
+
+	// a bad frame closes the connection after an error
+	if _, err := conn.Write([]byte("*1 r5\n$x\n")); err != nil {
+		t.Fatal(err)
+	}
+	rest, _ := io.ReadAll(bufio.NewReader(conn))
+	if !strings.HasPrefix(string(rest), "=r5 INVALID") {
+		t.Fatalf("the bad frame got %q", rest)
+	}
+}
+
+func TestPipelinedWritesShareARecord(t *testing.T) {
+	ts := startServer(t, nil)
+
+	before := countWALRecords(t, filepath.Join(ts.dir, wal.DEFAULT_WAL_PATH))
+
+	c := newClient(t, client.Options{Addr: ts.tcp})
+	pipe := c.Pipeline()
+	for i := 0; i < 50; i++ {
+		pipe.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value"))
+	}
+	pipe.Get([]byte("key49"))
+	pipe.Get([]byte("missing"))
+
+	results, err := pipe.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 52 {
+		t.Fatalf("%d results, want 52", len(results))
+	}
+	for i, result := range results[:50] {
+		if result.Err != nil {
+			t.Fatalf("put %d failed: %v", i, result.Err)
+		}
+	}
+	if string(results[50].Value) != "value" || results[51].Err != client.ErrNotFound {
+		t.Fatalf("the gets returned %+v and %+v", results[50], results[51])
+	}
+
+	// the puts that arrived together were written together
+	if records := countWALRecords(t, filepath.Join(ts.dir, wal.DEFAULT_WAL_PATH)) - before; records >= 50 {
+		t.Fatalf("the 50 pipelined puts took %d records", records)
+	}
+}
+
+func TestPipelinedWritesFailOnTheirOwn(t *testing.T) {
+	ts := startServer(t, nil)
+	if _, err := ts.db.CreateNamespace("small", dbengine.Quota{MaxBytes: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", ts.tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the write over the quota does not fail the ones around it
+	requests := framed("s", "SELECT", "small") +
+		framed("p1", "PUT", "a", "1") +
+		framed("p2", "PUT", "big", strings.Repeat("v", 200)) +
+		framed("p3", "PUT", "b", "2") +
+		framed("p4", "DEL", "a")
+	if _, err := conn.Write([]byte(requests)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "=s OK 0\n" +
+		"=p1 OK 0\n" +
+		"=p2 DENIED 1\n$24\nNamespace quota exceeded\n" +
+		"=p3 OK 0\n" +
+		"=p4 OK 0\n"
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read %q: %v", got, err)
+	}
+	if string(got) != want {
+		t.Fatalf("the replies are\n%q\nwant\n%q", got, want)
+	}
+
+	small, err := ts.db.Namespace("small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, exist, _ := small.Get([]byte("b")); !exist || string(value) != "2" {
+		t.Fatalf("b is %q in small", value)
+	}
+	if _, exist, _ := small.Get([]byte("big")); exist {
+		t.Fatal("the write over the quota was applied")
+	}
+}
@@ -0,0 +1,365 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dbengine "github.com/Avash027/midDB/db_engine"
+	"github.com/Avash027/midDB/raft"
+	"github.com/Avash027/midDB/wal"
+)
+
+const RAFT_TIMEOUT = 10 * time.Second
+
+func newRaftCluster(t *testing.T, size int, opts raft.Opts) *raft.Cluster {
+	return newRaftClusterIn(t, t.TempDir(), size, opts)
+}
+
+func newRaftClusterIn(t *testing.T, dir string, size int, opts raft.Opts) *raft.Cluster {
+	if opts.ElectionTimeout == 0 {
+		opts.ElectionTimeout = 300 * time.Millisecond
+	}
+	if opts.HeartbeatInterval == 0 {
+		opts.HeartbeatInterval = 30 * time.Millisecond
+	}
+
+	cluster, err := raft.NewCluster(dir, size, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cluster.Close() })
+
+	return cluster
+}
+
+func waitForLeader(t *testing.T, cluster *raft.Cluster) string {
+	leader, err := cluster.Leader(RAFT_TIMEOUT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leader
+}
+
+// checkReplicated waits until every running member applied what the leader
+// has, then checks their trees hold the keys.
+func checkReplicated(t *testing.T, cluster *raft.Cluster, leader string, keys map[string]string) {
+	if err := cluster.WaitApplied(cluster.Node(leader).Status().LastApplied, RAFT_TIMEOUT); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range cluster.Running() {
+		for key, want := range keys {
+			value, exist := cluster.DB(id).LsmTree.Get([]byte(key))
+			if want == "" {
+				if exist {
+					t.Fatalf("%s: %s should be deleted", id, key)
+				}
+				continue
+			}
+
+			if !exist || string(value) != want {
+				t.Fatalf("%s: %s is %q, want %q", id, key, value, want)
+			}
+		}
+	}
+}
+
+func TestRaftReplicatesWrites(t *testing.T) {
+	cluster := newRaftCluster(t, 3, raft.Opts{})
+	leader := waitForLeader(t, cluster)
+	db := cluster.DB(leader)
+
+	keys := map[string]string{}
+	for i := 0; i < 100; i++ {
+		key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)
+		if err := db.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		keys[key] = value
+	}
+
+	if err := db.Del([]byte("key0")); err != nil {
+		t.Fatal(err)
+	}
+	keys["key0"] = ""
+
+	if err := db.CompareAndSwap([]byte("key1"), []byte("value1"), []byte("swapped")); err != nil {
+		t.Fatal(err)
+	}
+	keys["key1"] = "swapped"
+
+	value, exist, err := db.Get([]byte("key1"))
+	if err != nil || !exist || string(value) != "swapped" {
+		t.Fatalf("leader read %q %v %v", value, exist, err)
+	}
+
+	checkReplicated(t, cluster, leader, keys)
+}
+
+func TestRaftFollowersRefuseClients(t *testing.T) {
+	cluster := newRaftCluster(t, 3, raft.Opts{})
+	leader := waitForLeader(t, cluster)
+
+	for _, id := range cluster.Running() {
+		if id == leader {
+			continue
+		}
+
+		db := cluster.DB(id)
+
+		if err := db.Put([]byte("key"), []byte("value")); !errors.Is(err, dbengine.ErrNotLeader) {
+			t.Fatalf("%s: write got %v", id, err)
+		}
+
+		if _, _, err := db.Get([]byte("key")); !errors.Is(err, dbengine.ErrNotLeader) {
+			t.Fatalf("%s: read got %v", id, err)
+		}
+
+		if _, err := db.CreateNamespace("other", dbengine.Quota{}); err != dbengine.ErrNotReplicated {
+			t.Fatalf("%s: namespace got %v", id, err)
+		}
+	}
+}
+
+func TestRaftFailover(t *testing.T) {
+	cluster := newRaftCluster(t, 3, raft.Opts{})
+	leader := waitForLeader(t, cluster)
+
+	if err := cluster.DB(leader).Put([]byte("before"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cluster.Stop(leader); err != nil {
+		t.Fatal(err)
+	}
+
+	next := waitForLeader(t, cluster)
+	if next == leader {
+		t.Fatalf("%s is still the leader", leader)
+	}
+
+	value, exist, err := cluster.DB(next).Get([]byte("before"))
+	if err != nil || !exist || string(value) != "1" {
+		t.Fatalf("new leader read %q %v %v", value, exist, err)
+	}
+
+	if err := cluster.DB(next).Put([]byte("after"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the old leader catches up once it is back
+	if err := cluster.Start(leader); err != nil {
+		t.Fatal(err)
+	}
+
+	next = waitForLeader(t, cluster)
+	if err := cluster.DB(next).Put([]byte("back"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+
+	checkReplicated(t, cluster, next, map[string]string{"before": "1", "after": "2", "back": "3"})
+}
+
+func TestRaftNeedsMajority(t *testing.T) {
+	cluster := newRaftCluster(t, 3, raft.Opts{CommitTimeout: time.Second})
+	leader := waitForLeader(t, cluster)
+
+	for _, id := range cluster.Running() {
+		if id != leader {
+			if err := cluster.Stop(id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// the leader steps down once it misses its majority, either way the
+	// write is not acknowledged
+	err := cluster.DB(leader).Put([]byte("key"), []byte("value"))
+	if err != dbengine.ErrNoQuorum && !errors.Is(err, dbengine.ErrNotLeader) {
+		t.Fatalf("write without a majority got %v", err)
+	}
+}
+
+func TestRaftMembership(t *testing.T) {
+	cluster := newRaftCluster(t, 3, raft.Opts{})
+	leader := waitForLeader(t, cluster)
+
+	if err := cluster.DB(leader).Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	member, err := cluster.Join("n4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cluster.Node(leader).AddMember(member); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cluster.Node(leader).AddMember(member); err != raft.ErrMemberExists {
+		t.Fatalf("adding a member twice got %v", err)
+	}
+
+	checkReplicated(t, cluster, leader, map[string]string{"key": "value"})
+
+	// the leader removes itself and a new leader takes over among the rest
+	if err := cluster.Node(leader).RemoveMember(leader); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cluster.Stop(leader); err != nil {
+		t.Fatal(err)
+	}
+
+	next := waitForLeader(t, cluster)
+
+	status := cluster.Node(next).Status()
+	if len(status.Members) != 3 {
+		t.Fatalf("members after the removal: %v", status.Members)
+	}
+
+	if err := cluster.DB(next).Put([]byte("key"), []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+
+	checkReplicated(t, cluster, next, map[string]string{"key": "changed"})
+}
+
+func TestRaftSnapshot(t *testing.T) {
+	cluster := newRaftCluster(t, 3, raft.Opts{MaxLogEntries: 50})
+	leader := waitForLeader(t, cluster)
+
+	var behind string
+	for _, id := range cluster.Running() {
+		if id != leader {
+			behind = id
+			break
+		}
+	}
+
+	if err := cluster.DB(leader).Put([]byte("gone"), []byte("soon")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cluster.WaitApplied(cluster.Node(leader).Status().LastApplied, RAFT_TIMEOUT); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cluster.Stop(behind); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := map[string]string{"gone": ""}
+	if err := cluster.DB(leader).Del([]byte("gone")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 300; i++ {
+		key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)
+		if err := cluster.DB(leader).Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		keys[key] = value
+	}
+
+	if cluster.Node(leader).Status().SnapshotIndex == 0 {
+		t.Fatal("the log of the leader was not compacted")
+	}
+
+	// the entries the member misses are gone, it gets a snapshot
+	if err := cluster.Start(behind); err != nil {
+		t.Fatal(err)
+	}
+
+	checkReplicated(t, cluster, leader, keys)
+
+	if cluster.Node(behind).Status().SnapshotIndex == 0 {
+		t.Fatalf("%s caught up without a snapshot", behind)
+	}
+
+	// the snapshot is replayed from the WAL after a restart
+	if err := cluster.Stop(behind); err != nil {
+		t.Fatal(err)
+	}
+	if err := cluster.Start(behind); err != nil {
+		t.Fatal(err)
+	}
+
+	checkReplicated(t, cluster, leader, keys)
+}
+
+// countInWAL returns how many times data is found in the segments of the
+// WAL of a member.
+func countInWAL(t *testing.T, dir string, id string, data string) int {
+	t.Helper()
+
+	segments, err := filepath.Glob(filepath.Join(dir, id, wal.DEFAULT_WAL_PATH, "*"+wal.SEGMENT_EXTENSION))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	for _, segment := range segments {
+		content, err := os.ReadFile(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count += bytes.Count(content, []byte(data))
+	}
+
+	return count
+}
+
+func TestRaftLogIsTheWAL(t *testing.T) {
+	dir := t.TempDir()
+	cluster := newRaftClusterIn(t, dir, 3, raft.Opts{})
+	leader := waitForLeader(t, cluster)
+
+	keys := map[string]string{}
+	for i := 0; i < 20; i++ {
+		key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("raft-value-%02d", i)
+		if err := cluster.DB(leader).Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		keys[key] = value
+	}
+	checkReplicated(t, cluster, leader, keys)
+
+	// every member goes down, the writes come back from the WAL alone and
+	// the entries committed again are not written twice
+	if err := cluster.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"n1", "n2", "n3"} {
+		if err := cluster.Start(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	leader = waitForLeader(t, cluster)
+	if err := cluster.DB(leader).Put([]byte("after"), []byte("raft-value-after")); err != nil {
+		t.Fatal(err)
+	}
+	keys["after"] = "raft-value-after"
+	checkReplicated(t, cluster, leader, keys)
+
+	for _, id := range cluster.Running() {
+		for _, value := range keys {
+			if n := countInWAL(t, dir, id, value); n != 1 {
+				t.Fatalf("%s: %s is %d times in the WAL, want once", id, value, n)
+			}
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, id, "raft", raft.SNAPSHOT_FILE_NAME)); err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+		if matches, _ := filepath.Glob(filepath.Join(dir, id, "raft", "*.log")); len(matches) != 0 {
+			t.Fatalf("%s keeps a log of its own: %v", id, matches)
+		}
+	}
+}
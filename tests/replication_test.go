@@ -0,0 +1,189 @@
+package tests
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dbengine "github.com/Avash027/midDB/db_engine"
+	"github.com/Avash027/midDB/replication"
+)
+
+const REPLICATION_TIMEOUT = 10 * time.Second
+
+// startLeader serves the replication of db and returns its address.
+func startLeader(t *testing.T, db *dbengine.DBEngine, opts replication.LeaderOpts) (*replication.Leader, string) {
+	leader, err := replication.NewLeader(db, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go leader.Serve(listener)
+
+	return leader, listener.Addr().String()
+}
+
+// startFollower follows the leader at addr with the state file stateFile.
+func startFollower(t *testing.T, db *dbengine.DBEngine, addr string, stateFile string) *replication.Follower {
+	follower, err := replication.NewFollower(db, replication.FollowerOpts{LeaderAddr: addr, StateFile: stateFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go follower.Run()
+
+	return follower
+}
+
+// waitFollowing waits until the follower applied the changes of the leader
+// up to seq.
+func waitFollowing(t *testing.T, follower *replication.Follower, seq uint64) {
+	t.Helper()
+
+	deadline := time.Now().Add(REPLICATION_TIMEOUT)
+	for time.Now().Before(deadline) {
+		if status := follower.Status(); status.Connected && status.Seq >= seq {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("the follower is at %+v, want seq %d", follower.Status(), seq)
+}
+
+func TestReplicationResyncsFromSnapshot(t *testing.T) {
+	db := openEngine(t, t.TempDir(), "")
+	putKeys(t, db, 0, 100)
+	if err := db.Del([]byte("key99")); err != nil {
+		t.Fatal(err)
+	}
+
+	leader, addr := startLeader(t, db, replication.LeaderOpts{Mode: replication.MODE_ASYNC})
+
+	// the follower comes from another run of the leader, so what it holds
+	// can not be trusted
+	dir := t.TempDir()
+	replica := openEngine(t, dir, "")
+	if err := replica.Put([]byte("stale"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	stateFile := filepath.Join(dir, replication.STATE_FILE_NAME)
+	if err := os.WriteFile(stateFile, []byte("otherrun 5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	follower := startFollower(t, replica, addr, stateFile)
+	waitFollowing(t, follower, db.LastSeq())
+
+	if status := follower.Status(); status.RunID != leader.Status().RunID {
+		t.Fatalf("the follower follows run %s, the leader is %s", status.RunID, leader.Status().RunID)
+	}
+
+	checkKeyRange(t, replica, 99, 100)
+	if _, exist, err := replica.Get([]byte("stale")); err != nil || exist {
+		t.Fatalf("the key only the follower had survived the snapshot: %v, %v", exist, err)
+	}
+
+	if err := replica.Put([]byte("key"), []byte("value")); !errors.Is(err, dbengine.ErrReadOnlyReplica) {
+		t.Fatalf("writing to the follower returned %v", err)
+	}
+
+	// the changes after the snapshot are streamed
+	putKeys(t, db, 99, 150)
+	waitFollowing(t, follower, db.LastSeq())
+	checkKeyRange(t, replica, 150, 150)
+}
+
+func TestReplicationSyncMode(t *testing.T) {
+	db := openEngine(t, t.TempDir(), "")
+	_, addr := startLeader(t, db, replication.LeaderOpts{
+		Mode:        replication.MODE_SYNC,
+		SyncTimeout: time.Second,
+		MinAcks:     1,
+	})
+
+	// with no follower to acknowledge it the write is refused untouched
+	if err := db.Put([]byte("key0"), []byte("value0")); !errors.Is(err, dbengine.ErrNoReplicas) {
+		t.Fatalf("writing without followers returned %v", err)
+	}
+	checkKeyRange(t, db, 0, 1)
+
+	dir := t.TempDir()
+	replica := openEngine(t, dir, "")
+	follower := startFollower(t, replica, addr, filepath.Join(dir, replication.STATE_FILE_NAME))
+	waitFollowing(t, follower, 0)
+
+	// an acknowledged write is on the follower when it returns
+	putKeys(t, db, 0, 10)
+	checkKeyRange(t, replica, 10, 11)
+}
+
+// follow connects to the leader at addr as a follower that never
+// acknowledges, and returns the first header the leader sends.
+func follow(t *testing.T, addr string, user string) string {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	fmt.Fprintf(conn, "FOLLOW - 0 %d 0\n%s", len(user), user)
+
+	conn.SetReadDeadline(time.Now().Add(REPLICATION_TIMEOUT))
+	header, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return header
+}
+
+func TestReplicationSyncTimeout(t *testing.T) {
+	db := openEngine(t, t.TempDir(), "")
+	leader, addr := startLeader(t, db, replication.LeaderOpts{
+		Mode:        replication.MODE_SYNC,
+		SyncTimeout: 200 * time.Millisecond,
+		MinAcks:     1,
+	})
+
+	if header := follow(t, addr, ""); !strings.HasPrefix(header, "SNAPSHOT ") {
+		t.Fatalf("the leader sent %q", header)
+	}
+
+	deadline := time.Now().Add(REPLICATION_TIMEOUT)
+	for len(leader.Status().Followers) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the follower is connected but never acknowledges, the write is
+	// applied all the same
+	if err := db.Put([]byte("key0"), []byte("value0")); !errors.Is(err, dbengine.ErrReplicaTimeout) {
+		t.Fatalf("writing to a silent follower returned %v", err)
+	}
+	checkKeyRange(t, db, 1, 1)
+}
+
+func TestReplicationLimitsCredentials(t *testing.T) {
+	db := openEngine(t, t.TempDir(), "")
+	_, addr := startLeader(t, db, replication.LeaderOpts{Mode: replication.MODE_ASYNC})
+
+	user := strings.Repeat("a", replication.MAX_CREDENTIAL_SIZE+1)
+	if header := follow(t, addr, user); !strings.HasPrefix(header, "ERROR ") {
+		t.Fatalf("the leader sent %q to a follower with a long user", header)
+	}
+}
@@ -0,0 +1,236 @@
+package tests
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	dbengine "github.com/Avash027/midDB/db_engine"
+)
+
+// respClient sends RESP arrays of bulk strings and renders the replies as
+// text: bulk strings as their value, nulls as (nil), simple strings, errors
+// and integers with their type byte and aggregates as [a b c].
+type respClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialRESP(t *testing.T, addr string) *respClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &respClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *respClient) send(args ...string) {
+	c.t.Helper()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *respClient) read() string {
+	c.t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	reply, err := readRESP(c.reader)
+	if err != nil {
+		c.t.Fatalf("reading a reply: %v", err)
+	}
+	return reply
+}
+
+func (c *respClient) do(args ...string) string {
+	c.t.Helper()
+
+	c.send(args...)
+	return c.read()
+}
+
+func readRESP(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+
+	if line == "" {
+		return "", fmt.Errorf("empty reply line")
+	}
+
+	switch line[0] {
+	case '+', '-', ':', ',', '#':
+		return line, nil
+	case '_':
+		return "(nil)", nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", err
+		}
+		if n < 0 {
+			return "(nil)", nil
+		}
+
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return "", err
+		}
+		return string(data[:n]), nil
+	case '*', '%', '~':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", err
+		}
+		if n < 0 {
+			return "(nil)", nil
+		}
+		if line[0] == '%' {
+			n *= 2
+		}
+
+		elements := make([]string, n)
+		for i := range elements {
+			if elements[i], err = readRESP(reader); err != nil {
+				return "", err
+			}
+		}
+		return "[" + strings.Join(elements, " ") + "]", nil
+	}
+
+	return "", fmt.Errorf("unknown reply %q", line)
+}
+
+func TestRESP(t *testing.T) {
+	ts := startServer(t, nil)
+	c := dialRESP(t, ts.resp)
+
+	replies := []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"SET", "key", "a value\r\nwith a line"}, "+OK"},
+		{[]string{"GET", "key"}, "a value\r\nwith a line"},
+		{[]string{"GET", "missing"}, "(nil)"},
+		{[]string{"SET", "key", "other", "NX"}, "(nil)"},
+		{[]string{"MSET", "k1", "v1", "k2", "v2"}, "+OK"},
+		{[]string{"MGET", "k1", "missing", "k2"}, "[v1 (nil) v2]"},
+		{[]string{"EXISTS", "k1", "k2", "missing"}, ":2"},
+		{[]string{"DEL", "k1", "missing"}, ":1"},
+		{[]string{"SCAN", "0", "MATCH", "k?"}, "[0 [k2]]"},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command"},
+		{[]string{"NOSUCH"}, "-ERR unknown command 'NOSUCH'"},
+	}
+
+	for _, r := range replies {
+		if reply := c.do(r.args...); reply != r.reply {
+			t.Fatalf("%v replied %q, want %q", r.args, reply, r.reply)
+		}
+	}
+
+	// RESP3 sends nulls and maps with their own types
+	if reply := c.do("HELLO", "3"); !strings.HasPrefix(reply, "[server middb version") {
+		t.Fatalf("HELLO 3 replied %q", reply)
+	}
+	c.send("GET", "missing")
+	if line, _ := c.reader.Peek(3); string(line) != "_\r\n" {
+		t.Fatalf("a missing key is %q in RESP3, want _", line)
+	}
+	c.read()
+
+	// pipelined commands are answered in order
+	c.send("SET", "p", "1")
+	c.send("GET", "p")
+	c.send("DEL", "p")
+	c.send("GET", "p")
+	for _, want := range []string{"+OK", "1", ":1", "(nil)"} {
+		if reply := c.read(); reply != want {
+			t.Fatalf("a pipelined command replied %q, want %q", reply, want)
+		}
+	}
+
+	// inline commands as sent by telnet
+	if _, err := c.conn.Write([]byte("PING\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if reply := c.read(); reply != "+PONG" {
+		t.Fatalf("the inline PING replied %q", reply)
+	}
+}
+
+func TestRESPExpiry(t *testing.T) {
+	ts := startServer(t, nil)
+	c := dialRESP(t, ts.resp)
+
+	if reply := c.do("SET", "key", "value", "PX", "100"); reply != "+OK" {
+		t.Fatalf("SET PX replied %q", reply)
+	}
+	if reply := c.do("GET", "key"); reply != "value" {
+		t.Fatalf("GET replied %q before the key expired", reply)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if reply := c.do("GET", "key"); reply != "(nil)" {
+		t.Fatalf("GET replied %q after the key expired", reply)
+	}
+	if reply := c.do("SET", "key", "value", "EX", "0"); !strings.HasPrefix(reply, "-ERR invalid expire time") {
+		t.Fatalf("SET EX 0 replied %q", reply)
+	}
+}
+
+func TestRESPScanAcrossConnections(t *testing.T) {
+	ts := startServer(t, nil)
+	putKeys(t, ts.db, 0, 15)
+	if _, err := ts.db.CreateNamespace("other", dbengine.Quota{}); err != nil {
+		t.Fatal(err)
+	}
+
+	first := dialRESP(t, ts.resp)
+	second := dialRESP(t, ts.resp)
+
+	// a pooled client continues a SCAN on another connection
+	reply := first.do("SCAN", "0", "COUNT", "10")
+	cursor := strings.Fields(strings.TrimPrefix(reply, "["))[0]
+	if cursor == "0" {
+		t.Fatalf("the first page is the last one: %q", reply)
+	}
+	want := "[0 [key5 key6 key7 key8 key9]]"
+	if reply := second.do("SCAN", cursor, "COUNT", "10"); reply != want {
+		t.Fatalf("the cursor replied %q on another connection, want %q", reply, want)
+	}
+
+	// a cursor can be used again, as with Redis
+	if reply := first.do("SCAN", cursor, "COUNT", "10"); reply != want {
+		t.Fatalf("the cursor replied %q the second time, want %q", reply, want)
+	}
+
+	// but not in another namespace
+	if reply := second.do("SELECT", "other"); reply != "+OK" {
+		t.Fatalf("SELECT replied %q", reply)
+	}
+	if reply := second.do("SCAN", cursor); reply != "-ERR invalid cursor" {
+		t.Fatalf("the cursor of the default namespace replied %q in another one", reply)
+	}
+}
@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	dbengine "github.com/Avash027/midDB/db_engine"
+	"github.com/Avash027/midDB/server"
+)
+
+// testServer is a server listening on free ports of 127.0.0.1, it runs
+// until the test process exits but its engine is closed with the test.
+type testServer struct {
+	db   *dbengine.DBEngine
+	dir  string
+	tcp  string
+	udp  string
+	resp string
+	http string
+	grpc string
+}
+
+// freePort returns a port nothing listens on for network, "tcp" or "udp".
+func freePort(t *testing.T, network string) string {
+	t.Helper()
+
+	var addr string
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = conn.LocalAddr().String()
+		conn.Close()
+	} else {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = listener.Addr().String()
+		listener.Close()
+	}
+
+	_, port, _ := net.SplitHostPort(addr)
+	return port
+}
+
+// startServer starts a server over a new engine, configure may set the
+// options that are not about the ports, such as Users or TLS.
+func startServer(t *testing.T, configure func(s *server.Server)) *testServer {
+	t.Helper()
+
+	dir := t.TempDir()
+	db := newEngine(dir, "")
+	s := &server.Server{
+		Host:     "127.0.0.1",
+		Port:     freePort(t, "tcp"),
+		UDPPort:  freePort(t, "udp"),
+		RESPPort: freePort(t, "tcp"),
+		HTTPPort: freePort(t, "tcp"),
+		GRPCPort: freePort(t, "tcp"),
+		DBEngine: db,
+	}
+	if configure != nil {
+		configure(s)
+	}
+
+	go s.Start()
+
+	addr := func(port string) string { return net.JoinHostPort(s.Host, port) }
+	ts := &testServer{db: db, dir: dir, tcp: addr(s.Port), udp: addr(s.UDPPort), resp: addr(s.RESPPort), http: addr(s.HTTPPort), grpc: addr(s.GRPCPort)}
+
+	// the listeners are up once the data is loaded
+	deadline := time.Now().Add(5 * time.Second)
+	for _, listener := range []string{ts.tcp, ts.resp, ts.http, ts.grpc} {
+		for {
+			conn, err := net.Dial("tcp", listener)
+			if err == nil {
+				conn.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("the server does not listen on %s: %v", listener, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	t.Cleanup(func() { closeEngine(db) })
+
+	return ts
+}
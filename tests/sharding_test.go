@@ -0,0 +1,303 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dbengine "github.com/Avash027/midDB/db_engine"
+	diskstore "github.com/Avash027/midDB/disk_store"
+	LsmTree "github.com/Avash027/midDB/lsm_tree"
+	"github.com/Avash027/midDB/sharding"
+	"github.com/Avash027/midDB/wal"
+)
+
+const SHARDING_TIMEOUT = 20 * time.Second
+
+// shardRing runs the nodes of a ring in one process, the client address of
+// each node is its ID.
+type shardRing struct {
+	t     *testing.T
+	dir   string
+	nodes map[string]*shardNode
+}
+
+type shardNode struct {
+	member sharding.Member
+	node   *sharding.Node
+	db     *dbengine.DBEngine
+}
+
+func newShardRing(t *testing.T, ids ...string) *shardRing {
+	r := &shardRing{t: t, dir: t.TempDir(), nodes: map[string]*shardNode{}}
+	t.Cleanup(r.close)
+
+	listeners := map[string]net.Listener{}
+	members := []sharding.Member{}
+	for _, id := range ids {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		listeners[id] = listener
+		members = append(members, sharding.Member{ID: id, Addr: listener.Addr().String(), ClientAddr: id})
+	}
+
+	for _, member := range members {
+		r.start(member, members, listeners[member.ID])
+	}
+
+	return r
+}
+
+// join starts a node that is not in the ring yet.
+func (r *shardRing) join(id string) sharding.Member {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		r.t.Fatal(err)
+	}
+
+	member := sharding.Member{ID: id, Addr: listener.Addr().String(), ClientAddr: id}
+	r.start(member, nil, listener)
+
+	return member
+}
+
+func (r *shardRing) start(member sharding.Member, members []sharding.Member, listener net.Listener) {
+	dir := filepath.Join(r.dir, member.ID)
+
+	lsmTree := LsmTree.InitNewLSMTree(LsmTree.LSMTreeOpts{
+		MaxElementsBeforeFlush: LsmTree.DEFAULT_MAX_ELEMENTS_BEFORE_FLUSH,
+		CompactionPeriod:       LsmTree.DEFAULT_COMPACTION_FREQUENCY,
+		Directory:              filepath.Join(dir, "sstables"),
+		CompactionOpts:         LsmTree.CompactionOpts{Style: LsmTree.DEFAULT_COMPACTION_STYLE},
+		BloomFilterOpts: LsmTree.BloomFilterOpts{
+			ErrorRate: LsmTree.DEFAULT_BLOOM_FILTER_ERROR_RATE,
+			Capacity:  LsmTree.DEFAULT_BLOOM_FILTER_CAPACITY,
+		},
+	})
+
+	store := diskstore.New(diskstore.DiskStoreOpts{
+		Directory:       filepath.Join(dir, "partitions"),
+		NumOfPartitions: diskstore.DEFAULT_NUM_OF_PARTITIONS,
+	})
+	if store == nil {
+		r.t.Fatal("could not open the partitions")
+	}
+
+	db := &dbengine.DBEngine{
+		LsmTree: lsmTree,
+		Wal:     wal.InitWAL(filepath.Join(dir, wal.DEFAULT_WAL_PATH)),
+		Store:   store,
+	}
+
+	node, err := sharding.NewNode(db, sharding.Opts{
+		ID:        member.ID,
+		Members:   members,
+		StateFile: filepath.Join(dir, sharding.STATE_FILE_NAME),
+	})
+	if err != nil {
+		r.t.Fatal(err)
+	}
+
+	if err := db.LoadFromDisk(lsmTree, db.Wal); err != nil {
+		r.t.Fatal(err)
+	}
+
+	go node.Serve(listener)
+	node.Start()
+
+	r.nodes[member.ID] = &shardNode{member: member, node: node, db: db}
+}
+
+func (r *shardRing) close() {
+	for _, n := range r.nodes {
+		n.node.Stop()
+		n.db.Close()
+	}
+}
+
+// db follows the MOVED errors from the first node to the one that serves
+// the key.
+func (r *shardRing) db(key []byte) *dbengine.DBEngine {
+	for _, n := range r.nodes {
+		for hops := 0; hops < 3; hops++ {
+			var moved *dbengine.MovedError
+			if _, _, err := n.db.Get(key); !errors.As(err, &moved) {
+				return n.db
+			}
+			n = r.nodes[moved.Addr]
+		}
+		break
+	}
+
+	r.t.Fatalf("no node serves %s", key)
+	return nil
+}
+
+// waitBalanced waits until every node has the same ring and is done with
+// the hand overs.
+func (r *shardRing) waitBalanced() {
+	deadline := time.Now().Add(SHARDING_TIMEOUT)
+
+	for time.Now().Before(deadline) {
+		balanced := true
+		var epoch uint64
+
+		for _, n := range r.nodes {
+			status := n.node.Status()
+			if epoch == 0 {
+				epoch = status.Epoch
+			}
+			if status.Epoch != epoch || status.Moving > 0 || status.Importing > 0 {
+				balanced = false
+			}
+		}
+
+		if balanced {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	r.t.Fatal("the ring did not rebalance")
+}
+
+func (r *shardRing) checkKeys(keys map[string]string) {
+	for key, want := range keys {
+		value, exist, err := r.db([]byte(key)).Get([]byte(key))
+		if err != nil || !exist || string(value) != want {
+			r.t.Fatalf("%s is %q %v %v, want %q", key, value, exist, err, want)
+		}
+	}
+}
+
+func TestShardingRingMovesFewSlots(t *testing.T) {
+	members := []sharding.Member{}
+	for i := 1; i <= 4; i++ {
+		members = append(members, sharding.Member{ID: fmt.Sprintf("n%d", i)})
+	}
+
+	before := sharding.NewRing(1, members[:3], nil)
+	after := sharding.NewRing(2, members, nil)
+
+	for id, slots := range after.Slots() {
+		if slots < sharding.NUM_OF_SLOTS/6 || slots > sharding.NUM_OF_SLOTS/3 {
+			t.Fatalf("%s owns %d of %d slots", id, slots, sharding.NUM_OF_SLOTS)
+		}
+	}
+
+	moved := 0
+	for slot := 0; slot < sharding.NUM_OF_SLOTS; slot++ {
+		old, _ := before.Owner(slot)
+		owner, _ := after.Owner(slot)
+
+		if old.ID != owner.ID {
+			if owner.ID != "n4" {
+				t.Fatalf("slot %d moved from %s to %s", slot, old.ID, owner.ID)
+			}
+			moved++
+		}
+	}
+
+	if moved != after.Slots()["n4"] {
+		t.Fatalf("%d slots moved, the new node owns %d", moved, after.Slots()["n4"])
+	}
+}
+
+func TestShardingRedirects(t *testing.T) {
+	ring := newShardRing(t, "n1", "n2")
+
+	keys := map[string]string{}
+	for i := 0; i < 200; i++ {
+		key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)
+		if err := ring.db([]byte(key)).Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		keys[key] = value
+	}
+
+	ring.checkKeys(keys)
+
+	n1 := ring.nodes["n1"].db
+	served := 0
+	for key := range keys {
+		err := n1.Put([]byte(key), []byte("changed"))
+
+		var moved *dbengine.MovedError
+		if errors.As(err, &moved) {
+			if moved.Addr != "n2" || moved.Slot != sharding.Slot([]byte(key)) {
+				t.Fatalf("%s moved to %d at %s", key, moved.Slot, moved.Addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[key] = "changed"
+		served++
+	}
+
+	if served == 0 || served == len(keys) {
+		t.Fatalf("n1 serves %d of %d keys", served, len(keys))
+	}
+
+	pairs, err := n1.Scan(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != served {
+		t.Fatalf("n1 scans %d keys, it serves %d", len(pairs), served)
+	}
+
+	ring.checkKeys(keys)
+}
+
+func TestShardingRebalance(t *testing.T) {
+	ring := newShardRing(t, "n1", "n2")
+
+	keys := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)
+		if err := ring.db([]byte(key)).Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		keys[key] = value
+	}
+
+	if err := ring.nodes["n1"].node.AddMember(ring.join("n3")); err != nil {
+		t.Fatal(err)
+	}
+
+	ring.waitBalanced()
+
+	if status := ring.nodes["n3"].node.Status(); status.Slots == 0 {
+		t.Fatal("n3 got no slots")
+	}
+
+	n3 := ring.nodes["n3"].db
+	pairs, err := n3.Scan(nil, nil, 0)
+	if err != nil || len(pairs) == 0 {
+		t.Fatalf("n3 holds %d keys, %v", len(pairs), err)
+	}
+
+	ring.checkKeys(keys)
+
+	// a node that leaves hands everything over
+	if err := ring.nodes["n2"].node.RemoveMember("n1", false); err != nil {
+		t.Fatal(err)
+	}
+
+	ring.waitBalanced()
+
+	if status := ring.nodes["n1"].node.Status(); status.Slots != 0 {
+		t.Fatalf("n1 still serves %d slots", status.Slots)
+	}
+
+	delete(ring.nodes, "n1")
+	ring.checkKeys(keys)
+}
@@ -0,0 +1,226 @@
+package tests
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Avash027/midDB/client"
+	"github.com/Avash027/midDB/server"
+)
+
+// testCA signs the certificates of a test.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+	pem  []byte
+}
+
+func newCA(t *testing.T, name string) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return &testCA{cert: cert, key: key, pool: pool, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate for 127.0.0.1 signed by the CA, in PEM, for a
+// client when client is set and for a server otherwise.
+func (ca *testCA) issue(t *testing.T, client bool) (certPEM []byte, keyPEM []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usage := x509.ExtKeyUsageServerAuth
+	if client {
+		usage = x509.ExtKeyUsageClientAuth
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// clientCert returns a client certificate signed by the CA.
+func (ca *testCA) clientCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	certPEM, keyPEM := ca.issue(t, true)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+// writeServerFiles writes a server certificate signed by ca and the client
+// CA into dir, and returns the TLS options that point at them.
+func writeServerFiles(t *testing.T, dir string, ca *testCA, verifyClient bool) server.TLSOpts {
+	t.Helper()
+
+	opts := server.TLSOpts{
+		CertFile:     filepath.Join(dir, "server.crt"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		CAFile:       filepath.Join(dir, "ca.crt"),
+		VerifyClient: verifyClient,
+	}
+
+	certPEM, keyPEM := ca.issue(t, false)
+	for path, data := range map[string][]byte{opts.CertFile: certPEM, opts.KeyFile: keyPEM, opts.CAFile: ca.pem} {
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return opts
+}
+
+func TestTLS(t *testing.T) {
+	ca := newCA(t, "test CA")
+	opts := writeServerFiles(t, t.TempDir(), ca, false)
+	ts := startServer(t, func(s *server.Server) { s.TLS = opts })
+
+	c := newClient(t, client.Options{Addr: ts.tcp, TLSConfig: &tls.Config{RootCAs: ca.pool}})
+	if err := c.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := c.Get([]byte("key")); err != nil || string(value) != "value" {
+		t.Fatalf("Get over TLS returned %q: %v", value, err)
+	}
+
+	// a client that does not trust the CA refuses the server
+	untrusting := newClient(t, client.Options{Addr: ts.tcp, TLSConfig: &tls.Config{RootCAs: x509.NewCertPool()}})
+	if _, err := untrusting.Get([]byte("key")); err == nil {
+		t.Fatal("a client that does not trust the CA got a reply")
+	}
+
+	// the HTTP listener is behind TLS as well
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool}}}
+	resp, err := httpClient.Get("https://" + ts.http + "/kv/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /kv/key over TLS returned %s", resp.Status)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newCA(t, "test CA")
+	opts := writeServerFiles(t, t.TempDir(), ca, true)
+	ts := startServer(t, func(s *server.Server) { s.TLS = opts })
+
+	c := newClient(t, client.Options{Addr: ts.tcp, TLSConfig: &tls.Config{
+		RootCAs:      ca.pool,
+		Certificates: []tls.Certificate{ca.clientCert(t)},
+	}})
+	if err := c.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	// without a certificate, or with one of another CA, the handshake fails
+	other := newCA(t, "other CA")
+	for name, certs := range map[string][]tls.Certificate{
+		"no certificate":              nil,
+		"a certificate of another CA": {other.clientCert(t)},
+	} {
+		c := newClient(t, client.Options{Addr: ts.tcp, TLSConfig: &tls.Config{RootCAs: ca.pool, Certificates: certs}})
+		if _, err := c.Get([]byte("key")); err == nil || errors.Is(err, client.ErrNotFound) {
+			t.Fatalf("a client with %s got %v", name, err)
+		}
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t, "test CA")
+	opts := writeServerFiles(t, dir, ca, false)
+	ts := startServer(t, func(s *server.Server) { s.TLS = opts })
+
+	// the certificates are read again on SIGHUP, new handshakes use them
+	next := newCA(t, "next CA")
+	writeServerFiles(t, dir, next, false)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := tls.Dial("tcp", ts.tcp, &tls.Config{RootCAs: next.pool})
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the certificate of the next CA was not picked up: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if conn, err := tls.Dial("tcp", ts.tcp, &tls.Config{RootCAs: ca.pool}); err == nil {
+		conn.Close()
+		t.Fatal("the server still presents the certificate of the old CA")
+	}
+}
@@ -0,0 +1,130 @@
+package tests
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	diskstore "github.com/Avash027/midDB/disk_store"
+)
+
+func TestCompareAndSwap(t *testing.T) {
+	db := openEngine(t, t.TempDir(), "")
+
+	if err := db.CompareAndSwap([]byte("missing"), []byte(""), []byte("value")); !errors.Is(err, diskstore.ErrCASConflict) {
+		t.Fatalf("swapping a missing key returned %v", err)
+	}
+
+	if err := db.PutIfAbsent([]byte("key"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutIfAbsent([]byte("key"), []byte("v2")); !errors.Is(err, diskstore.ErrCASConflict) {
+		t.Fatalf("putting an existing key returned %v", err)
+	}
+
+	if err := db.CompareAndSwap([]byte("key"), []byte("v2"), []byte("v3")); !errors.Is(err, diskstore.ErrCASConflict) {
+		t.Fatalf("swapping from the wrong value returned %v", err)
+	}
+	if err := db.CompareAndSwap([]byte("key"), []byte("v1"), []byte("v3")); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _, _ := db.Get([]byte("key")); string(value) != "v3" {
+		t.Fatalf("key is %q, want v3", value)
+	}
+}
+
+func TestCompareAndSwapRaces(t *testing.T) {
+	db := openEngine(t, t.TempDir(), "")
+
+	if err := db.Put([]byte("counter"), []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+
+	// each increment only lands when no other writer got in between, the
+	// losers read the counter again
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 25; {
+				value, _, err := db.Get([]byte("counter"))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				n, _ := strconv.Atoi(string(value))
+				err = db.CompareAndSwap([]byte("counter"), value, []byte(strconv.Itoa(n+1)))
+				if errors.Is(err, diskstore.ErrCASConflict) {
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				i++
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, _, _ := db.Get([]byte("counter")); string(value) != "200" {
+		t.Fatalf("the counter is %s, want 200", value)
+	}
+}
+
+func TestTransactionConflicts(t *testing.T) {
+	db := openEngine(t, t.TempDir(), "")
+
+	putKeys(t, db, 0, 2)
+
+	txn := db.Begin()
+	if value, exist, err := txn.Get([]byte("key0")); err != nil || !exist || string(value) != "value0" {
+		t.Fatalf("the transaction read key0 as %q: %v", value, err)
+	}
+
+	// another writer changes what the transaction read
+	if err := db.Put([]byte("key0"), []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	if value, _, _ := txn.Get([]byte("key0")); string(value) != "value0" {
+		t.Fatalf("the transaction reads key0 as %q after the write, want value0", value)
+	}
+
+	txn.Put([]byte("key0"), []byte("txn"))
+	txn.Put([]byte("key1"), []byte("txn"))
+	if err := txn.Commit(); !errors.Is(err, diskstore.ErrCASConflict) {
+		t.Fatalf("the commit returned %v", err)
+	}
+
+	// nothing of the transaction was written
+	for key, want := range map[string]string{"key0": "other", "key1": "value1"} {
+		if value, _, _ := db.Get([]byte(key)); string(value) != want {
+			t.Fatalf("%s is %q, want %q", key, value, want)
+		}
+	}
+
+	// a transaction whose reads did not change commits, whatever happened to
+	// the other keys
+	txn = db.Begin()
+	txn.Get([]byte("key1"))
+	if err := db.Put([]byte("key0"), []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	txn.Del([]byte("key1"))
+	txn.Put([]byte("key2"), []byte("txn"))
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, exist, _ := db.Get([]byte("key1")); exist {
+		t.Fatal("key1 was not deleted by the transaction")
+	}
+	if value, _, _ := db.Get([]byte("key2")); string(value) != "txn" {
+		t.Fatalf("key2 is %q, want txn", value)
+	}
+}
@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dbengine "github.com/Avash027/midDB/db_engine"
+	diskstore "github.com/Avash027/midDB/disk_store"
+	"github.com/Avash027/midDB/wal"
+)
+
+func TestTTL(t *testing.T) {
+	db := openEngine(t, t.TempDir(), "")
+
+	if err := db.PutWithTTL([]byte("short"), []byte("value"), 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	putKeys(t, db, 0, 2)
+
+	if ttl, err := db.TTL([]byte("short")); err != nil || ttl <= 0 || ttl > 200*time.Millisecond {
+		t.Fatalf("short has %v left: %v", ttl, err)
+	}
+	if ttl, err := db.TTL([]byte("key0")); err != nil || ttl != dbengine.NO_EXPIRY {
+		t.Fatalf("key0 has %v left, want no expiry: %v", ttl, err)
+	}
+
+	if err := db.Expire([]byte("key0"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, _ := db.TTL([]byte("key0")); ttl <= 59*time.Minute {
+		t.Fatalf("key0 has %v left, want an hour", ttl)
+	}
+	if value, _, _ := db.Get([]byte("key0")); string(value) != "value0" {
+		t.Fatalf("key0 is %q after EXPIRE, want value0", value)
+	}
+
+	if err := db.Expire([]byte("missing"), time.Hour); !errors.Is(err, diskstore.ErrKeyNotFound) {
+		t.Fatalf("EXPIRE on a missing key returned %v", err)
+	}
+
+	// a ttl that is not positive deletes the key
+	if err := db.Expire([]byte("key1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, exist, _ := db.Get([]byte("key1")); exist {
+		t.Fatal("key1 was not deleted by EXPIRE 0")
+	}
+
+	time.Sleep(250 * time.Millisecond)
+
+	if _, exist, _ := db.Get([]byte("short")); exist {
+		t.Fatal("short is still there after it expired")
+	}
+	if _, err := db.TTL([]byte("short")); !errors.Is(err, diskstore.ErrKeyNotFound) {
+		t.Fatalf("TTL on an expired key returned %v", err)
+	}
+
+	pairs, err := db.Scan(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 1 || string(pairs[0].Key) != "key0" {
+		t.Fatalf("the scan returned %v, want only key0", pairs)
+	}
+}
+
+func TestTTLIsPersisted(t *testing.T) {
+	dir := t.TempDir()
+	expiresAt := time.Now().Add(time.Hour).UnixMilli()
+
+	persistEntries(t, dir, []wal.Entry{
+		{Key: []byte("live"), Value: []byte("value"), ExpiresAt: expiresAt},
+		{Key: []byte("expired"), Value: []byte("value"), ExpiresAt: time.Now().Add(-time.Second).UnixMilli()},
+		{Key: []byte("forever"), Value: []byte("value")},
+	})
+
+	store := diskstore.New(diskstore.DiskStoreOpts{Directory: filepath.Join(dir, "partitions"), NumOfPartitions: 4})
+	defer store.Close()
+
+	entries := map[string]wal.Entry{}
+	for i := 0; i < 4; i++ {
+		for _, entry := range store.GetFileContents(i) {
+			entries[string(entry.Key)] = entry
+		}
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("the partitions hold %v, want live and forever", entries)
+	}
+	if entries["live"].ExpiresAt != expiresAt {
+		t.Fatalf("live expires at %d, want %d", entries["live"].ExpiresAt, expiresAt)
+	}
+	if entries["forever"].ExpiresAt != 0 {
+		t.Fatalf("forever expires at %d", entries["forever"].ExpiresAt)
+	}
+}
@@ -0,0 +1,127 @@
+package tests
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Avash027/midDB/client"
+	"github.com/Avash027/midDB/server"
+)
+
+// udpDo sends a packet to the UDP listener of ts and returns the reply.
+func udpDo(t *testing.T, ts *testServer, packet string) string {
+	t.Helper()
+
+	conn, err := net.Dial("udp", ts.udp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(packet)); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64*1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(buf[:n])
+}
+
+func TestUDP(t *testing.T) {
+	ts := startServer(t, nil)
+
+	replies := []struct {
+		packet string
+		reply  string
+	}{
+		{framed("u1", "PUT", "key", "a value"), "=u1 OK 0\n"},
+		{"GET key", "a value"},
+		{framed("u2", "GET", "key"), "=u2 OK 1\n$7\na value\n"},
+		{framed("u3", "MGET", "key", "missing"), "=u3 OK 2\n$7\na value\n$-1\n"},
+		{framed("u4", "CAS", "key", "wrong", "other"), "=u4 CONFLICT 0\n"},
+		{framed("u5", "PUT", "key2", "v2", "EX", "60"), "=u5 OK 0\n"},
+		{framed("u6", "PREFIX", "key"), "=u6 OK 4\n$3\nkey\n$7\na value\n$4\nkey2\n$2\nv2\n"},
+		{framed("u7", "MULTI"), "=u7 INVALID 1\n$31\nMULTI is not supported over UDP\n"},
+		{"DEL key", "OK"},
+		{"GET key", "Data not found"},
+	}
+
+	for _, r := range replies {
+		if reply := udpDo(t, ts, r.packet); reply != r.reply {
+			t.Fatalf("%q got %q, want %q", r.packet, reply, r.reply)
+		}
+	}
+}
+
+func TestUDPRequestTooLarge(t *testing.T) {
+	ts := startServer(t, nil)
+
+	// a request above udp_buffer_size is refused whole, never cut off and
+	// run
+	value := strings.Repeat("v", 3*server.DEFAULT_UDP_BUFFER_SIZE)
+	if reply := udpDo(t, ts, "PUT big "+value); reply != "Request too large for UDP" {
+		t.Fatalf("the inline request got %q", reply)
+	}
+	if reply := udpDo(t, ts, framed("u1", "PUT", "big", value)); reply != "=u1 INVALID 1\n$25\nRequest too large for UDP\n" {
+		t.Fatalf("the framed request got %q", reply)
+	}
+	if _, exist, _ := ts.db.Get([]byte("big")); exist {
+		t.Fatal("the request that was too large was written")
+	}
+
+	// the client reports the error
+	c := client.NewUDPClient(client.UDPOptions{Addr: ts.udp})
+	var serverErr *client.ServerError
+	if err := c.Put([]byte("big"), []byte(value)); !errors.As(err, &serverErr) || serverErr.Status != "INVALID" {
+		t.Fatalf("Put of a value that is too large returned %v", err)
+	}
+}
+
+func TestUDPClient(t *testing.T) {
+	ts := startServer(t, nil)
+	c := client.NewUDPClient(client.UDPOptions{Addr: ts.udp})
+
+	if err := c.Put([]byte("key"), []byte("two\nlines")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := c.Get([]byte("key")); err != nil || string(value) != "two\nlines" {
+		t.Fatalf("Get returned %q: %v", value, err)
+	}
+
+	values, err := c.MGet([]byte("key"), []byte("missing"))
+	if err != nil || len(values) != 2 || string(values[0]) != "two\nlines" || values[1] != nil {
+		t.Fatalf("MGet returned %q: %v", values, err)
+	}
+
+	if err := c.Del([]byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get([]byte("key")); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("Get after Del returned %v", err)
+	}
+}
+
+func TestUDPReadOnly(t *testing.T) {
+	ts := startServer(t, func(s *server.Server) { s.UDPReadOnly = true })
+	c := client.NewUDPClient(client.UDPOptions{Addr: ts.udp})
+
+	var serverErr *client.ServerError
+	if err := c.Put([]byte("key"), []byte("value")); !errors.As(err, &serverErr) || serverErr.Status != "DENIED" {
+		t.Fatalf("a write over a read only UDP listener returned %v", err)
+	}
+
+	if err := ts.db.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := c.Get([]byte("key")); err != nil || string(value) != "value" {
+		t.Fatalf("Get returned %q: %v", value, err)
+	}
+}
@@ -0,0 +1,301 @@
+package tests
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	LsmTree "github.com/Avash027/midDB/lsm_tree"
+	"github.com/Avash027/midDB/wal"
+)
+
+func writeEntries(t *testing.T, w *wal.WAL, from int, to int) {
+	for i := from; i < to; i++ {
+		entry := wal.Entry{Key: []byte(fmt.Sprintf("key%d", i)), Value: []byte(fmt.Sprintf("value%d", i))}
+		if err := w.WriteBatch([]wal.Entry{entry}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Persist(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkPending checks the entries not in the persistent store yet are
+// key<from> to key<to-1>, and returns where they end.
+func checkPending(t *testing.T, w *wal.WAL, from int, to int) wal.Position {
+	t.Helper()
+
+	entries, end, err := w.ReadEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != to-from {
+		t.Fatalf("%d entries are pending, want %d", len(entries), to-from)
+	}
+	for i, entry := range entries {
+		if string(entry.Key) != fmt.Sprintf("key%d", from+i) {
+			t.Fatalf("entry %d is %s, want key%d", i, entry.Key, from+i)
+		}
+	}
+
+	return end
+}
+
+func countSegments(t *testing.T, dir string) int {
+	t.Helper()
+
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+wal.SEGMENT_EXTENSION))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(matches)
+}
+
+func TestWALSegments(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), wal.DEFAULT_WAL_PATH)
+	archive := t.TempDir()
+
+	w := wal.InitWAL(dir)
+	w.SegmentSize = 1024
+	w.SegmentRetention = 1
+	w.ArchiveDirectory = archive
+
+	writeEntries(t, w, 0, 200)
+	if n := countSegments(t, dir); n < 5 {
+		t.Fatalf("%d segments after 200 entries, want a new one every 1024 bytes", n)
+	}
+
+	// nothing is released until the checkpoint moves, so a crash before
+	// replays the entries again
+	end := checkPending(t, w, 0, 200)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w = wal.InitWAL(dir)
+	w.SegmentSize = 1024
+	w.SegmentRetention = 1
+	w.ArchiveDirectory = archive
+	w.SetLastSeq(200)
+
+	checkPending(t, w, 0, 200)
+	writeEntries(t, w, 200, 210)
+
+	if err := w.Checkpoint(end); err != nil {
+		t.Fatal(err)
+	}
+
+	// the segments before the checkpoint were archived but for one
+	if n := countSegments(t, dir); n != 2 {
+		t.Fatalf("%d segments are left, want the one retained and the one written to", n)
+	}
+
+	archived, err := wal.ReadArchive(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archived) == 0 || archived[0].Seq != 1 {
+		t.Fatalf("the archive starts with %v", archived)
+	}
+
+	end = checkPending(t, w, 200, 210)
+	if err := w.Checkpoint(end); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w = wal.InitWAL(dir)
+	w.ArchiveDirectory = archive
+	defer w.Close()
+
+	end = checkPending(t, w, 0, 0)
+	if err := w.Checkpoint(end); err != nil {
+		t.Fatal(err)
+	}
+	if n := countSegments(t, dir); n != 1 {
+		t.Fatalf("%d segments are left without retention, want the one written to", n)
+	}
+
+	archived, err = wal.ReadArchive(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := archived[len(archived)-1]
+	if last.Seq != 210 {
+		t.Fatalf("the archive ends at seq %d, want 210", last.Seq)
+	}
+}
+
+func TestWALMovesLogFileIntoSegment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), wal.DEFAULT_WAL_PATH)
+
+	if err := os.WriteFile(path, []byte("+|key0|value0|\n+|key1|value1|\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := wal.InitWAL(path)
+	defer w.Close()
+
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		t.Fatalf("%s is not a directory: %v", path, err)
+	}
+
+	checkPending(t, w, 0, 2)
+}
+
+// logEntry is the entry index of a consensus log writing key<index>.
+func logEntry(index uint64) wal.LogEntry {
+	entries := []wal.Entry{{Key: []byte(fmt.Sprintf("key%d", index)), Value: []byte(fmt.Sprintf("value%d", index))}}
+	return wal.LogEntry{Index: index, Term: 1, Type: wal.LOG_ENTRY_COMMAND, Data: wal.EncodeRecord(entries)}
+}
+
+func TestWALConsensusLog(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), wal.DEFAULT_WAL_PATH)
+
+	w := wal.InitWAL(dir)
+	w.SegmentSize = 128
+
+	positions, err := w.AppendLog([]wal.LogEntry{logEntry(1), logEntry(2), logEntry(3), logEntry(4), logEntry(5)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the entries that are not applied do not go to the persistent store
+	checkPending(t, w, 1, 1)
+	w.Applied(2, nil)
+	end := checkPending(t, w, 1, 3)
+	if end.Index != 2 {
+		t.Fatalf("the entries end at index %d, want 2", end.Index)
+	}
+
+	// entries written by another leader replace the ones from index 4 on
+	if err := w.TruncateLog(positions[3]); err != nil {
+		t.Fatal(err)
+	}
+	replaced := logEntry(4)
+	replaced.Term = 2
+	if _, err := w.AppendLog([]wal.LogEntry{replaced}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Checkpoint(end); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w = wal.InitWAL(dir)
+	defer w.Close()
+
+	if index := w.PersistedIndex(); index != 2 {
+		t.Fatalf("the persistent store holds the entries up to %d, want 2", index)
+	}
+
+	entries, _, err := w.ReadLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	terms := []uint64{1, 1, 1, 2}
+	if len(entries) != len(terms) {
+		t.Fatalf("the log holds %d entries, want %d", len(entries), len(terms))
+	}
+	for i, entry := range entries {
+		if entry.Index != uint64(i+1) || entry.Term != terms[i] {
+			t.Fatalf("entry %d is %d in term %d", i, entry.Index, entry.Term)
+		}
+	}
+
+	w.Applied(4, nil)
+	checkPending(t, w, 3, 5)
+}
+
+func TestWALBatchIsOneRecord(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), wal.DEFAULT_WAL_PATH)
+	w := wal.InitWAL(dir)
+
+	batch := func(value string, keys ...string) []wal.Entry {
+		entries := []wal.Entry{}
+		for _, key := range keys {
+			entries = append(entries, wal.Entry{Key: []byte(key), Value: []byte(value)})
+		}
+		return entries
+	}
+
+	if err := w.WriteBatch(batch("first", "a", "b", "c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteBatch(append(batch("second", "a", "b"), wal.Entry{Key: []byte("c"), Delete: true})); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+wal.SEGMENT_EXTENSION))
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("the log is in %v: %v", segments, err)
+	}
+	records, err := wal.ReadRecords(segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || len(records[0].Entries) != 3 || len(records[1].Entries) != 3 {
+		t.Fatalf("the batches were written as %v", records)
+	}
+
+	// the process died in the middle of the second batch
+	info, err := os.Stat(segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(segments[0], info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	w = wal.InitWAL(dir)
+	defer w.Close()
+
+	lsmTree := openTree(t, t.TempDir(), LsmTree.CompactionOpts{Style: LsmTree.COMPACTION_STYLE_LEVELED})
+	if err := w.InitDB(lsmTree); err != nil {
+		t.Fatal(err)
+	}
+
+	checkTree(t, lsmTree, map[string]string{"a": "first", "b": "first", "c": "first"})
+}
+
+func TestWALChangesArePublishedAfterTheWrite(t *testing.T) {
+	w := wal.InitWAL(filepath.Join(t.TempDir(), wal.DEFAULT_WAL_PATH))
+	defer w.Close()
+
+	entries := []wal.Entry{{Key: []byte("a"), Value: []byte("1")}, {Key: []byte("b"), Value: []byte("2")}}
+	if err := w.WriteBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+
+	// written but not applied yet, consumers must not hear of it
+	changes, written, err := w.Changes(0, 0)
+	if err != nil || len(changes) != 0 || w.LastSeq() != 0 {
+		t.Fatalf("the feed holds %v up to %d before Publish: %v", changes, w.LastSeq(), err)
+	}
+
+	w.Publish(entries)
+
+	select {
+	case <-written:
+	default:
+		t.Fatal("Publish did not wake up the consumers")
+	}
+	changes, _, err = w.Changes(0, 0)
+	if err != nil || len(changes) != 2 || changes[1].Seq != 2 || !changes[1].LastInRecord {
+		t.Fatalf("the feed holds %v after Publish: %v", changes, err)
+	}
+}
@@ -0,0 +1,214 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Avash027/midDB/client"
+	dbengine "github.com/Avash027/midDB/db_engine"
+	"github.com/Avash027/midDB/wal"
+)
+
+// nextEvents reads n events of the watcher, or fails after 5 seconds.
+func nextEvents(t *testing.T, w *dbengine.Watcher, n int) []dbengine.Event {
+	t.Helper()
+
+	events := []dbengine.Event{}
+	timeout := time.After(5 * time.Second)
+
+	for len(events) < n {
+		select {
+		case event, ok := <-w.Events:
+			if !ok {
+				t.Fatalf("the watcher was closed after %d events: %v", len(events), w.Err())
+			}
+			events = append(events, event)
+		case <-timeout:
+			t.Fatalf("got %d events, want %d", len(events), n)
+		}
+	}
+
+	return events
+}
+
+// describe lays out events as "seq key value", with DEL for a delete.
+func describe(events []dbengine.Event) string {
+	s := ""
+	for _, event := range events {
+		if event.Delete {
+			s += fmt.Sprintf("%d %s DEL\n", event.Seq, event.Key)
+		} else {
+			s += fmt.Sprintf("%d %s %s\n", event.Seq, event.Key, event.Value)
+		}
+	}
+
+	return s
+}
+
+func TestWatch(t *testing.T) {
+	db := openEngine(t, t.TempDir(), "")
+
+	start := db.LastSeq()
+	w := db.Watch([]byte("user:"))
+	defer w.Close()
+
+	if err := db.Put([]byte("user:1"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("other"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	batch := dbengine.NewWriteBatch()
+	batch.Put([]byte("user:2"), []byte("c"))
+	batch.Delete([]byte("user:1"))
+	if err := db.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	// the changes to other keys are skipped, but still numbered
+	want := fmt.Sprintf("%d user:1 a\n%d user:2 c\n%d user:1 DEL\n", start+1, start+3, start+4)
+	if got := describe(nextEvents(t, w, 3)); got != want {
+		t.Fatalf("the events are\n%s\nwant\n%s", got, want)
+	}
+
+	// a consumer resumes after the last event it got
+	resumed, err := db.WatchAfter([]byte("user:"), start+3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	if got := describe(nextEvents(t, resumed, 1)); got != fmt.Sprintf("%d user:1 DEL\n", start+4) {
+		t.Fatalf("the resumed watcher got %s", got)
+	}
+}
+
+func TestWatchEventsFollowReads(t *testing.T) {
+	db := openEngine(t, t.TempDir(), "")
+
+	w := db.Watch(nil)
+	defer w.Close()
+
+	// a consumer that reads the key it was told about, as a cache would,
+	// finds it written
+	const writes = 500
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < writes; i++ {
+			event, ok := <-w.Events
+			if !ok {
+				done <- w.Err()
+				return
+			}
+
+			value, exist, err := db.Get(event.Key)
+			if err != nil || !exist || string(value) != string(event.Value) {
+				done <- fmt.Errorf("%s is %q after its event: %v", event.Key, value, err)
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for i := 0; i < writes; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the events did not all arrive")
+	}
+}
+
+func TestWatchAfterRetention(t *testing.T) {
+	db := openEngine(t, t.TempDir(), "")
+	db.Wal.ChangeRetention = 5
+
+	start := db.LastSeq()
+	putKeys(t, db, 0, 12)
+
+	if _, err := db.WatchAfter(nil, start); err != wal.ErrSeqTooOld {
+		t.Fatalf("resuming after a change that is no longer retained returned %v", err)
+	}
+
+	w, err := db.WatchAfter(nil, db.LastSeq()-2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if events := nextEvents(t, w, 2); events[1].Seq != db.LastSeq() {
+		t.Fatalf("the last event is %d, want %d", events[1].Seq, db.LastSeq())
+	}
+}
+
+func TestWatchDroppedNamespace(t *testing.T) {
+	db := openEngine(t, t.TempDir(), "")
+
+	namespace, err := db.CreateNamespace("users", dbengine.Quota{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := namespace.Watch(nil)
+	if err := db.DropNamespace("users"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case _, ok := <-w.Events:
+		if ok {
+			t.Fatal("the watcher of a dropped namespace got an event")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the watcher of a dropped namespace was not closed")
+	}
+	if w.Err() != dbengine.ErrNamespaceDropped {
+		t.Fatalf("the watcher was closed with %v", w.Err())
+	}
+}
+
+func TestClientWatch(t *testing.T) {
+	ts := startServer(t, nil)
+	c := newClient(t, client.Options{Addr: ts.tcp})
+
+	w, err := c.Watch([]byte("user:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Put([]byte("user:1"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put([]byte("other"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Del([]byte("user:1")); err != nil {
+		t.Fatal(err)
+	}
+
+	event, err := w.Next()
+	if err != nil || string(event.Key) != "user:1" || string(event.Value) != "a" || event.Delete {
+		t.Fatalf("the first event is %+v: %v", event, err)
+	}
+
+	// a new watcher resumes after the last event the first one returned
+	seq := w.Seq()
+	w.Close()
+
+	resumed, err := c.WatchAfter([]byte("user:"), seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+
+	event, err = resumed.Next()
+	if err != nil || string(event.Key) != "user:1" || !event.Delete || event.Seq != seq+2 {
+		t.Fatalf("the resumed watcher got %+v after %d: %v", event, seq, err)
+	}
+}
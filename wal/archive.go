@@ -0,0 +1,200 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// release archives a segment that is in the persistent store, moving it to
+// ArchiveDirectory under the same name, or deletes it when there is none. It
+// is on disk in the archive before it leaves the log.
+func (w *WAL) release(index uint64) error {
+	path := filepath.Join(w.dir, segmentName(index))
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if w.ArchiveDirectory == "" || info.Size() == 0 {
+		return os.Remove(path)
+	}
+
+	if err := os.MkdirAll(w.ArchiveDirectory, 0755); err != nil {
+		return err
+	}
+
+	dst := filepath.Join(w.ArchiveDirectory, segmentName(index))
+
+	// a copy left by a crash before the segment was deleted is complete,
+	// as copies are renamed into place
+	if archived, err := os.Stat(dst); err == nil {
+		if archived.Size() != info.Size() {
+			return fmt.Errorf("%s is already archived by another log", dst)
+		}
+		return os.Remove(path)
+	}
+
+	if err := os.Rename(path, dst); err == nil {
+		return nil
+	}
+
+	// the archive is on another file system
+	if err := copyFile(path, dst); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// CopyTo writes the records that are not in the persistent store yet to a
+// log file at path, which a WAL opens as its first segment, and returns the
+// sequence number of the last entry written. Writes wait for the copy. The
+// entries of a consensus log are copied up to the one applied last, as
+// plain records.
+func (w *WAL) CopyTo(path string) (uint64, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if _, err := os.Stat(path); err == nil {
+		return 0, fmt.Errorf("%s already exists", path)
+	}
+
+	if err := w.writer.Flush(); err != nil {
+		return 0, err
+	}
+
+	records, err := w.readRecords(w.checkpoint, w.end())
+	if err != nil {
+		return 0, err
+	}
+
+	copied := []Record{}
+	for _, record := range records {
+		if record.log != nil && record.log.Index > w.applied {
+			break
+		}
+		if record.log == nil || len(record.Entries) > 0 {
+			copied = append(copied, record)
+		}
+	}
+
+	if err := AppendRecords(path, copied); err != nil {
+		return 0, err
+	}
+
+	// the last record may still wait for Publish
+	return w.lastSeq + w.unpublished, nil
+}
+
+// ReadArchive returns the records of the segments in dir in the order they
+// were written. Records numbered below the ones before them, which were
+// written again, are returned once. Records written before the log kept
+// sequence numbers are numbered after the one before them.
+func ReadArchive(dir string) ([]Record, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []Record{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, dirEntry := range dirEntries {
+		if _, ok := segmentIndex(dirEntry.Name()); ok {
+			names = append(names, dirEntry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	records := []Record{}
+	next := uint64(1)
+
+	for _, name := range names {
+		segment, err := ReadRecords(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range segment {
+			if record.Seq == 0 {
+				record.Seq = next
+			}
+			if record.Seq < next || len(record.Entries) == 0 {
+				continue
+			}
+
+			records = append(records, record)
+			next = record.Seq + uint64(len(record.Entries))
+		}
+	}
+
+	return records, nil
+}
+
+// AppendRecords adds the records to the end of a log file, keeping their
+// sequence numbers and times, and syncs it.
+func AppendRecords(path string, records []Record) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if _, err := file.Write(encodeStampedRecord(record)); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// copyFile copies src to dst, which must not exist, through a temporary
+// file that is synced before it is renamed, so dst is either complete or
+// missing.
+func copyFile(src string, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("%s already exists", dst)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmpPath := dst + ".tmp"
+	out, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, dst)
+}
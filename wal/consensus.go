@@ -0,0 +1,174 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	fileutil "github.com/Avash027/midDB/internal/file_util"
+)
+
+// LOG_ENTRY_COMMAND is the type of the entries of a consensus log whose data
+// is a record made by EncodeRecord. Their entries are replayed and read back
+// like the ones of WriteBatch once they are applied.
+const LOG_ENTRY_COMMAND = 'C'
+
+// LogEntry is an entry of a consensus log, such as the Raft log of the raft
+// package, kept in the segments next to the other records. Index and Term
+// order the entries, Type and Data are up to the log but for
+// LOG_ENTRY_COMMAND.
+//
+// The entries are written before they are committed and may be replaced, see
+// TruncateLog. The log reports the ones it applied with Applied: the others
+// are neither replayed by InitDB nor moved to the persistent store, and the
+// segments holding the entries it still needs are kept, see Retain.
+type LogEntry struct {
+	Index uint64
+	Term  uint64
+	Type  byte
+	Data  []byte
+}
+
+// AppendLog writes the entries after the last record and syncs the segment.
+// It returns where each of them starts, to pass to TruncateLog.
+func (w *WAL) AppendLog(entries []LogEntry) ([]Position, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	positions := make([]Position, len(entries))
+	now := time.Now().UnixMilli()
+
+	for i, entry := range entries {
+		pos, err := w.write(encodeLogRecord(entry, now))
+		if err != nil {
+			return nil, err
+		}
+		positions[i] = pos
+	}
+
+	if err := w.writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	if err := w.File.Sync(); err != nil {
+		return nil, err
+	}
+	w.dirty = false
+
+	return positions, nil
+}
+
+// TruncateLog drops every record from pos on, which must be where an entry
+// AppendLog wrote starts, and writes the next records there. The segments
+// after it are removed last first, so a crash in the middle leaves a log
+// that ends earlier.
+func (w *WAL) TruncateLog(pos Position) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+
+	file := w.File
+	if pos.Segment != w.segment {
+		var err error
+		if file, err = os.OpenFile(filepath.Join(w.dir, segmentName(pos.Segment)), os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+			return err
+		}
+	}
+
+	segments, err := listSegments(w.dir)
+	if err != nil {
+		return err
+	}
+
+	for i := len(segments) - 1; i >= 0 && segments[i] > pos.Segment; i-- {
+		if err := os.Remove(filepath.Join(w.dir, segmentName(segments[i]))); err != nil {
+			return err
+		}
+	}
+
+	if file != w.File {
+		w.File.Close()
+		w.File = file
+		w.writer.Reset(file)
+		w.segment = pos.Segment
+	}
+
+	if err := w.File.Truncate(pos.Offset); err != nil {
+		return err
+	}
+	w.size = pos.Offset
+
+	if err := w.File.Sync(); err != nil {
+		return err
+	}
+
+	return fileutil.SyncDir(w.dir)
+}
+
+// ReadLog returns the entries of the consensus log in the segments that are
+// left, in the order they were written, and where each of them starts.
+// Entries are only written again at an index once TruncateLog cut the log
+// there and synced it, so every index is found once and in order.
+func (w *WAL) ReadLog() ([]LogEntry, []Position, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if err := w.writer.Flush(); err != nil {
+		return nil, nil, err
+	}
+
+	records, err := w.readRecords(Position{}, w.end())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries := []LogEntry{}
+	positions := []Position{}
+
+	for _, record := range records {
+		if record.log != nil {
+			entries = append(entries, *record.log)
+			positions = append(positions, record.start)
+		}
+	}
+
+	return entries, positions, nil
+}
+
+// Applied records that the entries of the consensus log up to index were
+// applied, and adds the entries of the one at index to the change feed. It
+// is called before the log is replayed with the entry applied last, and then
+// after each entry.
+func (w *WAL) Applied(index uint64, entries []Entry) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if index > w.applied {
+		w.applied = index
+	}
+
+	if len(entries) > 0 {
+		w.addChanges(entries)
+	}
+}
+
+// PersistedIndex returns the last entry of the consensus log that is in the
+// persistent store.
+func (w *WAL) PersistedIndex() uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.checkpoint.Index
+}
+
+// Retain keeps the segments from segment on once they are in the persistent
+// store, as the consensus log still reads its entries there. 0 keeps none.
+func (w *WAL) Retain(segment uint64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.retain = segment
+}
@@ -0,0 +1,90 @@
+package wal
+
+import "errors"
+
+// DEFAULT_CHANGE_RETENTION is how many changes the log keeps in memory for
+// consumers that resume after a disconnect.
+const DEFAULT_CHANGE_RETENTION = 100000
+
+var ErrSeqTooOld = errors.New("sequence number is no longer retained")
+
+// Change is an entry of a record written to the log with its sequence
+// number, which is the same as the one the tree gives it.
+type Change struct {
+	Seq uint64
+	Entry
+	// LastInRecord is set on the last entry of its record, so consumers
+	// can tell the records apart
+	LastInRecord bool
+}
+
+// SetLastSeq sets the sequence number of the last entry in the tree, once
+// the log has been replayed into it. The entries written afterwards are
+// numbered from there.
+func (w *WAL) SetLastSeq(seq uint64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.lastSeq = seq
+}
+
+// LastSeq returns the sequence number of the last entry written.
+func (w *WAL) LastSeq() uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.lastSeq
+}
+
+// Changes returns up to limit changes with a sequence number above seq, in
+// order, and a channel that is closed when the next record is written. It
+// returns ErrSeqTooOld when some of the changes after seq were already
+// dropped, and no change when seq is the last one.
+func (w *WAL) Changes(seq uint64, limit int) ([]Change, <-chan struct{}, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.written == nil {
+		w.written = make(chan struct{})
+	}
+
+	if seq >= w.lastSeq {
+		return nil, w.written, nil
+	}
+
+	if len(w.changes) == 0 || seq+1 < w.changes[0].Seq {
+		return nil, nil, ErrSeqTooOld
+	}
+
+	changes := w.changes[seq+1-w.changes[0].Seq:]
+	if limit > 0 && len(changes) > limit {
+		changes = changes[:limit]
+	}
+
+	return append([]Change{}, changes...), w.written, nil
+}
+
+// addChanges numbers the entries of a record that was just written and
+// wakes up the consumers waiting for them. It must be called with the lock
+// held.
+func (w *WAL) addChanges(entries []Entry) {
+	retention := w.ChangeRetention
+	if retention <= 0 {
+		retention = DEFAULT_CHANGE_RETENTION
+	}
+
+	for i, entry := range entries {
+		w.lastSeq++
+		w.changes = append(w.changes, Change{Seq: w.lastSeq, Entry: entry, LastInRecord: i == len(entries)-1})
+	}
+
+	// the oldest changes are dropped in bulk, so appending stays cheap
+	if len(w.changes) >= 2*retention {
+		w.changes = append([]Change{}, w.changes[len(w.changes)-retention:]...)
+	}
+
+	if w.written != nil {
+		close(w.written)
+		w.written = nil
+	}
+}
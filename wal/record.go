@@ -0,0 +1,437 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"strconv"
+	"strings"
+
+	fileutil "github.com/Avash027/midDB/internal/file_util"
+)
+
+const (
+	RECORD_MARKER         = 'R'
+	STAMPED_RECORD_MARKER = 'T'
+	LOG_RECORD_MARKER     = 'L'
+	RECORD_HEADER_SIZE    = 9
+
+	OP_PUT             = '+'
+	OP_DELETE          = '-'
+	OP_PUT_WITH_EXPIRY = '~'
+)
+
+var errInvalidRecord = errors.New("invalid WAL record")
+
+// Record is a batch of entries read back from a log. Seq is the sequence
+// number of its first entry and Time the unix time in milliseconds it was
+// written at, both are zero for records written before the log kept them.
+type Record struct {
+	Seq     uint64
+	Time    int64
+	Entries []Entry
+
+	// log is set on the entries of a consensus log, see consensus.go, and
+	// start and end are where the record is in the log
+	log   *LogEntry
+	start Position
+	end   Position
+}
+
+// encodeRecord lays out a batch of entries as
+//
+//	| 'R' | payload length (4) | crc32 of payload (4) | payload |
+//
+// where the payload is the number of entries followed by one operation per
+// entry. Every key and value is prefixed with its length, so they may hold
+// any byte:
+//
+//	'+' | key length | key | value length | value
+//	'-' | key length | key
+//	'~' | key length | key | value length | value | expires at
+//
+// All numbers inside the payload are varints.
+func encodeRecord(entries []Entry) []byte {
+	var payload []byte
+
+	payload = appendUvarint(payload, uint64(len(entries)))
+
+	for _, entry := range entries {
+		switch {
+		case entry.Delete:
+			payload = append(payload, OP_DELETE)
+			payload = appendBytes(payload, entry.Key)
+		case entry.ExpiresAt != 0:
+			payload = append(payload, OP_PUT_WITH_EXPIRY)
+			payload = appendBytes(payload, entry.Key)
+			payload = appendBytes(payload, entry.Value)
+			payload = appendVarint(payload, entry.ExpiresAt)
+		default:
+			payload = append(payload, OP_PUT)
+			payload = appendBytes(payload, entry.Key)
+			payload = appendBytes(payload, entry.Value)
+		}
+	}
+
+	return frameRecord(RECORD_MARKER, payload)
+}
+
+// encodeStampedRecord lays out a record the way the log keeps it, with the
+// sequence number of its first entry and the time it was written in front
+// of the payload of encodeRecord:
+//
+//	| 'T' | payload length (4) | crc32 of payload (4) | seq | time | payload |
+func encodeStampedRecord(record Record) []byte {
+	var payload []byte
+
+	payload = appendUvarint(payload, record.Seq)
+	payload = appendVarint(payload, record.Time)
+	payload = append(payload, encodeRecord(record.Entries)[RECORD_HEADER_SIZE:]...)
+
+	return frameRecord(STAMPED_RECORD_MARKER, payload)
+}
+
+// encodeLogRecord lays out an entry of a consensus log, whose data is kept
+// as it is:
+//
+//	| 'L' | payload length (4) | crc32 of payload (4) | index | term | type | time | data length | data |
+func encodeLogRecord(entry LogEntry, time int64) []byte {
+	var payload []byte
+
+	payload = appendUvarint(payload, entry.Index)
+	payload = appendUvarint(payload, entry.Term)
+	payload = append(payload, entry.Type)
+	payload = appendVarint(payload, time)
+	payload = appendBytes(payload, entry.Data)
+
+	return frameRecord(LOG_RECORD_MARKER, payload)
+}
+
+func frameRecord(marker byte, payload []byte) []byte {
+	record := make([]byte, RECORD_HEADER_SIZE, RECORD_HEADER_SIZE+len(payload))
+	record[0] = marker
+	binary.LittleEndian.PutUint32(record[1:5], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[5:9], crc32.ChecksumIEEE(payload))
+
+	return append(record, payload...)
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+func appendVarint(buf []byte, x int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+func appendBytes(buf []byte, data []byte) []byte {
+	buf = appendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+// EncodeRecord returns the record WriteBatch writes for the entries, which
+// is how replication ships them.
+func EncodeRecord(entries []Entry) []byte {
+	return encodeRecord(entries)
+}
+
+// DecodeRecord returns the entries of a single record made by EncodeRecord.
+func DecodeRecord(record []byte) ([]Entry, error) {
+	if len(record) < RECORD_HEADER_SIZE || record[0] != RECORD_MARKER {
+		return nil, errInvalidRecord
+	}
+
+	length := int(binary.LittleEndian.Uint32(record[1:5]))
+	if len(record) != RECORD_HEADER_SIZE+length {
+		return nil, errInvalidRecord
+	}
+
+	payload := record[RECORD_HEADER_SIZE:]
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(record[5:9]) {
+		return nil, errInvalidRecord
+	}
+
+	entries, ok := decodePayload(payload)
+	if !ok {
+		return nil, errInvalidRecord
+	}
+
+	return entries, nil
+}
+
+// decodeRecords returns every complete record in data. Logs written before
+// records were length prefixed hold one text record per line, all kinds can
+// be mixed in the same file.
+//
+// A record that was only partly written when the process died, or whose
+// checksum does not match, ends the log.
+func decodeRecords(data []byte) []Record {
+	records := []Record{}
+	size := int64(len(data))
+
+	for len(data) > 0 {
+		start := size - int64(len(data))
+
+		if data[0] == '\n' {
+			data = data[1:]
+			continue
+		}
+
+		if data[0] != RECORD_MARKER && data[0] != STAMPED_RECORD_MARKER && data[0] != LOG_RECORD_MARKER {
+			line := data
+			rest := []byte{}
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				line, rest = data[:i], data[i+1:]
+			}
+			data = rest
+
+			if entries, ok := parseRecord(string(line)); ok {
+				records = append(records, Record{Entries: entries, start: Position{Offset: start}, end: Position{Offset: size - int64(len(data))}})
+			}
+			continue
+		}
+
+		marker := data[0]
+
+		if len(data) < RECORD_HEADER_SIZE {
+			break
+		}
+
+		length := int(binary.LittleEndian.Uint32(data[1:5]))
+		checksum := binary.LittleEndian.Uint32(data[5:9])
+
+		if len(data)-RECORD_HEADER_SIZE < length {
+			break
+		}
+
+		payload := data[RECORD_HEADER_SIZE : RECORD_HEADER_SIZE+length]
+		data = data[RECORD_HEADER_SIZE+length:]
+
+		if crc32.ChecksumIEEE(payload) != checksum {
+			break
+		}
+
+		record := Record{start: Position{Offset: start}, end: Position{Offset: size - int64(len(data))}}
+
+		if marker == LOG_RECORD_MARKER {
+			var ok bool
+			if record.log, record.Time, ok = decodeLogPayload(payload); !ok {
+				break
+			}
+
+			if record.log.Type == LOG_ENTRY_COMMAND {
+				entries, err := DecodeRecord(record.log.Data)
+				if err != nil {
+					break
+				}
+				record.Entries = entries
+			}
+
+			records = append(records, record)
+			continue
+		}
+
+		if marker == STAMPED_RECORD_MARKER {
+			var ok bool
+			if record.Seq, record.Time, payload, ok = decodeStamp(payload); !ok {
+				break
+			}
+		}
+
+		entries, ok := decodePayload(payload)
+		if !ok {
+			break
+		}
+		record.Entries = entries
+		records = append(records, record)
+	}
+
+	return records
+}
+
+func decodeStamp(payload []byte) (uint64, int64, []byte, bool) {
+	seq, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return 0, 0, nil, false
+	}
+	payload = payload[n:]
+
+	time, n := binary.Varint(payload)
+	if n <= 0 {
+		return 0, 0, nil, false
+	}
+
+	return seq, time, payload[n:], true
+}
+
+func decodeLogPayload(payload []byte) (*LogEntry, int64, bool) {
+	var entry LogEntry
+	var n int
+
+	if entry.Index, n = binary.Uvarint(payload); n <= 0 {
+		return nil, 0, false
+	}
+	payload = payload[n:]
+
+	if entry.Term, n = binary.Uvarint(payload); n <= 0 || len(payload) == n {
+		return nil, 0, false
+	}
+	entry.Type = payload[n]
+	payload = payload[n+1:]
+
+	time, n := binary.Varint(payload)
+	if n <= 0 {
+		return nil, 0, false
+	}
+
+	var ok bool
+	if entry.Data, payload, ok = fileutil.ReadBytes(payload[n:]); !ok || len(payload) != 0 {
+		return nil, 0, false
+	}
+
+	return &entry, time, true
+}
+
+func decodePayload(payload []byte) ([]Entry, bool) {
+	count, n := binary.Uvarint(payload)
+	if n <= 0 || count > uint64(len(payload)) {
+		return nil, false
+	}
+	payload = payload[n:]
+
+	entries := make([]Entry, 0, count)
+
+	for i := uint64(0); i < count; i++ {
+		if len(payload) == 0 {
+			return nil, false
+		}
+
+		op := payload[0]
+		payload = payload[1:]
+
+		var entry Entry
+		var ok bool
+
+		entry.Key, payload, ok = fileutil.ReadBytes(payload)
+		if !ok {
+			return nil, false
+		}
+
+		switch op {
+		case OP_DELETE:
+			entry.Delete = true
+		case OP_PUT, OP_PUT_WITH_EXPIRY:
+			entry.Value, payload, ok = fileutil.ReadBytes(payload)
+			if !ok {
+				return nil, false
+			}
+
+			if op == OP_PUT_WITH_EXPIRY {
+				expiresAt, n := binary.Varint(payload)
+				if n <= 0 {
+					return nil, false
+				}
+				entry.ExpiresAt = expiresAt
+				payload = payload[n:]
+			}
+		default:
+			return nil, false
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, len(payload) == 0
+}
+
+// parseRecord decodes one line of a text log into its entries. It reports
+// false for lines that are not complete records. The text records look like
+//
+//	+|key|value|
+//	-|key|
+//	~|key|value|<expires at>|
+//	*|<number of entries>|+|key|value|-|key|...|
+func parseRecord(line string) ([]Entry, bool) {
+	args := strings.Split(line, "|")
+
+	// every field is followed by a delimiter, a record cut short by a crash
+	// does not end with one
+	if len(args) < 2 || args[len(args)-1] != "" {
+		return nil, false
+	}
+	args = args[:len(args)-1]
+
+	if args[0] != "*" {
+		entry, rest, ok := parseOperation(args)
+		if !ok || len(rest) != 0 {
+			return nil, false
+		}
+		return []Entry{entry}, true
+	}
+
+	if len(args) < 2 {
+		return nil, false
+	}
+
+	count, err := strconv.Atoi(args[1])
+	if err != nil || count < 0 {
+		return nil, false
+	}
+
+	entries := make([]Entry, 0, count)
+	rest := args[2:]
+
+	for i := 0; i < count; i++ {
+		var entry Entry
+		var ok bool
+
+		entry, rest, ok = parseOperation(rest)
+		if !ok {
+			return nil, false
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(rest) != 0 {
+		return nil, false
+	}
+
+	return entries, true
+}
+
+// parseOperation decodes the put or delete at the start of args and returns
+// the remaining fields.
+func parseOperation(args []string) (Entry, []string, bool) {
+	if len(args) == 0 {
+		return Entry{}, nil, false
+	}
+
+	switch args[0] {
+	case "+":
+		if len(args) < 3 {
+			return Entry{}, nil, false
+		}
+		return Entry{Key: []byte(args[1]), Value: []byte(args[2])}, args[3:], true
+	case "~":
+		if len(args) < 4 {
+			return Entry{}, nil, false
+		}
+		expiresAt, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			return Entry{}, nil, false
+		}
+		return Entry{Key: []byte(args[1]), Value: []byte(args[2]), ExpiresAt: expiresAt}, args[4:], true
+	case "-":
+		if len(args) < 2 {
+			return Entry{}, nil, false
+		}
+		return Entry{Key: []byte(args[1]), Delete: true}, args[2:], true
+	}
+
+	return Entry{}, nil, false
+}
@@ -0,0 +1,385 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The log is a directory of segments, 00000000000000000001.wal and so on,
+// written one after the other, and a CHECKPOINT file holding the position up
+// to which the entries are in the persistent store, with the index of the
+// last entry of a consensus log up to there. A new segment is started
+// when the current one grows past SegmentSize and every time the log is
+// opened, so a segment torn by a crash is never written to again.
+
+// SEGMENT_EXTENSION ends the names of the segments, which are numbered so
+// they sort in the order of the log.
+const SEGMENT_EXTENSION = ".wal"
+
+const CHECKPOINT_FILE_NAME = "CHECKPOINT"
+
+// DEFAULT_SEGMENT_SIZE is the size past which a new segment is started.
+const DEFAULT_SEGMENT_SIZE = 16 * 1024 * 1024
+
+// Position is a place in the log: an offset in a segment. Index is only set
+// by ReadEntries, it is the last entry of a consensus log applied before
+// the position.
+type Position struct {
+	Segment uint64
+	Offset  int64
+	Index   uint64
+}
+
+func segmentName(index uint64) string {
+	return fmt.Sprintf("%020d%s", index, SEGMENT_EXTENSION)
+}
+
+func segmentIndex(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, SEGMENT_EXTENSION) {
+		return 0, false
+	}
+
+	index, err := strconv.ParseUint(strings.TrimSuffix(name, SEGMENT_EXTENSION), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return index, true
+}
+
+// listSegments returns the indexes of the segments in dir in order.
+func listSegments(dir string) ([]uint64, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []uint64{}
+	for _, dirEntry := range dirEntries {
+		if index, ok := segmentIndex(dirEntry.Name()); ok && !dirEntry.IsDir() {
+			segments = append(segments, index)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+
+	return segments, nil
+}
+
+// openLog opens the log in dir for writing, in a new segment unless the last
+// one is empty, and returns its file and index.
+func openLog(dir string) (*os.File, uint64, error) {
+	if err := migrateLogFile(dir); err != nil {
+		return nil, 0, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, 0, err
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	index := uint64(1)
+	if len(segments) > 0 {
+		index = segments[len(segments)-1]
+
+		info, err := os.Stat(filepath.Join(dir, segmentName(index)))
+		if err != nil {
+			return nil, 0, err
+		}
+		if info.Size() > 0 {
+			index++
+		}
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, segmentName(index)), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return file, index, nil
+}
+
+// migrateLogFile turns a log written as a single file, by an older version
+// or by a restore, into the first segment of a directory at the same path.
+func migrateLogFile(path string) error {
+	movingPath := path + ".moving"
+
+	info, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err == nil && !info.IsDir() {
+		if err := os.Rename(path, movingPath); err != nil {
+			return err
+		}
+	}
+
+	// the file may also be left there by a crash in the middle of a move
+	if _, err := os.Stat(movingPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+
+	return os.Rename(movingPath, filepath.Join(path, segmentName(1)))
+}
+
+// rotate seals the segment written to and starts the next one. It must be
+// called with the lock held.
+func (w *WAL) rotate() error {
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+
+	if err := w.File.Sync(); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filepath.Join(w.dir, segmentName(w.segment+1)), os.O_CREATE|os.O_EXCL|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = w.File.Close()
+
+	w.File = file
+	w.writer.Reset(file)
+	w.segment++
+	w.size = 0
+
+	return err
+}
+
+// end returns the position after the last record written. It must be
+// called with the lock held.
+func (w *WAL) end() Position {
+	return Position{Segment: w.segment, Offset: w.size}
+}
+
+func (w *WAL) segmentSize() int64 {
+	if w.SegmentSize <= 0 {
+		return DEFAULT_SEGMENT_SIZE
+	}
+
+	return w.SegmentSize
+}
+
+// readRecords returns the complete records from the position from up to the
+// position to, segment by segment, so a record torn at the end of a segment
+// does not hide the next ones. It must be called with the lock held and the
+// buffer flushed.
+func (w *WAL) readRecords(from Position, to Position) ([]Record, error) {
+	segments, err := listSegments(w.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []Record{}
+
+	for _, index := range segments {
+		if index < from.Segment || index > to.Segment {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(w.dir, segmentName(index)))
+		if err != nil {
+			return nil, err
+		}
+
+		if index == to.Segment && to.Offset < int64(len(data)) {
+			data = data[:to.Offset]
+		}
+
+		base := int64(0)
+		if index == from.Segment {
+			if from.Offset >= int64(len(data)) {
+				continue
+			}
+			data = data[from.Offset:]
+			base = from.Offset
+		}
+
+		for _, record := range decodeRecords(data) {
+			record.start = Position{Segment: index, Offset: base + record.start.Offset}
+			record.end = Position{Segment: index, Offset: base + record.end.Offset}
+			records = append(records, record)
+		}
+	}
+
+	return records, nil
+}
+
+// readCheckpoint returns the position the entries that are not in the
+// persistent store start at, the start of the log when there is no marker.
+func readCheckpoint(dir string) (Position, error) {
+	data, err := os.ReadFile(filepath.Join(dir, CHECKPOINT_FILE_NAME))
+	if os.IsNotExist(err) {
+		return Position{}, nil
+	}
+	if err != nil {
+		return Position{}, err
+	}
+
+	// markers written before the log kept the index have two fields
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 && len(fields) != 3 {
+		return Position{}, fmt.Errorf("invalid WAL checkpoint %q", data)
+	}
+
+	var pos Position
+	if pos.Segment, err = strconv.ParseUint(fields[0], 10, 64); err != nil {
+		return Position{}, fmt.Errorf("invalid WAL checkpoint %q", data)
+	}
+	if pos.Offset, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return Position{}, fmt.Errorf("invalid WAL checkpoint %q", data)
+	}
+	if len(fields) == 3 {
+		if pos.Index, err = strconv.ParseUint(fields[2], 10, 64); err != nil {
+			return Position{}, fmt.Errorf("invalid WAL checkpoint %q", data)
+		}
+	}
+
+	return pos, nil
+}
+
+// writeCheckpoint replaces the marker through a temporary file that is
+// synced before it is renamed.
+func writeCheckpoint(dir string, pos Position) error {
+	path := filepath.Join(dir, CHECKPOINT_FILE_NAME)
+	tmpPath := path + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(file, "%d %d %d\n", pos.Segment, pos.Offset, pos.Index); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// Checkpoint records that the entries up to pos are in the persistent store,
+// so they are not replayed again. The segments that end before pos are then
+// archived, or deleted without an ArchiveDirectory, but for the last
+// SegmentRetention of them and the ones a consensus log retains, see Retain.
+func (w *WAL) Checkpoint(pos Position) error {
+	if err := writeCheckpoint(w.dir, pos); err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	w.checkpoint = pos
+	retain := w.retain
+	w.lock.Unlock()
+
+	segments, err := listSegments(w.dir)
+	if err != nil {
+		return err
+	}
+
+	done := []uint64{}
+	for _, index := range segments {
+		if index < pos.Segment && (retain == 0 || index < retain) {
+			done = append(done, index)
+		}
+	}
+
+	for len(done) > max(w.SegmentRetention, 0) {
+		if err := w.release(done[0]); err != nil {
+			return err
+		}
+		done = done[1:]
+	}
+
+	return nil
+}
+
+// Empty tells whether the log at path holds no record. A missing log is
+// empty.
+func Empty(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if !info.IsDir() {
+		return info.Size() == 0, nil
+	}
+
+	segments, err := listSegments(path)
+	if err != nil {
+		return false, err
+	}
+
+	for _, index := range segments {
+		info, err := os.Stat(filepath.Join(path, segmentName(index)))
+		if err != nil {
+			return false, err
+		}
+		if info.Size() > 0 {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// WriteLog writes the records as the log at path, which must be empty, see
+// Empty: into a single file when there is no log directory there, which the
+// WAL takes as its first segment, and into the first segment otherwise.
+func WriteLog(path string, records []Record) error {
+	empty, err := Empty(path)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return fmt.Errorf("%s already holds a log", path)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return AppendRecords(path, records)
+	}
+
+	segments, err := listSegments(path)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range segments {
+		if err := os.Remove(filepath.Join(path, segmentName(index))); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(filepath.Join(path, CHECKPOINT_FILE_NAME)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return AppendRecords(filepath.Join(path, segmentName(1)), records)
+}
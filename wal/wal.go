@@ -5,80 +5,131 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"strings"
 	"sync"
+	"time"
 
 	LsmTree "github.com/Avash027/midDB/lsm_tree"
 )
 
 type Entry struct {
-	Key    string `json:"k"`
-	Value  string `json:"v"`
+	Key    []byte `json:"k"`
+	Value  []byte `json:"v"`
 	Delete bool   `json:"-"`
+	// ExpiresAt is the unix time in milliseconds at which the value
+	// expires, zero means never
+	ExpiresAt int64 `json:"e,omitempty"`
 }
 
 const DEFAULT_WAL_PATH = "wal.aof"
 
 type WAL struct {
-	filepath string
-	File     *os.File
-	writer   *bufio.Writer
-	lock     sync.Mutex
+	// dir holds the segments and the checkpoint marker, see segment.go
+	dir    string
+	File   *os.File
+	writer *bufio.Writer
+	lock   sync.Mutex
+	// dirty is set when records were written since the last Persist
+	dirty bool
+	// segment is the index of File, size the bytes written to it, and
+	// checkpoint where the entries that are not in the persistent store
+	// start
+	segment    uint64
+	size       int64
+	checkpoint Position
+
+	// applied and retain are set by a consensus log kept in the segments,
+	// see consensus.go
+	applied uint64
+	retain  uint64
+
+	// SegmentSize is the size past which a new segment is started,
+	// DEFAULT_SEGMENT_SIZE when 0. SegmentRetention is how many segments
+	// already in the persistent store are kept before they are archived
+	// or deleted. Both are set before the first write.
+	SegmentSize      int64
+	SegmentRetention int
+
+	// ChangeRetention is how many of the last changes are kept for Changes,
+	// DEFAULT_CHANGE_RETENTION when 0. It is set before the first write.
+	ChangeRetention int
+	// lastSeq, changes and written make the change feed, see feed.go.
+	// unpublished counts the entries written by WriteBatch that Publish
+	// has not added to it yet.
+	lastSeq     uint64
+	changes     []Change
+	written     chan struct{}
+	unpublished uint64
+
+	// ArchiveDirectory, when set, gets the segments once they are in the
+	// persistent store instead of them being deleted, see archive.go. It
+	// is set before the first write.
+	ArchiveDirectory string
 }
 
+// InitWAL opens the log directory at path, creating it when it does not
+// exist. A log file found at path is moved into it as its first segment.
 func InitWAL(path string) *WAL {
-	var file *os.File
+	file, segment, err := openLog(path)
+	if err != nil {
+		panic(err)
+	}
 
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		file, err = os.Create(path)
-		if err != nil {
-			panic(err)
-		}
-	} else {
-		file, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
-		if err != nil {
-			panic(err)
-		}
+	checkpoint, err := readCheckpoint(path)
+	if err != nil {
+		panic(err)
 	}
 
 	writer := bufio.NewWriter(file)
 
-	return &WAL{filepath: path, File: file, writer: writer}
+	return &WAL{dir: path, File: file, writer: writer, segment: segment, checkpoint: checkpoint, applied: checkpoint.Index}
 }
 
-func (w *WAL) Write(data ...[]byte) error {
+// Write appends an encoded record to the log buffer.
+func (w *WAL) Write(record []byte) error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
+	_, err := w.write(record)
+	return err
+}
+
+// write returns where the record starts, it must be called with the lock
+// held.
+func (w *WAL) write(record []byte) (Position, error) {
+	if w.size > 0 && w.size+int64(len(record)) > w.segmentSize() {
+		if err := w.rotate(); err != nil {
+			return Position{}, err
+		}
+	}
+
 	// if the size of incoming data is more than the available buffer size
 	// then flush the buffer to the file
-	if len(data) > w.writer.Available() {
+	if len(record) > w.writer.Available() {
 		if err := w.writer.Flush(); err != nil {
 			fmt.Println(err)
-			return err
-		}
-	}
-
-	endByte := []byte("\n")
-	delimiter := []byte("|")
-
-	for _, d := range data {
-		d = append(d, delimiter...)
-		_, err := w.writer.Write(d)
-		if err != nil {
-			return err
+			return Position{}, err
 		}
 	}
 
-	w.writer.WriteString(string(endByte))
+	w.dirty = true
+	start := w.end()
 
-	return nil
+	n, err := w.writer.Write(record)
+	w.size += int64(n)
+	return start, err
 }
 
+// Persist flushes the buffered records and syncs the file. It returns right
+// away when nothing was written since the last call, so reads, which persist
+// the log first, only pay for a sync after a write.
 func (w *WAL) Persist() error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
+	if !w.dirty {
+		return nil
+	}
+
 	if err := w.writer.Flush(); err != nil {
 		return err
 	}
@@ -89,105 +140,140 @@ func (w *WAL) Persist() error {
 
 	// clear the write buffer
 	w.writer.Reset(w.File)
+	w.dirty = false
 
 	return nil
 }
 
-func (w *WAL) ReadEntries() []Entry {
+// WriteBatch writes the entries as a single record, so after a crash either
+// all of them are recovered or none is. See encodeStampedRecord for the
+// layout. The entries reach the change feed once they are applied and
+// passed to Publish, so consumers never see a change reads do not see yet.
+// One batch is written and published at a time.
+func (w *WAL) WriteBatch(entries []Entry) error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
-	file, err := os.OpenFile(w.filepath, os.O_RDONLY, 0644)
+	record := encodeStampedRecord(Record{Seq: w.lastSeq + w.unpublished + 1, Time: time.Now().UnixMilli(), Entries: entries})
 
-	if err != nil {
-		panic(err)
+	if _, err := w.write(record); err != nil {
+		return err
 	}
 
-	reader := bufio.NewReader(file)
+	w.unpublished += uint64(len(entries))
+	return nil
+}
+
+// Publish adds the entries of the last WriteBatch to the change feed.
+func (w *WAL) Publish(entries []Entry) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.unpublished -= uint64(len(entries))
+	w.addChanges(entries)
+}
+
+// ReadRecords returns every complete record of a log file.
+func ReadRecords(path string) ([]Record, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY, 0644)
 
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	defer file.Close()
 
-	data, err := io.ReadAll(reader)
+	data, err := io.ReadAll(bufio.NewReader(file))
 
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	cmds := strings.Split(string(data), "\n")
+	records := decodeRecords(data)
 
-	entries := make([]Entry, 0, len(cmds))
+	return records, nil
+}
 
-	for _, cmd := range cmds {
-		if cmd == "" {
-			continue
+// ReadEntries returns the entries written since the checkpoint, which are not
+// in the persistent store yet, and the position they end at, to pass to
+// Checkpoint once they are. With an ArchiveDirectory a new segment is
+// started, so the one holding them is archived then. The entries of a
+// consensus log stop at the first one that is not applied yet.
+func (w *WAL) ReadEntries() ([]Entry, Position, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.ArchiveDirectory != "" && w.size > 0 {
+		if err := w.rotate(); err != nil {
+			return nil, Position{}, err
 		}
+	}
+
+	if err := w.writer.Flush(); err != nil {
+		return nil, Position{}, err
+	}
+
+	end := w.end()
+
+	records, err := w.readRecords(w.checkpoint, end)
+	if err != nil {
+		return nil, Position{}, err
+	}
+
+	entries := []Entry{}
 
-		args := strings.Split(cmd, "|")
-
-		switch args[0] {
-		case "+":
-			if len(args) != 4 {
-				continue
-			}
-			entries = append(entries, Entry{Key: args[1], Value: args[2], Delete: false})
-		case "-":
-			if len(args) != 3 {
-				continue
-			}
-			entries = append(entries, Entry{Key: args[1], Delete: true})
+	for _, record := range records {
+		if record.log != nil && record.log.Index > w.applied {
+			end = record.start
+			break
 		}
+		entries = append(entries, record.Entries...)
 	}
 
-	return entries
+	end.Index = w.applied
+	return entries, end, nil
 }
 
+// InitDB replays the log since the checkpoint into the tree. Each record is
+// applied as one batch, the entries of a consensus log only up to the one
+// applied last, see Applied.
 func (w *WAL) InitDB(lsmTree *LsmTree.LSMTree) error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
-	file, err := os.OpenFile(w.filepath, os.O_RDONLY, 0644)
-
-	if err != nil {
-		return err
-	}
-
-	reader := bufio.NewReader(file)
-
-	if err != nil {
+	if err := w.writer.Flush(); err != nil {
 		return err
 	}
 
-	data, err := io.ReadAll(reader)
+	records, err := w.readRecords(w.checkpoint, w.end())
 
 	if err != nil {
 		return err
 	}
 
-	cmds := strings.Split(string(data), "\n")
-
-	for _, cmd := range cmds {
-		if cmd == "" {
+	for _, record := range records {
+		if record.log != nil && record.log.Index > w.applied {
 			continue
 		}
 
-		args := strings.Split(cmd, "|")
-
-		switch args[0] {
-		case "+":
-			lsmTree.Put(args[1], args[2])
-		case "-":
-			lsmTree.Del(args[1])
+		pairs := make([]LsmTree.Pair, len(record.Entries))
+		for i, entry := range record.Entries {
+			pairs[i] = LsmTree.Pair{Key: entry.Key, Value: entry.Value, Tombstone: entry.Delete, ExpiresAt: entry.ExpiresAt}
 		}
+
+		lsmTree.ApplyBatch(pairs)
 	}
 
 	return nil
 }
 
-func (w *WAL) Truncate() {
+// Close persists the log and closes its file.
+func (w *WAL) Close() error {
+	if err := w.Persist(); err != nil {
+		return err
+	}
+
 	w.lock.Lock()
 	defer w.lock.Unlock()
-	w.File.Truncate(0)
-	w.File.Seek(0, 0)
+
+	return w.File.Close()
 }